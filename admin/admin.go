@@ -0,0 +1,108 @@
+package admin
+
+import (
+  "net/http"
+  "github.com/docker/go-plugins-helpers/sdk"
+  "github.com/phocs/vde_plug_docker/plugin"
+  "github.com/phocs/vde_plug_docker/vdenet"
+  "github.com/phocs/vde_plug_docker/endpoint"
+  "github.com/docker/go-plugins-helpers/network"
+)
+
+/* Admin API of the running plugin, served on its socket next to the docker ones */
+const (
+  networkStatsPath  = "/Admin.NetworkStats"
+  ensureNetworkPath = "/Admin.EnsureNetwork"
+  attachPath        = "/Admin.Attach"
+  detachPath        = "/Admin.Detach"
+  captureStartPath  = "/Admin.CaptureStart"
+  captureStopPath   = "/Admin.CaptureStop"
+  capturesPath      = "/Admin.Captures"
+)
+
+type NetworkStatsRequest struct {
+  /* ID or ID prefix of the network, all the networks if empty */
+  NetworkID string
+}
+
+type NetworkStatsResponse struct {
+  Networks map[string]map[string]endpoint.Stats
+}
+
+/* EnsureNetworkRequest creates a network unless it exists already */
+type EnsureNetworkRequest network.CreateNetworkRequest
+
+type DetachRequest struct {
+  NetworkID  string
+  EndpointID string
+}
+
+type CaptureStopRequest struct {
+  NetworkID  string
+  /* ID or ID prefix of the endpoint, the capture of the whole network if empty */
+  EndpointID string
+}
+
+type CapturesResponse struct {
+  Captures []vdenet.CaptureInfo
+}
+
+type EmptyResponse struct{}
+
+type ErrorResponse struct {
+  Err string
+}
+
+func encode(w http.ResponseWriter, res interface{}, err error) {
+  if err != nil {
+    sdk.EncodeResponse(w, &ErrorResponse{ Err: err.Error() }, true)
+    return
+  }
+  sdk.EncodeResponse(w, res, false)
+}
+
+func Register(s *plugin.Server, driver *vdenet.Driver) {
+  s.HandleFunc(networkStatsPath, func(w http.ResponseWriter, r *http.Request) {
+    req := &NetworkStatsRequest{}
+    if sdk.DecodeRequest(w, r, req) == nil {
+      stats, err := driver.NetworkStats(req.NetworkID)
+      encode(w, &NetworkStatsResponse{ Networks: stats }, err)
+    }
+  })
+  s.HandleFunc(ensureNetworkPath, func(w http.ResponseWriter, r *http.Request) {
+    req := &EnsureNetworkRequest{}
+    if sdk.DecodeRequest(w, r, req) == nil {
+      encode(w, &EmptyResponse{}, driver.EnsureNetwork((*network.CreateNetworkRequest)(req)))
+    }
+  })
+  s.HandleFunc(attachPath, func(w http.ResponseWriter, r *http.Request) {
+    req := &vdenet.AttachRequest{}
+    if sdk.DecodeRequest(w, r, req) == nil {
+      res, err := driver.Attach(req)
+      encode(w, res, err)
+    }
+  })
+  s.HandleFunc(detachPath, func(w http.ResponseWriter, r *http.Request) {
+    req := &DetachRequest{}
+    if sdk.DecodeRequest(w, r, req) == nil {
+      encode(w, &EmptyResponse{}, driver.Detach(req.NetworkID, req.EndpointID))
+    }
+  })
+  s.HandleFunc(captureStartPath, func(w http.ResponseWriter, r *http.Request) {
+    req := &vdenet.CaptureRequest{}
+    if sdk.DecodeRequest(w, r, req) == nil {
+      res, err := driver.StartCapture(req)
+      encode(w, res, err)
+    }
+  })
+  s.HandleFunc(captureStopPath, func(w http.ResponseWriter, r *http.Request) {
+    req := &CaptureStopRequest{}
+    if sdk.DecodeRequest(w, r, req) == nil {
+      res, err := driver.StopCapture(req.NetworkID, req.EndpointID)
+      encode(w, res, err)
+    }
+  })
+  s.HandleFunc(capturesPath, func(w http.ResponseWriter, r *http.Request) {
+    encode(w, &CapturesResponse{ Captures: driver.Captures() }, nil)
+  })
+}
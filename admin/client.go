@@ -0,0 +1,81 @@
+package admin
+
+import (
+  "net"
+  "bytes"
+  "errors"
+  "net/http"
+  "encoding/json"
+  "github.com/docker/go-plugins-helpers/sdk"
+  "github.com/phocs/vde_plug_docker/vdenet"
+)
+
+/* Client calls the admin API of the plugin listening on Sock */
+type Client struct {
+  Sock string
+  http *http.Client
+}
+
+func NewClient(sock string) *Client {
+  return &Client {
+    Sock: sock,
+    http: &http.Client{ Transport: &http.Transport {
+      Dial: func(_, _ string) (net.Conn, error) {
+        return net.Dial("unix", sock)
+      },
+    }},
+  }
+}
+
+func (this *Client) call(path string, req, res interface{}) error {
+  buf, err := json.Marshal(req)
+  if err != nil {
+    return err
+  }
+  resp, err := this.http.Post("http://plugin" + path, sdk.DefaultContentTypeV1_1, bytes.NewReader(buf))
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    e := &ErrorResponse{}
+    if err = json.NewDecoder(resp.Body).Decode(e); err != nil || e.Err == "" {
+      return errors.New(resp.Status)
+    }
+    return errors.New(e.Err)
+  }
+  return json.NewDecoder(resp.Body).Decode(res)
+}
+
+func (this *Client) NetworkStats(netid string) (*NetworkStatsResponse, error) {
+  res := &NetworkStatsResponse{}
+  return res, this.call(networkStatsPath, &NetworkStatsRequest{ NetworkID: netid }, res)
+}
+
+func (this *Client) EnsureNetwork(req *EnsureNetworkRequest) error {
+  return this.call(ensureNetworkPath, req, &EmptyResponse{})
+}
+
+func (this *Client) Attach(req *vdenet.AttachRequest) (*vdenet.AttachResponse, error) {
+  res := &vdenet.AttachResponse{}
+  return res, this.call(attachPath, req, res)
+}
+
+func (this *Client) Detach(netid, epid string) error {
+  return this.call(detachPath, &DetachRequest{ NetworkID: netid, EndpointID: epid }, &EmptyResponse{})
+}
+
+func (this *Client) StartCapture(req *vdenet.CaptureRequest) (*vdenet.CaptureInfo, error) {
+  res := &vdenet.CaptureInfo{}
+  return res, this.call(captureStartPath, req, res)
+}
+
+func (this *Client) StopCapture(netid, epid string) (*vdenet.CaptureInfo, error) {
+  res := &vdenet.CaptureInfo{}
+  return res, this.call(captureStopPath, &CaptureStopRequest{ NetworkID: netid, EndpointID: epid }, res)
+}
+
+func (this *Client) Captures() (*CapturesResponse, error) {
+  res := &CapturesResponse{}
+  return res, this.call(capturesPath, &EmptyResponse{}, res)
+}
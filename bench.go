@@ -0,0 +1,147 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "errors"
+  "io/ioutil"
+  "sync/atomic"
+  "text/tabwriter"
+  "golang.org/x/sys/unix"
+  log "github.com/Sirupsen/logrus"
+  "github.com/vishvananda/netlink"
+  "github.com/phocs/vde_plug_docker/packet"
+  "github.com/phocs/vde_plug_docker/endpoint"
+  "github.com/phocs/vde_plug_docker/vdeswitch"
+)
+
+/* Flows of each generator: the kernel spreads them on the queues of the tap */
+const benchFlows = 64
+
+/* The frames are for nobody on the network, the receiving tap drops them */
+var benchDstMAC = net.HardwareAddr{ 0x02, 0, 0, 0, 0xbe, 0x0c }
+
+/* bench measures the packets per second from a tap to another through their
+   plugs, on a built-in switch or on sock */
+func bench(queues, size, rate int, duration time.Duration, sock string) {
+  if size < packet.EthernetHeaderLen + packet.IPv4HeaderLen + packet.UDPHeaderLen {
+    log.Fatalf("Invalid size %d", size)
+  }
+  if queues < 1 {
+    log.Fatalf("Invalid queues %d", queues)
+  }
+  if sock == "" {
+    dir, err := ioutil.TempDir("", "vde_plug_bench")
+    if err != nil {
+      log.Fatal(err)
+    }
+    sw := vdeswitch.New(dir, false)
+    if err = sw.Start(); err != nil {
+      os.RemoveAll(dir)
+      log.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    defer sw.Stop()
+    sock = "vde://" + dir
+  }
+  var edpts []*endpoint.EndpointStat
+  defer func() {
+    for _, edpt := range edpts {
+      edpt.LinkPlugStop()
+      edpt.LinkDel()
+    }
+  }()
+  for i := 0; i < 2; i++ {
+    edpt, err := benchEndpoint(fmt.Sprintf("vdebench%d", i), queues, sock)
+    if edpt != nil {
+      edpts = append(edpts, edpt)
+    }
+    if err != nil {
+      log.Error(err)
+      return
+    }
+  }
+  sent, err := benchGenerate(edpts[0], queues, size, rate / queues, duration)
+  if err != nil {
+    log.Error(err)
+    return
+  }
+  /* The frames still in the queues */
+  time.Sleep(100 * time.Millisecond)
+  tx, rx := edpts[0].Stats(), edpts[1].Stats()
+  secs := duration.Seconds()
+  w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+  fmt.Fprintln(w, "QUEUES\tSIZE\tSENT PPS\tPLUG TX PPS\tPLUG RX PPS\tLOST")
+  fmt.Fprintf(w, "%d\t%d\t%.0f\t%.0f\t%.0f\t%d\n", queues, size,
+    float64(sent) / secs, float64(tx.TxPackets) / secs, float64(rx.RxPackets) / secs, int64(sent) - int64(rx.RxPackets))
+  w.Flush()
+}
+
+/* benchEndpoint creates the tap ifname, up and plugged to sock */
+func benchEndpoint(ifname string, queues int, sock string) (*endpoint.EndpointStat, error) {
+  edpt := &endpoint.EndpointStat{ IfName: ifname, MacAddress: endpoint.RandomMacAddr() }
+  edpt.Queues = queues
+  if err := edpt.LinkAdd(); err != nil {
+    return nil, errors.New("Tap " + ifname + ": " + err.Error())
+  }
+  if err := edpt.LinkPlugTo(sock, nil); err != nil {
+    return edpt, err
+  }
+  /* Only the frames of the test on the taps */
+  ioutil.WriteFile("/proc/sys/net/ipv6/conf/" + ifname + "/disable_ipv6", []byte("1"), 0644)
+  link, err := netlink.LinkByName(ifname)
+  if err == nil {
+    err = netlink.LinkSetUp(link)
+  }
+  return edpt, err
+}
+
+/* benchGenerate sends frames of size bytes on the tap of edpt for duration, from
+   a packet socket for each queue, and returns how many */
+func benchGenerate(edpt *endpoint.EndpointStat, queues, size, rate int, duration time.Duration) (uint64, error) {
+  link, err := netlink.LinkByName(edpt.IfName)
+  if err != nil {
+    return 0, err
+  }
+  srcmac, _ := net.ParseMAC(edpt.MacAddress)
+  addr := &unix.SockaddrLinklayer{ Ifindex: link.Attrs().Index }
+  payload := make([]byte, size - packet.EthernetHeaderLen - packet.IPv4HeaderLen - packet.UDPHeaderLen)
+  var sent uint64
+  var wg sync.WaitGroup
+  deadline := time.Now().Add(duration)
+  for q := 0; q < queues; q++ {
+    fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW | unix.SOCK_CLOEXEC, 0)
+    if err != nil {
+      wg.Wait()
+      return 0, err
+    }
+    frames := make([][]byte, benchFlows)
+    for i := range frames {
+      frames[i] = packet.NewUDPv4(benchDstMAC, srcmac, net.IPv4(10, 255, 0, 1), net.IPv4(10, 255, 0, 2),
+        uint16(1024 + q * benchFlows + i), 9, payload)
+    }
+    wg.Add(1)
+    go func(fd int) {
+      defer wg.Done()
+      defer unix.Close(fd)
+      var count uint64
+      start := time.Now()
+      for i := 0; time.Now().Before(deadline); i++ {
+        if unix.Sendto(fd, frames[i % benchFlows], 0, addr) == nil {
+          count++
+        }
+        if rate > 0 && i % 32 == 31 {
+          if due := start.Add(time.Duration(i + 1) * time.Second / time.Duration(rate)); time.Now().Before(due) {
+            time.Sleep(time.Until(due))
+          }
+        }
+      }
+      atomic.AddUint64(&sent, count)
+    }(fd)
+  }
+  wg.Wait()
+  return sent, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "time"
+  "os/exec"
+  "strings"
+  "path/filepath"
+  "text/tabwriter"
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/admin"
+  "github.com/phocs/vde_plug_docker/packet"
+  "github.com/phocs/vde_plug_docker/vdenet"
+)
+
+/* compileFilter returns the bytecode of a filter: a tcpdump expression is
+   compiled by tcpdump itself, for Ethernet frames */
+func compileFilter(filter string) (string, error) {
+  if filter == "" {
+    return "", nil
+  }
+  /* Bytecode starts with the number of instructions, an expression never does */
+  if c := filter[0]; c >= '0' && c <= '9' {
+    prog, err := packet.ParseBPF(filter)
+    if err != nil {
+      return "", err
+    }
+    return prog.String(), nil
+  }
+  out, err := exec.Command("tcpdump", "-y", "EN10MB", "-ddd", filter).Output()
+  if err != nil {
+    if exit, ok := err.(*exec.ExitError); ok {
+      return "", fmt.Errorf("tcpdump: %s", strings.TrimSpace(string(exit.Stderr)))
+    }
+    return "", fmt.Errorf("%s, the filter must be bytecode", err)
+  }
+  prog, err := packet.ParseBPF(string(out))
+  if err != nil {
+    return "", err
+  }
+  return prog.String(), nil
+}
+
+func captureStart(netid, epid, filter, dir string, snaplen int, size int64, every time.Duration, files int) {
+  prog, err := compileFilter(filter)
+  if err != nil {
+    log.Fatal(err)
+  }
+  /* The files are written by the plugin */
+  if dir, err = filepath.Abs(dir); err != nil {
+    log.Fatal(err)
+  }
+  info, err := admin.NewClient(unixSock).StartCapture(&vdenet.CaptureRequest{
+    NetworkID:  netid,
+    EndpointID: epid,
+    Filter:     prog,
+    Dir:        dir,
+    Snaplen:    snaplen,
+    RotateSize: size,
+    RotateTime: every,
+    Files:      files,
+  })
+  if err != nil {
+    log.Fatal(err)
+  }
+  fmt.Println(info.File)
+}
+
+func captureStop(netid, epid string) {
+  info, err := admin.NewClient(unixSock).StopCapture(netid, epid)
+  if err != nil {
+    log.Fatal(err)
+  }
+  fmt.Printf("%d packets, %d bytes in %d files, last %s\n", info.Packets, info.Bytes, info.Files, info.File)
+  if info.Err != "" {
+    log.Warn(info.Err)
+  }
+}
+
+func captureList() {
+  res, err := admin.NewClient(unixSock).Captures()
+  if err != nil {
+    log.Fatal(err)
+  }
+  w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+  fmt.Fprintln(w, "NETWORK\tENDPOINT\tSTARTED\tPACKETS\tBYTES\tFILES\tFILE\tERROR")
+  for _, info := range res.Captures {
+    epid := shortID(info.EndpointID)
+    if epid == "" {
+      epid = "*"
+    }
+    fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n", shortID(info.NetworkID), epid,
+      info.Started.Format(time.RFC3339), info.Packets, info.Bytes, info.Files, info.File, info.Err)
+  }
+  w.Flush()
+}
@@ -0,0 +1,69 @@
+package cluster
+
+import (
+  "fmt"
+  "errors"
+  "strings"
+)
+
+/* Network is the definition of a global scope network, shared by all the hosts */
+type Network struct {
+  NetworkID   string            `json:"NetworkID"`
+  Options     map[string]string `json:"Options"`
+  IPv4Pool    string            `json:"IPv4Pool"`
+  IPv4Gateway string            `json:"IPv4Gateway"`
+  IPv6Pool    string            `json:"IPv6Pool"`
+  IPv6Gateway string            `json:"IPv6Gateway"`
+}
+
+/* Claim is the owner of an address of a global scope network */
+type Claim struct {
+  Host     string `json:"Host"`
+  Endpoint string `json:"Endpoint"`
+}
+
+/* Store is the state shared between the drivers of all the hosts */
+type Store interface {
+  PutNetwork(nw *Network) error
+  GetNetwork(netid string) (*Network, error)
+  DeleteNetwork(netid string) error
+  /* ClaimAddress fails with an AddressInUse error if addr is owned by someone else */
+  ClaimAddress(netid, addr string, claim Claim) error
+  ReleaseAddress(netid, addr string, claim Claim) error
+  /* SetNode records the discovery address of host */
+  SetNode(host, addr string) error
+  /* ReleaseNode forgets the host with the given discovery address and its claims */
+  ReleaseNode(addr string) error
+  Close() error
+}
+
+type OpenFunc func(path string) (Store, error)
+
+var backends = make(map[string]OpenFunc)
+
+var ErrNotFound = errors.New("Network not found in the cluster store")
+
+type AddressInUse struct {
+  Addr  string
+  Claim Claim
+}
+
+func (this *AddressInUse) Error() string {
+  return fmt.Sprintf("Address %s in use by endpoint %s on host %s", this.Addr, this.Claim.Endpoint, this.Claim.Host)
+}
+
+func Register(scheme string, open OpenFunc) {
+  backends[scheme] = open
+}
+
+/* Open returns the store of the url scheme://path, e.g. file:///shared/vde.json */
+func Open(url string) (Store, error) {
+  i := strings.Index(url, "://")
+  if i < 0 {
+    return nil, errors.New("Invalid cluster store url: " + url)
+  }
+  if open := backends[url[:i]]; open != nil {
+    return open(url[i+3:])
+  }
+  return nil, errors.New("Cluster store not supported: " + url)
+}
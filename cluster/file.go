@@ -0,0 +1,195 @@
+package cluster
+
+import (
+  "os"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+  "golang.org/x/sys/unix"
+)
+
+/* FileStore keeps the cluster state in a JSON file, serialized with flock(2)
+   on a lock file next to it: the updates replace the file with rename(2), so
+   the readers on the other hosts see either the old state or the new one.
+   On a shared filesystem it can stand in for a real distributed store. */
+type FileStore struct {
+  Path string
+}
+
+type fileState struct {
+  Networks  map[string]*Network          `json:"Networks"`
+  Addresses map[string]map[string]Claim  `json:"Addresses"`
+  Nodes     map[string]string            `json:"Nodes"`
+}
+
+const (
+  OpenMode   = 0644
+  LockSuffix = ".lock"
+  TmpSuffix  = ".tmp"
+)
+
+func init() {
+  Register("file", NewFileStore)
+}
+
+func NewFileStore(path string) (Store, error) {
+  store := &FileStore{ Path: path }
+  return store, store.update(func(*fileState) (bool, error) { return false, nil })
+}
+
+/* update runs fn on the current state under an exclusive lock, then writes it
+   back if fn reports a change */
+func (this *FileStore) update(fn func(state *fileState) (bool, error)) error {
+  lock, err := os.OpenFile(this.Path + LockSuffix, os.O_RDWR | os.O_CREATE, OpenMode)
+  if err != nil {
+    return err
+  }
+  defer lock.Close()
+  if err = unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+    return err
+  }
+  state := &fileState{}
+  if buf, err := ioutil.ReadFile(this.Path); err != nil && !os.IsNotExist(err) {
+    return err
+  } else if len(buf) > 0 {
+    if err = json.Unmarshal(buf, state); err != nil {
+      return err
+    }
+  }
+  if state.Networks == nil {
+    state.Networks = make(map[string]*Network)
+  }
+  if state.Addresses == nil {
+    state.Addresses = make(map[string]map[string]Claim)
+  }
+  if state.Nodes == nil {
+    state.Nodes = make(map[string]string)
+  }
+  changed, err := fn(state)
+  if err != nil || !changed {
+    return err
+  }
+  buf, err := json.Marshal(state)
+  if err != nil {
+    return err
+  }
+  return this.store(buf)
+}
+
+/* store writes buf in a temporary file that replaces the state once synced */
+func (this *FileStore) store(buf []byte) error {
+  tmp := this.Path + TmpSuffix
+  file, err := os.OpenFile(tmp, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, OpenMode)
+  if err != nil {
+    return err
+  }
+  if _, err = file.Write(buf); err == nil {
+    err = file.Sync()
+  }
+  if errclose := file.Close(); err == nil {
+    err = errclose
+  }
+  if err == nil {
+    err = os.Rename(tmp, this.Path)
+  }
+  if err != nil {
+    os.Remove(tmp)
+    return err
+  }
+  dir, err := os.Open(filepath.Dir(this.Path))
+  if err != nil {
+    return err
+  }
+  defer dir.Close()
+  return dir.Sync()
+}
+
+func (this *FileStore) PutNetwork(nw *Network) error {
+  return this.update(func(state *fileState) (bool, error) {
+    state.Networks[nw.NetworkID] = nw
+    return true, nil
+  })
+}
+
+func (this *FileStore) GetNetwork(netid string) (*Network, error) {
+  var nw *Network
+  err := this.update(func(state *fileState) (bool, error) {
+    if nw = state.Networks[netid]; nw == nil {
+      return false, ErrNotFound
+    }
+    return false, nil
+  })
+  return nw, err
+}
+
+func (this *FileStore) DeleteNetwork(netid string) error {
+  return this.update(func(state *fileState) (bool, error) {
+    _, changed := state.Networks[netid]
+    if _, ok := state.Addresses[netid]; ok {
+      changed = true
+    }
+    delete(state.Networks, netid)
+    delete(state.Addresses, netid)
+    return changed, nil
+  })
+}
+
+func (this *FileStore) ClaimAddress(netid, addr string, claim Claim) error {
+  return this.update(func(state *fileState) (bool, error) {
+    claims := state.Addresses[netid]
+    if claims == nil {
+      claims = make(map[string]Claim)
+      state.Addresses[netid] = claims
+    }
+    if owner, ok := claims[addr]; ok {
+      if owner != claim {
+        return false, &AddressInUse{ Addr: addr, Claim: owner }
+      }
+      return false, nil
+    }
+    claims[addr] = claim
+    return true, nil
+  })
+}
+
+func (this *FileStore) ReleaseAddress(netid, addr string, claim Claim) error {
+  return this.update(func(state *fileState) (bool, error) {
+    if owner, ok := state.Addresses[netid][addr]; ok && owner == claim {
+      delete(state.Addresses[netid], addr)
+      return true, nil
+    }
+    return false, nil
+  })
+}
+
+func (this *FileStore) SetNode(host, addr string) error {
+  return this.update(func(state *fileState) (bool, error) {
+    if state.Nodes[addr] == host {
+      return false, nil
+    }
+    state.Nodes[addr] = host
+    return true, nil
+  })
+}
+
+func (this *FileStore) ReleaseNode(addr string) error {
+  return this.update(func(state *fileState) (bool, error) {
+    host, ok := state.Nodes[addr]
+    if !ok {
+      return false, nil
+    }
+    delete(state.Nodes, addr)
+    for _, claims := range state.Addresses {
+      for a, owner := range claims {
+        if owner.Host == host {
+          delete(claims, a)
+        }
+      }
+    }
+    return true, nil
+  })
+}
+
+func (this *FileStore) Close() error {
+  return nil
+}
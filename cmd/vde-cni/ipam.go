@@ -0,0 +1,49 @@
+package main
+
+import (
+  "os"
+  "bytes"
+  "os/exec"
+  "strings"
+  "path/filepath"
+  "encoding/json"
+)
+
+/* findPlugin looks the plugin up in the directories of CNI_PATH */
+func findPlugin(name, path string) (string, error) {
+  for _, dir := range filepath.SplitList(path) {
+    file := filepath.Join(dir, name)
+    if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+      return file, nil
+    }
+  }
+  return "", Errorf(ErrInvalidConfig, "failed to find plugin %q in path %s", name, path)
+}
+
+/* delegateIPAM runs the IPAM plugin of conf with the same environment and
+   configuration, command overrides CNI_COMMAND */
+func delegateIPAM(env *Env, conf *NetConf, stdin []byte, command string) (*Result, error) {
+  file, err := findPlugin(conf.IPAM.Type, env.Path)
+  if err != nil {
+    return nil, err
+  }
+  var stdout bytes.Buffer
+  cmd := exec.Command(file)
+  cmd.Env = append(os.Environ(), "CNI_COMMAND=" + command)
+  cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(stdin), &stdout, os.Stderr
+  if err = cmd.Run(); err != nil {
+    cnierr := &Error{}
+    if json.Unmarshal(stdout.Bytes(), cnierr) == nil && cnierr.Msg != "" {
+      return nil, cnierr
+    }
+    return nil, Errorf(ErrPlugin, "%s %s: %s", conf.IPAM.Type, command, strings.TrimSpace(stdout.String() + " " + err.Error()))
+  }
+  if command != CmdAdd {
+    return nil, nil
+  }
+  result := &Result{}
+  if err = json.Unmarshal(stdout.Bytes(), result); err != nil {
+    return nil, Errorf(ErrDecode, "%s result: %s", conf.IPAM.Type, err)
+  }
+  return result, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+  "os"
+  "net"
+  "github.com/vishvananda/netns"
+  "github.com/vishvananda/netlink"
+  "github.com/phocs/vde_plug_docker/endpoint"
+)
+
+/* withNetns runs fn with a thread in the network namespace nspath, see endpoint.InNetns */
+func withNetns(nspath string, fn func() error) error {
+  ns, err := netns.GetFromPath(nspath)
+  if err != nil {
+    return Errorf(ErrInvalidEnv, "failed to open netns %s: %s", nspath, err)
+  }
+  defer ns.Close()
+  return endpoint.InNetns(ns, fn)
+}
+
+func parseIPNet(addr string) (*net.IPNet, error) {
+  ip, ipnet, err := net.ParseCIDR(addr)
+  if err != nil {
+    return nil, err
+  }
+  ipnet.IP = ip
+  return ipnet, nil
+}
+
+func isIPv6(addr string) bool {
+  ip, _, err := net.ParseCIDR(addr)
+  return err == nil && ip.To4() == nil
+}
+
+/* addEndpoint creates in the current netns the tap of edpt with the addresses
+   and the routes of result, and opens it */
+func addEndpoint(edpt *endpoint.EndpointStat, result *Result) (*os.File, error) {
+  for _, ip := range result.IPs {
+    if isIPv6(ip.Address) && edpt.IPv6Address == "" {
+      edpt.IPv6Address = ip.Address
+    } else if !isIPv6(ip.Address) && edpt.IPv4Address == "" {
+      edpt.IPv4Address = ip.Address
+    }
+  }
+  if err := edpt.LinkAdd(); err != nil {
+    return nil, err
+  }
+  tap, err := configure(edpt, result)
+  if err != nil {
+    edpt.LinkDel()
+  }
+  return tap, err
+}
+
+func configure(edpt *endpoint.EndpointStat, result *Result) (*os.File, error) {
+  link, err := netlink.LinkByName(edpt.IfName)
+  if err != nil {
+    return nil, err
+  }
+  /* Unlike Docker the runtime does not set the MAC, LinkAdd sets the first address of each family */
+  mac, err := net.ParseMAC(edpt.MacAddress)
+  if err != nil {
+    return nil, Errorf(ErrInvalidConfig, "invalid MAC %s: %s", edpt.MacAddress, err)
+  }
+  if err = netlink.LinkSetHardwareAddr(link, mac); err != nil {
+    return nil, err
+  }
+  for _, ip := range result.IPs {
+    if ip.Address == edpt.IPv4Address || ip.Address == edpt.IPv6Address {
+      continue
+    }
+    addr, err := netlink.ParseAddr(ip.Address)
+    if err != nil {
+      return nil, err
+    }
+    if err = netlink.AddrAdd(link, addr); err != nil {
+      return nil, err
+    }
+  }
+  tap, err := endpoint.OpenTap(edpt.IfName)
+  if err != nil {
+    return nil, err
+  }
+  if err = netlink.LinkSetUp(link); err != nil {
+    tap.Close()
+    return nil, err
+  }
+  for _, route := range result.Routes {
+    if err = addRoute(link, route, result.IPs); err != nil {
+      tap.Close()
+      return nil, Errorf(ErrPlugin, "failed to add route %s: %s", route.Dst, err)
+    }
+  }
+  return tap, nil
+}
+
+/* addRoute adds route through its gateway, the one of the addresses of the same family by default */
+func addRoute(link netlink.Link, route *Route, ips []*IPConfig) error {
+  _, dst, err := net.ParseCIDR(route.Dst)
+  if err != nil {
+    return err
+  }
+  gw := net.ParseIP(route.GW)
+  if gw == nil {
+    for _, ip := range ips {
+      if ipgw := net.ParseIP(ip.Gateway); ipgw != nil && (ipgw.To4() == nil) == (dst.IP.To4() == nil) {
+        gw = ipgw
+        break
+      }
+    }
+  }
+  r := &netlink.Route{ LinkIndex: link.Attrs().Index, Dst: dst, Gw: gw }
+  if gw == nil {
+    r.Scope = netlink.SCOPE_LINK
+  }
+  return netlink.RouteAdd(r)
+}
+
+/* checkEndpoint verifies that the tap in the current netns has the MAC and the addresses of iface */
+func checkEndpoint(iface *Interface, ips []*IPConfig) error {
+  link, err := netlink.LinkByName(iface.Name)
+  if err != nil {
+    return Errorf(ErrPlugin, "interface %s: %s", iface.Name, err)
+  }
+  if iface.Mac != "" && link.Attrs().HardwareAddr.String() != iface.Mac {
+    return Errorf(ErrPlugin, "interface %s has MAC %s, expected %s", iface.Name, link.Attrs().HardwareAddr, iface.Mac)
+  }
+  addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+  if err != nil {
+    return err
+  }
+  for _, ip := range ips {
+    ipnet, err := parseIPNet(ip.Address)
+    if err != nil {
+      return Errorf(ErrDecode, "prevResult address %s: %s", ip.Address, err)
+    }
+    found := false
+    for _, addr := range addrs {
+      found = found || addr.IPNet.String() == ipnet.String()
+    }
+    if !found {
+      return Errorf(ErrPlugin, "interface %s misses the address %s", iface.Name, ip.Address)
+    }
+  }
+  return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+  "os"
+  "strings"
+  "io/ioutil"
+  "encoding/json"
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/endpoint"
+)
+
+/* Commands of the CNI spec */
+const (
+  CmdAdd     = "ADD"
+  CmdDel     = "DEL"
+  CmdCheck   = "CHECK"
+  CmdVersion = "VERSION"
+)
+
+/* Env holds the CNI_* variables of the invocation */
+type Env struct {
+  Command     string
+  ContainerID string
+  Netns       string
+  IfName      string
+  Args        map[string]string
+  Path        string
+}
+
+func getEnv() (*Env, error) {
+  env := &Env {
+    Command:     os.Getenv("CNI_COMMAND"),
+    ContainerID: os.Getenv("CNI_CONTAINERID"),
+    Netns:       os.Getenv("CNI_NETNS"),
+    IfName:      os.Getenv("CNI_IFNAME"),
+    Args:        make(map[string]string),
+    Path:        os.Getenv("CNI_PATH"),
+  }
+  for _, kv := range strings.Split(os.Getenv("CNI_ARGS"), ";") {
+    if pair := strings.SplitN(kv, "=", 2); len(pair) == 2 {
+      env.Args[pair[0]] = pair[1]
+    }
+  }
+  required := map[string]string{ "CNI_CONTAINERID": env.ContainerID, "CNI_IFNAME": env.IfName, "CNI_PATH": env.Path }
+  switch env.Command {
+  case CmdVersion:
+    return env, nil
+  case CmdAdd, CmdCheck:
+    required["CNI_NETNS"] = env.Netns
+  case CmdDel:
+  case "":
+    return nil, Errorf(ErrInvalidEnv, "required env variable CNI_COMMAND missing")
+  default:
+    return nil, Errorf(ErrInvalidEnv, "unknown CNI_COMMAND: %s", env.Command)
+  }
+  for name, value := range required {
+    if value == "" {
+      return nil, Errorf(ErrInvalidEnv, "required env variable %s missing", name)
+    }
+  }
+  return env, nil
+}
+
+func parseConf(stdin []byte) (*NetConf, error) {
+  conf := &NetConf{}
+  if err := json.Unmarshal(stdin, conf); err != nil {
+    return nil, Errorf(ErrDecode, "failed to decode the network configuration: %s", err)
+  }
+  if conf.CNIVersion == "" {
+    conf.CNIVersion = "0.1.0"
+  }
+  if !supported(conf.CNIVersion) {
+    return nil, &Error{ Code: ErrIncompatibleVersion, Msg: "incompatible CNI versions",
+      Details: "config is " + conf.CNIVersion + ", plugin supports " + strings.Join(SupportedVersions, ", ") }
+  }
+  if conf.Sock == "" {
+    return nil, Errorf(ErrInvalidConfig, "missing sock in the network configuration")
+  }
+  return conf, nil
+}
+
+func cmdAdd(env *Env, conf *NetConf, stdin []byte) (*Result, error) {
+  result := &Result{}
+  var err error
+  if conf.IPAM.Type != "" {
+    if result, err = delegateIPAM(env, conf, stdin, CmdAdd); err != nil {
+      return nil, err
+    }
+  }
+  edpt := &endpoint.EndpointStat{ IfName: env.IfName, MacAddress: env.Args["MAC"] }
+  if edpt.MacAddress == "" {
+    edpt.MacAddress = endpoint.RandomMacAddr()
+  }
+  var tap *os.File
+  err = withNetns(env.Netns, func() (err error) {
+    tap, err = addEndpoint(edpt, result)
+    return err
+  })
+  /* The helper runs in the host netns, where the VDE network is reachable */
+  if err == nil {
+    if err = startPlug(env, conf, tap); err != nil {
+      endpoint.DelTapAt(env.Netns, edpt.IfName, edpt.MacAddress)
+    }
+  }
+  if err != nil {
+    if conf.IPAM.Type != "" {
+      delegateIPAM(env, conf, stdin, CmdDel)
+    }
+    return nil, err
+  }
+  idx := 0
+  for _, ip := range result.IPs {
+    ip.Interface = &idx
+  }
+  result.Interfaces = []*Interface{ { Name: edpt.IfName, Mac: edpt.MacAddress, Sandbox: env.Netns } }
+  if result.DNS == nil {
+    result.DNS = conf.DNS
+  }
+  result.convert(conf.CNIVersion)
+  return result, nil
+}
+
+/* cmdDel releases whatever is left of the attachment, it succeeds when done already */
+func cmdDel(env *Env, conf *NetConf, stdin []byte) error {
+  if err := stopPlug(env); err != nil {
+    return err
+  }
+  if env.Netns != "" {
+    if err := endpoint.DelTapAt(env.Netns, env.IfName, ""); err != nil && err != endpoint.ErrLinkNotFound {
+      log.Debugf("DelTapAt [ %s ] [ %s ]: [ %s ]", env.Netns, env.IfName, err)
+    }
+  }
+  if conf.IPAM.Type != "" {
+    if _, err := delegateIPAM(env, conf, stdin, CmdDel); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func cmdCheck(env *Env, conf *NetConf, stdin []byte) error {
+  if conf.CNIVersion == "0.3.0" || conf.CNIVersion == "0.3.1" {
+    return &Error{ Code: ErrIncompatibleVersion, Msg: "incompatible CNI versions",
+      Details: "CHECK requires version 0.4.0 or later, config is " + conf.CNIVersion }
+  }
+  prev := &Result{}
+  if len(conf.PrevResult) == 0 {
+    return Errorf(ErrInvalidConfig, "missing prevResult in the network configuration")
+  }
+  if err := json.Unmarshal(conf.PrevResult, prev); err != nil {
+    return Errorf(ErrDecode, "failed to decode prevResult: %s", err)
+  }
+  if conf.IPAM.Type != "" {
+    if _, err := delegateIPAM(env, conf, stdin, CmdCheck); err != nil {
+      return err
+    }
+  }
+  var iface *Interface
+  idx := -1
+  for i, ifc := range prev.Interfaces {
+    if ifc.Name == env.IfName && (ifc.Sandbox == "" || ifc.Sandbox == env.Netns) {
+      iface, idx = ifc, i
+    }
+  }
+  if iface == nil {
+    return Errorf(ErrInvalidConfig, "interface %s not in prevResult", env.IfName)
+  }
+  ips := []*IPConfig{}
+  for _, ip := range prev.IPs {
+    if ip.Interface != nil && *ip.Interface == idx {
+      ips = append(ips, ip)
+    }
+  }
+  if err := withNetns(env.Netns, func() error { return checkEndpoint(iface, ips) }); err != nil {
+    return err
+  }
+  if plugPid(env) == 0 {
+    return Errorf(ErrPlugin, "interface %s is not plugged to %s", env.IfName, conf.Sock)
+  }
+  return nil
+}
+
+/* fail prints err in the format of the spec and exits */
+func fail(version string, err error) {
+  cnierr, ok := err.(*Error)
+  if !ok {
+    cnierr = &Error{ Code: ErrPlugin, Msg: err.Error() }
+  }
+  if cnierr.CNIVersion == "" {
+    cnierr.CNIVersion = version
+  }
+  json.NewEncoder(os.Stdout).Encode(cnierr)
+  os.Exit(1)
+}
+
+func main() {
+  if len(os.Args) == 3 && os.Args[1] == plugArg {
+    plug(os.Args[2])
+    return
+  }
+  log.SetOutput(os.Stderr)
+  env, err := getEnv()
+  if err != nil {
+    fail(CurrentVersion, err)
+  }
+  stdin, err := ioutil.ReadAll(os.Stdin)
+  if err != nil {
+    fail(CurrentVersion, Errorf(ErrDecode, "failed to read the network configuration: %s", err))
+  }
+  if env.Command == CmdVersion {
+    version := struct{ CNIVersion string `json:"cniVersion"` }{}
+    json.Unmarshal(stdin, &version)
+    if version.CNIVersion == "" {
+      version.CNIVersion = CurrentVersion
+    }
+    json.NewEncoder(os.Stdout).Encode(&VersionResult{ version.CNIVersion, SupportedVersions })
+    return
+  }
+  conf, err := parseConf(stdin)
+  if err != nil {
+    fail(CurrentVersion, err)
+  }
+  switch env.Command {
+  case CmdAdd:
+    result, err := cmdAdd(env, conf, stdin)
+    if err != nil {
+      fail(conf.CNIVersion, err)
+    }
+    json.NewEncoder(os.Stdout).Encode(result)
+  case CmdDel:
+    err = cmdDel(env, conf, stdin)
+  case CmdCheck:
+    err = cmdCheck(env, conf, stdin)
+  }
+  if err != nil {
+    fail(conf.CNIVersion, err)
+  }
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "bytes"
+  "strconv"
+  "syscall"
+  "os/exec"
+  "os/signal"
+  "io/ioutil"
+  "path/filepath"
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/endpoint"
+)
+
+/* The plug of a container outlives the plugin: the tap is forwarded by a
+   helper, the plugin itself run again as "vde-cni plug <sock>" in its own
+   session, that gets the tap as fd 3 and reports on fd 4 once plugged. */
+const (
+  plugArg   = "plug"
+  plugReady = "ok"
+  StateDir  = "/run/vde-cni"
+)
+
+func pidFile(env *Env) string {
+  return filepath.Join(StateDir, env.ContainerID + "-" + env.IfName + ".pid")
+}
+
+/* startPlug hands tap to a new helper plugged to sock, tap is closed in any case */
+func startPlug(env *Env, conf *NetConf, tap *os.File) error {
+  defer tap.Close()
+  ready, readyw, err := os.Pipe()
+  if err != nil {
+    return err
+  }
+  defer ready.Close()
+  cmd := exec.Command("/proc/self/exe", plugArg, conf.Sock)
+  cmd.Args[0] = os.Args[0]
+  cmd.Env = []string{}
+  cmd.ExtraFiles = []*os.File{ tap, readyw }
+  cmd.SysProcAttr = &syscall.SysProcAttr{ Setsid: true }
+  if conf.LogFile != "" {
+    logf, err := os.OpenFile(conf.LogFile, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+    if err != nil {
+      readyw.Close()
+      return err
+    }
+    defer logf.Close()
+    cmd.Stderr = logf
+  }
+  err = cmd.Start()
+  readyw.Close()
+  if err != nil {
+    return err
+  }
+  msg, _ := ioutil.ReadAll(ready)
+  if string(msg) != plugReady {
+    cmd.Process.Kill()
+    cmd.Wait()
+    if len(msg) == 0 {
+      msg = []byte("plug helper exited")
+    }
+    return fmt.Errorf("failed to plug %s to %s: %s", env.IfName, conf.Sock, msg)
+  }
+  err = os.MkdirAll(StateDir, 0755)
+  if err == nil {
+    err = ioutil.WriteFile(pidFile(env), []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+  }
+  if err != nil {
+    cmd.Process.Kill()
+    cmd.Wait()
+    return err
+  }
+  return cmd.Process.Release()
+}
+
+/* plugPid returns the helper of env, 0 if it is not running */
+func plugPid(env *Env) int {
+  data, err := ioutil.ReadFile(pidFile(env))
+  if err != nil {
+    return 0
+  }
+  pid, err := strconv.Atoi(string(bytes.TrimSpace(data)))
+  if err != nil || pid <= 0 {
+    return 0
+  }
+  /* The pid may have been reused after a reboot or a crash of the helper */
+  cmdline, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+  if err != nil {
+    return 0
+  }
+  args := bytes.Split(cmdline, []byte{0})
+  if len(args) < 2 || string(args[1]) != plugArg {
+    return 0
+  }
+  return pid
+}
+
+/* stopPlug terminates the helper of env, if any */
+func stopPlug(env *Env) error {
+  if pid := plugPid(env); pid != 0 {
+    if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+      return err
+    }
+  }
+  if err := os.Remove(pidFile(env)); err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  return nil
+}
+
+/* plug is the body of the helper: it forwards until it is terminated or the tap is deleted */
+func plug(sock string) {
+  tap, ready := os.NewFile(3, endpoint.TunDevice), os.NewFile(4, "ready")
+  plugger, err := endpoint.PlugTap(tap, sock)
+  if err != nil {
+    fmt.Fprint(ready, err)
+    os.Exit(1)
+  }
+  fmt.Fprint(ready, plugReady)
+  ready.Close()
+  log.Infof("Plugged [ %s ]", sock)
+
+  sigs := make(chan os.Signal, 1)
+  signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+  signal.Ignore(syscall.SIGHUP)
+  go func() {
+    sig := <-sigs
+    log.Infof("Unplugging [ %s ] on %s", sock, sig)
+    plugger.Stop()
+  }()
+  plugger.Wait()
+  st := plugger.Stats()
+  log.Infof("Unplugged [ %s ]: rx %d packets, tx %d packets, %d reconnects", sock, st.RxPackets, st.TxPackets, st.Reconnects)
+}
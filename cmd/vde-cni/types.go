@@ -0,0 +1,120 @@
+package main
+
+import (
+  "fmt"
+  "encoding/json"
+)
+
+/* Versions of the CNI spec understood by the plugin, the addresses of the
+   results carry their IP version before CurrentVersion */
+const CurrentVersion = "1.0.0"
+
+var SupportedVersions = []string{ "0.3.0", "0.3.1", "0.4.0", CurrentVersion }
+
+/* Error codes of the CNI spec, the ones over 99 are of the plugin */
+const (
+  ErrIncompatibleVersion = 1
+  ErrInvalidEnv          = 4
+  ErrDecode              = 6
+  ErrInvalidConfig       = 7
+  ErrTryAgainLater       = 11
+  ErrPlugin              = 100
+)
+
+/* NetConf is the network configuration read from stdin */
+type NetConf struct {
+  CNIVersion string          `json:"cniVersion"`
+  Name       string          `json:"name"`
+  Type       string          `json:"type"`
+  Sock       string          `json:"sock"`
+  LogFile    string          `json:"logFile,omitempty"`
+  IPAM       IPAMConf        `json:"ipam,omitempty"`
+  DNS        *DNS            `json:"dns,omitempty"`
+  PrevResult json.RawMessage `json:"prevResult,omitempty"`
+}
+
+/* IPAMConf names the IPAM plugin, the rest of its configuration is read by the plugin */
+type IPAMConf struct {
+  Type string `json:"type"`
+}
+
+type Interface struct {
+  Name    string `json:"name"`
+  Mac     string `json:"mac,omitempty"`
+  Sandbox string `json:"sandbox,omitempty"`
+}
+
+/* IPConfig is an address of the result, Version is only in the results before 1.0.0 */
+type IPConfig struct {
+  Version   string `json:"version,omitempty"`
+  Interface *int   `json:"interface,omitempty"`
+  Address   string `json:"address"`
+  Gateway   string `json:"gateway,omitempty"`
+}
+
+type Route struct {
+  Dst string `json:"dst"`
+  GW  string `json:"gw,omitempty"`
+}
+
+type DNS struct {
+  Nameservers []string `json:"nameservers,omitempty"`
+  Domain      string   `json:"domain,omitempty"`
+  Search      []string `json:"search,omitempty"`
+  Options     []string `json:"options,omitempty"`
+}
+
+type Result struct {
+  CNIVersion string       `json:"cniVersion"`
+  Interfaces []*Interface `json:"interfaces,omitempty"`
+  IPs        []*IPConfig  `json:"ips,omitempty"`
+  Routes     []*Route     `json:"routes,omitempty"`
+  DNS        *DNS         `json:"dns,omitempty"`
+}
+
+type VersionResult struct {
+  CNIVersion        string   `json:"cniVersion"`
+  SupportedVersions []string `json:"supportedVersions"`
+}
+
+/* Error is printed on stdout when a command fails */
+type Error struct {
+  CNIVersion string `json:"cniVersion"`
+  Code       int    `json:"code"`
+  Msg        string `json:"msg"`
+  Details    string `json:"details,omitempty"`
+}
+
+func (this *Error) Error() string {
+  if this.Details != "" {
+    return this.Msg + ": " + this.Details
+  }
+  return this.Msg
+}
+
+func Errorf(code int, format string, args ...interface{}) *Error {
+  return &Error{ Code: code, Msg: fmt.Sprintf(format, args...) }
+}
+
+func supported(version string) bool {
+  for _, v := range SupportedVersions {
+    if v == version {
+      return true
+    }
+  }
+  return false
+}
+
+/* convert adapts the addresses of result to version */
+func (this *Result) convert(version string) {
+  this.CNIVersion = version
+  for _, ip := range this.IPs {
+    ip.Version = ""
+    if version != CurrentVersion {
+      ip.Version = "4"
+      if isIPv6(ip.Address) {
+        ip.Version = "6"
+      }
+    }
+  }
+}
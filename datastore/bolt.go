@@ -0,0 +1,117 @@
+package datastore
+
+import (
+  "time"
+  "bytes"
+  "encoding/json"
+  bolt "go.etcd.io/bbolt"
+)
+
+/* BoltStore keeps the records in a bbolt database, each update writes only
+   the records it changes */
+type BoltStore struct {
+  db *bolt.DB
+}
+
+type boltTx struct {
+  tx *bolt.Tx
+}
+
+/* OpenTimeout bounds the wait for the lock held by another instance */
+const OpenTimeout = 5 * time.Second
+
+func init() {
+  Register("bolt", func(path string, _ ...Migration) (Store, error) {
+    return NewBoltStore(path)
+  })
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+  db, err := bolt.Open(path, OpenMode, &bolt.Options{ Timeout: OpenTimeout })
+  if err != nil {
+    return nil, err
+  }
+  return &BoltStore{ db: db }, nil
+}
+
+func (this *BoltStore) Update(fn func(tx Tx) error) error {
+  return this.db.Update(func(tx *bolt.Tx) error {
+    return fn(&boltTx{ tx: tx })
+  })
+}
+
+func (this *BoltStore) View(fn func(tx Tx) error) error {
+  return this.db.View(func(tx *bolt.Tx) error {
+    return fn(&boltTx{ tx: tx })
+  })
+}
+
+func (this *BoltStore) Clean() error {
+  return this.db.Update(func(tx *bolt.Tx) error {
+    var names [][]byte
+    tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+      names = append(names, append([]byte(nil), name...))
+      return nil
+    })
+    for _, name := range names {
+      if err := tx.DeleteBucket(name); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+}
+
+func (this *BoltStore) Close() error {
+  return this.db.Close()
+}
+
+func (this *boltTx) Get(bucket, key string, elem interface{}) error {
+  b := this.tx.Bucket([]byte(bucket))
+  if b == nil {
+    return ErrNotFound
+  }
+  value := b.Get([]byte(key))
+  if value == nil {
+    return ErrNotFound
+  }
+  return json.Unmarshal(value, elem)
+}
+
+func (this *boltTx) Put(bucket, key string, elem interface{}) error {
+  if !this.tx.Writable() {
+    return ErrReadOnly
+  }
+  value, err := json.Marshal(elem)
+  if err != nil {
+    return err
+  }
+  b, err := this.tx.CreateBucketIfNotExists([]byte(bucket))
+  if err != nil {
+    return err
+  }
+  return b.Put([]byte(key), value)
+}
+
+func (this *boltTx) Delete(bucket, key string) error {
+  if !this.tx.Writable() {
+    return ErrReadOnly
+  }
+  if b := this.tx.Bucket([]byte(bucket)); b != nil {
+    return b.Delete([]byte(key))
+  }
+  return nil
+}
+
+func (this *boltTx) Keys(bucket, prefix string) ([]string, error) {
+  var keys []string
+  b := this.tx.Bucket([]byte(bucket))
+  if b == nil {
+    return keys, nil
+  }
+  c := b.Cursor()
+  for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+    keys = append(keys, string(k))
+  }
+  return keys, nil
+}
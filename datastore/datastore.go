@@ -1,56 +1,167 @@
 package datastore
 
 import (
+  "os"
+  "fmt"
   "sync"
   "io/ioutil"
+  "path/filepath"
   "encoding/json"
   log "github.com/Sirupsen/logrus"
 )
 
+/* Migration upgrades a decoded document from its version to the next one */
+type Migration func(doc map[string]interface{}) error
+
+/* DataStore is a JSON document, written atomically */
 type DataStore struct {
   sync.Mutex
-  Path  string
+  Path        string
+  /* Migrations[i] upgrades a document of version i, the current version is len(Migrations) */
+  Migrations  []Migration
+  /* Path holds a generation loaded or written by this store */
+  current     bool
+}
+
+/* document is the stored format, version 0 documents have no envelope */
+type document struct {
+  Version int             `json:"Version"`
+  Data    json.RawMessage `json:"Data"`
 }
 
-const OpenMode = 0644
+const (
+  OpenMode  = 0644
+  TmpSuffix = ".tmp"
+  BakSuffix = ".bak"
+  BadSuffix = ".bad"
+)
 
-var store = DataStore {
-  Path: "./datastore.json",
+func New(path string) *DataStore {
+  return &DataStore{ Path: path }
 }
 
-func SetPath(path string) {
-  store.Path = path
+func (this *DataStore) Version() int {
+  return len(this.Migrations)
 }
 
-func Clean() {
-  store.Lock()
-  defer store.Unlock()
-  if err := ioutil.WriteFile(store.Path, nil, OpenMode); err != nil {
-    log.Warnf("Datastore.Clean: [ %s ]", err)
+/* Clean removes the data store, its backup and leftovers */
+func (this *DataStore) Clean() {
+  this.Lock()
+  defer this.Unlock()
+  this.current = false
+  for _, path := range []string{ this.Path, this.Path + BakSuffix, this.Path + TmpSuffix, this.Path + BadSuffix } {
+    if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+      log.Warnf("Datastore.Clean: [ %s ]", err)
+    }
   }
 }
 
-func Load(elem interface{}) error {
-  var err error
-  store.Lock()
-  defer store.Unlock()
-  if buf, err := ioutil.ReadFile(store.Path); err == nil {
-    return json.Unmarshal(buf, &elem)
-  } else {
+/* Load decodes the data store in elem, falling back to the backup of the
+   previous generation when the current one is missing or damaged */
+func (this *DataStore) Load(elem interface{}) error {
+  this.Lock()
+  defer this.Unlock()
+  err := this.load(this.Path, elem)
+  if this.current = err == nil; err != nil {
     log.Warnf("Datastore.Load: [ %s ]", err)
+    if errbak := this.load(this.Path + BakSuffix, elem); errbak == nil {
+      log.Warnf("Datastore.Load: restored [ %s ]", this.Path + BakSuffix)
+      return nil
+    }
   }
   return err
 }
 
-func Store(elem interface{}) error {
-  var err error
-  if buf, err := json.Marshal(&elem); err == nil {
-    store.Lock()
-    err = ioutil.WriteFile(store.Path, buf, OpenMode)
-    store.Unlock()
+func (this *DataStore) load(path string, elem interface{}) error {
+  buf, err := ioutil.ReadFile(path)
+  if err != nil {
+    return err
+  }
+  var doc map[string]interface{}
+  if err = json.Unmarshal(buf, &doc); err != nil {
+    return err
+  }
+  version := 0
+  if v, ok := doc["Version"].(float64); ok {
+    version = int(v)
+    doc, _ = doc["Data"].(map[string]interface{})
+  }
+  if version > this.Version() {
+    return fmt.Errorf("%s: version %d is newer than %d", path, version, this.Version())
+  }
+  for ; version < this.Version(); version++ {
+    if doc == nil {
+      doc = make(map[string]interface{})
+    }
+    if err = this.Migrations[version](doc); err != nil {
+      return fmt.Errorf("%s: migration from version %d: %s", path, version, err)
+    }
+    log.Infof("Datastore.Load: [ %s ] migrated to version %d", path, version + 1)
+  }
+  if buf, err = json.Marshal(doc); err != nil {
+    return err
+  }
+  return json.Unmarshal(buf, elem)
+}
+
+/* Store writes elem in a temporary file that replaces the data store once
+   synced, the previous generation is kept as backup */
+func (this *DataStore) Store(elem interface{}) error {
+  data, err := json.Marshal(elem)
+  if err == nil {
+    var buf []byte
+    if buf, err = json.Marshal(&document{ Version: this.Version(), Data: data }); err == nil {
+      this.Lock()
+      err = this.store(buf)
+      this.Unlock()
+    }
   }
   if err != nil {
     log.Warnf("Datastore.Store: [ %s ]", err)
   }
   return err
 }
+
+func (this *DataStore) store(buf []byte) error {
+  tmp := this.Path + TmpSuffix
+  file, err := os.OpenFile(tmp, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, OpenMode)
+  if err != nil {
+    return err
+  }
+  if _, err = file.Write(buf); err == nil {
+    err = file.Sync()
+  }
+  if errclose := file.Close(); err == nil {
+    err = errclose
+  }
+  if err != nil {
+    os.Remove(tmp)
+    return err
+  }
+  if _, err = os.Stat(this.Path); err == nil && this.current {
+    /* The backup is a second link to the current generation */
+    os.Remove(this.Path + BakSuffix)
+    if err = os.Link(this.Path, this.Path + BakSuffix); err != nil {
+      log.Warnf("Datastore.Store: backup [ %s ]", err)
+    }
+  } else if err == nil {
+    /* Unreadable, or written by a newer version: keep it for inspection */
+    log.Warnf("Datastore.Store: [ %s ] moved to [ %s ]", this.Path, this.Path + BadSuffix)
+    os.Rename(this.Path, this.Path + BadSuffix)
+  }
+  if err = os.Rename(tmp, this.Path); err != nil {
+    os.Remove(tmp)
+    return err
+  }
+  this.current = true
+  return syncDir(filepath.Dir(this.Path))
+}
+
+func syncDir(path string) error {
+  dir, err := os.Open(path)
+  if err != nil {
+    return err
+  }
+  defer dir.Close()
+  return dir.Sync()
+}
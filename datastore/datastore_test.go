@@ -0,0 +1,135 @@
+package datastore
+
+import (
+  "os"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+)
+
+func writeFile(t *testing.T, path, content string) {
+  if err := ioutil.WriteFile(path, []byte(content), OpenMode); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func readFile(t *testing.T, path string) string {
+  buf, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return string(buf)
+}
+
+func exists(path string) bool {
+  _, err := os.Stat(path)
+  return err == nil
+}
+
+func TestDataStoreGenerations(t *testing.T) {
+  path := filepath.Join(tempDir(t), "vde.json")
+  doc := New(path)
+  var r record
+  if err := doc.Load(&r); err == nil {
+    t.Errorf("Load of a missing store: no error")
+  }
+  doc.Store(&record{ Name: "first" })
+  if exists(path + BakSuffix) {
+    t.Errorf("backup of the first generation")
+  }
+  doc.Store(&record{ Name: "second" })
+  if got, want := readFile(t, path + BakSuffix), `{"Version":0,"Data":{"Name":"first","Count":0}}`; got != want {
+    t.Errorf("backup %s, want %s", got, want)
+  }
+  doc = New(path)
+  if err := doc.Load(&r); err != nil || r.Name != "second" {
+    t.Errorf("Load %+v %v", r, err)
+  }
+  if exists(path + TmpSuffix) {
+    t.Errorf("temporary file left")
+  }
+  doc.Clean()
+  for _, suffix := range []string{ "", BakSuffix, TmpSuffix, BadSuffix } {
+    if exists(path + suffix) {
+      t.Errorf("%s left by Clean", path + suffix)
+    }
+  }
+}
+
+func TestDataStoreLoadBackup(t *testing.T) {
+  for _, tc := range []struct {
+    name    string
+    primary string
+    backup  string
+    want    string
+    ok      bool
+  } {
+    { "corrupt", `{"Version":0,"Data":{"Na`, `{"Version":0,"Data":{"Name":"backup"}}`, "backup", true },
+    { "missing", "", `{"Version":0,"Data":{"Name":"backup"}}`, "backup", true },
+    { "newer version", `{"Version":9,"Data":{"Name":"primary"}}`, `{"Version":0,"Data":{"Name":"backup"}}`, "backup", true },
+    { "corrupt backup", `{"Na`, `{"Na`, "", false },
+    { "no backup", `{"Na`, "", "", false },
+    { "version 0 without envelope", `{"Name":"primary"}`, "", "primary", true },
+  } {
+    path := filepath.Join(tempDir(t), "vde.json")
+    if tc.primary != "" {
+      writeFile(t, path, tc.primary)
+    }
+    if tc.backup != "" {
+      writeFile(t, path + BakSuffix, tc.backup)
+    }
+    doc := New(path)
+    var r record
+    if err := doc.Load(&r); (err == nil) != tc.ok || r.Name != tc.want {
+      t.Errorf("%s: Load %+v %v", tc.name, r, err)
+      continue
+    }
+    /* The next generation replaces a primary that could not be loaded, kept aside */
+    doc.Store(&record{ Name: "next" })
+    if r = (record{}); New(path).Load(&r) != nil || r.Name != "next" {
+      t.Errorf("%s: Load after Store %+v", tc.name, r)
+    }
+    if tc.primary == "" || tc.want == "primary" {
+      if exists(path + BadSuffix) {
+        t.Errorf("%s: %s moved aside", tc.name, path)
+      }
+    } else if got := readFile(t, path + BadSuffix); got != tc.primary {
+      t.Errorf("%s: moved aside %s, want %s", tc.name, got, tc.primary)
+    }
+    /* The backup of a loaded primary is the previous generation */
+    if tc.want == "primary" {
+      if got := readFile(t, path + BakSuffix); got != tc.primary {
+        t.Errorf("%s: backup %s, want %s", tc.name, got, tc.primary)
+      }
+    }
+  }
+}
+
+func TestDataStoreMigrations(t *testing.T) {
+  path := filepath.Join(tempDir(t), "vde.json")
+  writeFile(t, path, `{"Name":"v0"}`)
+  migrations := []Migration{
+    func(doc map[string]interface{}) error {
+      doc["Count"] = float64(1)
+      return nil
+    },
+    func(doc map[string]interface{}) error {
+      doc["Count"] = doc["Count"].(float64) + 1
+      return nil
+    },
+  }
+  doc := &DataStore{ Path: path, Migrations: migrations }
+  var r record
+  if err := doc.Load(&r); err != nil || r != (record{ "v0", 2 }) {
+    t.Errorf("Load %+v %v", r, err)
+  }
+  doc.Store(&r)
+  if got, want := readFile(t, path), `{"Version":2,"Data":{"Name":"v0","Count":2}}`; got != want {
+    t.Errorf("stored %s, want %s", got, want)
+  }
+  /* A store of a newer version is not downgraded, without a backup to fall back to */
+  os.Remove(path + BakSuffix)
+  if err := New(path).Load(&r); err == nil {
+    t.Errorf("Load of a newer version: no error")
+  }
+}
@@ -0,0 +1,38 @@
+package datastore
+
+/* FileStore keeps the records in memory and writes them all in a JSON
+   document on every update, see DataStore */
+type FileStore struct {
+  MemoryStore
+  doc *DataStore
+}
+
+func init() {
+  Register("file", func(path string, migrations ...Migration) (Store, error) {
+    return NewFileStore(path, migrations...)
+  })
+}
+
+func NewFileStore(path string, migrations ...Migration) (*FileStore, error) {
+  store := &FileStore {
+    MemoryStore: MemoryStore{ data: make(buckets) },
+    doc:         &DataStore{ Path: path, Migrations: migrations },
+  }
+  store.persist = func(data buckets) error {
+    return store.doc.Store(data)
+  }
+  if err := store.doc.Load(&store.data); err != nil || store.data == nil {
+    /* Missing or unreadable, in the latter case it is moved aside on the next update */
+    store.data = make(buckets)
+  }
+  return store, nil
+}
+
+/* Clean removes the document and its backup as well */
+func (this *FileStore) Clean() error {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  this.doc.Clean()
+  this.data = make(buckets)
+  return nil
+}
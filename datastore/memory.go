@@ -0,0 +1,121 @@
+package datastore
+
+import (
+  "sort"
+  "sync"
+  "strings"
+  "encoding/json"
+)
+
+/* buckets maps each bucket to its records, it is also the document of a FileStore */
+type buckets map[string]map[string]json.RawMessage
+
+/* MemoryStore keeps the records in memory, the state is lost on exit */
+type MemoryStore struct {
+  mutex   sync.RWMutex
+  data    buckets
+  /* persist is called with the new state before an update is committed */
+  persist func(data buckets) error
+}
+
+type memoryTx struct {
+  data     buckets
+  writable bool
+}
+
+func init() {
+  Register("memory", func(string, ...Migration) (Store, error) {
+    return NewMemoryStore(), nil
+  })
+}
+
+func NewMemoryStore() *MemoryStore {
+  return &MemoryStore{ data: make(buckets) }
+}
+
+/* copy duplicates the maps, the records are never modified in place */
+func (this buckets) copy() buckets {
+  data := make(buckets, len(this))
+  for name, records := range this {
+    data[name] = make(map[string]json.RawMessage, len(records))
+    for key, value := range records {
+      data[name][key] = value
+    }
+  }
+  return data
+}
+
+func (this *MemoryStore) Update(fn func(tx Tx) error) error {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  tx := &memoryTx{ data: this.data.copy(), writable: true }
+  if err := fn(tx); err != nil {
+    return err
+  }
+  if this.persist != nil {
+    if err := this.persist(tx.data); err != nil {
+      return err
+    }
+  }
+  this.data = tx.data
+  return nil
+}
+
+func (this *MemoryStore) View(fn func(tx Tx) error) error {
+  this.mutex.RLock()
+  defer this.mutex.RUnlock()
+  return fn(&memoryTx{ data: this.data })
+}
+
+func (this *MemoryStore) Clean() error {
+  return this.Update(func(tx Tx) error {
+    tx.(*memoryTx).data = make(buckets)
+    return nil
+  })
+}
+
+func (this *MemoryStore) Close() error {
+  return nil
+}
+
+func (this *memoryTx) Get(bucket, key string, elem interface{}) error {
+  value, ok := this.data[bucket][key]
+  if !ok {
+    return ErrNotFound
+  }
+  return json.Unmarshal(value, elem)
+}
+
+func (this *memoryTx) Put(bucket, key string, elem interface{}) error {
+  if !this.writable {
+    return ErrReadOnly
+  }
+  value, err := json.Marshal(elem)
+  if err != nil {
+    return err
+  }
+  if this.data[bucket] == nil {
+    this.data[bucket] = make(map[string]json.RawMessage)
+  }
+  this.data[bucket][key] = value
+  return nil
+}
+
+func (this *memoryTx) Delete(bucket, key string) error {
+  if !this.writable {
+    return ErrReadOnly
+  }
+  delete(this.data[bucket], key)
+  return nil
+}
+
+func (this *memoryTx) Keys(bucket, prefix string) ([]string, error) {
+  var keys []string
+  for key := range this.data[bucket] {
+    if strings.HasPrefix(key, prefix) {
+      keys = append(keys, key)
+    }
+  }
+  sort.Strings(keys)
+  return keys, nil
+}
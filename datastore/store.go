@@ -0,0 +1,53 @@
+package datastore
+
+import (
+  "errors"
+  "strings"
+)
+
+/* Store keeps the state of a driver as JSON records, grouped in buckets and
+   identified by a key, e.g. a network or an endpoint */
+type Store interface {
+  /* Update runs fn in a read-write transaction, nothing is written if fn fails */
+  Update(fn func(tx Tx) error) error
+  /* View runs fn in a read-only transaction */
+  View(fn func(tx Tx) error) error
+  /* Clean removes all the records */
+  Clean() error
+  Close() error
+}
+
+type Tx interface {
+  /* Get decodes the record in elem, or fails with ErrNotFound */
+  Get(bucket, key string, elem interface{}) error
+  Put(bucket, key string, elem interface{}) error
+  Delete(bucket, key string) error
+  /* Keys returns the sorted keys of bucket starting with prefix */
+  Keys(bucket, prefix string) ([]string, error)
+}
+
+/* OpenFunc opens a store, a document based one upgrades it with migrations */
+type OpenFunc func(path string, migrations ...Migration) (Store, error)
+
+var backends = make(map[string]OpenFunc)
+
+var (
+  ErrNotFound = errors.New("Record not found")
+  ErrReadOnly = errors.New("Read-only transaction")
+)
+
+func Register(scheme string, open OpenFunc) {
+  backends[scheme] = open
+}
+
+/* Open returns the store of the url scheme://path, e.g. bolt:///etc/docker/vde.db */
+func Open(url string, migrations ...Migration) (Store, error) {
+  i := strings.Index(url, "://")
+  if i < 0 {
+    return nil, errors.New("Invalid datastore url: " + url)
+  }
+  if open := backends[url[:i]]; open != nil {
+    return open(url[i+3:], migrations...)
+  }
+  return nil, errors.New("Datastore not supported: " + url)
+}
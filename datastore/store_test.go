@@ -0,0 +1,142 @@
+package datastore
+
+import (
+  "errors"
+  "reflect"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+)
+
+type record struct {
+  Name  string
+  Count int
+}
+
+func tempDir(t *testing.T) string {
+  dir, err := ioutil.TempDir("", "datastore")
+  if err != nil {
+    t.Fatal(err)
+  }
+  return dir
+}
+
+/* keys returns the keys of bucket with prefix in a read-only transaction */
+func keys(t *testing.T, store Store, bucket, prefix string) []string {
+  var keys []string
+  if err := store.View(func(tx Tx) (err error) {
+    keys, err = tx.Keys(bucket, prefix)
+    return err
+  }); err != nil {
+    t.Fatal(err)
+  }
+  return keys
+}
+
+func TestStores(t *testing.T) {
+  dir := tempDir(t)
+  for _, scheme := range []string{ "memory", "file", "bolt" } {
+    url := scheme + "://" + filepath.Join(dir, scheme)
+    store, err := Open(url)
+    if err != nil {
+      t.Fatalf("%s: %s", scheme, err)
+    }
+    if err = store.Update(func(tx Tx) error {
+      for _, key := range []string{ "n2", "n1", "n10", "m1" } {
+        if err := tx.Put("networks", key, &record{ Name: key, Count: len(key) }); err != nil {
+          return err
+        }
+      }
+      return tx.Put("endpoints", "n1/e1", &record{ Name: "e1" })
+    }); err != nil {
+      t.Fatalf("%s: Update %s", scheme, err)
+    }
+
+    if got, want := keys(t, store, "networks", ""), []string{ "m1", "n1", "n10", "n2" }; !reflect.DeepEqual(got, want) {
+      t.Errorf("%s: Keys %v, want %v", scheme, got, want)
+    }
+    if got, want := keys(t, store, "networks", "n1"), []string{ "n1", "n10" }; !reflect.DeepEqual(got, want) {
+      t.Errorf("%s: Keys n1 %v, want %v", scheme, got, want)
+    }
+    if got := keys(t, store, "missing", ""); len(got) != 0 {
+      t.Errorf("%s: Keys of a missing bucket %v", scheme, got)
+    }
+
+    store.View(func(tx Tx) error {
+      var r record
+      if err := tx.Get("networks", "n10", &r); err != nil || r != (record{ "n10", 3 }) {
+        t.Errorf("%s: Get %+v %v", scheme, r, err)
+      }
+      if err := tx.Get("networks", "n3", &r); err != ErrNotFound {
+        t.Errorf("%s: Get of a missing key %v", scheme, err)
+      }
+      if err := tx.Get("missing", "n1", &r); err != ErrNotFound {
+        t.Errorf("%s: Get of a missing bucket %v", scheme, err)
+      }
+      if err := tx.Put("networks", "n3", &r); err != ErrReadOnly {
+        t.Errorf("%s: Put in View %v", scheme, err)
+      }
+      if err := tx.Delete("networks", "n1"); err != ErrReadOnly {
+        t.Errorf("%s: Delete in View %v", scheme, err)
+      }
+      return nil
+    })
+
+    /* A failed update writes nothing */
+    failed := errors.New("failed")
+    if err := store.Update(func(tx Tx) error {
+      tx.Put("networks", "n3", &record{ Name: "n3" })
+      tx.Delete("networks", "n1")
+      return failed
+    }); err != failed {
+      t.Errorf("%s: failed Update %v", scheme, err)
+    }
+    if got, want := keys(t, store, "networks", "n"), []string{ "n1", "n10", "n2" }; !reflect.DeepEqual(got, want) {
+      t.Errorf("%s: Keys after a failed Update %v, want %v", scheme, got, want)
+    }
+
+    if err := store.Update(func(tx Tx) error {
+      if err := tx.Delete("networks", "n1"); err != nil {
+        return err
+      }
+      if err := tx.Delete("networks", "n3"); err != nil {
+        return err
+      }
+      return tx.Delete("missing", "n1")
+    }); err != nil {
+      t.Errorf("%s: Delete %s", scheme, err)
+    }
+    if got, want := keys(t, store, "networks", "n"), []string{ "n10", "n2" }; !reflect.DeepEqual(got, want) {
+      t.Errorf("%s: Keys after Delete %v, want %v", scheme, got, want)
+    }
+
+    /* The records outlive the store, but in memory */
+    store.Close()
+    if store, err = Open(url); err != nil {
+      t.Fatalf("%s: open again %s", scheme, err)
+    }
+    want := []string{ "m1", "n10", "n2" }
+    if scheme == "memory" {
+      want = nil
+    }
+    if got := keys(t, store, "networks", ""); !reflect.DeepEqual(got, want) {
+      t.Errorf("%s: Keys when opened again %v, want %v", scheme, got, want)
+    }
+
+    if err := store.Clean(); err != nil {
+      t.Errorf("%s: Clean %s", scheme, err)
+    }
+    if got := keys(t, store, "networks", ""); len(got) != 0 {
+      t.Errorf("%s: Keys after Clean %v", scheme, got)
+    }
+    store.Close()
+  }
+}
+
+func TestOpenErrors(t *testing.T) {
+  for _, url := range []string{ "", "/var/lib/vde.json", "etcd://localhost/vde" } {
+    if _, err := Open(url); err == nil {
+      t.Errorf("%s: no error", url)
+    }
+  }
+}
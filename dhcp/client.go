@@ -0,0 +1,326 @@
+package dhcp
+
+import (
+  "net"
+  "sync"
+  "time"
+  "bytes"
+  "errors"
+  "math/rand"
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/packet"
+)
+
+const (
+  /* Default time to obtain a lease */
+  AcquireTimeout = 10 * time.Second
+  /* Attempts of a renewal and delay between the failed ones */
+  retransmitMin  = time.Second
+  retransmitMax  = 8 * time.Second
+  retryMin       = 60 * time.Second
+)
+
+var (
+  ErrTimeout = errors.New("No reply from the DHCP servers")
+  ErrNak     = errors.New("Request refused by the DHCP server")
+)
+
+/* Lease is the configuration obtained from a DHCP server */
+type Lease struct {
+  /* CIDR */
+  Address   string    `json:"Address"`
+  Gateway   string    `json:"Gateway,omitempty"`
+  Routes    []Route   `json:"Routes,omitempty"`
+  DNS       []string  `json:"DNS,omitempty"`
+  Server    string    `json:"Server"`
+  ServerMAC string    `json:"ServerMAC"`
+  Obtained  time.Time `json:"Obtained"`
+  /* Seconds from Obtained */
+  Duration  uint32    `json:"Duration"`
+  T1        uint32    `json:"T1"`
+  T2        uint32    `json:"T2"`
+}
+
+func (this *Lease) at(secs uint32) time.Time {
+  return this.Obtained.Add(time.Duration(secs) * time.Second)
+}
+
+func (this *Lease) ip() net.IP {
+  ip, _, _ := net.ParseCIDR(this.Address)
+  return ip.To4()
+}
+
+type reply struct {
+  msg *Message
+  src net.HardwareAddr
+}
+
+/* Client obtains and renews the lease of a MAC address. The frames are sent
+   with send, the ones from the network are passed to Input. */
+type Client struct {
+  mac     net.HardwareAddr
+  send    func(frame []byte) error
+  replies chan reply
+  mutex   sync.Mutex
+  lease   *Lease
+  started bool
+  stop    chan struct{}
+  done    chan struct{}
+}
+
+func NewClient(mac net.HardwareAddr, send func(frame []byte) error) *Client {
+  return &Client{
+    mac:     mac,
+    send:    send,
+    replies: make(chan reply, 8),
+    stop:    make(chan struct{}),
+    done:    make(chan struct{}),
+  }
+}
+
+/* Input takes the replies to the client out of the frames to the endpoint */
+func (this *Client) Input(frame []byte) bool {
+  eth, _, udp, ok := packet.ParseUDPv4(frame)
+  if !ok || udp.SrcPort() != ServerPort || udp.DstPort() != ClientPort {
+    return false
+  }
+  if !bytes.Equal(eth.Dst(), this.mac) && !bytes.Equal(eth.Dst(), packet.Broadcast) {
+    return false
+  }
+  msg, err := Unmarshal(udp.Payload())
+  if err != nil || msg.Op != BootReply || !bytes.Equal(msg.CHAddr, this.mac) {
+    return false
+  }
+  select {
+  case this.replies <- reply{ msg, net.HardwareAddr(append([]byte{}, eth.Src()...)) }:
+  default:
+  }
+  return true
+}
+
+func (this *Client) request(msgtype uint8, xid uint32) *Message {
+  msg := &Message{ Op: BootRequest, Xid: xid, CHAddr: this.mac, Options: make(Options) }
+  msg.Options[OptMessageType] = []byte{ msgtype }
+  msg.Options[OptClientID] = append([]byte{ 1 }, this.mac...)
+  msg.Options[OptParameterList] = []byte{ OptSubnetMask, OptRouter, OptDNS, OptDomainName, OptClasslessRoutes }
+  return msg
+}
+
+/* exchange sends msg until a reply of one of the types arrives, or timeout */
+func (this *Client) exchange(msg *Message, dst *Lease, timeout time.Duration, types ...uint8) (*reply, error) {
+  src, dstip, dstmac := net.IPv4zero, net.IPv4bcast, packet.Broadcast
+  if msg.CIAddr != nil {
+    src = msg.CIAddr
+  } else {
+    /* Without an address the replies can not be unicast */
+    msg.Flags |= flagBroadcast
+  }
+  if dst != nil {
+    /* Unicast to the server of the lease, during the renewal */
+    dstip = net.ParseIP(dst.Server)
+    dstmac, _ = net.ParseMAC(dst.ServerMAC)
+  }
+  frame := packet.NewUDPv4(dstmac, this.mac, src, dstip, ClientPort, ServerPort, msg.Marshal())
+  deadline := time.After(timeout)
+  for delay := retransmitMin; ; delay *= 2 {
+    if delay > retransmitMax {
+      delay = retransmitMax
+    }
+    if err := this.send(frame); err != nil {
+      log.Debugf("DHCP [ %s ] send: [ %s ]", this.mac, err)
+    }
+    retransmit := time.After(delay)
+    for wait := true; wait; {
+      select {
+      case r := <-this.replies:
+        if r.msg.Xid != msg.Xid {
+          continue
+        }
+        for _, t := range types {
+          if r.msg.Type() == t {
+            return &r, nil
+          }
+        }
+      case <-retransmit:
+        wait = false
+      case <-deadline:
+        return nil, ErrTimeout
+      case <-this.stop:
+        return nil, ErrTimeout
+      }
+    }
+  }
+}
+
+/* newLease reads the configuration of an ACK */
+func newLease(r *reply) *Lease {
+  opts := r.msg.Options
+  mask := net.IPMask(opts[OptSubnetMask])
+  if len(mask) != 4 {
+    mask = r.msg.YIAddr.DefaultMask()
+  }
+  lease := &Lease{
+    Address:   (&net.IPNet{ IP: r.msg.YIAddr.To4(), Mask: mask }).String(),
+    ServerMAC: r.src.String(),
+    Obtained:  time.Now(),
+    Duration:  0xffffffff,
+  }
+  if server := opts.IP(OptServerID); server != nil {
+    lease.Server = server.String()
+  }
+  if router := opts.IP(OptRouter); router != nil {
+    lease.Gateway = router.String()
+  }
+  for _, dns := range opts.IPs(OptDNS) {
+    lease.DNS = append(lease.DNS, dns.String())
+  }
+  /* The classless routes replace the routers (RFC 3442) */
+  if routes, err := opts.Routes(); err == nil && len(routes) > 0 {
+    lease.Gateway = ""
+    for _, route := range routes {
+      if route.Destination == "0.0.0.0/0" {
+        lease.Gateway = route.Gateway
+      } else {
+        lease.Routes = append(lease.Routes, route)
+      }
+    }
+  }
+  if d, ok := opts.Uint32(OptLeaseTime); ok {
+    lease.Duration = d
+  }
+  lease.T1, lease.T2 = lease.Duration / 2, uint32(uint64(lease.Duration) * 7 / 8)
+  if t1, ok := opts.Uint32(OptRenewalTime); ok && t1 < lease.Duration {
+    lease.T1 = t1
+  }
+  if t2, ok := opts.Uint32(OptRebindingTime); ok && t2 < lease.Duration {
+    lease.T2 = t2
+  }
+  return lease
+}
+
+/* Acquire obtains a new lease: DISCOVER, OFFER, REQUEST, ACK */
+func (this *Client) Acquire(timeout time.Duration) (*Lease, error) {
+  deadline := time.Now().Add(timeout)
+  discover := this.request(Discover, rand.Uint32())
+  offer, err := this.exchange(discover, nil, timeout, Offer)
+  if err != nil {
+    return nil, err
+  }
+  request := this.request(Request, discover.Xid)
+  request.Options.SetIP(OptRequestedIP, offer.msg.YIAddr)
+  request.Options[OptServerID] = offer.msg.Options[OptServerID]
+  ack, err := this.exchange(request, nil, time.Until(deadline), Ack, Nak)
+  if err != nil {
+    return nil, err
+  } else if ack.msg.Type() == Nak {
+    return nil, ErrNak
+  }
+  lease := newLease(ack)
+  this.mutex.Lock()
+  this.lease = lease
+  this.mutex.Unlock()
+  return lease, nil
+}
+
+/* renew extends lease: unicast to its server (RENEWING), broadcast after T2
+   (REBINDING), broadcast with the address requested once expired (INIT-REBOOT) */
+func (this *Client) renew(lease *Lease, now time.Time) (*Lease, error) {
+  var msg *Message
+  var dst *Lease
+  switch {
+  case now.Before(lease.at(lease.T2)):
+    msg, dst = this.request(Request, rand.Uint32()), lease
+    msg.CIAddr = lease.ip()
+  case now.Before(lease.at(lease.Duration)):
+    msg = this.request(Request, rand.Uint32())
+    msg.CIAddr = lease.ip()
+  default:
+    msg = this.request(Request, rand.Uint32())
+    msg.Options.SetIP(OptRequestedIP, lease.ip())
+  }
+  r, err := this.exchange(msg, dst, retransmitMax * 2, Ack, Nak)
+  if err != nil {
+    return nil, err
+  } else if r.msg.Type() == Nak {
+    return nil, ErrNak
+  } else if !r.msg.YIAddr.Equal(lease.ip()) {
+    return nil, errors.New("DHCP server changed the address to " + r.msg.YIAddr.String())
+  }
+  return newLease(r), nil
+}
+
+/* Start renews lease in the background until Stop, the renewal is immediate
+   if lease is old (e.g. restored after a restart) */
+func (this *Client) Start(lease *Lease) {
+  this.mutex.Lock()
+  this.lease, this.started = lease, true
+  this.mutex.Unlock()
+  go this.run()
+}
+
+func (this *Client) run() {
+  defer close(this.done)
+  for {
+    lease := this.Lease()
+    now := time.Now()
+    wait := lease.at(lease.T1).Sub(now)
+    if lease.Duration == 0xffffffff {
+      /* Infinite lease */
+      wait = 1 << 62
+    }
+    if wait <= 0 {
+      renewed, err := this.renew(lease, now)
+      if err == nil {
+        log.Debugf("DHCP [ %s ] renewed [ %s ]", this.mac, renewed.Address)
+        this.mutex.Lock()
+        this.lease = renewed
+        this.mutex.Unlock()
+        continue
+      }
+      log.Warnf("DHCP [ %s ] renew [ %s ]: [ %s ]", this.mac, lease.Address, err)
+      /* Half of the time left to the next state, at least retryMin (RFC 2131 4.4.5) */
+      wait = retryMin
+      for _, next := range []time.Time{ lease.at(lease.T2), lease.at(lease.Duration) } {
+        if left := next.Sub(now) / 2; left > retryMin {
+          wait = left
+          break
+        }
+      }
+    }
+    select {
+    case <-this.stop:
+      return
+    case <-time.After(wait):
+    }
+  }
+}
+
+func (this *Client) Lease() *Lease {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  return this.lease
+}
+
+/* Stop ends the renewals, with release the lease is given back to the server */
+func (this *Client) Stop(release bool) {
+  select {
+  case <-this.stop:
+    return
+  default:
+    close(this.stop)
+  }
+  this.mutex.Lock()
+  started := this.started
+  this.mutex.Unlock()
+  if started {
+    <-this.done
+  }
+  if lease := this.Lease(); release && lease != nil && lease.Server != "" {
+    msg := this.request(Release, rand.Uint32())
+    msg.CIAddr = lease.ip()
+    msg.Options[OptServerID] = net.ParseIP(lease.Server).To4()
+    delete(msg.Options, OptParameterList)
+    dstmac, _ := net.ParseMAC(lease.ServerMAC)
+    this.send(packet.NewUDPv4(dstmac, this.mac, lease.ip(), net.ParseIP(lease.Server), ClientPort, ServerPort, msg.Marshal()))
+  }
+}
@@ -0,0 +1,247 @@
+package dhcp
+
+import (
+  "net"
+  "sort"
+  "errors"
+  "encoding/binary"
+)
+
+const (
+  ServerPort = 67
+  ClientPort = 68
+)
+
+/* Op of the messages */
+const (
+  BootRequest = 1
+  BootReply   = 2
+)
+
+/* Values of OptMessageType */
+const (
+  Discover = 1
+  Offer    = 2
+  Request  = 3
+  Decline  = 4
+  Ack      = 5
+  Nak      = 6
+  Release  = 7
+  Inform   = 8
+)
+
+/* Options of RFC 2132 and RFC 3442 */
+const (
+  OptPad              = 0
+  OptSubnetMask       = 1
+  OptRouter           = 3
+  OptDNS              = 6
+  OptHostName         = 12
+  OptDomainName       = 15
+  OptInterfaceMTU     = 26
+  OptBroadcast        = 28
+  OptRequestedIP      = 50
+  OptLeaseTime        = 51
+  OptMessageType      = 53
+  OptServerID         = 54
+  OptParameterList    = 55
+  OptRenewalTime      = 58
+  OptRebindingTime    = 59
+  OptClientID         = 61
+  OptClasslessRoutes  = 121
+  OptEnd              = 255
+)
+
+const (
+  headerLen   = 236
+  magicCookie = 0x63825363
+  flagBroadcast = 0x8000
+)
+
+var ErrMalformed = errors.New("Malformed DHCP message")
+
+type Options map[uint8][]byte
+
+/* Message is a DHCPv4 message (RFC 2131) */
+type Message struct {
+  Op      uint8
+  Xid     uint32
+  Secs    uint16
+  Flags   uint16
+  CIAddr  net.IP
+  YIAddr  net.IP
+  SIAddr  net.IP
+  GIAddr  net.IP
+  CHAddr  net.HardwareAddr
+  Options Options
+}
+
+func ip4(ip net.IP) net.IP {
+  if ip = ip.To4(); ip == nil {
+    return net.IPv4zero.To4()
+  }
+  return ip
+}
+
+func (this *Message) Marshal() []byte {
+  b := make([]byte, headerLen + 4, 300)
+  b[0], b[1], b[2] = this.Op, 1, 6
+  binary.BigEndian.PutUint32(b[4:8], this.Xid)
+  binary.BigEndian.PutUint16(b[8:10], this.Secs)
+  binary.BigEndian.PutUint16(b[10:12], this.Flags)
+  copy(b[12:16], ip4(this.CIAddr))
+  copy(b[16:20], ip4(this.YIAddr))
+  copy(b[20:24], ip4(this.SIAddr))
+  copy(b[24:28], ip4(this.GIAddr))
+  copy(b[28:44], this.CHAddr)
+  binary.BigEndian.PutUint32(b[headerLen:], magicCookie)
+  /* Sorted, the message type first */
+  codes := make([]int, 0, len(this.Options))
+  for code := range this.Options {
+    codes = append(codes, int(code))
+  }
+  sort.Ints(codes)
+  if _, ok := this.Options[OptMessageType]; ok {
+    b = append(b, OptMessageType, 1, this.Options[OptMessageType][0])
+  }
+  for _, code := range codes {
+    if code == OptMessageType {
+      continue
+    }
+    value := this.Options[uint8(code)]
+    for len(value) > 255 {
+      b = append(b, uint8(code), 255)
+      b, value = append(b, value[:255]...), value[255:]
+    }
+    b = append(b, uint8(code), uint8(len(value)))
+    b = append(b, value...)
+  }
+  b = append(b, OptEnd)
+  /* Some old servers drop the messages shorter than a BOOTP one */
+  for len(b) < 300 {
+    b = append(b, OptPad)
+  }
+  return b
+}
+
+func Unmarshal(b []byte) (*Message, error) {
+  if len(b) < headerLen + 4 || binary.BigEndian.Uint32(b[headerLen:]) != magicCookie || b[2] > 16 {
+    return nil, ErrMalformed
+  }
+  msg := &Message{
+    Op:      b[0],
+    Xid:     binary.BigEndian.Uint32(b[4:8]),
+    Secs:    binary.BigEndian.Uint16(b[8:10]),
+    Flags:   binary.BigEndian.Uint16(b[10:12]),
+    CIAddr:  net.IP(append([]byte{}, b[12:16]...)),
+    YIAddr:  net.IP(append([]byte{}, b[16:20]...)),
+    SIAddr:  net.IP(append([]byte{}, b[20:24]...)),
+    GIAddr:  net.IP(append([]byte{}, b[24:28]...)),
+    CHAddr:  net.HardwareAddr(append([]byte{}, b[28:28+b[2]]...)),
+    Options: make(Options),
+  }
+  opts := b[headerLen+4:]
+  for len(opts) > 0 {
+    code := opts[0]
+    if code == OptEnd {
+      break
+    } else if code == OptPad {
+      opts = opts[1:]
+      continue
+    }
+    if len(opts) < 2 || len(opts) < 2 + int(opts[1]) {
+      return nil, ErrMalformed
+    }
+    /* Long options are split in more instances (RFC 3396) */
+    msg.Options[code] = append(msg.Options[code], opts[2:2+opts[1]]...)
+    opts = opts[2+opts[1]:]
+  }
+  return msg, nil
+}
+
+func (this *Message) Type() uint8 {
+  if v := this.Options[OptMessageType]; len(v) == 1 {
+    return v[0]
+  }
+  return 0
+}
+
+/* IP returns the first address of an option */
+func (this Options) IP(code uint8) net.IP {
+  if v := this[code]; len(v) >= 4 {
+    return net.IP(v[:4])
+  }
+  return nil
+}
+
+func (this Options) IPs(code uint8) []net.IP {
+  var ips []net.IP
+  for v := this[code]; len(v) >= 4; v = v[4:] {
+    ips = append(ips, net.IP(v[:4]))
+  }
+  return ips
+}
+
+func (this Options) Uint32(code uint8) (uint32, bool) {
+  if v := this[code]; len(v) == 4 {
+    return binary.BigEndian.Uint32(v), true
+  }
+  return 0, false
+}
+
+func (this Options) SetIP(code uint8, ips ...net.IP) {
+  var v []byte
+  for _, ip := range ips {
+    v = append(v, ip.To4()...)
+  }
+  this[code] = v
+}
+
+func (this Options) SetUint32(code uint8, n uint32) {
+  v := make([]byte, 4)
+  binary.BigEndian.PutUint32(v, n)
+  this[code] = v
+}
+
+/* Route is a classless static route, Gateway is 0.0.0.0 for the connected ones */
+type Route struct {
+  Destination string `json:"Destination"`
+  Gateway     string `json:"Gateway"`
+}
+
+/* Routes decodes OptClasslessRoutes (RFC 3442) */
+func (this Options) Routes() ([]Route, error) {
+  var routes []Route
+  for v := this[OptClasslessRoutes]; len(v) > 0; {
+    ones := int(v[0])
+    n := (ones + 7) / 8
+    if ones > 32 || len(v) < 1 + n + 4 {
+      return nil, ErrMalformed
+    }
+    dst := make(net.IP, 4)
+    copy(dst, v[1:1+n])
+    routes = append(routes, Route{
+      Destination: (&net.IPNet{ IP: dst, Mask: net.CIDRMask(ones, 32) }).String(),
+      Gateway:     net.IP(v[1+n:5+n]).String(),
+    })
+    v = v[5+n:]
+  }
+  return routes, nil
+}
+
+/* SetRoutes encodes routes in OptClasslessRoutes */
+func (this Options) SetRoutes(routes []Route) error {
+  var v []byte
+  for _, r := range routes {
+    _, dst, err := net.ParseCIDR(r.Destination)
+    if err != nil || dst.IP.To4() == nil {
+      return ErrMalformed
+    }
+    ones, _ := dst.Mask.Size()
+    v = append(v, uint8(ones))
+    v = append(v, dst.IP.To4()[:(ones + 7) / 8]...)
+    v = append(v, ip4(net.ParseIP(r.Gateway))...)
+  }
+  this[OptClasslessRoutes] = v
+  return nil
+}
@@ -0,0 +1,167 @@
+package dhcp
+
+import (
+  "net"
+  "time"
+  "bytes"
+  "errors"
+  "strings"
+)
+
+/* Binding is an address leased by a Server */
+type Binding struct {
+  /* The hardware address of a DHCPv4 client, the DUID/IAID of a DHCPv6 one */
+  Client   string    `json:"Client"`
+  Address  string    `json:"Address"`
+  MAC      string    `json:"MacAddress"`
+  Hostname string    `json:"Hostname,omitempty"`
+  Expires  time.Time `json:"Expires"`
+  /* Offered and not yet requested, it is not saved */
+  offered  bool
+}
+
+/* declined marks the addresses found in use by a client (DHCPDECLINE) */
+const declined = "declined"
+
+/* ParseRange accepts an address range first-last, the bounds included */
+func ParseRange(s string) (net.IP, net.IP, error) {
+  bounds := strings.SplitN(strings.TrimSpace(s), "-", 2)
+  if len(bounds) != 2 {
+    return nil, nil, errors.New("Invalid address range: " + s)
+  }
+  first, last := net.ParseIP(bounds[0]), net.ParseIP(bounds[1])
+  if first == nil || last == nil || (first.To4() == nil) != (last.To4() == nil) || compareIP(first, last) > 0 {
+    return nil, nil, errors.New("Invalid address range: " + s)
+  }
+  return first, last, nil
+}
+
+func compareIP(a, b net.IP) int {
+  return bytes.Compare(a.To16(), b.To16())
+}
+
+func prevIP(ip net.IP) net.IP {
+  prev := make(net.IP, len(ip))
+  copy(prev, ip)
+  for i := len(prev) - 1; i >= 0; i-- {
+    if prev[i]--; prev[i] != 0xff {
+      break
+    }
+  }
+  return prev
+}
+
+/* pool hands out the addresses of a range of subnet, from the last one down:
+   Docker assigns the addresses of the containers from the first one up */
+type pool struct {
+  subnet      *net.IPNet
+  first, last net.IP
+  /* By address and by client */
+  bindings    map[string]*Binding
+  clients     map[string]*Binding
+}
+
+/* newPool returns the pool of the range of subnet, the whole subnet if it is empty */
+func newPool(subnet *net.IPNet, iprange string) (*pool, error) {
+  p := &pool{ subnet: subnet, bindings: make(map[string]*Binding), clients: make(map[string]*Binding) }
+  if iprange == "" {
+    p.first = subnet.IP.Mask(subnet.Mask)
+    p.last = make(net.IP, len(p.first))
+    for i := range p.first {
+      p.last[i] = p.first[i] | ^subnet.Mask[i]
+    }
+    return p, nil
+  }
+  first, last, err := ParseRange(iprange)
+  if err != nil {
+    return nil, err
+  }
+  if !subnet.Contains(first) || !subnet.Contains(last) {
+    return nil, errors.New("Address range " + iprange + " out of " + subnet.String())
+  }
+  if subnet.IP.To4() != nil {
+    first, last = first.To4(), last.To4()
+  }
+  p.first, p.last = first, last
+  return p, nil
+}
+
+/* usable excludes the network address and the IPv4 broadcast */
+func (this *pool) usable(ip net.IP) bool {
+  if !this.subnet.Contains(ip) || ip.Equal(ip.Mask(this.subnet.Mask)) {
+    return false
+  }
+  if ip.To4() == nil {
+    return true
+  }
+  ones, bits := this.subnet.Mask.Size()
+  bcast := make(net.IP, net.IPv4len)
+  for i := range bcast {
+    bcast[i] = this.subnet.IP.To4()[i] | ^this.subnet.Mask[len(this.subnet.Mask) - 4 + i]
+  }
+  return bits - ones < 2 || !ip.Equal(bcast)
+}
+
+func (this *pool) contains(ip net.IP) bool {
+  return compareIP(ip, this.first) >= 0 && compareIP(ip, this.last) <= 0 && this.usable(ip)
+}
+
+/* add binds b, it returns the previous binding of its client to another address */
+func (this *pool) add(b *Binding) *Binding {
+  old := this.clients[b.Client]
+  if old != nil && old.Address != b.Address {
+    delete(this.bindings, old.Address)
+  } else {
+    old = nil
+  }
+  if other := this.bindings[b.Address]; other != nil && other.Client != b.Client {
+    delete(this.clients, other.Client)
+  }
+  this.bindings[b.Address], this.clients[b.Client] = b, b
+  return old
+}
+
+func (this *pool) remove(b *Binding) {
+  if this.bindings[b.Address] == b {
+    delete(this.bindings, b.Address)
+  }
+  if this.clients[b.Client] == b {
+    delete(this.clients, b.Client)
+  }
+}
+
+/* free reports whether ip can be leased to client */
+func (this *pool) free(ip net.IP, client string, reserved map[string]string, now time.Time) bool {
+  if !this.usable(ip) || reserved[ip.String()] != "" {
+    return false
+  }
+  b := this.bindings[ip.String()]
+  return b == nil || b.Client == client || now.After(b.Expires)
+}
+
+/* next returns the first free address of the range from the top */
+func (this *pool) next(client string, reserved map[string]string, now time.Time) net.IP {
+  for ip := this.last; compareIP(ip, this.first) >= 0; ip = prevIP(ip) {
+    if this.free(ip, client, reserved, now) {
+      return ip
+    }
+    if ip.Equal(this.first) {
+      break
+    }
+  }
+  return nil
+}
+
+/* choose returns the address for client: the one it had, the one it asks
+   if free and in the range, or the next free one */
+func (this *pool) choose(client string, requested net.IP, reserved map[string]string, now time.Time) net.IP {
+  if b := this.clients[client]; b != nil {
+    if ip := net.ParseIP(b.Address); this.free(ip, client, reserved, now) {
+      return ip
+    }
+  }
+  if requested != nil && this.contains(requested) && this.free(requested, client, reserved, now) {
+    return requested
+  }
+  return this.next(client, reserved, now)
+}
@@ -0,0 +1,91 @@
+package dhcp
+
+import (
+  "net"
+  "time"
+  "testing"
+)
+
+func testPool(t *testing.T, cidr, iprange string, bindings ...*Binding) *pool {
+  _, subnet, err := net.ParseCIDR(cidr)
+  if err != nil {
+    t.Fatal(err)
+  }
+  p, err := newPool(subnet, iprange)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, b := range bindings {
+    p.add(b)
+  }
+  return p
+}
+
+func TestPoolNext(t *testing.T) {
+  now := time.Now()
+  later, earlier := now.Add(time.Hour), now.Add(-time.Second)
+  for _, tc := range []struct {
+    name     string
+    cidr     string
+    iprange  string
+    bindings []*Binding
+    reserved map[string]string
+    want     string
+  } {
+    { "top of the subnet, no broadcast", "10.0.0.0/24", "", nil, nil, "10.0.0.254" },
+    { "top of the range", "10.0.0.0/24", "10.0.0.100-10.0.0.110", nil, nil, "10.0.0.110" },
+    { "range up to the broadcast", "10.0.0.0/24", "10.0.0.250-10.0.0.255", nil, nil, "10.0.0.254" },
+    { "reserved", "10.0.0.0/24", "", nil, map[string]string{ "10.0.0.254": "gateway" }, "10.0.0.253" },
+    { "declined", "10.0.0.0/24", "", nil, map[string]string{ "10.0.0.254": declined }, "10.0.0.253" },
+    { "bound to another client", "10.0.0.0/24", "",
+      []*Binding{ { Client: "other", Address: "10.0.0.254", Expires: later } }, nil, "10.0.0.253" },
+    { "expired binding of another client", "10.0.0.0/24", "",
+      []*Binding{ { Client: "other", Address: "10.0.0.254", Expires: earlier } }, nil, "10.0.0.254" },
+    { "bound to the client", "10.0.0.0/24", "",
+      []*Binding{ { Client: "client", Address: "10.0.0.254", Expires: later } }, nil, "10.0.0.254" },
+    { "range full", "10.0.0.0/24", "10.0.0.10-10.0.0.11",
+      []*Binding{ { Client: "a", Address: "10.0.0.11", Expires: later }, { Client: "b", Address: "10.0.0.10", Expires: later } },
+      nil, "" },
+    { "range of the network address", "10.0.0.0/24", "10.0.0.0-10.0.0.0", nil, nil, "" },
+    { "/30 without broadcast", "10.0.0.0/30", "", nil, nil, "10.0.0.2" },
+    { "/31 with both addresses", "10.0.0.0/31", "", nil, nil, "10.0.0.1" },
+    { "/32 of the network address", "10.0.0.1/32", "", nil, nil, "" },
+    { "first of the subnet", "10.0.1.0/24", "10.0.1.0-10.0.1.1", nil, nil, "10.0.1.1" },
+    { "IPv6 top of the subnet", "fd00::/120", "", nil, nil, "fd00::ff" },
+    { "IPv6 range", "fd00::/64", "fd00::10-fd00::20",
+      []*Binding{ { Client: "other", Address: "fd00::20", Expires: later } }, nil, "fd00::1f" },
+  } {
+    p := testPool(t, tc.cidr, tc.iprange, tc.bindings...)
+    got := p.next("client", tc.reserved, now)
+    if tc.want == "" {
+      if got != nil {
+        t.Errorf("%s: %s, want none", tc.name, got)
+      }
+    } else if !got.Equal(net.ParseIP(tc.want)) {
+      t.Errorf("%s: %v, want %s", tc.name, got, tc.want)
+    }
+  }
+}
+
+func TestPoolChoose(t *testing.T) {
+  now := time.Now()
+  later := now.Add(time.Hour)
+  for _, tc := range []struct {
+    name      string
+    bindings  []*Binding
+    requested string
+    want      string
+  } {
+    { "next", nil, "", "10.0.0.30" },
+    { "previous binding", []*Binding{ { Client: "client", Address: "10.0.0.25", Expires: now.Add(-time.Hour) } }, "10.0.0.21", "10.0.0.25" },
+    { "requested", nil, "10.0.0.21", "10.0.0.21" },
+    { "requested out of the range", nil, "10.0.0.5", "10.0.0.30" },
+    { "requested and bound", []*Binding{ { Client: "other", Address: "10.0.0.21", Expires: later } }, "10.0.0.21", "10.0.0.30" },
+  } {
+    p := testPool(t, "10.0.0.0/24", "10.0.0.20-10.0.0.30", tc.bindings...)
+    got := p.choose("client", net.ParseIP(tc.requested), nil, now)
+    if !got.Equal(net.ParseIP(tc.want)) {
+      t.Errorf("%s: %v, want %s", tc.name, got, tc.want)
+    }
+  }
+}
@@ -0,0 +1,414 @@
+package dhcp
+
+import (
+  "net"
+  "sync"
+  "time"
+  "bytes"
+  "errors"
+  "strings"
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/packet"
+)
+
+const (
+  /* Default duration of the leases of a Server */
+  LeaseTime = time.Hour
+  /* An offered address is kept for the client until it requests it */
+  offerTime = 30 * time.Second
+)
+
+type ServerConfig struct {
+  /* Hardware address of the server on the network */
+  MAC       net.HardwareAddr
+  /* IPv4 address of the server in CIDR form, the pool is in its subnet */
+  Address   string
+  /* Range of the IPv4 pool first-last, the whole subnet if empty */
+  Range     string
+  /* Router given to the clients, if any */
+  Router    string
+  /* DNS servers and domain name given to the clients, if any */
+  DNS       []string
+  Domain    string
+  /* MTU given to the clients, if not 0 */
+  MTU       int
+  /* Subnet and range of the DHCPv6 pool, no DHCPv6 if empty */
+  Subnet6   string
+  Range6    string
+  LeaseTime time.Duration
+  /* Bindings of a previous run */
+  Bindings  []*Binding
+  /* Save is called on each change of a binding to keep it, removed when it is gone */
+  Save      func(b *Binding, removed bool)
+}
+
+/* Server hands out the addresses of a network to the peers outside Docker
+   (e.g. VMs). The frames are sent with send, the ones from the network are
+   passed to Input. It answers the ARP requests for its own IPv4 address, the
+   clients renew their leases there. */
+type Server struct {
+  config    ServerConfig
+  send      func(frame []byte) error
+  mutex     sync.Mutex
+  ip        net.IP
+  linklocal net.IP
+  duid      []byte
+  pool4     *pool
+  pool6     *pool
+  /* Addresses not to lease, e.g. the ones of the containers, by address */
+  reserved  map[string]string
+  started   bool
+  stop      chan struct{}
+  done      chan struct{}
+}
+
+func NewServer(config ServerConfig, send func(frame []byte) error) (*Server, error) {
+  if len(config.MAC) != 6 {
+    return nil, errors.New("Invalid DHCP server MAC address")
+  }
+  if config.LeaseTime <= 0 {
+    config.LeaseTime = LeaseTime
+  }
+  if config.Save == nil {
+    config.Save = func(*Binding, bool) {}
+  }
+  server := &Server{
+    config:    config,
+    send:      send,
+    linklocal: packet.LinkLocal(config.MAC),
+    /* DUID-LL (RFC 8415 11.4) */
+    duid:      append([]byte{ 0, 3, 0, 1 }, config.MAC...),
+    reserved:  make(map[string]string),
+    stop:      make(chan struct{}),
+    done:      make(chan struct{}),
+  }
+  if config.Address != "" {
+    ip, subnet, err := net.ParseCIDR(config.Address)
+    if err != nil || ip.To4() == nil {
+      return nil, errors.New("Invalid DHCP server address: " + config.Address)
+    }
+    if server.pool4, err = newPool(subnet, config.Range); err != nil {
+      return nil, err
+    }
+    server.ip = ip.To4()
+    server.reserved[server.ip.String()] = "server"
+  }
+  if config.Router != "" {
+    if net.ParseIP(config.Router).To4() == nil {
+      return nil, errors.New("Invalid DHCP router: " + config.Router)
+    }
+    server.reserved[net.ParseIP(config.Router).String()] = "router"
+  }
+  if config.Subnet6 != "" {
+    ip, subnet, err := net.ParseCIDR(config.Subnet6)
+    if err != nil || ip.To4() != nil {
+      return nil, errors.New("Invalid DHCPv6 subnet: " + config.Subnet6)
+    }
+    if server.pool6, err = newPool(subnet, config.Range6); err != nil {
+      return nil, err
+    }
+  }
+  for _, b := range config.Bindings {
+    if p := server.pool(net.ParseIP(b.Address)); p != nil {
+      p.add(b)
+    } else {
+      /* The network has been defined again with another subnet */
+      config.Save(b, true)
+    }
+  }
+  return server, nil
+}
+
+/* pool returns the pool of the subnet of ip, if any */
+func (this *Server) pool(ip net.IP) *pool {
+  switch {
+  case ip == nil:
+  case ip.To4() != nil && this.pool4 != nil && this.pool4.subnet.Contains(ip):
+    return this.pool4
+  case ip.To4() == nil && this.pool6 != nil && this.pool6.subnet.Contains(ip):
+    return this.pool6
+  }
+  return nil
+}
+
+/* commit binds b, it is saved unless only offered */
+func (this *Server) commit(p *pool, b *Binding) {
+  if old := p.add(b); old != nil && !old.offered {
+    this.config.Save(old, true)
+  }
+  if !b.offered {
+    this.config.Save(b, false)
+  }
+}
+
+func (this *Server) drop(p *pool, b *Binding) {
+  p.remove(b)
+  if !b.offered {
+    this.config.Save(b, true)
+  }
+}
+
+/* Reserve excludes addr (an address or CIDR) from the pools, it fails if a
+   client holds a lease of it */
+func (this *Server) Reserve(addr, owner string) error {
+  ip := net.ParseIP(strings.Split(addr, "/")[0])
+  if ip == nil {
+    return nil
+  }
+  if ip.Equal(this.ip) {
+    return errors.New("Address " + ip.String() + " used by the DHCP server")
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if p := this.pool(ip); p != nil {
+    if b := p.bindings[ip.String()]; b != nil && b.offered {
+      p.remove(b)
+    } else if b != nil && time.Now().Before(b.Expires) && !strings.HasPrefix(b.Client, declined) {
+      return errors.New("Address " + ip.String() + " leased by the DHCP server to " + b.MAC)
+    }
+  }
+  this.reserved[ip.String()] = owner
+  return nil
+}
+
+func (this *Server) Unreserve(addr string) {
+  ip := net.ParseIP(strings.Split(addr, "/")[0])
+  if ip == nil || ip.Equal(this.ip) {
+    return
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  delete(this.reserved, ip.String())
+}
+
+/* Bindings returns the current leases */
+func (this *Server) Bindings() []*Binding {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  var bindings []*Binding
+  now := time.Now()
+  for _, p := range []*pool{ this.pool4, this.pool6 } {
+    if p == nil {
+      continue
+    }
+    for _, b := range p.bindings {
+      if !b.offered && now.Before(b.Expires) && !strings.HasPrefix(b.Client, declined) {
+        lease := *b
+        bindings = append(bindings, &lease)
+      }
+    }
+  }
+  return bindings
+}
+
+/* Start sends the periodic Router Advertisements of DHCPv6 */
+func (this *Server) Start() {
+  this.mutex.Lock()
+  this.started = true
+  this.mutex.Unlock()
+  go this.advertise()
+}
+
+func (this *Server) Stop() {
+  select {
+  case <-this.stop:
+    return
+  default:
+    close(this.stop)
+  }
+  this.mutex.Lock()
+  started := this.started
+  this.mutex.Unlock()
+  if started {
+    <-this.done
+  }
+}
+
+/* Input handles the frames to the server, the others are ignored */
+func (this *Server) Input(frame []byte) {
+  eth, ok := packet.ParseEthernet(frame)
+  if !ok || bytes.Equal(eth.Src(), this.config.MAC) {
+    return
+  }
+  if !eth.IsMulticast() && !bytes.Equal(eth.Dst(), this.config.MAC) {
+    return
+  }
+  switch eth.Type() {
+  case packet.EtherTypeARP:
+    this.inputARP(eth)
+  case packet.EtherTypeIPv4:
+    this.input4(frame)
+  case packet.EtherTypeIPv6:
+    this.input6(frame)
+  }
+}
+
+func (this *Server) output(frame []byte) {
+  if err := this.send(frame); err != nil {
+    log.Debugf("DHCPServer [ %s ] send: [ %s ]", this.config.MAC, err)
+  }
+}
+
+func (this *Server) inputARP(eth packet.Ethernet) {
+  arp, ok := packet.ParseARP(eth.Payload())
+  if !ok || this.ip == nil || arp.Op() != packet.ARPRequest || !arp.TargetIP().Equal(this.ip) {
+    return
+  }
+  this.output(packet.NewARP(packet.ARPReply, this.config.MAC, this.ip, arp.SenderMAC(), arp.SenderIP()))
+}
+
+func (this *Server) input4(frame []byte) {
+  _, _, udp, ok := packet.ParseUDPv4(frame)
+  if !ok || this.pool4 == nil || udp.DstPort() != ServerPort {
+    return
+  }
+  msg, err := Unmarshal(udp.Payload())
+  if err != nil || msg.Op != BootRequest || len(msg.CHAddr) != 6 {
+    return
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  var reply *Message
+  switch msg.Type() {
+  case Discover:
+    reply = this.discover(msg)
+  case Request:
+    reply = this.request(msg)
+  case Decline:
+    this.decline(msg)
+  case Release:
+    this.release(msg)
+  case Inform:
+    reply = this.reply(msg, Ack)
+    this.configure(reply)
+  }
+  if reply != nil {
+    this.reply4(msg, reply)
+  }
+}
+
+func (this *Server) reply(msg *Message, msgtype uint8) *Message {
+  r := &Message{ Op: BootReply, Xid: msg.Xid, Flags: msg.Flags, GIAddr: msg.GIAddr, CHAddr: msg.CHAddr, Options: make(Options) }
+  r.Options[OptMessageType] = []byte{ msgtype }
+  r.Options.SetIP(OptServerID, this.ip)
+  return r
+}
+
+/* configure sets the options of the network in r */
+func (this *Server) configure(r *Message) {
+  mask := this.pool4.subnet.Mask
+  r.Options[OptSubnetMask] = append([]byte{}, mask[len(mask) - 4:]...)
+  if this.config.Router != "" {
+    r.Options.SetIP(OptRouter, net.ParseIP(this.config.Router))
+  }
+  var dns []net.IP
+  for _, addr := range this.config.DNS {
+    dns = append(dns, net.ParseIP(addr))
+  }
+  if len(dns) > 0 {
+    r.Options.SetIP(OptDNS, dns...)
+  }
+  if this.config.Domain != "" {
+    r.Options[OptDomainName] = []byte(this.config.Domain)
+  }
+  if this.config.MTU != 0 {
+    r.Options[OptInterfaceMTU] = []byte{ byte(this.config.MTU >> 8), byte(this.config.MTU) }
+  }
+}
+
+/* lease makes r give ip to the client */
+func (this *Server) lease(r *Message, ip net.IP) {
+  secs := uint32(this.config.LeaseTime / time.Second)
+  r.YIAddr = ip
+  r.Options.SetUint32(OptLeaseTime, secs)
+  r.Options.SetUint32(OptRenewalTime, secs / 2)
+  r.Options.SetUint32(OptRebindingTime, uint32(uint64(secs) * 7 / 8))
+  this.configure(r)
+}
+
+/* reply4 sends r as RFC 2131 4.1 says: to the address of a client that has
+   one, broadcast if the client asks for it or on a NAK */
+func (this *Server) reply4(msg, r *Message) {
+  dstip, dstmac := net.IPv4bcast, packet.Broadcast
+  switch {
+  case r.Type() == Nak:
+  case !msg.CIAddr.IsUnspecified():
+    dstip, dstmac = msg.CIAddr, msg.CHAddr
+  case msg.Flags & flagBroadcast == 0:
+    dstip, dstmac = r.YIAddr, msg.CHAddr
+  }
+  this.output(packet.NewUDPv4(dstmac, this.config.MAC, this.ip, dstip, ServerPort, ClientPort, r.Marshal()))
+}
+
+func (this *Server) discover(msg *Message) *Message {
+  client, now := msg.CHAddr.String(), time.Now()
+  ip := this.pool4.choose(client, msg.Options.IP(OptRequestedIP), this.reserved, now)
+  if ip == nil {
+    log.Warnf("DHCPServer [ %s ] no address left for [ %s ]", this.config.MAC, client)
+    return nil
+  }
+  ip = ip.To4()
+  if b := this.pool4.clients[client]; b == nil || b.Address != ip.String() || now.After(b.Expires) {
+    this.commit(this.pool4, &Binding{ Client: client, Address: ip.String(), MAC: client, Expires: now.Add(offerTime), offered: true })
+  }
+  offer := this.reply(msg, Offer)
+  this.lease(offer, ip)
+  return offer
+}
+
+func (this *Server) request(msg *Message) *Message {
+  client, now := msg.CHAddr.String(), time.Now()
+  if server := msg.Options.IP(OptServerID); server != nil && !server.Equal(this.ip) {
+    /* The client has chosen another server */
+    if b := this.pool4.clients[client]; b != nil && b.offered {
+      this.pool4.remove(b)
+    }
+    return nil
+  }
+  /* SELECTING and INIT-REBOOT ask an address, RENEWING and REBINDING extend theirs */
+  ip := msg.Options.IP(OptRequestedIP)
+  if ip == nil {
+    ip = msg.CIAddr
+  }
+  if ip == nil || !this.pool4.contains(ip) || !this.pool4.free(ip, client, this.reserved, now) {
+    log.Debugf("DHCPServer [ %s ] nak [ %s ] to [ %s ]", this.config.MAC, ip, client)
+    return this.reply(msg, Nak)
+  }
+  ip = ip.To4()
+  b := &Binding{
+    Client:   client,
+    Address:  ip.String(),
+    MAC:      client,
+    Hostname: string(msg.Options[OptHostName]),
+    Expires:  now.Add(this.config.LeaseTime),
+  }
+  this.commit(this.pool4, b)
+  log.Debugf("DHCPServer [ %s ] ack [ %s ] to [ %s ]", this.config.MAC, ip, client)
+  ack := this.reply(msg, Ack)
+  this.lease(ack, ip)
+  return ack
+}
+
+/* decline keeps the address away from the clients for a lease time */
+func (this *Server) decline(msg *Message) {
+  client, ip := msg.CHAddr.String(), msg.Options.IP(OptRequestedIP)
+  if server := msg.Options.IP(OptServerID); server == nil || !server.Equal(this.ip) || ip == nil {
+    return
+  }
+  if b := this.pool4.bindings[ip.String()]; b != nil && b.Client == client {
+    log.Warnf("DHCPServer [ %s ] address [ %s ] in use, declined by [ %s ]", this.config.MAC, ip, client)
+    this.drop(this.pool4, b)
+    this.commit(this.pool4, &Binding{ Client: declined + "/" + b.Address, Address: b.Address, MAC: client, Expires: time.Now().Add(this.config.LeaseTime) })
+  }
+}
+
+func (this *Server) release(msg *Message) {
+  client := msg.CHAddr.String()
+  if server := msg.Options.IP(OptServerID); server == nil || !server.Equal(this.ip) {
+    return
+  }
+  if b := this.pool4.clients[client]; b != nil && b.Address == msg.CIAddr.String() {
+    log.Debugf("DHCPServer [ %s ] release [ %s ] from [ %s ]", this.config.MAC, b.Address, client)
+    this.drop(this.pool4, b)
+  }
+}
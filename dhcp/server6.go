@@ -0,0 +1,323 @@
+package dhcp
+
+import (
+  "net"
+  "time"
+  "bytes"
+  "encoding/hex"
+  "encoding/binary"
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/packet"
+)
+
+/* DHCPv6 (RFC 8415), the Server handles the addresses of IA_NA only */
+const (
+  ClientPort6 = 546
+  ServerPort6 = 547
+)
+
+/* Types of the DHCPv6 messages */
+const (
+  Solicit6     = 1
+  Advertise6   = 2
+  Request6     = 3
+  Confirm6     = 4
+  Renew6       = 5
+  Rebind6      = 6
+  Reply6       = 7
+  Release6     = 8
+  Decline6     = 9
+  InfoRequest6 = 11
+)
+
+const (
+  opt6ClientID    = 1
+  opt6ServerID    = 2
+  opt6IANA        = 3
+  opt6IAAddr      = 5
+  opt6StatusCode  = 13
+  opt6RapidCommit = 14
+
+  status6Success      = 0
+  status6NoAddrsAvail = 2
+  status6NoBinding    = 3
+  status6NotOnLink    = 4
+)
+
+/* Neighbor Discovery (RFC 4861) */
+const (
+  routerSolicitation  = 133
+  routerAdvertisement = 134
+  /* MaxRtrAdvInterval default */
+  advertiseInterval   = 600 * time.Second
+)
+
+var (
+  AllServers6 = net.ParseIP("ff02::1:2")
+  allNodes6   = net.ParseIP("ff02::1")
+)
+
+type option6 struct {
+  code uint16
+  data []byte
+}
+
+type message6 struct {
+  msgtype uint8
+  xid     []byte
+  options []option6
+}
+
+func parseOptions6(b []byte) ([]option6, bool) {
+  var options []option6
+  for len(b) > 0 {
+    if len(b) < 4 || len(b) < 4 + int(binary.BigEndian.Uint16(b[2:4])) {
+      return nil, false
+    }
+    n := 4 + int(binary.BigEndian.Uint16(b[2:4]))
+    options = append(options, option6{ binary.BigEndian.Uint16(b[0:2]), b[4:n] })
+    b = b[n:]
+  }
+  return options, true
+}
+
+func unmarshal6(b []byte) (*message6, bool) {
+  if len(b) < 4 {
+    return nil, false
+  }
+  options, ok := parseOptions6(b[4:])
+  return &message6{ msgtype: b[0], xid: b[1:4], options: options }, ok
+}
+
+/* get returns the first option code, nil if missing */
+func (this *message6) get(code uint16) []byte {
+  for _, opt := range this.options {
+    if opt.code == code {
+      return append([]byte{}, opt.data...)
+    }
+  }
+  return nil
+}
+
+func (this *message6) has(code uint16) bool {
+  for _, opt := range this.options {
+    if opt.code == code {
+      return true
+    }
+  }
+  return false
+}
+
+func (this *message6) add(code uint16, data []byte) {
+  this.options = append(this.options, option6{ code, data })
+}
+
+func putOption6(b []byte, code uint16, data []byte) []byte {
+  b = append(b, byte(code >> 8), byte(code), byte(len(data) >> 8), byte(len(data)))
+  return append(b, data...)
+}
+
+func (this *message6) marshal() []byte {
+  b := append([]byte{ this.msgtype }, this.xid...)
+  for _, opt := range this.options {
+    b = putOption6(b, opt.code, opt.data)
+  }
+  return b
+}
+
+func status6(code uint16, text string) []byte {
+  return append([]byte{ byte(code >> 8), byte(code) }, text...)
+}
+
+/* iaAddresses returns the addresses in the options of an IA_NA */
+func iaAddresses(ia []byte) []net.IP {
+  var ips []net.IP
+  options, _ := parseOptions6(ia[12:])
+  for _, opt := range options {
+    if opt.code == opt6IAAddr && len(opt.data) >= 24 {
+      ips = append(ips, net.IP(opt.data[:16]))
+    }
+  }
+  return ips
+}
+
+/* ia returns an IA_NA with ip, or with the status code when ip is nil */
+func (this *Server) ia(iaid []byte, ip net.IP, code uint16, text string) []byte {
+  b := make([]byte, 12)
+  copy(b, iaid)
+  if ip == nil {
+    return putOption6(b, opt6StatusCode, status6(code, text))
+  }
+  secs := uint32(this.config.LeaseTime / time.Second)
+  binary.BigEndian.PutUint32(b[4:8], secs / 2)
+  binary.BigEndian.PutUint32(b[8:12], uint32(uint64(secs) * 4 / 5))
+  addr := make([]byte, 24)
+  copy(addr, ip.To16())
+  binary.BigEndian.PutUint32(addr[16:20], secs)
+  binary.BigEndian.PutUint32(addr[20:24], secs)
+  return putOption6(b, opt6IAAddr, addr)
+}
+
+func (this *Server) input6(frame []byte) {
+  if this.pool6 == nil {
+    return
+  }
+  if _, _, icmp, ok := packet.ParseICMPv6(frame); ok {
+    if icmp[0] == routerSolicitation {
+      this.output(this.routerAdvertisement())
+    }
+    return
+  }
+  eth, ip, udp, ok := packet.ParseUDPv6(frame)
+  if !ok || udp.DstPort() != ServerPort6 || !ip.Dst().Equal(AllServers6) && !ip.Dst().Equal(this.linklocal) {
+    return
+  }
+  msg, ok := unmarshal6(udp.Payload())
+  if !ok || !msg.has(opt6ClientID) {
+    return
+  }
+  serverid := msg.get(opt6ServerID)
+  switch msg.msgtype {
+  case Solicit6, Confirm6, Rebind6:
+    if serverid != nil {
+      return
+    }
+  case Request6, Renew6, Release6, Decline6:
+    if !bytes.Equal(serverid, this.duid) {
+      return
+    }
+  case InfoRequest6:
+    if serverid != nil && !bytes.Equal(serverid, this.duid) {
+      return
+    }
+  default:
+    return
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  reply := &message6{ msgtype: Reply6, xid: msg.xid }
+  reply.add(opt6ServerID, this.duid)
+  reply.add(opt6ClientID, msg.get(opt6ClientID))
+  switch msg.msgtype {
+  case Solicit6:
+    if msg.has(opt6RapidCommit) {
+      reply.add(opt6RapidCommit, nil)
+    } else {
+      reply.msgtype = Advertise6
+    }
+    fallthrough
+  case Request6, Renew6, Rebind6:
+    for _, opt := range msg.options {
+      if opt.code == opt6IANA && len(opt.data) >= 12 {
+        reply.add(opt6IANA, this.bind6(msg, reply.msgtype == Advertise6, opt.data, eth.Src()))
+      }
+    }
+  case Release6, Decline6:
+    for _, opt := range msg.options {
+      if opt.code == opt6IANA && len(opt.data) >= 12 {
+        this.release6(msg, opt.data, eth.Src())
+      }
+    }
+    reply.add(opt6StatusCode, status6(status6Success, ""))
+  case Confirm6:
+    code := uint16(status6Success)
+    for _, opt := range msg.options {
+      if opt.code != opt6IANA || len(opt.data) < 12 {
+        continue
+      }
+      for _, addr := range iaAddresses(opt.data) {
+        if !this.pool6.subnet.Contains(addr) {
+          code = status6NotOnLink
+        }
+      }
+    }
+    reply.add(opt6StatusCode, status6(code, ""))
+  }
+  this.output(packet.NewUDPv6(eth.Src(), this.config.MAC, this.linklocal, ip.Src(), ServerPort6, ClientPort6, reply.marshal()))
+}
+
+/* client6 identifies an IA_NA of a client, by its DUID and IAID */
+func client6(msg *message6, ia []byte) string {
+  return hex.EncodeToString(msg.get(opt6ClientID)) + "/" + hex.EncodeToString(ia[:4])
+}
+
+/* bind6 returns the IA_NA of the reply: on Renew the client must have a
+   binding, the other messages obtain one as DHCPv4 does */
+func (this *Server) bind6(msg *message6, offer bool, ia []byte, mac net.HardwareAddr) []byte {
+  client, now := client6(msg, ia), time.Now()
+  var requested, ip net.IP
+  if addrs := iaAddresses(ia); len(addrs) > 0 {
+    requested = addrs[0]
+  }
+  if b := this.pool6.clients[client]; msg.msgtype == Renew6 {
+    if b == nil || !this.pool6.free(net.ParseIP(b.Address), client, this.reserved, now) {
+      return this.ia(ia[:4], nil, status6NoBinding, "Binding not found")
+    }
+    ip = net.ParseIP(b.Address)
+  } else if ip = this.pool6.choose(client, requested, this.reserved, now); ip == nil {
+    log.Warnf("DHCPServer [ %s ] no IPv6 address left for [ %s ]", this.config.MAC, client)
+    return this.ia(ia[:4], nil, status6NoAddrsAvail, "No addresses available")
+  }
+  b := &Binding{ Client: client, Address: ip.String(), MAC: mac.String(), Expires: now.Add(this.config.LeaseTime) }
+  if offer {
+    b.Expires, b.offered = now.Add(offerTime), true
+    if old := this.pool6.clients[client]; old != nil && old.Address == b.Address && !old.offered {
+      b = nil
+    }
+  }
+  if b != nil {
+    this.commit(this.pool6, b)
+  }
+  if !offer {
+    log.Debugf("DHCPServer [ %s ] reply [ %s ] to [ %s ]", this.config.MAC, ip, client)
+  }
+  return this.ia(ia[:4], ip, status6Success, "")
+}
+
+func (this *Server) release6(msg *message6, ia []byte, mac net.HardwareAddr) {
+  b := this.pool6.clients[client6(msg, ia)]
+  if b == nil {
+    return
+  }
+  this.drop(this.pool6, b)
+  if msg.msgtype == Decline6 {
+    log.Warnf("DHCPServer [ %s ] address [ %s ] in use, declined by [ %s ]", this.config.MAC, b.Address, mac)
+    this.commit(this.pool6, &Binding{ Client: declined + "/" + b.Address, Address: b.Address, MAC: mac.String(), Expires: time.Now().Add(this.config.LeaseTime) })
+  }
+}
+
+/* routerAdvertisement tells the hosts to obtain their addresses with DHCPv6
+   (managed flag), on the prefix of the pool. It is not a default router. */
+func (this *Server) routerAdvertisement() packet.Ethernet {
+  ones, _ := this.pool6.subnet.Mask.Size()
+  body := make([]byte, 12, 12 + 8 + 32)
+  /* Hop limit, managed and other configuration flags, router lifetime 0 */
+  body[0], body[1] = packet.DefaultTTL, 0xc0
+  /* Source link-layer address */
+  body = append(append(body, 1, 1), this.config.MAC...)
+  /* Prefix information: on-link, not for autoconfiguration */
+  prefix := make([]byte, 32)
+  prefix[0], prefix[1], prefix[2], prefix[3] = 3, 4, uint8(ones), 0x80
+  binary.BigEndian.PutUint32(prefix[4:8], 0xffffffff)
+  binary.BigEndian.PutUint32(prefix[8:12], 0xffffffff)
+  copy(prefix[16:32], this.pool6.subnet.IP.To16())
+  body = append(body, prefix...)
+  return packet.NewICMPv6(packet.MulticastMAC(allNodes6), this.config.MAC, this.linklocal, allNodes6, packet.NDHopLimit, routerAdvertisement, 0, body)
+}
+
+/* advertise sends the unsolicited Router Advertisements until Stop */
+func (this *Server) advertise() {
+  defer close(this.done)
+  if this.pool6 == nil {
+    <-this.stop
+    return
+  }
+  for {
+    this.output(this.routerAdvertisement())
+    select {
+    case <-this.stop:
+      return
+    case <-time.After(advertiseInterval):
+    }
+  }
+}
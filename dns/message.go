@@ -0,0 +1,236 @@
+package dns
+
+import (
+  "net"
+  "errors"
+  "strings"
+  "encoding/binary"
+)
+
+const (
+  Port      = 53
+  headerLen = 12
+  /* Largest UDP response to a query without EDNS0 (RFC 1035) */
+  MinPayload = 512
+)
+
+/* Types and classes of the records */
+const (
+  TypeA    = 1
+  TypeAAAA = 28
+  TypeANY  = 255
+  /* Pseudo record of EDNS0 (RFC 6891), its class is the UDP payload size */
+  TypeOPT  = 41
+  ClassIN  = 1
+)
+
+/* Response codes */
+const (
+  RcodeSuccess  = 0
+  RcodeFormat   = 1
+  RcodeServFail = 2
+  RcodeNXDomain = 3
+  RcodeNotImpl  = 4
+)
+
+const (
+  flagQR     = 0x8000
+  flagAA     = 0x0400
+  flagRD     = 0x0100
+  flagRA     = 0x0080
+  opcodeMask = 0x7800
+)
+
+var ErrMalformed = errors.New("Malformed DNS message")
+
+/* Query is the question of a DNS query (RFC 1035), the server handles one */
+type Query struct {
+  ID    uint16
+  Flags uint16
+  Name  string
+  Type  uint16
+  Class uint16
+  /* EDNS0 reports whether the query has an OPT record, with the largest
+     UDP response of the client in UDPSize */
+  EDNS0   bool
+  UDPSize uint16
+  /* Raw question, echoed in the response */
+  question []byte
+  /* Offset of the class of the OPT record, see WithUDPSize */
+  optClass int
+}
+
+/* skipName returns the offset after the name at i, with or without compression */
+func skipName(b []byte, i int) (int, error) {
+  for {
+    if i >= len(b) {
+      return 0, ErrMalformed
+    }
+    switch n := int(b[i]); {
+    case n == 0:
+      return i + 1, nil
+    case n & 0xc0 == 0xc0:
+      if i + 2 > len(b) {
+        return 0, ErrMalformed
+      }
+      return i + 2, nil
+    case n > 63:
+      return 0, ErrMalformed
+    default:
+      i += 1 + n
+    }
+  }
+}
+
+/* parseEDNS0 looks for the OPT record after the question, in the records of
+   the other sections at i */
+func (this *Query) parseEDNS0(b []byte, i int) error {
+  count := int(binary.BigEndian.Uint16(b[6:8])) + int(binary.BigEndian.Uint16(b[8:10])) + int(binary.BigEndian.Uint16(b[10:12]))
+  for ; count > 0; count-- {
+    name := i
+    var err error
+    if i, err = skipName(b, i); err != nil {
+      return err
+    }
+    /* Type, class, TTL and data length */
+    if i + 10 > len(b) {
+      return ErrMalformed
+    }
+    if binary.BigEndian.Uint16(b[i:i+2]) == TypeOPT && b[name] == 0 {
+      this.EDNS0 = true
+      this.UDPSize = binary.BigEndian.Uint16(b[i+2:i+4])
+      this.optClass = i + 2
+    }
+    if i += 10 + int(binary.BigEndian.Uint16(b[i+8:i+10])); i > len(b) {
+      return ErrMalformed
+    }
+  }
+  return nil
+}
+
+/* ParseQuery reads the header, the first question and the EDNS0 record of a query */
+func ParseQuery(b []byte) (*Query, error) {
+  if len(b) < headerLen {
+    return nil, ErrMalformed
+  }
+  q := &Query{ ID: binary.BigEndian.Uint16(b[0:2]), Flags: binary.BigEndian.Uint16(b[2:4]) }
+  if q.Flags & flagQR != 0 || binary.BigEndian.Uint16(b[4:6]) < 1 {
+    return nil, ErrMalformed
+  }
+  var labels []string
+  i := headerLen
+  for {
+    if i >= len(b) {
+      return nil, ErrMalformed
+    }
+    n := int(b[i])
+    if n == 0 {
+      i++
+      break
+    }
+    /* No compression in a question alone */
+    if n > 63 || i + 1 + n > len(b) {
+      return nil, ErrMalformed
+    }
+    labels = append(labels, string(b[i+1:i+1+n]))
+    i += 1 + n
+  }
+  if i + 4 > len(b) {
+    return nil, ErrMalformed
+  }
+  q.Name = strings.ToLower(strings.Join(labels, "."))
+  q.Type = binary.BigEndian.Uint16(b[i:i+2])
+  q.Class = binary.BigEndian.Uint16(b[i+2:i+4])
+  q.question = append([]byte{}, b[headerLen:i+4]...)
+  /* The other questions are not answered */
+  if binary.BigEndian.Uint16(b[4:6]) == 1 {
+    if err := q.parseEDNS0(b, i + 4); err != nil {
+      return nil, err
+    }
+  }
+  return q, nil
+}
+
+/* WithUDPSize returns a copy of the query b, parsed as this, that advertises
+   size in its OPT record: the upstream servers truncate to it themselves */
+func (this *Query) WithUDPSize(b []byte, size int) []byte {
+  b = append([]byte{}, b...)
+  if this.EDNS0 && int(this.UDPSize) > size {
+    binary.BigEndian.PutUint16(b[this.optClass:this.optClass+2], uint16(size))
+  }
+  return b
+}
+
+/* opt is the OPT record of a response to a query with EDNS0, it advertises size */
+func opt(size int) []byte {
+  rr := make([]byte, 11)
+  binary.BigEndian.PutUint16(rr[1:3], TypeOPT)
+  binary.BigEndian.PutUint16(rr[3:5], uint16(size))
+  return rr
+}
+
+/* Opcode is 0 for the standard queries */
+func (this *Query) Opcode() uint16 {
+  return (this.Flags & opcodeMask) >> 11
+}
+
+/* Response returns the answer to q with the addresses of the name, of the type
+   asked, and an OPT record advertising MinPayload if q has one */
+func (this *Query) Response(rcode uint16, ips []net.IP, ttl uint32, recursion bool) []byte {
+  var answers [][]byte
+  for _, ip := range ips {
+    var rtype uint16
+    var rdata []byte
+    if ip4 := ip.To4(); ip4 != nil && (this.Type == TypeA || this.Type == TypeANY) {
+      rtype, rdata = TypeA, ip4
+    } else if ip4 == nil && (this.Type == TypeAAAA || this.Type == TypeANY) {
+      rtype, rdata = TypeAAAA, ip.To16()
+    } else {
+      continue
+    }
+    /* The name is a pointer to the question */
+    rr := make([]byte, 12, 12 + len(rdata))
+    binary.BigEndian.PutUint16(rr[0:2], 0xc000 | headerLen)
+    binary.BigEndian.PutUint16(rr[2:4], rtype)
+    binary.BigEndian.PutUint16(rr[4:6], ClassIN)
+    binary.BigEndian.PutUint32(rr[6:10], ttl)
+    binary.BigEndian.PutUint16(rr[10:12], uint16(len(rdata)))
+    answers = append(answers, append(rr, rdata...))
+  }
+  b := make([]byte, headerLen, 512)
+  flags := flagQR | flagAA | this.Flags & (opcodeMask | flagRD) | rcode
+  if recursion {
+    flags |= flagRA
+  }
+  binary.BigEndian.PutUint16(b[0:2], this.ID)
+  binary.BigEndian.PutUint16(b[2:4], flags)
+  binary.BigEndian.PutUint16(b[4:6], 1)
+  binary.BigEndian.PutUint16(b[6:8], uint16(len(answers)))
+  b = append(b, this.question...)
+  for _, rr := range answers {
+    b = append(b, rr...)
+  }
+  if this.EDNS0 {
+    binary.BigEndian.PutUint16(b[10:12], 1)
+    b = append(b, opt(MinPayload)...)
+  }
+  return b
+}
+
+/* ValidName reports whether name is a host name (RFC 1123) */
+func ValidName(name string) bool {
+  if name == "" || len(name) > 253 {
+    return false
+  }
+  for _, label := range strings.Split(name, ".") {
+    if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+      return false
+    }
+    for _, c := range label {
+      if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+        return false
+      }
+    }
+  }
+  return true
+}
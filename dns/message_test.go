@@ -0,0 +1,112 @@
+package dns
+
+import (
+  "net"
+  "testing"
+  "encoding/binary"
+  "github.com/phocs/vde_plug_docker/packet"
+)
+
+/* query is a query of type A of name, a label, with an OPT record of size if not 0 */
+func query(name string, size uint16) []byte {
+  b := make([]byte, headerLen)
+  binary.BigEndian.PutUint16(b[0:2], 0x1234)
+  binary.BigEndian.PutUint16(b[2:4], flagRD)
+  binary.BigEndian.PutUint16(b[4:6], 1)
+  b = append(append(b, byte(len(name))), name...)
+  b = append(b, 0, 0, TypeA, 0, ClassIN)
+  if size != 0 {
+    binary.BigEndian.PutUint16(b[10:12], 1)
+    b = append(b, opt(int(size))...)
+  }
+  return b
+}
+
+func TestParseQueryEDNS0(t *testing.T) {
+  /* An OPT record with an option of 4 bytes */
+  cookie := query("web", 4096)
+  binary.BigEndian.PutUint16(cookie[len(cookie) - 2:], 4)
+  cookie = append(cookie, 0, 10, 0, 0)
+  /* An answer with a compressed name before the OPT record */
+  answer := query("web", 0)
+  binary.BigEndian.PutUint16(answer[6:8], 1)
+  binary.BigEndian.PutUint16(answer[10:12], 1)
+  answer = append(answer, 0xc0, headerLen, 0, TypeA, 0, ClassIN, 0, 0, 0, 0, 0, 4, 10, 0, 0, 1)
+  answer = append(answer, opt(1232)...)
+  for _, tc := range []struct {
+    name  string
+    query []byte
+    edns0 bool
+    size  uint16
+    ok    bool
+  } {
+    { "no EDNS0", query("web", 0), false, 0, true },
+    { "EDNS0", query("web", 1232), true, 1232, true },
+    { "EDNS0 with an option", cookie, true, 4096, true },
+    { "after an answer", answer, true, 1232, true },
+    { "truncated OPT", query("web", 1232)[:headerLen + 9 + 5], false, 0, false },
+    { "OPT data past the end", cookie[:len(cookie) - 1], false, 0, false },
+  } {
+    q, err := ParseQuery(tc.query)
+    if (err == nil) != tc.ok {
+      t.Errorf("%s: %v", tc.name, err)
+    } else if err == nil && (q.EDNS0 != tc.edns0 || q.UDPSize != tc.size) {
+      t.Errorf("%s: EDNS0 %v %d, want %v %d", tc.name, q.EDNS0, q.UDPSize, tc.edns0, tc.size)
+    }
+  }
+}
+
+func TestPayloadLimit(t *testing.T) {
+  for _, tc := range []struct {
+    name  string
+    mtu   int
+    size  uint16
+    limit int
+  } {
+    { "no EDNS0", 1500, 0, MinPayload },
+    { "EDNS0", 1500, 1232, 1232 },
+    { "EDNS0 smaller than MinPayload", 1500, 100, MinPayload },
+    { "EDNS0 larger than a frame", 1500, 4096, 1472 },
+    { "default MTU", 0, 4096, 1472 },
+    { "jumbo frames", 9000, 4096, 4096 },
+  } {
+    s, err := NewServer(Config{ Address: "10.0.0.53", MTU: tc.mtu }, nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+    q, _ := ParseQuery(query("web", tc.size))
+    if got := s.payloadLimit(q); got != tc.limit {
+      t.Errorf("%s: %d, want %d", tc.name, got, tc.limit)
+    }
+  }
+}
+
+func TestResponseEDNS0(t *testing.T) {
+  /* Larger than MinPayload, less than 1232 bytes */
+  ips := make([]net.IP, 60)
+  for i := range ips {
+    ips[i] = net.IPv4(10, 0, 0, byte(i))
+  }
+  for _, size := range []uint16{ 0, 1232 } {
+    q, _ := ParseQuery(query("web", size))
+    r := q.Response(RcodeSuccess, ips, TTL, false)
+    /* The OPT record, if any, is the last one */
+    if got := binary.BigEndian.Uint16(r[10:12]) == 1; got != q.EDNS0 {
+      t.Errorf("size %d: OPT record %v", size, got)
+    }
+    s, _ := NewServer(Config{ Address: "10.0.0.53" }, nil)
+    limit := s.payloadLimit(q)
+    if len(r) > limit {
+      r = truncated(q, r)
+    }
+    if len(r) > limit || size == 0 && r[2] & 0x02 == 0 || size != 0 && r[2] & 0x02 != 0 {
+      t.Errorf("size %d: response of %d bytes, TC %v", size, len(r), r[2] & 0x02 != 0)
+    }
+  }
+  /* The forwarded query asks for what fits */
+  big, _ := ParseQuery(query("web", 9000))
+  fwd, _ := ParseQuery(big.WithUDPSize(query("web", 9000), 1500 - packet.IPv4HeaderLen - packet.UDPHeaderLen))
+  if fwd.UDPSize != 1472 {
+    t.Errorf("forwarded UDP size %d", fwd.UDPSize)
+  }
+}
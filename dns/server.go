@@ -0,0 +1,374 @@
+package dns
+
+import (
+  "net"
+  "sync"
+  "time"
+  "bytes"
+  "errors"
+  "strings"
+  "crypto/rand"
+  "crypto/sha1"
+  "encoding/hex"
+  "encoding/json"
+  "encoding/binary"
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/packet"
+)
+
+const (
+  /* UDP port of the announcements between the servers of a segment */
+  AnnouncePort     = 5380
+  announceInterval = 30 * time.Second
+  /* A learned record is dropped after three missed announcements */
+  learnedTTL       = 3 * announceInterval
+  /* Records of an announcement, it fits in a frame */
+  announceRecords  = 16
+  /* TTL of the answers, the records change with the containers */
+  TTL              = 10
+  forwardTimeout   = 2 * time.Second
+  /* Queries forwarded at the same time, the others are answered SERVFAIL */
+  forwardMax       = 64
+  /* MTU of the segment if the Config has none */
+  defaultMTU       = 1500
+)
+
+var ErrInvalidAddress = errors.New("Invalid DNS server address")
+
+/* Record gives the addresses of a name */
+type Record struct {
+  Name string `json:"Name"`
+  IPv4 string `json:"IPv4,omitempty"`
+  IPv6 string `json:"IPv6,omitempty"`
+}
+
+/* announcement carries the records of a server to the others of the segment,
+   with TTL 0 they are removed */
+type announcement struct {
+  Origin  string   `json:"Origin"`
+  TTL     uint32   `json:"TTL"`
+  Records []Record `json:"Records"`
+}
+
+type Config struct {
+  /* IPv4 address of the server */
+  Address string
+  /* Hardware address, see ServerMAC */
+  MAC     net.HardwareAddr
+  /* Optional domain of the names, they are answered with and without it */
+  Domain  string
+  /* Upstream servers (host:port) of the other names, NXDOMAIN if none */
+  Forward []string
+  /* Extra returns more local records, e.g. the host names of the DHCP leases */
+  Extra   func() []Record
+  /* MTU of the segment, it bounds the responses to the queries with EDNS0:
+     defaultMTU if 0 */
+  MTU     int
+}
+
+/* Server answers the queries for the names of a network at its address. The
+   servers of the same network on other hosts share the address and the MAC:
+   each one announces the records of its endpoints and learns the others. */
+type Server struct {
+  config  Config
+  ip      net.IP
+  origin  string
+  send    func(frame []byte) error
+  mutex   sync.Mutex
+  /* Records of the local endpoints by owner, the learned ones by key */
+  local   map[string][]Record
+  learned map[string]time.Time
+  /* A slot for each query being forwarded */
+  slots   chan struct{}
+  started bool
+  stop    chan struct{}
+  done    chan struct{}
+}
+
+/* ServerMAC is the hardware address of the servers at address on segment (the VDE sock) */
+func ServerMAC(segment, address string) net.HardwareAddr {
+  sum := sha1.Sum([]byte(segment + "|" + address))
+  mac := net.HardwareAddr(sum[:6])
+  mac[0] = mac[0] & 0xfe | 0x02
+  return mac
+}
+
+func NewServer(config Config, send func(frame []byte) error) (*Server, error) {
+  ip := net.ParseIP(config.Address).To4()
+  if ip == nil {
+    return nil, ErrInvalidAddress
+  }
+  if config.Extra == nil {
+    config.Extra = func() []Record { return nil }
+  }
+  if config.MTU == 0 {
+    config.MTU = defaultMTU
+  }
+  config.Domain = strings.ToLower(strings.Trim(config.Domain, "."))
+  origin := make([]byte, 8)
+  rand.Read(origin)
+  return &Server{
+    config:  config,
+    ip:      ip,
+    origin:  hex.EncodeToString(origin),
+    send:    send,
+    local:   make(map[string][]Record),
+    learned: make(map[string]time.Time),
+    slots:   make(chan struct{}, forwardMax),
+    stop:    make(chan struct{}),
+    done:    make(chan struct{}),
+  }, nil
+}
+
+/* Add sets the records of owner (e.g. an endpoint) and announces them */
+func (this *Server) Add(owner string, records ...Record) {
+  this.mutex.Lock()
+  this.local[owner] = records
+  this.mutex.Unlock()
+  this.announce(records, uint32(learnedTTL / time.Second))
+}
+
+/* Remove drops the records of owner, on the other servers as well */
+func (this *Server) Remove(owner string) {
+  this.mutex.Lock()
+  records := this.local[owner]
+  delete(this.local, owner)
+  this.mutex.Unlock()
+  if len(records) > 0 {
+    this.announce(records, 0)
+  }
+}
+
+/* Records returns the local records */
+func (this *Server) Records() []Record {
+  this.mutex.Lock()
+  var records []Record
+  for _, owned := range this.local {
+    records = append(records, owned...)
+  }
+  this.mutex.Unlock()
+  return append(records, this.config.Extra()...)
+}
+
+func learnedKey(origin string, r Record) string {
+  return strings.Join([]string{ origin, r.Name, r.IPv4, r.IPv6 }, "|")
+}
+
+/* lookup returns the addresses of name, known reports whether the name exists */
+func (this *Server) lookup(name string) (ips []net.IP, known bool) {
+  if this.config.Domain != "" {
+    name = strings.TrimSuffix(name, "." + this.config.Domain)
+  }
+  add := func(r Record) {
+    if !strings.EqualFold(r.Name, name) {
+      return
+    }
+    known = true
+    for _, addr := range []string{ r.IPv4, r.IPv6 } {
+      if ip := net.ParseIP(addr); ip != nil {
+        ips = append(ips, ip)
+      }
+    }
+  }
+  for _, r := range this.Records() {
+    add(r)
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  now := time.Now()
+  for key, expires := range this.learned {
+    if now.After(expires) {
+      delete(this.learned, key)
+      continue
+    }
+    fields := strings.Split(key, "|")
+    add(Record{ Name: fields[1], IPv4: fields[2], IPv6: fields[3] })
+  }
+  return ips, known
+}
+
+func (this *Server) output(frame []byte) {
+  if err := this.send(frame); err != nil {
+    log.Debugf("DNSServer [ %s ] send: [ %s ]", this.ip, err)
+  }
+}
+
+/* announce broadcasts records to the other servers of the segment */
+func (this *Server) announce(records []Record, ttl uint32) {
+  for len(records) > 0 {
+    n := len(records)
+    if n > announceRecords {
+      n = announceRecords
+    }
+    payload, _ := json.Marshal(&announcement{ Origin: this.origin, TTL: ttl, Records: records[:n] })
+    this.output(packet.NewUDPv4(packet.Broadcast, this.config.MAC, this.ip, net.IPv4bcast, AnnouncePort, AnnouncePort, payload))
+    records = records[n:]
+  }
+}
+
+func (this *Server) learn(payload []byte) {
+  var a announcement
+  if err := json.Unmarshal(payload, &a); err != nil || a.Origin == this.origin {
+    return
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  for _, r := range a.Records {
+    if a.TTL == 0 {
+      delete(this.learned, learnedKey(a.Origin, r))
+    } else if ValidName(r.Name) {
+      this.learned[learnedKey(a.Origin, r)] = time.Now().Add(time.Duration(a.TTL) * time.Second)
+    }
+  }
+}
+
+/* Start announces the local records periodically, until Stop */
+func (this *Server) Start() {
+  this.mutex.Lock()
+  this.started = true
+  this.mutex.Unlock()
+  go func() {
+    defer close(this.done)
+    for {
+      this.announce(this.Records(), uint32(learnedTTL / time.Second))
+      select {
+      case <-this.stop:
+        return
+      case <-time.After(announceInterval):
+      }
+    }
+  }()
+}
+
+func (this *Server) Stop() {
+  select {
+  case <-this.stop:
+    return
+  default:
+    close(this.stop)
+  }
+  this.mutex.Lock()
+  started := this.started
+  this.mutex.Unlock()
+  if started {
+    <-this.done
+  }
+}
+
+/* Input handles the frames to the server: ARP requests of its address,
+   queries and announcements */
+func (this *Server) Input(frame []byte) {
+  eth, ok := packet.ParseEthernet(frame)
+  if !ok || !eth.IsMulticast() && !bytes.Equal(eth.Dst(), this.config.MAC) {
+    return
+  }
+  if eth.Type() == packet.EtherTypeARP {
+    if arp, ok := packet.ParseARP(eth.Payload()); ok && arp.Op() == packet.ARPRequest && arp.TargetIP().Equal(this.ip) && !bytes.Equal(arp.SenderMAC(), this.config.MAC) {
+      this.output(packet.NewARP(packet.ARPReply, this.config.MAC, this.ip, arp.SenderMAC(), arp.SenderIP()))
+    }
+    return
+  }
+  _, ip, udp, ok := packet.ParseUDPv4(frame)
+  if !ok {
+    return
+  }
+  if udp.DstPort() == AnnouncePort && ip.Src().Equal(this.ip) {
+    this.learn(udp.Payload())
+  } else if udp.DstPort() == Port && ip.Dst().Equal(this.ip) {
+    this.query(eth, ip, udp)
+  }
+}
+
+func (this *Server) query(eth packet.Ethernet, ip packet.IPv4, udp packet.UDP) {
+  q, err := ParseQuery(udp.Payload())
+  if err != nil {
+    return
+  }
+  /* The frame is reused after Input */
+  dstmac := net.HardwareAddr(append([]byte{}, eth.Src()...))
+  dst, sport := net.IP(append([]byte{}, ip.Src()...)), udp.SrcPort()
+  limit := this.payloadLimit(q)
+  reply := func(payload []byte) {
+    if len(payload) > limit {
+      payload = truncated(q, payload)
+    }
+    this.output(packet.NewUDPv4(dstmac, this.config.MAC, this.ip, dst, Port, sport, payload))
+  }
+  forward := len(this.config.Forward) > 0
+  if q.Opcode() != 0 {
+    reply(q.Response(RcodeNotImpl, nil, 0, forward))
+  } else if ips, known := this.lookup(q.Name); known {
+    reply(q.Response(RcodeSuccess, ips, TTL, forward))
+  } else if forward {
+    select {
+    case this.slots <- struct{}{}:
+      payload := q.WithUDPSize(udp.Payload(), limit)
+      go func() {
+        defer func() { <-this.slots }()
+        this.forward(payload, q, reply)
+      }()
+    default:
+      log.Debugf("DNSServer [ %s ] forward of [ %s ]: [ %d queries in flight ]", this.ip, q.Name, forwardMax)
+      reply(q.Response(RcodeServFail, nil, 0, forward))
+    }
+  } else {
+    reply(q.Response(RcodeNXDomain, nil, 0, forward))
+  }
+}
+
+/* payloadLimit is the largest response to q: MinPayload, more if the client
+   asks for it with EDNS0 (RFC 6891) up to a frame of the segment */
+func (this *Server) payloadLimit(q *Query) int {
+  limit := MinPayload
+  if q.EDNS0 && int(q.UDPSize) > limit {
+    limit = int(q.UDPSize)
+  }
+  if max := this.config.MTU - packet.IPv4HeaderLen - packet.UDPHeaderLen; limit > max {
+    limit = max
+  }
+  return limit
+}
+
+/* forward relays a query to the upstream servers, from the host */
+func (this *Server) forward(payload []byte, q *Query, reply func([]byte)) {
+  buf := make([]byte, 65535)
+  for _, upstream := range this.config.Forward {
+    conn, err := net.DialTimeout("udp", upstream, forwardTimeout)
+    if err != nil {
+      continue
+    }
+    conn.SetDeadline(time.Now().Add(forwardTimeout))
+    _, err = conn.Write(payload)
+    n := 0
+    for err == nil {
+      /* Skip the stale replies */
+      if n, err = conn.Read(buf); err == nil && n >= headerLen && binary.BigEndian.Uint16(buf[0:2]) == q.ID {
+        break
+      }
+    }
+    conn.Close()
+    if err == nil {
+      reply(buf[:n])
+      return
+    }
+    log.Debugf("DNSServer [ %s ] forward to [ %s ]: [ %s ]", this.ip, upstream, err)
+  }
+  reply(q.Response(RcodeServFail, nil, 0, true))
+}
+
+/* truncated is the header of a response larger than the client takes, with TC
+   set. There is no TCP on the segment: the forwarded queries ask the upstream
+   servers for responses that fit, see payloadLimit, this is the last resort. */
+func truncated(q *Query, payload []byte) []byte {
+  b := append(append([]byte{}, payload[:headerLen]...), q.question...)
+  b[2] |= 0x02
+  binary.BigEndian.PutUint16(b[4:6], 1)
+  binary.BigEndian.PutUint16(b[6:8], 0)
+  binary.BigEndian.PutUint16(b[8:10], 0)
+  binary.BigEndian.PutUint16(b[10:12], 0)
+  if q.EDNS0 {
+    binary.BigEndian.PutUint16(b[10:12], 1)
+    b = append(b, opt(MinPayload)...)
+  }
+  return b
+}
@@ -0,0 +1,327 @@
+package endpoint
+
+import (
+  "os"
+  "fmt"
+  "sync"
+  "time"
+  "bufio"
+  "path/filepath"
+  "github.com/phocs/vde_plug_docker/packet"
+  "github.com/phocs/vde_plug_docker/vdeplug"
+)
+
+/* Bytes kept of each frame by default, as tcpdump, and the interval between
+   the writes of the buffered frames to the file */
+const (
+  CaptureSnaplen = 262144
+  CaptureFlush   = time.Second
+)
+
+/* pcapng blocks and options, see draft-ietf-opsawg-pcapng */
+const (
+  pcapngSHB        = 0x0a0d0d0a
+  pcapngIDB        = 0x00000001
+  pcapngEPB        = 0x00000006
+  pcapngMagic      = 0x1a2b3c4d
+  pcapngLinkEth    = 1
+  pcapngEndOfOpt   = 0
+  pcapngUserAppl   = 4
+  pcapngIfName     = 2
+  pcapngIfDescr    = 3
+  pcapngEPBFlags   = 2
+  /* Direction in the epb_flags */
+  pcapngInbound    = 1
+  pcapngOutbound   = 2
+  /* Enhanced Packet Block without the frame: header, flags and trailer */
+  pcapngEPBHdrLen  = 28
+  pcapngEPBTailLen = 16
+)
+
+var pcapngPadding [4]byte
+
+type CaptureConfig struct {
+  /* The files are Dir/Prefix-<time>-<n>.pcapng */
+  Dir        string
+  Prefix     string
+  /* Frames the filter rejects are not written, nil for all */
+  Filter     packet.BPF
+  Snaplen    int
+  /* A new file after RotateSize bytes or RotateTime, 0 for never */
+  RotateSize int64
+  RotateTime time.Duration
+  /* Files kept, the oldest ones are removed, 0 for all */
+  Files      int
+}
+
+/* CaptureStatus are the counters and the current file of a Capture */
+type CaptureStatus struct {
+  File    string `json:"File"`
+  Files   int    `json:"Files"`
+  Packets uint64 `json:"Packets"`
+  Bytes   uint64 `json:"Bytes"`
+  /* The write that stopped the capture failed */
+  Err     string `json:"Err,omitempty"`
+}
+
+type captureIface struct {
+  name  string
+  descr string
+}
+
+/* Capture writes the frames of the plugs it taps to pcapng files, an
+   interface for each plug. The plugs call it from their workers. */
+type Capture struct {
+  config  CaptureConfig
+  mutex   sync.Mutex
+  file    *os.File
+  w       *bufio.Writer
+  size    int64
+  opened  time.Time
+  seq     int
+  files   []string
+  ifaces  []captureIface
+  status  CaptureStatus
+  closed  bool
+  hdr     [pcapngEPBHdrLen + pcapngEPBTailLen]byte
+  done    chan struct{}
+  wg      sync.WaitGroup
+}
+
+/* NewCapture opens the first file of a capture */
+func NewCapture(config CaptureConfig) (*Capture, error) {
+  if config.Snaplen <= 0 {
+    config.Snaplen = CaptureSnaplen
+  }
+  capture := &Capture{ config: config, done: make(chan struct{}) }
+  if err := capture.rotate(); err != nil {
+    if capture.file != nil {
+      capture.file.Close()
+    }
+    return nil, err
+  }
+  capture.wg.Add(1)
+  go capture.flusher()
+  return capture, nil
+}
+
+/* pcapngOption appends an option with its padding to b */
+func pcapngOption(b []byte, code uint16, value string) []byte {
+  var hdr [4]byte
+  vdeplug.NativeEndian.PutUint16(hdr[0:], code)
+  vdeplug.NativeEndian.PutUint16(hdr[2:], uint16(len(value)))
+  b = append(append(b, hdr[:]...), value...)
+  return append(b, pcapngPadding[:pad4(len(value))]...)
+}
+
+func pad4(n int) int {
+  return (4 - n % 4) % 4
+}
+
+/* writeBlock writes a block with body and options, which end with opt_endofopt */
+func (this *Capture) writeBlock(kind uint32, body []byte, opts []byte) error {
+  opts = append(opts, 0, 0, 0, 0)
+  var hdr [8]byte
+  length := uint32(8 + len(body) + len(opts) + 4)
+  vdeplug.NativeEndian.PutUint32(hdr[0:], kind)
+  vdeplug.NativeEndian.PutUint32(hdr[4:], length)
+  this.w.Write(hdr[:])
+  this.w.Write(body)
+  this.w.Write(opts)
+  _, err := this.w.Write(hdr[4:8])
+  this.size += int64(length)
+  return err
+}
+
+func (this *Capture) writeIface(iface captureIface) error {
+  body := make([]byte, 8)
+  vdeplug.NativeEndian.PutUint16(body[0:], pcapngLinkEth)
+  vdeplug.NativeEndian.PutUint32(body[4:], uint32(this.config.Snaplen))
+  opts := pcapngOption(nil, pcapngIfName, iface.name)
+  if iface.descr != "" {
+    opts = pcapngOption(opts, pcapngIfDescr, iface.descr)
+  }
+  return this.writeBlock(pcapngIDB, body, opts)
+}
+
+/* rotate closes the current file, if any, and opens the next one with the
+   interfaces known so far. The caller holds the lock, NewCapture apart. */
+func (this *Capture) rotate() error {
+  if this.file != nil {
+    this.w.Flush()
+    this.file.Close()
+  }
+  this.opened = time.Now()
+  path := filepath.Join(this.config.Dir,
+    fmt.Sprintf("%s-%s-%d.pcapng", this.config.Prefix, this.opened.Format("20060102-150405"), this.seq))
+  file, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0640)
+  if err != nil {
+    this.file = nil
+    return err
+  }
+  this.seq++
+  this.file, this.w, this.size = file, bufio.NewWriterSize(file, 256 * 1024), 0
+  this.files = append(this.files, path)
+  if this.config.Files > 0 && len(this.files) > this.config.Files {
+    os.Remove(this.files[0])
+    this.files = this.files[1:]
+  }
+  this.status.File, this.status.Files = path, this.seq
+  body := make([]byte, 16)
+  vdeplug.NativeEndian.PutUint32(body[0:], pcapngMagic)
+  vdeplug.NativeEndian.PutUint16(body[4:], 1)
+  vdeplug.NativeEndian.PutUint16(body[6:], 0)
+  /* Section length not known */
+  vdeplug.NativeEndian.PutUint64(body[8:], ^uint64(0))
+  if err = this.writeBlock(pcapngSHB, body, pcapngOption(nil, pcapngUserAppl, PlugDescr)); err != nil {
+    return err
+  }
+  for _, iface := range this.ifaces {
+    if err = this.writeIface(iface); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+/* fail stops the capture after a failed write, the caller holds the lock */
+func (this *Capture) fail(err error) {
+  this.status.Err = err.Error()
+  this.closed = true
+  if this.file != nil {
+    this.file.Close()
+    this.file = nil
+  }
+}
+
+/* flusher writes the buffered frames and rotates the files by time */
+func (this *Capture) flusher() {
+  defer this.wg.Done()
+  ticker := time.NewTicker(CaptureFlush)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-this.done:
+      return
+    case now := <-ticker.C:
+      this.mutex.Lock()
+      if !this.closed {
+        err := this.w.Flush()
+        if err == nil && this.config.RotateTime > 0 && now.Sub(this.opened) >= this.config.RotateTime {
+          err = this.rotate()
+        }
+        if err != nil {
+          this.fail(err)
+        }
+      }
+      this.mutex.Unlock()
+    }
+  }
+}
+
+/* Tap returns the capture function of a plug, see Plugger.SetCapture, for
+   the interface name: the plugs with the same name share it */
+func (this *Capture) Tap(name, descr string) func(frame []byte, out bool) {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  id := -1
+  for i, iface := range this.ifaces {
+    if iface.name == name {
+      id = i
+    }
+  }
+  if id < 0 {
+    id = len(this.ifaces)
+    this.ifaces = append(this.ifaces, captureIface{ name: name, descr: descr })
+    if !this.closed {
+      if err := this.writeIface(this.ifaces[id]); err != nil {
+        this.fail(err)
+      }
+    }
+  }
+  return func(frame []byte, out bool) {
+    this.write(uint32(id), frame, out)
+  }
+}
+
+/* write writes an Enhanced Packet Block of frame, cut to the snaplen and to the
+   bytes the filter keeps */
+func (this *Capture) write(id uint32, frame []byte, out bool) {
+  n := len(frame)
+  if this.config.Filter != nil {
+    keep := this.config.Filter.Run(frame)
+    if keep == 0 {
+      return
+    }
+    if uint64(keep) < uint64(n) {
+      n = int(keep)
+    }
+  }
+  if n > this.config.Snaplen {
+    n = this.config.Snaplen
+  }
+  ts := uint64(time.Now().UnixNano() / 1000)
+  flags := uint32(pcapngInbound)
+  if out {
+    flags = pcapngOutbound
+  }
+  padding := pad4(n)
+  length := uint32(pcapngEPBHdrLen + n + padding + pcapngEPBTailLen)
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if this.closed {
+    return
+  }
+  hdr, tail := this.hdr[:pcapngEPBHdrLen], this.hdr[pcapngEPBHdrLen:]
+  order := vdeplug.NativeEndian
+  order.PutUint32(hdr[0:], pcapngEPB)
+  order.PutUint32(hdr[4:], length)
+  order.PutUint32(hdr[8:], id)
+  order.PutUint32(hdr[12:], uint32(ts >> 32))
+  order.PutUint32(hdr[16:], uint32(ts))
+  order.PutUint32(hdr[20:], uint32(n))
+  order.PutUint32(hdr[24:], uint32(len(frame)))
+  order.PutUint16(tail[0:], pcapngEPBFlags)
+  order.PutUint16(tail[2:], 4)
+  order.PutUint32(tail[4:], flags)
+  order.PutUint32(tail[8:], pcapngEndOfOpt)
+  order.PutUint32(tail[12:], length)
+  this.w.Write(hdr)
+  this.w.Write(frame[:n])
+  this.w.Write(pcapngPadding[:padding])
+  if _, err := this.w.Write(tail); err != nil {
+    this.fail(err)
+    return
+  }
+  this.size += int64(length)
+  this.status.Packets++
+  this.status.Bytes += uint64(len(frame))
+  if this.config.RotateSize > 0 && this.size >= this.config.RotateSize {
+    if err := this.rotate(); err != nil {
+      this.fail(err)
+    }
+  }
+}
+
+func (this *Capture) Status() CaptureStatus {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  return this.status
+}
+
+/* Close writes what is left and closes the file, the taps write no more */
+func (this *Capture) Close() error {
+  close(this.done)
+  this.wg.Wait()
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if this.closed {
+    return nil
+  }
+  this.closed = true
+  err := this.w.Flush()
+  if cerr := this.file.Close(); err == nil {
+    err = cerr
+  }
+  return err
+}
@@ -0,0 +1,53 @@
+package endpoint
+
+import (
+  "net"
+  "time"
+  "errors"
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/dhcp"
+)
+
+/* DHCPStart obtains a lease through the plug, unless the endpoint has one
+   already (e.g. restored after a restart), and keeps renewing it */
+func (this *EndpointStat) DHCPStart(timeout time.Duration) error {
+  if this.Plugger == nil {
+    return errors.New("DHCPStart error: " + this.IfName + " not plugged")
+  }
+  mac, err := net.ParseMAC(this.MacAddress)
+  if err != nil {
+    return err
+  }
+  client := dhcp.NewClient(mac, this.Plugger.Inject)
+  this.Plugger.SetHook(client.Input)
+  if this.DHCP == nil {
+    lease, err := client.Acquire(timeout)
+    if err != nil {
+      this.Plugger.SetHook(nil)
+      return errors.New("DHCPStart error: " + this.IfName + ": " + err.Error())
+    }
+    log.Debugf("DHCPStart [ %s ] lease [ %+v ]", this.IfName, lease)
+    this.DHCP = lease
+    this.IPv4Address = lease.Address
+  }
+  client.Start(this.DHCP)
+  this.DHCPClient = client
+  return nil
+}
+
+/* DHCPStop ends the renewals, the lease is released to the server if release */
+func (this *EndpointStat) DHCPStop(release bool) {
+  if this.DHCPClient == nil {
+    return
+  }
+  this.DHCPClient.Stop(release)
+  if this.Plugger != nil {
+    this.Plugger.SetHook(nil)
+  }
+  if release {
+    this.DHCP = nil
+  } else {
+    this.DHCP = this.DHCPClient.Lease()
+  }
+  this.DHCPClient = nil
+}
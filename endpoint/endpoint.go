@@ -1,29 +1,41 @@
 package endpoint
 
-//#cgo LDFLAGS: -lvdeplug -lpthread
-//#include <vdeplug.h>
-import "C"
 import (
+  "os"
   "net"
   "errors"
   "crypto/rand"
   log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/dhcp"
   "github.com/vishvananda/netlink"
   "github.com/docker/go-plugins-helpers/network"
 )
 
 type EndpointStat struct {
-  Plugger         uintptr `json:"Plugger"`
+  Plugger         *Plugger `json:"-"`
+  DHCPClient      *dhcp.Client `json:"-"`
+  Plugged         bool    `json:"Plugged"`
   IfName          string  `json:"IfName"`
   SandboxKey      string  `json:"SandboxKey"`
   IPv4Address     string  `json:"IPv4Address"`
 	IPv6Address     string  `json:"IPv6Address"`
   MacAddress      string  `json:"MacAddress"`
+  /* Lease of the networks with ipam=dhcp */
+  DHCP            *dhcp.Lease `json:"DHCP,omitempty"`
+  /* Names of the endpoint on the DNS server of the network */
+  DNSNames        []string `json:"DNSNames,omitempty"`
+  /* Static routes of the endpoint, added to the ones of the network */
+  Routes          []Route `json:"Routes,omitempty"`
+  /* Rate limits of the endpoint, over the ones of the network */
+  Limits          *Limits `json:"Limits,omitempty"`
+  /* Attributes of the tap, set by LinkAdd */
+  LinkConfig
 }
 
 func NewEndpointStat(r *network.CreateEndpointRequest) (*EndpointStat) {
   new := EndpointStat{
-    Plugger:      0,
+    Plugger:      nil,
+    Plugged:      false,
     IfName:       "vde" + r.EndpointID[:11],
     SandboxKey:   "",
     IPv4Address:  r.Interface.Address,
@@ -44,10 +56,29 @@ func (this *EndpointStat) LinkAdd() error {
   tapdev := &netlink.Tuntap{LinkAttrs: linkattrs}
   tapdev.Flags = netlink.TUNTAP_NO_PI
   tapdev.Mode =  netlink.TUNTAP_MODE_TAP
+  if this.Queues > 1 {
+    tapdev.Flags |= netlink.TUNTAP_MULTI_QUEUE
+  }
+  if this.GSO {
+    tapdev.Flags |= netlink.TUNTAP_VNET_HDR
+  }
 
   if err := netlink.LinkAdd(tapdev); err != nil {
     return err
   }
+  /* The offloads of TSO are there once a queue asks for them */
+  if this.GSO {
+    taps, err := OpenTapQueues(this.IfName, this.Queues, true)
+    if err != nil {
+      netlink.LinkDel(tapdev)
+      return err
+    }
+    closeTaps(taps)
+  }
+  if err := this.LinkConfig.apply(tapdev); err != nil {
+    netlink.LinkDel(tapdev)
+    return err
+  }
   if ipv4, err := netlink.ParseAddr(this.IPv4Address); err == nil {
     netlink.AddrAdd(tapdev, ipv4)
   }
@@ -57,26 +88,126 @@ func (this *EndpointStat) LinkAdd() error {
   return nil
 }
 
+/* LinkDel removes the tap, from the sandbox if it is still there */
 func (this *EndpointStat) LinkDel() error {
-  var err error
-  if link, err := netlink.LinkByName(this.IfName); err == nil {
+  link, err := netlink.LinkByName(this.IfName)
+  if err == nil {
     err = netlink.LinkDel(link)
+  } else if this.SandboxKey != "" {
+    err = DelTapAt(this.SandboxKey, this.IfName, this.MacAddress)
   }
   return err
 }
 
-func (this *EndpointStat) LinkPlugTo(sock string) error {
+/* LinkPlugTo plugs the tap of the endpoint to sock, filter (nil for none)
+   sees its frames from the first one */
+func (this *EndpointStat) LinkPlugTo(sock string, filter func(frame []byte) bool) error {
   log.Debugf("LinkPlugTo [ %s ] [ %s ]", this.IfName, sock)
-  this.Plugger = uintptr(C.vdeplug_join(C.CString(this.IfName), C.CString(sock)))
-  if this.Plugger == 0 {
-    return errors.New("LinkPlugTo error: " + this.IfName + " to " + sock)
+  plugger, err := NewPlugger(this.IfName, sock, this.Queues, this.gsoMAC(), filter)
+  if err != nil {
+    return errors.New("LinkPlugTo error: " + this.IfName + " to " + sock + ": " + err.Error())
+  }
+  this.Plugger = plugger
+  this.Plugged = true
+  return nil
+}
+
+/* LinkReopen opens the tap of a running container from its sandbox, after a plugin restart */
+func (this *EndpointStat) LinkReopen() ([]*os.File, error) {
+  log.Debugf("LinkReopen [ %s ] [ %s ]", this.IfName, this.SandboxKey)
+  if this.SandboxKey == "" {
+    return nil, ErrLinkNotFound
+  }
+  return OpenTapAt(this.SandboxKey, this.IfName, this.MacAddress, this.Queues, this.GSO)
+}
+
+/* LinkPlugTap is LinkPlugTo for the taps opened by LinkReopen */
+func (this *EndpointStat) LinkPlugTap(taps []*os.File, sock string, filter func(frame []byte) bool) error {
+  log.Debugf("LinkPlugTap [ %s ] [ %s ]", this.IfName, sock)
+  plugger, err := PlugTaps(taps, sock, this.gsoMAC(), filter)
+  if err != nil {
+    return errors.New("LinkPlugTap error: " + this.IfName + " to " + sock + ": " + err.Error())
   }
+  this.Plugger = plugger
+  this.Plugged = true
   return nil
 }
 
+/* gsoMAC is the MAC the plug announces to the GSO peers, nil without GSO */
+func (this *EndpointStat) gsoMAC() net.HardwareAddr {
+  if !this.GSO {
+    return nil
+  }
+  mac, _ := net.ParseMAC(this.MacAddress)
+  return mac
+}
+
+/* LinkPlugRelease stops forwarding but keeps the tap and the Plugged state,
+   so that the endpoint is plugged again by the next plugin instance */
+func (this *EndpointStat) LinkPlugRelease() {
+  this.DHCPStop(false)
+  if this.Plugger != nil {
+    this.Plugger.Stop()
+  }
+  this.Plugger = nil
+}
+
 func (this *EndpointStat) LinkPlugStop() {
-  C.vdeplug_leave(C.uintptr_t(this.Plugger));
-  this.Plugger = 0
+  this.DHCPStop(true)
+  if this.Plugger != nil {
+    this.Plugger.Stop()
+  }
+  this.Plugger = nil
+  this.Plugged = false
+}
+
+/* NewFilter returns the Filter of the current addresses of the endpoint */
+func (this *EndpointStat) NewFilter() (*Filter, error) {
+  return NewFilter(this.MacAddress, this.IPv4Address, this.IPv6Address)
+}
+
+/* LinkFilter makes the plug drop the frames of the endpoint with forged
+   sources, it replaces the filter of the previous addresses (e.g. before a lease) */
+func (this *EndpointStat) LinkFilter() error {
+  if this.Plugger == nil {
+    return errors.New("LinkFilter error: " + this.IfName + " not plugged")
+  }
+  filter, err := this.NewFilter()
+  if err != nil {
+    return err
+  }
+  this.Plugger.SetFilter(filter.Allow)
+  return nil
+}
+
+/* LinkLimit makes the plug drop the frames of the endpoint over limits */
+func (this *EndpointStat) LinkLimit(limits Limits) error {
+  if this.Plugger == nil {
+    return errors.New("LinkLimit error: " + this.IfName + " not plugged")
+  }
+  if limits.IsZero() {
+    this.Plugger.SetLimiter(nil)
+  } else {
+    this.Plugger.SetLimiter(NewLimiter(limits).Allow)
+  }
+  return nil
+}
+
+/* LinkCapture makes the plug pass the frames of the endpoint to capture, nil stops it */
+func (this *EndpointStat) LinkCapture(capture func(frame []byte, out bool)) error {
+  if this.Plugger == nil {
+    return errors.New("LinkCapture error: " + this.IfName + " not plugged")
+  }
+  this.Plugger.SetCapture(capture)
+  return nil
+}
+
+/* Stats returns the counters of the current plug, zero when unplugged */
+func (this *EndpointStat) Stats() Stats {
+  if this.Plugger != nil {
+    return this.Plugger.Stats()
+  }
+  return Stats{}
 }
 
 /*Copied from include/linux/etherdevice.h
@@ -0,0 +1,159 @@
+package endpoint
+
+import (
+  "net"
+  "bytes"
+  "errors"
+  "github.com/phocs/vde_plug_docker/packet"
+)
+
+/* ICMPv6 messages of the Neighbor Discovery (RFC 4861) and the MLD reports
+   (RFC 2710, RFC 3810) checked by the Filter */
+const (
+  mldReport               = 131
+  ndRouterAdvertisement   = 134
+  ndNeighborSolicitation  = 135
+  ndNeighborAdvertisement = 136
+  ndRedirect              = 137
+  mldv2Report             = 143
+  ndSourceLinkAddr        = 1
+  ndTargetLinkAddr        = 2
+  dhcpServerPort          = 67
+)
+
+/* Filter lets through the frames of an endpoint that carry its own addresses:
+   the source MAC, the source of IPv4 and IPv6, the sender of ARP and the
+   addresses announced by the Neighbor Discovery. The other types are dropped. */
+type Filter struct {
+  mac       net.HardwareAddr
+  ipv4      net.IP
+  ipv6      net.IP
+  linklocal net.IP
+}
+
+/* parseAddress takes an address with or without prefix length, nil if empty */
+func parseAddress(addr string) (net.IP, error) {
+  if addr == "" {
+    return nil, nil
+  }
+  if ip, _, err := net.ParseCIDR(addr); err == nil {
+    return ip, nil
+  }
+  if ip := net.ParseIP(addr); ip != nil {
+    return ip, nil
+  }
+  return nil, errors.New("Invalid address " + addr)
+}
+
+func NewFilter(mac, ipv4, ipv6 string) (*Filter, error) {
+  hwaddr, err := net.ParseMAC(mac)
+  if err != nil {
+    return nil, err
+  }
+  filter := &Filter{ mac: hwaddr, linklocal: packet.LinkLocal(hwaddr) }
+  if filter.ipv4, err = parseAddress(ipv4); err != nil {
+    return nil, err
+  }
+  if filter.ipv6, err = parseAddress(ipv6); err != nil {
+    return nil, err
+  }
+  return filter, nil
+}
+
+/* Allow reports whether frame may reach the VDE network */
+func (this *Filter) Allow(frame []byte) bool {
+  eth, ok := packet.ParseEthernet(frame)
+  if !ok || !bytes.Equal(eth.Src(), this.mac) {
+    return false
+  }
+  switch eth.Type() {
+  case packet.EtherTypeIPv4:
+    return this.allowIPv4(eth.Payload())
+  case packet.EtherTypeARP:
+    arp, ok := packet.ParseARP(eth.Payload())
+    /* A sender 0.0.0.0 probes an address (RFC 5227) */
+    return ok && bytes.Equal(arp.SenderMAC(), this.mac) && (arp.SenderIP().Equal(this.ipv4) || arp.SenderIP().IsUnspecified())
+  case packet.EtherTypeIPv6:
+    return this.allowIPv6(eth.Payload())
+  }
+  return false
+}
+
+func (this *Filter) allowIPv4(b []byte) bool {
+  ip, ok := packet.ParseIPv4(b)
+  if !ok {
+    return false
+  }
+  if this.ipv4 != nil && ip.Src().Equal(this.ipv4) {
+    return true
+  }
+  /* A DHCP client without an address yet */
+  if ip.Src().IsUnspecified() && ip.Protocol() == packet.ProtoUDP && !ip.IsFragment() {
+    udp, ok := packet.ParseUDP(ip.Payload())
+    return ok && udp.DstPort() == dhcpServerPort
+  }
+  return false
+}
+
+/* ownIPv6 reports whether ip is an address of the endpoint, its link-local one included */
+func (this *Filter) ownIPv6(ip net.IP) bool {
+  return this.ipv6 != nil && ip.Equal(this.ipv6) || ip.Equal(this.linklocal)
+}
+
+func (this *Filter) allowIPv6(b []byte) bool {
+  ip, ok := packet.ParseIPv6(b)
+  if !ok {
+    return false
+  }
+  /* The extension headers do not hide the Neighbor Discovery */
+  proto, payload, ok := ip.UpperLayer()
+  if !ok {
+    return false
+  }
+  unspecified := ip.Src().IsUnspecified()
+  if !unspecified && !this.ownIPv6(ip.Src()) {
+    return false
+  }
+  if proto != packet.ProtoICMPv6 {
+    return !unspecified
+  }
+  icmp := payload
+  if len(icmp) < packet.ICMPv6HeaderLen {
+    return false
+  }
+  /* The unspecified source is the one of the Duplicate Address Detection
+     (RFC 4862) and of its MLD reports (RFC 3590) */
+  if unspecified && icmp[0] != ndNeighborSolicitation && icmp[0] != mldReport && icmp[0] != mldv2Report {
+    return false
+  }
+  switch icmp[0] {
+  case ndRouterAdvertisement, ndRedirect:
+    /* An endpoint is not a router */
+    return false
+  case ndNeighborSolicitation, ndNeighborAdvertisement:
+    /* Type, code, checksum, flags, target, options */
+    if len(icmp) < 24 {
+      return false
+    }
+    if icmp[0] == ndNeighborAdvertisement && !this.ownIPv6(net.IP(icmp[8:24])) {
+      return false
+    }
+    return this.allowLinkAddr(icmp[24:])
+  }
+  return true
+}
+
+/* allowLinkAddr checks the link-layer address options of a Neighbor Discovery message */
+func (this *Filter) allowLinkAddr(options []byte) bool {
+  for len(options) > 0 {
+    if len(options) < 2 || options[1] == 0 || len(options) < int(options[1]) * 8 {
+      return false
+    }
+    n := int(options[1]) * 8
+    if (options[0] == ndSourceLinkAddr || options[0] == ndTargetLinkAddr) && !bytes.Equal(options[2:8], this.mac) {
+      return false
+    }
+    options = options[n:]
+  }
+  return true
+}
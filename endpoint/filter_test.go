@@ -0,0 +1,121 @@
+package endpoint
+
+import (
+  "net"
+  "testing"
+  "encoding/binary"
+  "github.com/phocs/vde_plug_docker/packet"
+)
+
+var (
+  filterMAC   = net.HardwareAddr{ 0x02, 0, 0, 0, 0, 1 }
+  otherMAC    = net.HardwareAddr{ 0x02, 0, 0, 0, 0, 2 }
+  filterIPv4  = net.ParseIP("10.0.0.2")
+  filterIPv6  = net.ParseIP("fd00::2")
+  otherIPv6   = net.ParseIP("fd00::3")
+  allNodes    = net.ParseIP("ff02::1")
+  unspecified = net.ParseIP("::")
+)
+
+/* extHeader inserts after the IPv6 header of frame an extension header of typ,
+   of n bytes, with the fragment offset off if it is a Fragment header */
+func extHeader(frame []byte, typ uint8, n int, off uint16) []byte {
+  head := packet.EthernetHeaderLen + packet.IPv6HeaderLen
+  frame = append(append(append([]byte{}, frame[:head]...), make([]byte, n)...), frame[head:]...)
+  ip, ext := frame[packet.EthernetHeaderLen:], frame[head:head+n]
+  ext[0] = ip[6]
+  switch typ {
+  case packet.IPv6AH:
+    ext[1] = byte(n / 4 - 2)
+  case packet.IPv6Fragment:
+    binary.BigEndian.PutUint16(ext[2:4], off << 3)
+  default:
+    ext[1] = byte(n / 8 - 1)
+  }
+  ip[6] = typ
+  binary.BigEndian.PutUint16(ip[4:6], binary.BigEndian.Uint16(ip[4:6]) + uint16(n))
+  return frame
+}
+
+/* icmpv6 is an ICMPv6 message of typ from src, with the target and options
+   of the Neighbor Discovery if target is not nil */
+func icmpv6(srcmac net.HardwareAddr, src net.IP, typ uint8, target net.IP, options ...byte) []byte {
+  body := make([]byte, 4)
+  if target != nil {
+    body = append(body, target.To16()...)
+  }
+  return packet.NewICMPv6(packet.MulticastMAC(allNodes), srcmac, src, allNodes, packet.NDHopLimit, typ, 0, append(body, options...))
+}
+
+func linkAddrOption(typ uint8, mac net.HardwareAddr) []byte {
+  return append([]byte{ typ, 1 }, mac...)
+}
+
+func TestFilterAllow(t *testing.T) {
+  filter, err := NewFilter(filterMAC.String(), "10.0.0.2/24", "fd00::2/64")
+  if err != nil {
+    t.Fatal(err)
+  }
+  linklocal := packet.LinkLocal(filterMAC)
+  udp6 := packet.NewUDPv6(otherMAC, filterMAC, filterIPv6, otherIPv6, 1000, 2000, []byte("data"))
+  ra := icmpv6(filterMAC, linklocal, ndRouterAdvertisement, nil, make([]byte, 12)...)
+  redirect := icmpv6(filterMAC, linklocal, ndRedirect, otherIPv6, otherIPv6.To16()...)
+  forgedNA := icmpv6(filterMAC, filterIPv6, ndNeighborAdvertisement, otherIPv6)
+  echo := icmpv6(filterMAC, filterIPv6, 128, nil)
+  for _, tc := range []struct {
+    name  string
+    frame []byte
+    want  bool
+  } {
+    { "IPv4", packet.NewUDPv4(otherMAC, filterMAC, filterIPv4, net.ParseIP("10.0.0.3"), 1000, 2000, nil), true },
+    { "IPv4 forged source", packet.NewUDPv4(otherMAC, filterMAC, net.ParseIP("10.0.0.9"), net.ParseIP("10.0.0.3"), 1000, 2000, nil), false },
+    { "IPv4 forged MAC", packet.NewUDPv4(otherMAC, otherMAC, filterIPv4, net.ParseIP("10.0.0.3"), 1000, 2000, nil), false },
+    { "DHCP discover", packet.NewUDPv4(packet.Broadcast, filterMAC, net.IPv4zero, net.IPv4bcast, 68, dhcpServerPort, nil), true },
+    { "IPv4 unspecified not DHCP", packet.NewUDPv4(packet.Broadcast, filterMAC, net.IPv4zero, net.IPv4bcast, 68, 53, nil), false },
+    { "ARP", packet.NewARP(1, filterMAC, filterIPv4, nil, net.ParseIP("10.0.0.3")), true },
+    { "ARP probe", packet.NewARP(1, filterMAC, net.IPv4zero, nil, filterIPv4), true },
+    { "ARP forged sender", packet.NewARP(2, filterMAC, net.ParseIP("10.0.0.1"), otherMAC, net.ParseIP("10.0.0.3")), false },
+    { "IPv6", udp6, true },
+    { "IPv6 forged source", packet.NewUDPv6(otherMAC, filterMAC, otherIPv6, filterIPv6, 1000, 2000, nil), false },
+    { "IPv6 link-local", packet.NewUDPv6(otherMAC, filterMAC, linklocal, otherIPv6, 1000, 2000, nil), true },
+    { "IPv6 truncated", udp6[:len(udp6) - 1], false },
+    { "ICMPv6 echo", echo, true },
+    { "ICMPv6 truncated", echo[:packet.EthernetHeaderLen + packet.IPv6HeaderLen + 3], false },
+    { "NS", icmpv6(filterMAC, filterIPv6, ndNeighborSolicitation, otherIPv6, linkAddrOption(ndSourceLinkAddr, filterMAC)...), true },
+    { "NS forged link address", icmpv6(filterMAC, filterIPv6, ndNeighborSolicitation, otherIPv6, linkAddrOption(ndSourceLinkAddr, otherMAC)...), false },
+    { "NS bad option length", icmpv6(filterMAC, filterIPv6, ndNeighborSolicitation, otherIPv6, ndSourceLinkAddr, 0), false },
+    { "NA", icmpv6(filterMAC, filterIPv6, ndNeighborAdvertisement, filterIPv6, linkAddrOption(ndTargetLinkAddr, filterMAC)...), true },
+    { "NA forged target", forgedNA, false },
+    { "RA", ra, false },
+    { "redirect", redirect, false },
+    /* The unspecified source only for the Duplicate Address Detection */
+    { "DAD NS", icmpv6(filterMAC, unspecified, ndNeighborSolicitation, filterIPv6), true },
+    { "DAD MLD report", icmpv6(filterMAC, unspecified, mldReport, allNodes), true },
+    { "DAD MLDv2 report", icmpv6(filterMAC, unspecified, mldv2Report, nil), true },
+    { "unspecified NA", icmpv6(filterMAC, unspecified, ndNeighborAdvertisement, filterIPv6), false },
+    { "unspecified echo", icmpv6(filterMAC, unspecified, 128, nil), false },
+    { "unspecified UDP", packet.NewUDPv6(otherMAC, filterMAC, unspecified, otherIPv6, 1000, 2000, nil), false },
+    /* The extension headers before the ICMPv6 header */
+    { "RA after Hop-by-Hop", extHeader(ra, packet.IPv6HopByHop, 8, 0), false },
+    { "redirect after Destination Options", extHeader(redirect, packet.IPv6DestOpts, 16, 0), false },
+    { "NA after two headers", extHeader(extHeader(forgedNA, packet.IPv6DestOpts, 8, 0), packet.IPv6HopByHop, 8, 0), false },
+    { "RA after AH", extHeader(ra, packet.IPv6AH, 12, 0), false },
+    { "RA in the first fragment", extHeader(ra, packet.IPv6Fragment, 8, 0), false },
+    { "echo after Hop-by-Hop", extHeader(echo, packet.IPv6HopByHop, 8, 0), true },
+    { "UDP after Routing", extHeader(udp6, packet.IPv6Routing, 24, 0), true },
+    { "fragment after the first", extHeader(udp6, packet.IPv6Fragment, 8, 1), true },
+    { "unspecified fragment after the first", extHeader(icmpv6(filterMAC, unspecified, mldReport, allNodes), packet.IPv6Fragment, 8, 1), false },
+    { "DAD NS after Hop-by-Hop", extHeader(icmpv6(filterMAC, unspecified, ndNeighborSolicitation, filterIPv6), packet.IPv6HopByHop, 8, 0), true },
+    { "extension header past the end", extHeader(ra, packet.IPv6HopByHop, 8, 0)[:packet.EthernetHeaderLen + packet.IPv6HeaderLen + 4], false },
+    { "extension header longer than the packet", func() []byte {
+        frame := extHeader(ra, packet.IPv6DestOpts, 8, 0)
+        frame[packet.EthernetHeaderLen + packet.IPv6HeaderLen + 1] = 255
+        return frame
+      }(), false },
+    { "unknown EtherType", packet.NewEthernet(otherMAC, filterMAC, 0x88b5, 10), false },
+  } {
+    if got := filter.Allow(tc.frame); got != tc.want {
+      t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+    }
+  }
+}
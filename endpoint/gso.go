@@ -0,0 +1,135 @@
+package endpoint
+
+import (
+  "net"
+  "bytes"
+  "sync"
+  "time"
+  "encoding/binary"
+  "github.com/phocs/vde_plug_docker/packet"
+  "github.com/phocs/vde_plug_docker/vdeplug"
+)
+
+/* The plugs of the taps with IFF_VNET_HDR carry the TCP super frames of the
+   containers to the peers that take them, wrapped in frames of the local
+   experimental EtherType with their virtio_net_hdr. A plug announces itself
+   with a hello as long as the longest wrapped frame: the peers that receive
+   it whole know that the path (switch, transport, VLAN) carries them. For the
+   others (VMs, a vde_switch, the plugs without GSO) the frames are segmented,
+   as for all of them on the transports of shorter frames (vxvde, libvdeplug). */
+const (
+  EtherTypeGSO     = 0x88b5
+  GSOHelloInterval = 10 * time.Second
+  GSOPeerTimeout   = 3 * GSOHelloInterval
+)
+
+const (
+  gsoMagic    = "VDEG"
+  gsoVersion  = 1
+  gsoHello    = 1
+  gsoFrame    = 2
+  gsoBye      = 3
+  /* Ethernet header, magic, kind and version */
+  gsoHdrLen   = packet.EthernetHeaderLen + 6
+  /* The hello and the wrapped frames leave room for the tag of a VLAN */
+  gsoFrameMax = vdeplug.MaxBufSize - packet.VLANTagLen
+)
+
+/* TUNSETOFFLOAD flags of the taps with GSO, see include/uapi/linux/if_tun.h */
+const (
+  tunFCsum   = 0x01
+  tunFTSO4   = 0x02
+  tunFTSO6   = 0x04
+  tunFTSOECN = 0x08
+  tunOffload = tunFCsum | tunFTSO4 | tunFTSO6 | tunFTSOECN
+)
+
+/* gsoKind returns the kind of the frames of the GSO plugs, 0 for the others */
+func gsoKind(frame []byte) byte {
+  if len(frame) < gsoHdrLen || binary.BigEndian.Uint16(frame[12:14]) != EtherTypeGSO ||
+      string(frame[14:18]) != gsoMagic || frame[19] != gsoVersion {
+    return 0
+  }
+  return frame[18]
+}
+
+func putGSOHdr(b, dst, src []byte, kind byte) {
+  copy(b[0:6], dst)
+  copy(b[6:12], src)
+  binary.BigEndian.PutUint16(b[12:14], EtherTypeGSO)
+  copy(b[14:18], gsoMagic)
+  b[18] = kind
+  b[19] = gsoVersion
+}
+
+/* convertHdr rewrites the virtio_net_hdr at b from an order to another: the
+   taps use the one of the host, the VDE network little endian */
+func convertHdr(b []byte, from, to binary.ByteOrder) {
+  if from != to {
+    packet.ParseVirtioNetHdr(b, from).Put(b, to)
+  }
+}
+
+/* gsoPeers are the peers of a plug that take the wrapped frames, by MAC */
+type gsoPeers struct {
+  mac   net.HardwareAddr
+  /* The transport can not carry the hellos, there are no peers */
+  mute  bool
+  mutex sync.Mutex
+  peers map[[6]byte]time.Time
+}
+
+func newGSOPeers(mac net.HardwareAddr, sock string) *gsoPeers {
+  return &gsoPeers{ mac: mac, mute: vdeplug.MaxFrame(sock) < gsoFrameMax, peers: make(map[[6]byte]time.Time) }
+}
+
+/* capable reports whether the destination of a frame takes the wrapped frames */
+func (this *gsoPeers) capable(dst []byte) bool {
+  var key [6]byte
+  if dst[0] & 1 != 0 {
+    return false
+  }
+  copy(key[:], dst)
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  expires, ok := this.peers[key]
+  return ok && time.Now().Before(expires)
+}
+
+/* hello returns a hello or a bye of the plug for dst */
+func (this *gsoPeers) hello(dst net.HardwareAddr, kind byte) []byte {
+  if kind != gsoHello {
+    frame := make([]byte, gsoHdrLen)
+    putGSOHdr(frame, dst, this.mac, kind)
+    return frame
+  }
+  frame := make([]byte, gsoFrameMax)
+  putGSOHdr(frame, dst, this.mac, kind)
+  binary.BigEndian.PutUint32(frame[gsoHdrLen:], uint32(len(frame)))
+  return frame
+}
+
+/* input learns from the hellos and the byes of the peers, true for the hello
+   of a new peer: it gets one back, not to wait for the next */
+func (this *gsoPeers) input(frame []byte, kind byte) bool {
+  var src [6]byte
+  if copy(src[:], frame[6:12]); bytes.Equal(src[:], this.mac) {
+    return false
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  switch kind {
+  case gsoHello:
+    /* Cut somewhere on the way */
+    if len(frame) < gsoFrameMax || int(binary.BigEndian.Uint32(frame[gsoHdrLen:])) != len(frame) {
+      return false
+    }
+    now := time.Now()
+    expires, known := this.peers[src]
+    this.peers[src] = now.Add(GSOPeerTimeout)
+    return !known || now.After(expires)
+  case gsoBye:
+    delete(this.peers, src)
+  }
+  return false
+}
@@ -0,0 +1,45 @@
+package endpoint
+
+import (
+  "io/ioutil"
+  "github.com/vishvananda/netlink"
+)
+
+const (
+  ipv4Forwarding = "/proc/sys/net/ipv4/ip_forward"
+  ipv6Forwarding = "/proc/sys/net/ipv6/conf/all/forwarding"
+)
+
+/* LinkUp sets up the tap of an endpoint that stays on the host (e.g. the
+   gateway of a network), it is created if missing and its addresses are set again */
+func (this *EndpointStat) LinkUp() error {
+  link, err := netlink.LinkByName(this.IfName)
+  if err != nil {
+    if err = this.LinkAdd(); err != nil {
+      return err
+    }
+    if link, err = netlink.LinkByName(this.IfName); err != nil {
+      return err
+    }
+  } else {
+    for _, addr := range []string{ this.IPv4Address, this.IPv6Address } {
+      if ip, err := netlink.ParseAddr(addr); err == nil {
+        netlink.AddrReplace(link, ip)
+      }
+    }
+  }
+  return netlink.LinkSetUp(link)
+}
+
+/* EnableForwarding turns the IP forwarding of the host on, for the families asked */
+func EnableForwarding(ipv4, ipv6 bool) error {
+  for path, on := range map[string]bool{ ipv4Forwarding: ipv4, ipv6Forwarding: ipv6 } {
+    if !on {
+      continue
+    }
+    if err := ioutil.WriteFile(path, []byte("1\n"), 0644); err != nil {
+      return err
+    }
+  }
+  return nil
+}
@@ -0,0 +1,104 @@
+package endpoint
+
+import (
+  "sync"
+  "time"
+  "github.com/phocs/vde_plug_docker/vdeplug"
+)
+
+/* Limits of the traffic of an endpoint towards the VDE network, 0 is no limit */
+type Limits struct {
+  /* Bits per second */
+  Bandwidth uint64 `json:"Bandwidth,omitempty"`
+  /* Packets per second */
+  Packets   uint64 `json:"Packets,omitempty"`
+  /* Broadcast and multicast packets per second */
+  Broadcast uint64 `json:"Broadcast,omitempty"`
+}
+
+func (this Limits) IsZero() bool {
+  return this == Limits{}
+}
+
+/* The buckets hold a tenth of a second of traffic, at least a few frames or a GSO segment */
+const (
+  burstDivisor = 10
+  minBurstPackets = 8
+  minBurstBytes = vdeplug.MaxBufSize
+)
+
+/* bucket is a token bucket: rate tokens a second, up to burst */
+type bucket struct {
+  rate   float64
+  burst  float64
+  tokens float64
+  last   time.Time
+}
+
+func newBucket(rate uint64, min float64) *bucket {
+  if rate == 0 {
+    return nil
+  }
+  burst := float64(rate) / burstDivisor
+  if burst < min {
+    burst = min
+  }
+  return &bucket{ rate: float64(rate), burst: burst, tokens: burst }
+}
+
+func (this *bucket) refill(now time.Time) {
+  if !this.last.IsZero() {
+    this.tokens += now.Sub(this.last).Seconds() * this.rate
+    if this.tokens > this.burst {
+      this.tokens = this.burst
+    }
+  }
+  this.last = now
+}
+
+/* Limiter enforces Limits on the frames of an endpoint, the workers of the
+   queues of a tap share it */
+type Limiter struct {
+  mutex     sync.Mutex
+  bytes     *bucket
+  packets   *bucket
+  broadcast *bucket
+}
+
+func NewLimiter(limits Limits) *Limiter {
+  return &Limiter{
+    bytes:     newBucket(limits.Bandwidth / 8, minBurstBytes),
+    packets:   newBucket(limits.Packets, minBurstPackets),
+    broadcast: newBucket(limits.Broadcast, minBurstPackets),
+  }
+}
+
+/* Allow reports whether frame, sent as packets frames of size bytes (more than
+   one for a GSO frame), is within the limits, and takes its tokens if so. A
+   cost over the burst needs a full bucket and leaves it below zero. */
+func (this *Limiter) Allow(frame []byte, packets, size int) bool {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  now := time.Now()
+  buckets := []*bucket{ this.bytes, this.packets }
+  costs := []float64{ float64(size), float64(packets) }
+  /* The group bit of the destination MAC address */
+  if len(frame) > 0 && frame[0] & 1 != 0 {
+    buckets = append(buckets, this.broadcast)
+    costs = append(costs, float64(packets))
+  }
+  for i, b := range buckets {
+    if b == nil {
+      continue
+    }
+    if b.refill(now); b.tokens < costs[i] && b.tokens < b.burst {
+      return false
+    }
+  }
+  for i, b := range buckets {
+    if b != nil {
+      b.tokens -= costs[i]
+    }
+  }
+  return true
+}
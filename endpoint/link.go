@@ -0,0 +1,137 @@
+package endpoint
+
+import (
+  "sort"
+  "errors"
+  "strconv"
+  "strings"
+  "unsafe"
+  "golang.org/x/sys/unix"
+  "github.com/vishvananda/netlink"
+)
+
+/* LinkConfig are the attributes of a tap, the defaults of the kernel for the zero values */
+type LinkConfig struct {
+  MTU        int             `json:"MTU,omitempty"`
+  TxQueueLen int             `json:"TxQueueLen,omitempty"`
+  /* Queues of a multi-queue tap, the plug has a worker for each one */
+  Queues     int             `json:"Queues,omitempty"`
+  /* A tap with IFF_VNET_HDR and TSO, its plug takes the super frames, see gsoPeers */
+  GSO        bool            `json:"GSO,omitempty"`
+  /* Offloads turned on or off by name, see Offloads */
+  Offloads   map[string]bool `json:"Offloads,omitempty"`
+}
+
+/* Offloads are the ethtool commands (get, set) of the offloads of a tap, the
+   legacy ones: the kernel maps them to the features of the device */
+var Offloads = map[string][2]uint32 {
+  "tx":  { 0x16, 0x17 },
+  "sg":  { 0x18, 0x19 },
+  "tso": { 0x1e, 0x1f },
+  "gso": { 0x23, 0x24 },
+  "gro": { 0x2b, 0x2c },
+}
+
+type ethtoolValue struct {
+  Cmd  uint32
+  Data uint32
+}
+
+type ifReqData struct {
+  Name [unix.IFNAMSIZ]byte
+  Data uintptr
+  pad  [24 - unsafe.Sizeof(uintptr(0))]byte
+}
+
+func ethtool(fd int, ifname string, value *ethtoolValue) error {
+  req := ifReqData{ Data: uintptr(unsafe.Pointer(value)) }
+  copy(req.Name[:unix.IFNAMSIZ-1], ifname)
+  _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&req)))
+  if errno != 0 {
+    return errno
+  }
+  return nil
+}
+
+/* setOffloads turns the offloads of ifname on or off, an error if the device does not follow */
+func setOffloads(ifname string, offloads map[string]bool) error {
+  if len(offloads) == 0 {
+    return nil
+  }
+  fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM | unix.SOCK_CLOEXEC, 0)
+  if err != nil {
+    return err
+  }
+  defer unix.Close(fd)
+  for name, on := range offloads {
+    cmds, ok := Offloads[name]
+    if !ok {
+      return errors.New("Unknown offload " + name)
+    }
+    value := &ethtoolValue{ Cmd: cmds[1] }
+    if on {
+      value.Data = 1
+    }
+    if err := ethtool(fd, ifname, value); err != nil {
+      return errors.New("Offload " + name + " of " + ifname + ": " + err.Error())
+    }
+    value = &ethtoolValue{ Cmd: cmds[0] }
+    if err := ethtool(fd, ifname, value); err != nil {
+      return errors.New("Offload " + name + " of " + ifname + ": " + err.Error())
+    }
+    if (value.Data != 0) != on {
+      return errors.New("Offload " + name + " not supported by " + ifname)
+    }
+  }
+  return nil
+}
+
+/* apply sets the attributes on link */
+func (this LinkConfig) apply(link netlink.Link) error {
+  if this.MTU != 0 {
+    if err := netlink.LinkSetMTU(link, this.MTU); err != nil {
+      return errors.New("MTU " + strconv.Itoa(this.MTU) + ": " + err.Error())
+    }
+  }
+  if this.TxQueueLen != 0 {
+    if err := netlink.LinkSetTxQLen(link, this.TxQueueLen); err != nil {
+      return errors.New("txqueuelen " + strconv.Itoa(this.TxQueueLen) + ": " + err.Error())
+    }
+  }
+  return setOffloads(link.Attrs().Name, this.Offloads)
+}
+
+/* OffloadsString returns the offloads as name=on|off, separated by commas */
+func (this LinkConfig) OffloadsString() string {
+  var offloads []string
+  for name, on := range this.Offloads {
+    if on {
+      offloads = append(offloads, name + "=on")
+    } else {
+      offloads = append(offloads, name + "=off")
+    }
+  }
+  sort.Strings(offloads)
+  return strings.Join(offloads, ",")
+}
+
+/* Map returns the attributes set, in the format of an EndpointInfo value */
+func (this LinkConfig) Map() map[string]string {
+  info := make(map[string]string)
+  if this.MTU != 0 {
+    info["mtu"] = strconv.Itoa(this.MTU)
+  }
+  if this.TxQueueLen != 0 {
+    info["txqueuelen"] = strconv.Itoa(this.TxQueueLen)
+  }
+  if this.Queues > 1 {
+    info["queues"] = strconv.Itoa(this.Queues)
+  }
+  if this.GSO {
+    info["gso"] = "on"
+  }
+  if len(this.Offloads) > 0 {
+    info["offloads"] = this.OffloadsString()
+  }
+  return info
+}
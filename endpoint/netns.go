@@ -0,0 +1,183 @@
+package endpoint
+
+import (
+  "os"
+  "net"
+  "errors"
+  "runtime"
+  "github.com/vishvananda/netns"
+  "github.com/vishvananda/netlink"
+)
+
+var ErrLinkNotFound = errors.New("Link not found in the sandbox")
+
+/* findLink looks the tap up by name, then by MAC address, Docker renames it in the sandbox */
+func findLink(handle *netlink.Handle, ifname, mac string) (netlink.Link, error) {
+  if link, err := handle.LinkByName(ifname); err == nil {
+    return link, nil
+  }
+  links, err := handle.LinkList()
+  if err != nil {
+    return nil, err
+  }
+  for _, link := range links {
+    if mac != "" && link.Attrs().HardwareAddr.String() == mac {
+      return link, nil
+    }
+  }
+  return nil, ErrLinkNotFound
+}
+
+/* sandboxLink finds the tap that Docker moved (and renamed) into the sandbox nspath */
+func sandboxLink(ns netns.NsHandle, ifname, mac string) (string, error) {
+  handle, err := netlink.NewHandleAt(ns)
+  if err != nil {
+    return "", err
+  }
+  defer handle.Delete()
+  link, err := findLink(handle, ifname, mac)
+  if err != nil {
+    return "", err
+  }
+  return link.Attrs().Name, nil
+}
+
+/* DelTapAt removes the tap of an endpoint from the network namespace nspath */
+func DelTapAt(nspath, ifname, mac string) error {
+  ns, err := netns.GetFromPath(nspath)
+  if err != nil {
+    return err
+  }
+  defer ns.Close()
+  handle, err := netlink.NewHandleAt(ns)
+  if err != nil {
+    return err
+  }
+  defer handle.Delete()
+  link, err := findLink(handle, ifname, mac)
+  if err != nil {
+    return err
+  }
+  return handle.LinkDel(link)
+}
+
+/* InNetns runs fn with its thread in the network namespace ns, on a goroutine
+   of its own: if the thread cannot go back, it stays locked and the runtime
+   ends it with the goroutine, while the caller (maybe the main goroutine)
+   never leaves its namespace */
+func InNetns(ns netns.NsHandle, fn func() error) error {
+  errs := make(chan error, 1)
+  go func() {
+    runtime.LockOSThread()
+    origns, err := netns.Get()
+    if err != nil {
+      runtime.UnlockOSThread()
+      errs <- err
+      return
+    }
+    defer origns.Close()
+    if err = netns.Set(ns); err != nil {
+      runtime.UnlockOSThread()
+      errs <- err
+      return
+    }
+    err = fn()
+    if netns.Set(origns) == nil {
+      runtime.UnlockOSThread()
+    }
+    errs <- err
+  }()
+  return <-errs
+}
+
+/* OpenTapAt opens the queues of the tap of an endpoint from the network namespace nspath */
+func OpenTapAt(nspath, ifname, mac string, queues int, vnetHdr bool) ([]*os.File, error) {
+  ns, err := netns.GetFromPath(nspath)
+  if err != nil {
+    return nil, err
+  }
+  defer ns.Close()
+  name, err := sandboxLink(ns, ifname, mac)
+  if err != nil {
+    return nil, err
+  }
+  /* TUNSETIFF looks the name up in the namespace of the calling thread */
+  var taps []*os.File
+  err = InNetns(ns, func() (err error) {
+    taps, err = OpenTapQueues(name, queues, vnetHdr)
+    return err
+  })
+  return taps, err
+}
+
+/* Route of the sandbox, through Gateway or directly connected if it is empty */
+type Route struct {
+  Destination string
+  Gateway     string
+}
+
+/* LinkMoveTo moves the tap into the network namespace nspath as name, with its
+   MAC, addresses and routes: what Docker does after Join, for the runtimes
+   that leave it to the network plugin */
+func (this *EndpointStat) LinkMoveTo(nspath, name string, routes []Route) error {
+  link, err := netlink.LinkByName(this.IfName)
+  if err != nil {
+    return err
+  }
+  if mac, err := net.ParseMAC(this.MacAddress); err != nil {
+    return err
+  } else if err = netlink.LinkSetHardwareAddr(link, mac); err != nil {
+    return err
+  }
+  ns, err := netns.GetFromPath(nspath)
+  if err != nil {
+    return err
+  }
+  defer ns.Close()
+  if err = netlink.LinkSetNsFd(link, int(ns)); err != nil {
+    return err
+  }
+  this.SandboxKey = nspath
+  handle, err := netlink.NewHandleAt(ns)
+  if err != nil {
+    return err
+  }
+  defer handle.Delete()
+  if link, err = handle.LinkByName(this.IfName); err != nil {
+    return err
+  }
+  if name != "" && name != this.IfName {
+    if err = handle.LinkSetName(link, name); err != nil {
+      return err
+    }
+  }
+  for _, cidr := range []string{ this.IPv4Address, this.IPv6Address } {
+    if cidr == "" {
+      continue
+    }
+    addr, err := netlink.ParseAddr(cidr)
+    if err != nil {
+      return err
+    }
+    if err = handle.AddrAdd(link, addr); err != nil {
+      return err
+    }
+  }
+  if err = handle.LinkSetUp(link); err != nil {
+    return err
+  }
+  for _, route := range routes {
+    _, dst, err := net.ParseCIDR(route.Destination)
+    if err != nil {
+      return err
+    }
+    r := &netlink.Route{ LinkIndex: link.Attrs().Index, Dst: dst, Gw: net.ParseIP(route.Gateway) }
+    if r.Gw == nil {
+      r.Scope = netlink.SCOPE_LINK
+    }
+    if err = handle.RouteAdd(r); err != nil {
+      return err
+    }
+  }
+  return nil
+}
@@ -0,0 +1,456 @@
+package endpoint
+
+import (
+  "os"
+  "net"
+  "sync"
+  "time"
+  "syscall"
+  "sync/atomic"
+  "encoding/binary"
+  "golang.org/x/sys/unix"
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/packet"
+  "github.com/phocs/vde_plug_docker/vdeplug"
+)
+
+const PlugDescr = "vde_plug_docker"
+
+/* Delays between the attempts to open again a lost VDE connection */
+const (
+  ReconnectMin = 100 * time.Millisecond
+  ReconnectMax = 5 * time.Second
+)
+
+/* Plugger forwards the frames between a tap and a VDE network, it replaces
+   the plug2tap thread of vdeplug.c. A lost VDE connection (e.g. a restarted
+   switch) is opened again, the tap is kept. Each queue of the tap has its
+   worker towards the VDE network, the frames move in batches both ways.
+   The taps with GSO have a virtio_net_hdr, see gsoPeers. */
+type Plugger struct {
+  /* First field, 64-bit aligned for the atomic counters */
+  stats     Stats
+  taps      []*os.File
+  sock      string
+  mutex     sync.RWMutex
+  conn      vdeplug.Conn
+  hook      func(frame []byte) bool
+  filter    func(frame []byte) bool
+  limiter   func(frame []byte, packets, size int) bool
+  capture   func(frame []byte, out bool)
+  /* nil if the taps have no virtio_net_hdr */
+  gso       *gsoPeers
+  stopped   chan struct{}
+  wg        sync.WaitGroup
+  closeOnce sync.Once
+}
+
+/* NewPlugger opens the queues of the tap ifname and plugs them to sock, with
+   a virtio_net_hdr if gso is the MAC of the endpoint. filter, if not nil, is
+   the one of SetFilter from the first frame. */
+func NewPlugger(ifname, sock string, queues int, gso net.HardwareAddr, filter func(frame []byte) bool) (*Plugger, error) {
+  taps, err := OpenTapQueues(ifname, queues, gso != nil)
+  if err != nil {
+    return nil, err
+  }
+  return PlugTaps(taps, sock, gso, filter)
+}
+
+/* PlugTap starts forwarding between an already open tap and sock, tap is closed on error */
+func PlugTap(tap *os.File, sock string) (*Plugger, error) {
+  return PlugTaps([]*os.File{ tap }, sock, nil, nil)
+}
+
+/* PlugTaps is PlugTap for the queues of a tap, opened with IFF_VNET_HDR if gso
+   is the MAC of the endpoint: the plug announces it to its GSO peers. filter
+   is set before the workers start, see NewPlugger. */
+func PlugTaps(taps []*os.File, sock string, gso net.HardwareAddr, filter func(frame []byte) bool) (*Plugger, error) {
+  plugger := &Plugger{ taps: taps, sock: sock, filter: filter, stopped: make(chan struct{}) }
+  if gso != nil {
+    plugger.gso = newGSOPeers(gso, sock)
+  }
+  conn, err := openConn(sock, &plugger.stats)
+  if err != nil {
+    closeTaps(taps)
+    return nil, err
+  }
+  plugger.conn = conn
+  plugger.wg.Add(len(taps) + 1)
+  for _, tap := range taps {
+    go plugger.tapToVde(tap)
+  }
+  go plugger.vdeToTap()
+  if gso != nil && !plugger.gso.mute {
+    plugger.wg.Add(1)
+    go plugger.announce()
+  }
+  return plugger, nil
+}
+
+func (this *Plugger) getConn() vdeplug.Conn {
+  this.mutex.RLock()
+  defer this.mutex.RUnlock()
+  return this.conn
+}
+
+func (this *Plugger) getHook() func(frame []byte) bool {
+  this.mutex.RLock()
+  defer this.mutex.RUnlock()
+  return this.hook
+}
+
+/* SetHook makes hook see the frames from the VDE network before the tap, the
+   ones it returns true for are not forwarded. The frame is only valid during the call. */
+func (this *Plugger) SetHook(hook func(frame []byte) bool) {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  this.hook = hook
+}
+
+func (this *Plugger) getFilter() func(frame []byte) bool {
+  this.mutex.RLock()
+  defer this.mutex.RUnlock()
+  return this.filter
+}
+
+/* SetFilter makes filter see the frames from the tap, the ones it returns
+   false for are dropped and counted. The frame is only valid during the call. */
+func (this *Plugger) SetFilter(filter func(frame []byte) bool) {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  this.filter = filter
+}
+
+func (this *Plugger) getLimiter() func(frame []byte, packets, size int) bool {
+  this.mutex.RLock()
+  defer this.mutex.RUnlock()
+  return this.limiter
+}
+
+/* SetLimiter makes limiter see the frames from the tap that passed the filter,
+   with the packets and bytes they are sent as: the ones it returns false for
+   are dropped and counted */
+func (this *Plugger) SetLimiter(limiter func(frame []byte, packets, size int) bool) {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  this.limiter = limiter
+}
+
+func (this *Plugger) getCapture() func(frame []byte, out bool) {
+  this.mutex.RLock()
+  defer this.mutex.RUnlock()
+  return this.capture
+}
+
+/* SetCapture makes capture see the frames of the endpoint both ways, out for
+   the ones from the tap, before the filter and the hook: the super frames of
+   a tap with GSO whole. The frame is only valid during the call. */
+func (this *Plugger) SetCapture(capture func(frame []byte, out bool)) {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  this.capture = capture
+}
+
+/* Inject sends a frame of the plug itself to the VDE network */
+func (this *Plugger) Inject(frame []byte) error {
+  _, err := this.getConn().Send(frame)
+  return err
+}
+
+/* newBatch returns the buffers of size bytes of a batch of frames, their views
+   after head bytes, where the frames are read, and the sizes of the frames */
+func newBatch(size, head int) ([][]byte, [][]byte, []int) {
+  bufs := make([][]byte, vdeplug.BatchSize)
+  views := make([][]byte, vdeplug.BatchSize)
+  for i := range bufs {
+    bufs[i] = make([]byte, size)
+    views[i] = bufs[i][head:]
+  }
+  return bufs, views, make([]int, vdeplug.BatchSize)
+}
+
+/* readTap waits for a frame of the queue raw, then reads the ones already
+   there up to len(bufs): a tap has no recvmmsg */
+func readTap(raw syscall.RawConn, bufs [][]byte, sizes []int) (int, error) {
+  count := 0
+  var err error
+  rerr := raw.Read(func(fd uintptr) bool {
+    for count < len(bufs) {
+      var n int
+      if n, err = unix.Read(int(fd), bufs[count]); err == unix.EINTR {
+        continue
+      } else if err != nil || n == 0 {
+        break
+      }
+      sizes[count] = n
+      count++
+    }
+    return count > 0 || err != unix.EAGAIN
+  })
+  if count > 0 {
+    return count, nil
+  }
+  if rerr != nil {
+    return 0, rerr
+  }
+  return 0, err
+}
+
+/* tapToVde is the worker of a queue of the tap */
+func (this *Plugger) tapToVde(tap *os.File) {
+  defer this.wg.Done()
+  raw, err := tap.SyscallConn()
+  if err != nil {
+    this.terminate(err)
+    return
+  }
+  /* The frames of a tap with GSO are read after the room to wrap them */
+  bufs, views, sizes := newBatch(vdeplug.EthBufSize, 0)
+  var segbuf []byte
+  if this.gso != nil {
+    bufs, views, sizes = newBatch(gsoFrameMax, gsoHdrLen)
+    segbuf = make([]byte, 2 * vdeplug.MaxBufSize)
+  }
+  frames := make([][]byte, 0, len(bufs))
+  for {
+    n, err := readTap(raw, views, sizes)
+    if err != nil || n == 0 {
+      this.terminate(err)
+      return
+    }
+    filter, limiter, capture := this.getFilter(), this.getLimiter(), this.getCapture()
+    frames = frames[:0]
+    space := segbuf
+    for i := 0; i < n; i++ {
+      frame := views[i][:sizes[i]]
+      var hdr packet.VirtioNetHdr
+      if this.gso != nil {
+        if len(frame) < packet.VirtioNetHdrLen + packet.EthernetHeaderLen {
+          continue
+        }
+        hdr = packet.ParseVirtioNetHdr(frame, vdeplug.NativeEndian)
+        frame = frame[packet.VirtioNetHdrLen:]
+      }
+      if capture != nil {
+        capture(frame, true)
+      }
+      /* A GSO frame counts as its segments */
+      packets, size := 1, len(frame)
+      if hdr.GSOType != packet.GSONone {
+        if n, bytes, err := packet.GSOSegments(hdr, frame); err == nil {
+          packets, size = n, bytes
+        }
+      }
+      if filter != nil && !filter(frame) {
+        atomic.AddUint64(&this.stats.TxFiltered, 1)
+      } else if limiter != nil && !limiter(frame, packets, size) {
+        atomic.AddUint64(&this.stats.TxLimited, 1)
+      } else if hdr.GSOType == packet.GSONone {
+        if err := packet.CompleteChecksum(hdr, frame); err != nil {
+          this.stats.tx(0, err)
+          continue
+        }
+        frames = append(frames, frame)
+      } else if this.gso.capable(frame[0:6]) {
+        wrapped := bufs[i][:gsoHdrLen + packet.VirtioNetHdrLen + len(frame)]
+        putGSOHdr(wrapped, frame[0:6], frame[6:12], gsoFrame)
+        convertHdr(wrapped[gsoHdrLen:], vdeplug.NativeEndian, binary.LittleEndian)
+        frames = append(frames, wrapped)
+        atomic.AddUint64(&this.stats.TxGSO, 1)
+      } else {
+        /* Sent whole before running out of space for the segments */
+        mark := len(frames)
+        if frames, err = packet.SegmentTCP(hdr, frame, space, frames); err == packet.ErrGSOSpace && mark > 0 {
+          this.send(frames[:mark])
+          frames, space = frames[:0], segbuf
+          frames, err = packet.SegmentTCP(hdr, frame, space, frames)
+          mark = 0
+        }
+        if err != nil {
+          frames = frames[:mark]
+          this.stats.tx(0, err)
+          continue
+        }
+        for _, seg := range frames[mark:] {
+          space = space[len(seg):]
+        }
+        atomic.AddUint64(&this.stats.TxSegmented, 1)
+      }
+    }
+    this.send(frames)
+  }
+}
+
+/* send sends a batch to the VDE network, a frame that fails is counted and skipped */
+func (this *Plugger) send(frames [][]byte) {
+  conn := this.getConn()
+  for len(frames) > 0 {
+    n, err := vdeplug.SendBatch(conn, frames)
+    for _, frame := range frames[:n] {
+      this.stats.tx(len(frame), nil)
+    }
+    if err == nil || n >= len(frames) {
+      return
+    }
+    log.Debugf("Plugger.Send: [ %s ]", err)
+    this.stats.tx(0, err)
+    frames = frames[n+1:]
+  }
+}
+
+func (this *Plugger) vdeToTap() {
+  defer this.wg.Done()
+  /* The frames for a tap with GSO are read after the room for the virtio_net_hdr */
+  bufs, views, sizes := newBatch(vdeplug.EthBufSize, 0)
+  if this.gso != nil {
+    bufs, views, sizes = newBatch(packet.VirtioNetHdrLen + vdeplug.MaxBufSize, packet.VirtioNetHdrLen)
+  }
+  for {
+    conn := this.getConn()
+    n, err := vdeplug.RecvBatch(conn, views, sizes)
+    if err != nil || n == 0 {
+      if !this.reconnect(conn, err) {
+        return
+      }
+      continue
+    }
+    hook, capture := this.getHook(), this.getCapture()
+    for i := 0; i < n; i++ {
+      frame := views[i][:sizes[i]]
+      out := frame
+      switch kind := gsoKind(frame); {
+      case kind == 0:
+        if capture != nil {
+          capture(frame, false)
+        }
+        if hook != nil && hook(frame) {
+          continue
+        }
+        if this.gso != nil {
+          out = bufs[i][:packet.VirtioNetHdrLen + len(frame)]
+          packet.VirtioNetHdr{}.Put(out, vdeplug.NativeEndian)
+        }
+      case this.gso == nil:
+        /* Never announced, from a peer that still has to forget it */
+        continue
+      case kind == gsoFrame:
+        if len(frame) < gsoHdrLen + packet.VirtioNetHdrLen + packet.EthernetHeaderLen {
+          continue
+        }
+        out = frame[gsoHdrLen:]
+        convertHdr(out, binary.LittleEndian, vdeplug.NativeEndian)
+        frame = out[packet.VirtioNetHdrLen:]
+        if capture != nil {
+          capture(frame, false)
+        }
+      default:
+        if this.gso.input(frame, kind) && !this.gso.mute {
+          this.Inject(this.gso.hello(frame[6:12], gsoHello))
+        }
+        continue
+      }
+      if _, err = this.taps[0].Write(out); err != nil {
+        log.Debugf("Plugger.Write: [ %s ]", err)
+      }
+      this.stats.rx(len(frame), err)
+    }
+  }
+}
+
+/* announce sends the hellos of a plug with GSO, until it is stopped */
+func (this *Plugger) announce() {
+  defer this.wg.Done()
+  ticker := time.NewTicker(GSOHelloInterval)
+  defer ticker.Stop()
+  for {
+    this.Inject(this.gso.hello(packet.Broadcast, gsoHello))
+    select {
+    case <-this.stopped:
+      return
+    case <-ticker.C:
+    }
+  }
+}
+
+/* reconnect replaces the failed conn until it succeeds or the plugger is stopped */
+func (this *Plugger) reconnect(old vdeplug.Conn, err error) bool {
+  select {
+  case <-this.stopped:
+    return false
+  default:
+  }
+  log.Infof("Plugger [ %s ] connection lost: [ %v ]", this.sock, err)
+  old.Close()
+  conn := redial(this.sock, &this.stats, this.stopped)
+  if conn == nil {
+    return false
+  }
+  this.mutex.Lock()
+  select {
+  case <-this.stopped:
+    this.mutex.Unlock()
+    conn.Close()
+    return false
+  default:
+    this.conn = conn
+    this.mutex.Unlock()
+  }
+  atomic.AddUint64(&this.stats.Reconnects, 1)
+  log.Infof("Plugger [ %s ] reconnected", this.sock)
+  if this.gso != nil && !this.gso.mute {
+    this.Inject(this.gso.hello(packet.Broadcast, gsoHello))
+  }
+  return true
+}
+
+/* redial opens sock again, with growing delays, nil once stopped is closed */
+func redial(sock string, stats *Stats, stopped <-chan struct{}) vdeplug.Conn {
+  for delay := ReconnectMin; ; delay *= 2 {
+    if delay > ReconnectMax {
+      delay = ReconnectMax
+    }
+    select {
+    case <-stopped:
+      return nil
+    case <-time.After(delay):
+    }
+    conn, err := openConn(sock, stats)
+    if err == nil {
+      return conn
+    }
+    log.Debugf("Plugger [ %s ] reconnect: [ %s ]", sock, err)
+  }
+}
+
+/* terminate closes both sides, the forwarding goroutines exit as well */
+func (this *Plugger) terminate(err error) {
+  this.closeOnce.Do(func() {
+    if err != nil {
+      log.Debugf("Plugger terminated: [ %s ]", err)
+    }
+    this.mutex.Lock()
+    close(this.stopped)
+    /* The peers stop sending the wrapped frames at once */
+    if this.gso != nil && !this.gso.mute {
+      this.conn.Send(this.gso.hello(packet.Broadcast, gsoBye))
+    }
+    this.conn.Close()
+    this.mutex.Unlock()
+    closeTaps(this.taps)
+  })
+}
+
+/* Stop unplugs the tap and waits for the forwarding goroutines */
+func (this *Plugger) Stop() {
+  this.terminate(nil)
+  this.wg.Wait()
+}
+
+/* Wait blocks until the plugger is stopped or its tap is gone */
+func (this *Plugger) Wait() {
+  this.wg.Wait()
+}
+
+func (this *Plugger) Stats() Stats {
+  return this.stats.Snapshot()
+}
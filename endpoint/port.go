@@ -0,0 +1,88 @@
+package endpoint
+
+import (
+  "sync"
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/vdeplug"
+)
+
+/* Port is a plug of the plugin itself on a VDE network, without a tap: the
+   frames are handled by the services of the network (e.g. the DHCP server).
+   A lost connection is opened again, like the one of a Plugger. */
+type Port struct {
+  sock      string
+  handler   func(frame []byte)
+  mutex     sync.RWMutex
+  conn      vdeplug.Conn
+  stopped   chan struct{}
+  wg        sync.WaitGroup
+  closeOnce sync.Once
+}
+
+/* NewPort plugs to sock, handler is called with each frame received, only valid during the call */
+func NewPort(sock string, handler func(frame []byte)) (*Port, error) {
+  conn, err := openConn(sock, nil)
+  if err != nil {
+    return nil, err
+  }
+  port := &Port{ sock: sock, handler: handler, conn: conn, stopped: make(chan struct{}) }
+  port.wg.Add(1)
+  go port.recv()
+  return port, nil
+}
+
+func (this *Port) getConn() vdeplug.Conn {
+  this.mutex.RLock()
+  defer this.mutex.RUnlock()
+  return this.conn
+}
+
+func (this *Port) Send(frame []byte) error {
+  _, err := this.getConn().Send(frame)
+  return err
+}
+
+func (this *Port) recv() {
+  defer this.wg.Done()
+  buf := make([]byte, vdeplug.EthBufSize)
+  for {
+    conn := this.getConn()
+    n, err := conn.Recv(buf)
+    if err == nil && n > 0 {
+      this.handler(buf[:n])
+      continue
+    }
+    select {
+    case <-this.stopped:
+      return
+    default:
+    }
+    log.Infof("Port [ %s ] connection lost: [ %v ]", this.sock, err)
+    conn.Close()
+    if conn = redial(this.sock, nil, this.stopped); conn == nil {
+      return
+    }
+    this.mutex.Lock()
+    select {
+    case <-this.stopped:
+      this.mutex.Unlock()
+      conn.Close()
+      return
+    default:
+      this.conn = conn
+      this.mutex.Unlock()
+    }
+    log.Infof("Port [ %s ] reconnected", this.sock)
+  }
+}
+
+/* Stop unplugs the port and waits for the receiving goroutine */
+func (this *Port) Stop() {
+  this.closeOnce.Do(func() {
+    this.mutex.Lock()
+    close(this.stopped)
+    this.conn.Close()
+    this.mutex.Unlock()
+  })
+  this.wg.Wait()
+}
@@ -0,0 +1,115 @@
+package endpoint
+
+import (
+  "strconv"
+  "syscall"
+  "sync/atomic"
+)
+
+/* Stats are the forwarding counters of an endpoint, seen from the container:
+   rx from the VDE network to the tap, tx from the tap to the VDE network */
+type Stats struct {
+  RxPackets  uint64 `json:"RxPackets"`
+  RxBytes    uint64 `json:"RxBytes"`
+  RxDropped  uint64 `json:"RxDropped"`
+  RxErrors   uint64 `json:"RxErrors"`
+  TxPackets  uint64 `json:"TxPackets"`
+  TxBytes    uint64 `json:"TxBytes"`
+  TxDropped  uint64 `json:"TxDropped"`
+  TxErrors   uint64 `json:"TxErrors"`
+  /* Frames from the tap with forged sources, see Filter */
+  TxFiltered uint64 `json:"TxFiltered"`
+  /* Frames from the tap over the Limits */
+  TxLimited  uint64 `json:"TxLimited"`
+  /* Frames tagged towards and untagged from the VDE network of a VLAN, and the
+     ones from the other VLANs dropped */
+  VLANTagged   uint64 `json:"VLANTagged"`
+  VLANUntagged uint64 `json:"VLANUntagged"`
+  VLANForeign  uint64 `json:"VLANForeign"`
+  /* TCP super frames from a tap with GSO sent whole to the peers, and the
+     ones segmented by the plug */
+  TxGSO       uint64 `json:"TxGSO"`
+  TxSegmented uint64 `json:"TxSegmented"`
+  /* VDE connections opened again after a failure */
+  Reconnects uint64 `json:"Reconnects"`
+}
+
+func (this *Stats) rx(n int, err error) {
+  if err == nil {
+    atomic.AddUint64(&this.RxPackets, 1)
+    atomic.AddUint64(&this.RxBytes, uint64(n))
+  } else if dropped(err) {
+    atomic.AddUint64(&this.RxDropped, 1)
+  } else {
+    atomic.AddUint64(&this.RxErrors, 1)
+  }
+}
+
+func (this *Stats) tx(n int, err error) {
+  if err == nil {
+    atomic.AddUint64(&this.TxPackets, 1)
+    atomic.AddUint64(&this.TxBytes, uint64(n))
+  } else if dropped(err) {
+    atomic.AddUint64(&this.TxDropped, 1)
+  } else {
+    atomic.AddUint64(&this.TxErrors, 1)
+  }
+}
+
+/* dropped tells a full queue apart from a failure */
+func dropped(err error) bool {
+  for {
+    switch e := err.(type) {
+    case syscall.Errno:
+      return e == syscall.EAGAIN || e == syscall.ENOBUFS
+    case interface{ Unwrap() error }:
+      err = e.Unwrap()
+    default:
+      return false
+    }
+  }
+}
+
+/* Snapshot returns a consistent copy of each counter */
+func (this *Stats) Snapshot() Stats {
+  return Stats {
+    RxPackets:  atomic.LoadUint64(&this.RxPackets),
+    RxBytes:    atomic.LoadUint64(&this.RxBytes),
+    RxDropped:  atomic.LoadUint64(&this.RxDropped),
+    RxErrors:   atomic.LoadUint64(&this.RxErrors),
+    TxPackets:  atomic.LoadUint64(&this.TxPackets),
+    TxBytes:    atomic.LoadUint64(&this.TxBytes),
+    TxDropped:  atomic.LoadUint64(&this.TxDropped),
+    TxErrors:   atomic.LoadUint64(&this.TxErrors),
+    TxFiltered: atomic.LoadUint64(&this.TxFiltered),
+    TxLimited:  atomic.LoadUint64(&this.TxLimited),
+    VLANTagged:   atomic.LoadUint64(&this.VLANTagged),
+    VLANUntagged: atomic.LoadUint64(&this.VLANUntagged),
+    VLANForeign:  atomic.LoadUint64(&this.VLANForeign),
+    TxGSO:       atomic.LoadUint64(&this.TxGSO),
+    TxSegmented: atomic.LoadUint64(&this.TxSegmented),
+    Reconnects: atomic.LoadUint64(&this.Reconnects),
+  }
+}
+
+/* Map returns the counters in the format of an EndpointInfo value */
+func (this Stats) Map() map[string]string {
+  return map[string]string {
+    "rx_packets": strconv.FormatUint(this.RxPackets, 10),
+    "rx_bytes":   strconv.FormatUint(this.RxBytes, 10),
+    "rx_dropped": strconv.FormatUint(this.RxDropped, 10),
+    "rx_errors":  strconv.FormatUint(this.RxErrors, 10),
+    "tx_packets": strconv.FormatUint(this.TxPackets, 10),
+    "tx_bytes":   strconv.FormatUint(this.TxBytes, 10),
+    "tx_dropped": strconv.FormatUint(this.TxDropped, 10),
+    "tx_errors":  strconv.FormatUint(this.TxErrors, 10),
+    "tx_filtered": strconv.FormatUint(this.TxFiltered, 10),
+    "tx_limited": strconv.FormatUint(this.TxLimited, 10),
+    "vlan_tagged": strconv.FormatUint(this.VLANTagged, 10),
+    "vlan_untagged": strconv.FormatUint(this.VLANUntagged, 10),
+    "vlan_foreign": strconv.FormatUint(this.VLANForeign, 10),
+    "tx_gso": strconv.FormatUint(this.TxGSO, 10),
+    "tx_segmented": strconv.FormatUint(this.TxSegmented, 10),
+    "reconnects": strconv.FormatUint(this.Reconnects, 10),
+  }
+}
@@ -0,0 +1,90 @@
+package endpoint
+
+import (
+  "os"
+  "unsafe"
+  "syscall"
+  "golang.org/x/sys/unix"
+)
+
+const TunDevice = "/dev/net/tun"
+
+type ifReq struct {
+  Name  [unix.IFNAMSIZ]byte
+  Flags uint16
+  pad   [24 - 2]byte
+}
+
+/* OpenTap attaches to the (persistent) tap named ifname, as open_tap did in vdeplug.c */
+func OpenTap(ifname string) (*os.File, error) {
+  return openTap(ifname, unix.IFF_TAP | unix.IFF_NO_PI)
+}
+
+/* OpenTapQueues attaches to the queues of the tap named ifname, one file each:
+   more than one needs a tap created with IFF_MULTI_QUEUE. With vnetHdr the
+   frames have a virtio_net_hdr, and the tap sends TCP super frames (TSO). */
+func OpenTapQueues(ifname string, queues int, vnetHdr bool) ([]*os.File, error) {
+  var flags uint16 = unix.IFF_TAP | unix.IFF_NO_PI
+  if queues > 1 {
+    flags |= unix.IFF_MULTI_QUEUE
+  } else {
+    queues = 1
+  }
+  if vnetHdr {
+    flags |= unix.IFF_VNET_HDR
+  }
+  taps := make([]*os.File, 0, queues)
+  for i := 0; i < queues; i++ {
+    tap, err := openTap(ifname, flags)
+    if err == nil && vnetHdr {
+      if err = ioctl(tap, unix.TUNSETOFFLOAD, tunOffload); err != nil {
+        tap.Close()
+      }
+    }
+    if err != nil {
+      closeTaps(taps)
+      return nil, err
+    }
+    taps = append(taps, tap)
+  }
+  return taps, nil
+}
+
+func ioctl(tap *os.File, req, arg uintptr) error {
+  raw, err := tap.SyscallConn()
+  if err != nil {
+    return err
+  }
+  var errno syscall.Errno
+  if err = raw.Control(func(fd uintptr) {
+    _, _, errno = unix.Syscall(unix.SYS_IOCTL, fd, req, arg)
+  }); err != nil {
+    return err
+  }
+  if errno != 0 {
+    return errno
+  }
+  return nil
+}
+
+func openTap(ifname string, flags uint16) (*os.File, error) {
+  fd, err := unix.Open(TunDevice, unix.O_RDWR | unix.O_CLOEXEC | unix.O_NONBLOCK, 0)
+  if err != nil {
+    return nil, err
+  }
+  req := ifReq{ Flags: flags }
+  copy(req.Name[:unix.IFNAMSIZ-1], ifname)
+  _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETIFF, uintptr(unsafe.Pointer(&req)))
+  if errno != 0 {
+    unix.Close(fd)
+    return nil, errno
+  }
+  /* The fd is non blocking, so the runtime poller can interrupt a pending Read on Close */
+  return os.NewFile(uintptr(fd), TunDevice), nil
+}
+
+func closeTaps(taps []*os.File) {
+  for _, tap := range taps {
+    tap.Close()
+  }
+}
@@ -0,0 +1,164 @@
+package endpoint
+
+import (
+  "sync"
+  "errors"
+  "strconv"
+  "strings"
+  "sync/atomic"
+  "encoding/binary"
+  "github.com/phocs/vde_plug_docker/packet"
+  "github.com/phocs/vde_plug_docker/vdeplug"
+)
+
+/* Option of the urls of the plugs: the frames are tagged with this VLAN on
+   the VDE network, and untagged on the side of the plug */
+const OptVLAN = "vlan"
+
+var errVLANFrame = errors.New("Frame size out of the bounds of a VLAN")
+
+/* VLANURL returns sock with the vlan option, sock itself if vid is 0 */
+func VLANURL(sock string, vid uint16) string {
+  if vid == 0 {
+    return sock
+  }
+  return sock + "/" + OptVLAN + "=" + strconv.Itoa(int(vid))
+}
+
+/* splitVLAN removes the vlan option from sock, the backends do not know it */
+func splitVLAN(sock string) (string, uint16, error) {
+  elems := strings.Split(sock, "/")
+  for i := len(elems) - 1; i > 0 && strings.Contains(elems[i], "="); i-- {
+    kv := strings.SplitN(elems[i], "=", 2)
+    if kv[0] != OptVLAN {
+      continue
+    }
+    vid, err := strconv.ParseUint(kv[1], 10, 16)
+    if err != nil || vid == 0 || vid > packet.VLANMax {
+      return "", 0, errors.New("Invalid vlan in " + sock)
+    }
+    elems = append(elems[:i], elems[i+1:]...)
+    return strings.Join(elems, "/"), uint16(vid), nil
+  }
+  return sock, 0, nil
+}
+
+/* vlanConn is a Conn on a trunk: the frames sent are tagged, the ones
+   received are untagged, the ones of the other VLANs are dropped */
+type vlanConn struct {
+  vdeplug.Conn
+  vid   uint16
+  stats *Stats
+  bufs  sync.Pool
+}
+
+/* openConn opens sock, with the tagging of its vlan option if any. The counters
+   of the tagged frames go to stats, if not nil. */
+func openConn(sock string, stats *Stats) (vdeplug.Conn, error) {
+  sock, vid, err := splitVLAN(sock)
+  if err != nil {
+    return nil, err
+  }
+  conn, err := vdeplug.Open(sock, PlugDescr)
+  if err != nil || vid == 0 {
+    return conn, err
+  }
+  if stats == nil {
+    stats = &Stats{}
+  }
+  vconn := &vlanConn{ Conn: conn, vid: vid, stats: stats }
+  vconn.bufs.New = func() interface{} { return make([]byte, vdeplug.MaxBufSize) }
+  return vconn, nil
+}
+
+/* tag writes frame in buf with the tag of the VLAN */
+func (this *vlanConn) tag(buf, frame []byte) ([]byte, error) {
+  if len(frame) < packet.EthernetHeaderLen || len(frame) + packet.VLANTagLen > vdeplug.MaxBufSize {
+    return nil, errVLANFrame
+  }
+  copy(buf, frame[:12])
+  binary.BigEndian.PutUint16(buf[12:14], packet.EtherTypeVLAN)
+  binary.BigEndian.PutUint16(buf[14:16], this.vid)
+  return buf[:16 + copy(buf[16:], frame[12:])], nil
+}
+
+/* untag removes the tag of the VLAN from frame in place, false for the other VLANs */
+func (this *vlanConn) untag(frame []byte) (int, bool) {
+  if vid, ok := packet.Ethernet(frame).VLAN(); ok && vid == this.vid {
+    copy(frame[12:], frame[16:])
+    atomic.AddUint64(&this.stats.VLANUntagged, 1)
+    return len(frame) - packet.VLANTagLen, true
+  }
+  atomic.AddUint64(&this.stats.VLANForeign, 1)
+  return 0, false
+}
+
+func (this *vlanConn) Send(frame []byte) (int, error) {
+  buf := this.bufs.Get().([]byte)
+  defer this.bufs.Put(buf)
+  tagged, err := this.tag(buf, frame)
+  if err != nil {
+    return 0, err
+  }
+  if _, err := this.Conn.Send(tagged); err != nil {
+    return 0, err
+  }
+  atomic.AddUint64(&this.stats.VLANTagged, 1)
+  return len(frame), nil
+}
+
+func (this *vlanConn) Recv(buf []byte) (int, error) {
+  for {
+    n, err := this.Conn.Recv(buf)
+    if err != nil || n == 0 {
+      return n, err
+    }
+    if n, ok := this.untag(buf[:n]); ok {
+      return n, nil
+    }
+  }
+}
+
+/* SendBatch tags the frames and sends them with a batch of the Conn, up to
+   the first one out of the bounds of a VLAN */
+func (this *vlanConn) SendBatch(frames [][]byte) (int, error) {
+  var tagged [][]byte
+  var terr error
+  for _, frame := range frames {
+    buf := this.bufs.Get().([]byte)
+    defer this.bufs.Put(buf)
+    pkt, err := this.tag(buf, frame)
+    if err != nil {
+      terr = err
+      break
+    }
+    tagged = append(tagged, pkt)
+  }
+  n, err := vdeplug.SendBatch(this.Conn, tagged)
+  atomic.AddUint64(&this.stats.VLANTagged, uint64(n))
+  if err == nil {
+    err = terr
+  }
+  return n, err
+}
+
+/* RecvBatch keeps the frames of the VLAN, untagged, at the head of bufs */
+func (this *vlanConn) RecvBatch(bufs [][]byte, sizes []int) (int, error) {
+  for {
+    n, err := vdeplug.RecvBatch(this.Conn, bufs, sizes)
+    if err != nil || n == 0 {
+      return n, err
+    }
+    kept := 0
+    for i := 0; i < n; i++ {
+      if size, ok := this.untag(bufs[i][:sizes[i]]); ok {
+        bufs[kept], bufs[i] = bufs[i], bufs[kept]
+        sizes[kept] = size
+        kept++
+      }
+    }
+    if kept > 0 {
+      return kept, nil
+    }
+  }
+}
@@ -1,37 +1,187 @@
-
 package main
 
 import (
+  "os"
+  "path/filepath"
+  "context"
+  "syscall"
+  "net/http"
+  "os/signal"
   log "github.com/Sirupsen/logrus"
   "gopkg.in/alecthomas/kingpin.v2"
+  "github.com/phocs/vde_plug_docker/admin"
+  "github.com/phocs/vde_plug_docker/metrics"
+  "github.com/phocs/vde_plug_docker/endpoint"
   "github.com/phocs/vde_plug_docker/vdenet"
+  "github.com/phocs/vde_plug_docker/plugin"
+  "github.com/phocs/vde_plug_docker/vdeipam"
+  "github.com/phocs/vde_plug_docker/cluster"
+  "github.com/phocs/vde_plug_docker/datastore"
   "github.com/docker/go-plugins-helpers/network"
 )
 
 const unixSock      = "/run/docker/plugins/vde.sock"
 const dsFile        = "/vde_plug_docker.json"
 const dsDefaultDir  = "/etc/docker"
+const clusterFile   = "/vde_plug_docker_cluster.json"
+/* Document of the IPAM driver of the previous versions, imported in the data store */
+const ipamFile      = "/vde_plug_docker_ipam.json"
 
 var (
   dsPath    string
   debugMode = kingpin.Flag("debug", "Enable debug mode.").Bool()
   dsClean   = kingpin.Flag("clean", "Delete old the data store.").Bool()
   dsDir     = kingpin.Flag("dir-path", "Directory path of the data store.").String()
+  dsURL     = kingpin.Flag("datastore", "Data store of the networks: file://, bolt:// or memory://, default file://<dir-path>/vde_plug_docker.json").String()
+  swDir     = kingpin.Flag("switch-dir", "Directory of the built-in switches sockets.").Default(vdenet.SwitchDirDefault).String()
+  scope     = kingpin.Flag("scope", "Scope of the networks: local or global (multi-host).").Default(network.LocalScope).Enum(network.LocalScope, network.GlobalScope)
+  clStore   = kingpin.Flag("cluster-store", "Shared state of the global scope networks, e.g. file:///shared/vde.json").String()
+  hostName  = kingpin.Flag("host-name", "Name of this host in the cluster store.").String()
+  metricsAt = kingpin.Flag("metrics-listen", "Address of the Prometheus metrics endpoint, e.g. :9323").String()
+  shutdown  = kingpin.Flag("shutdown", "On SIGTERM/SIGINT keep the endpoints plugged for the next instance, or unplug them.").Default(vdenet.ShutdownKeep).Enum(vdenet.ShutdownKeep, vdenet.ShutdownUnplug)
+  drainTime = kingpin.Flag("shutdown-timeout", "Time to wait for the requests in flight on shutdown.").Default("30s").Duration()
+
+  serveCmd  = kingpin.Command("serve", "Run the plugin (default).").Default()
+  statsCmd  = kingpin.Command("stats", "Show the forwarding counters of the endpoints.")
+  statsNet  = statsCmd.Arg("network", "ID or ID prefix of the network.").String()
+
+  captureCmd   = kingpin.Command("capture", "Write the frames of the endpoints to pcapng files.")
+  capStartCmd  = captureCmd.Command("start", "Start a capture on the endpoints of a network, or on one of them.")
+  capStartNet  = capStartCmd.Flag("network", "ID or ID prefix of the network.").Required().String()
+  capStartEp   = capStartCmd.Flag("endpoint", "ID or ID prefix of the endpoint, default all the endpoints.").String()
+  capFilter    = capStartCmd.Flag("filter", "tcpdump filter expression, or its bytecode as printed by tcpdump -ddd.").String()
+  capDir       = capStartCmd.Flag("dir", "Directory of the files.").Default(".").String()
+  capSnaplen   = capStartCmd.Flag("snaplen", "Bytes kept of each frame.").Default("262144").Int()
+  capSize      = capStartCmd.Flag("rotate-size", "Size of a file before the next one, e.g. 100MB, 0 for no limit.").Default("0").Bytes()
+  capTime      = capStartCmd.Flag("rotate-time", "Time of a file before the next one, e.g. 1h, 0 for no limit.").Default("0").Duration()
+  capFiles     = capStartCmd.Flag("files", "Files kept, the oldest ones are removed, 0 for all.").Default("0").Int()
+  capStopCmd   = captureCmd.Command("stop", "Stop a capture.")
+  capStopNet   = capStopCmd.Flag("network", "ID or ID prefix of the network.").Required().String()
+  capStopEp    = capStopCmd.Flag("endpoint", "ID or ID prefix of the endpoint, default the capture of the whole network.").String()
+  capListCmd   = captureCmd.Command("list", "Show the running captures.")
+
+  benchCmd  = kingpin.Command("bench", "Measure the packets per second between two taps plugged to a VDE switch.")
+  benchQs   = benchCmd.Flag("queues", "Queues of the taps, and senders.").Default("1").Int()
+  benchSize = benchCmd.Flag("size", "Size of the frames.").Default("64").Int()
+  benchRate = benchCmd.Flag("rate", "Frames per second of the senders, 0 for as fast as they can.").Default("0").Int()
+  benchTime = benchCmd.Flag("duration", "Duration of the test.").Default("5s").Duration()
+  benchSock = benchCmd.Flag("sock", "VDE sock of the taps, default a built-in switch.").String()
+
+  netavarkCmd = kingpin.Command("netavark", "Run as a netavark plugin of Podman, through the running plugin.")
+  nvCreateCmd = netavarkCmd.Command("create", "Define a network, read from stdin.")
+  nvSetupCmd  = netavarkCmd.Command("setup", "Connect a container, read from stdin.")
+  nvSetupNs   = nvSetupCmd.Arg("netns", "Network namespace path of the container.").Required().String()
+  nvDownCmd   = netavarkCmd.Command("teardown", "Disconnect a container, read from stdin.")
+  nvDownNs    = nvDownCmd.Arg("netns", "Network namespace path of the container.").Required().String()
+  nvInfoCmd   = netavarkCmd.Command("info", "Show the plugin version.")
 )
 
 func main() {
-	kingpin.Parse()
-  if *dsDir != "" {
-    dsPath = *dsDir +  dsFile
-  } else {
-    dsPath = dsDefaultDir + dsFile
+  args := os.Args[1:]
+  if filepath.Base(os.Args[0]) == netavarkPlugin {
+    args = append([]string{ netavarkCmd.FullCommand() }, args...)
   }
+  switch kingpin.MustParse(kingpin.CommandLine.Parse(args)) {
+  case statsCmd.FullCommand():
+    stats(*statsNet)
+  case capStartCmd.FullCommand():
+    captureStart(*capStartNet, *capStartEp, *capFilter, *capDir, *capSnaplen, int64(*capSize), *capTime, *capFiles)
+  case capStopCmd.FullCommand():
+    captureStop(*capStopNet, *capStopEp)
+  case capListCmd.FullCommand():
+    captureList()
+  case benchCmd.FullCommand():
+    bench(*benchQs, *benchSize, *benchRate, *benchTime, *benchSock)
+  case nvCreateCmd.FullCommand():
+    netavarkCreate()
+  case nvSetupCmd.FullCommand():
+    netavarkSetup(*nvSetupNs)
+  case nvDownCmd.FullCommand():
+    netavarkTeardown(*nvDownNs)
+  case nvInfoCmd.FullCommand():
+    netavarkInfo()
+  case serveCmd.FullCommand():
+    serve()
+  }
+}
+
+func serve() {
+  if *dsDir == "" {
+    *dsDir = dsDefaultDir
+  }
+  dsPath = *dsDir +  dsFile
   if *debugMode {
     log.SetLevel(log.DebugLevel)
   }
-  d := vdenet.NewDriver(dsPath, *dsClean)
-  h := network.NewHandler(&d)
-  if err := h.ServeUnix("vde", 0); err != nil {
+  if *dsURL == "" {
+    *dsURL = "file://" + dsPath
+  }
+  store, err := datastore.Open(*dsURL, vdenet.Migrations...)
+  if err != nil {
+    log.Fatal(err)
+  }
+  defer store.Close()
+  config := vdenet.Config{
+    Store:     store,
+    Clean:     *dsClean,
+    SwitchDir: *swDir,
+    Scope:     *scope,
+    Host:      *hostName,
+  }
+  if *scope == network.GlobalScope {
+    if *clStore == "" {
+      *clStore = "file://" + *dsDir + clusterFile
+    }
+    if config.Cluster, err = cluster.Open(*clStore); err != nil {
+      log.Fatal(err)
+    }
+    if config.Host == "" {
+      config.Host, _ = os.Hostname()
+    }
+  }
+  ipam := vdeipam.NewDriver(store, *dsClean)
+  if !*dsClean {
+    if err := ipam.Import(*dsDir + ipamFile); err != nil {
+      log.Warnf("IPAM import: [ %s ]", err)
+    }
+  }
+  config.IPAM = ipam
+  d := vdenet.NewDriver(config)
+  var s *plugin.Server
+  if *metricsAt != "" {
+    m := metrics.NewDriver(d)
+    s = plugin.NewServer(m)
+    go serveMetrics(*metricsAt, metrics.Handler(m, func() (map[string]map[string]endpoint.Stats, error) {
+      return d.NetworkStats("")
+    }))
+  } else {
+    s = plugin.NewServer(d)
+  }
+  vdeipam.Register(s, ipam)
+  admin.Register(s, d)
+  done := make(chan struct{})
+  go func() {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+    log.Infof("Signal received: [ %s ]", <-signals)
+    ctx, cancel := context.WithTimeout(context.Background(), *drainTime)
+    if err := s.Shutdown(ctx); err != nil {
+      log.Warnf("Shutdown: [ %s ]", err)
+    }
+    cancel()
+    d.Shutdown(*shutdown)
+    close(done)
+  }()
+  if err := s.ServeUnix("vde", 0); err != nil {
+    log.Fatal(err)
+  }
+  <-done
+}
+
+func serveMetrics(addr string, handler http.Handler) {
+  mux := http.NewServeMux()
+  mux.Handle("/metrics", handler)
+  if err := http.ListenAndServe(addr, mux); err != nil {
     log.Fatal(err)
   }
 }
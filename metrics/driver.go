@@ -0,0 +1,131 @@
+package metrics
+
+import (
+  "sort"
+  "time"
+  "sync"
+  "github.com/docker/go-plugins-helpers/network"
+)
+
+/* Driver decorates a network.Driver with the latency and the errors of each method */
+type Driver struct {
+  network.Driver
+  mutex     sync.Mutex
+  durations map[string]*Histogram
+  errors    map[string]uint64
+}
+
+func NewDriver(driver network.Driver) *Driver {
+  this := &Driver {
+    Driver:    driver,
+    durations: make(map[string]*Histogram),
+    errors:    make(map[string]uint64),
+  }
+  for _, method := range Methods {
+    this.durations[method] = NewHistogram(DefBuckets)
+    this.errors[method] = 0
+  }
+  return this
+}
+
+/* Methods of network.Driver */
+var Methods = []string {
+  "GetCapabilities", "CreateNetwork", "AllocateNetwork", "DeleteNetwork", "FreeNetwork",
+  "CreateEndpoint", "DeleteEndpoint", "EndpointInfo", "Join", "Leave",
+  "DiscoverNew", "DiscoverDelete", "ProgramExternalConnectivity", "RevokeExternalConnectivity",
+}
+
+func (this *Driver) observe(method string, start time.Time, err error) {
+  this.durations[method].Observe(time.Since(start).Seconds())
+  if err != nil {
+    this.mutex.Lock()
+    this.errors[method]++
+    this.mutex.Unlock()
+  }
+}
+
+/* Collect writes the samples of the driver methods */
+func (this *Driver) Collect(w *Writer) {
+  methods := append([]string{}, Methods...)
+  sort.Strings(methods)
+  for _, method := range methods {
+    w.Histogram(Namespace + "_driver_request_duration_seconds", "Duration of the network driver requests.",
+      this.durations[method], Label{ "method", method })
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  for _, method := range methods {
+    w.Counter(Namespace + "_driver_request_errors_total", "Network driver requests failed.",
+      float64(this.errors[method]), Label{ "method", method })
+  }
+}
+
+func (this *Driver) GetCapabilities() (res *network.CapabilitiesResponse, err error) {
+  defer func(start time.Time) { this.observe("GetCapabilities", start, err) }(time.Now())
+  return this.Driver.GetCapabilities()
+}
+
+func (this *Driver) CreateNetwork(r *network.CreateNetworkRequest) (err error) {
+  defer func(start time.Time) { this.observe("CreateNetwork", start, err) }(time.Now())
+  return this.Driver.CreateNetwork(r)
+}
+
+func (this *Driver) AllocateNetwork(r *network.AllocateNetworkRequest) (res *network.AllocateNetworkResponse, err error) {
+  defer func(start time.Time) { this.observe("AllocateNetwork", start, err) }(time.Now())
+  return this.Driver.AllocateNetwork(r)
+}
+
+func (this *Driver) DeleteNetwork(r *network.DeleteNetworkRequest) (err error) {
+  defer func(start time.Time) { this.observe("DeleteNetwork", start, err) }(time.Now())
+  return this.Driver.DeleteNetwork(r)
+}
+
+func (this *Driver) FreeNetwork(r *network.FreeNetworkRequest) (err error) {
+  defer func(start time.Time) { this.observe("FreeNetwork", start, err) }(time.Now())
+  return this.Driver.FreeNetwork(r)
+}
+
+func (this *Driver) CreateEndpoint(r *network.CreateEndpointRequest) (res *network.CreateEndpointResponse, err error) {
+  defer func(start time.Time) { this.observe("CreateEndpoint", start, err) }(time.Now())
+  return this.Driver.CreateEndpoint(r)
+}
+
+func (this *Driver) DeleteEndpoint(r *network.DeleteEndpointRequest) (err error) {
+  defer func(start time.Time) { this.observe("DeleteEndpoint", start, err) }(time.Now())
+  return this.Driver.DeleteEndpoint(r)
+}
+
+func (this *Driver) EndpointInfo(r *network.InfoRequest) (res *network.InfoResponse, err error) {
+  defer func(start time.Time) { this.observe("EndpointInfo", start, err) }(time.Now())
+  return this.Driver.EndpointInfo(r)
+}
+
+func (this *Driver) Join(r *network.JoinRequest) (res *network.JoinResponse, err error) {
+  defer func(start time.Time) { this.observe("Join", start, err) }(time.Now())
+  return this.Driver.Join(r)
+}
+
+func (this *Driver) Leave(r *network.LeaveRequest) (err error) {
+  defer func(start time.Time) { this.observe("Leave", start, err) }(time.Now())
+  return this.Driver.Leave(r)
+}
+
+func (this *Driver) DiscoverNew(r *network.DiscoveryNotification) (err error) {
+  defer func(start time.Time) { this.observe("DiscoverNew", start, err) }(time.Now())
+  return this.Driver.DiscoverNew(r)
+}
+
+func (this *Driver) DiscoverDelete(r *network.DiscoveryNotification) (err error) {
+  defer func(start time.Time) { this.observe("DiscoverDelete", start, err) }(time.Now())
+  return this.Driver.DiscoverDelete(r)
+}
+
+func (this *Driver) ProgramExternalConnectivity(r *network.ProgramExternalConnectivityRequest) (err error) {
+  defer func(start time.Time) { this.observe("ProgramExternalConnectivity", start, err) }(time.Now())
+  return this.Driver.ProgramExternalConnectivity(r)
+}
+
+func (this *Driver) RevokeExternalConnectivity(r *network.RevokeExternalConnectivityRequest) (err error) {
+  defer func(start time.Time) { this.observe("RevokeExternalConnectivity", start, err) }(time.Now())
+  return this.Driver.RevokeExternalConnectivity(r)
+}
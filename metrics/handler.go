@@ -0,0 +1,77 @@
+package metrics
+
+import (
+  "sort"
+  "net/http"
+  "github.com/phocs/vde_plug_docker/endpoint"
+)
+
+/* StatsFunc returns the counters of the endpoints of each network */
+type StatsFunc func() (map[string]map[string]endpoint.Stats, error)
+
+type counter struct {
+  name, help string
+  value      func(st *endpoint.Stats) uint64
+}
+
+var endpointCounters = []counter {
+  { "rx_packets_total", "Frames forwarded from the VDE network to the endpoint.", func(st *endpoint.Stats) uint64 { return st.RxPackets } },
+  { "rx_bytes_total", "Bytes forwarded from the VDE network to the endpoint.", func(st *endpoint.Stats) uint64 { return st.RxBytes } },
+  { "rx_dropped_total", "Frames to the endpoint dropped.", func(st *endpoint.Stats) uint64 { return st.RxDropped } },
+  { "rx_errors_total", "Frames to the endpoint failed.", func(st *endpoint.Stats) uint64 { return st.RxErrors } },
+  { "tx_packets_total", "Frames forwarded from the endpoint to the VDE network.", func(st *endpoint.Stats) uint64 { return st.TxPackets } },
+  { "tx_bytes_total", "Bytes forwarded from the endpoint to the VDE network.", func(st *endpoint.Stats) uint64 { return st.TxBytes } },
+  { "tx_dropped_total", "Frames from the endpoint dropped.", func(st *endpoint.Stats) uint64 { return st.TxDropped } },
+  { "tx_errors_total", "Frames from the endpoint failed.", func(st *endpoint.Stats) uint64 { return st.TxErrors } },
+  { "tx_filtered_total", "Frames from the endpoint with forged sources dropped.", func(st *endpoint.Stats) uint64 { return st.TxFiltered } },
+  { "tx_limited_total", "Frames from the endpoint over its rate limits dropped.", func(st *endpoint.Stats) uint64 { return st.TxLimited } },
+  { "vlan_tagged_total", "Frames from the endpoint tagged with the VLAN of the network.", func(st *endpoint.Stats) uint64 { return st.VLANTagged } },
+  { "vlan_untagged_total", "Frames to the endpoint untagged from the VLAN of the network.", func(st *endpoint.Stats) uint64 { return st.VLANUntagged } },
+  { "vlan_foreign_total", "Frames of the other VLANs dropped.", func(st *endpoint.Stats) uint64 { return st.VLANForeign } },
+  { "tx_gso_total", "TCP super frames from the endpoint sent whole to the GSO peers.", func(st *endpoint.Stats) uint64 { return st.TxGSO } },
+  { "tx_segmented_total", "TCP super frames from the endpoint segmented by the plug.", func(st *endpoint.Stats) uint64 { return st.TxSegmented } },
+  { "plug_reconnects_total", "VDE connections of the endpoint opened again.", func(st *endpoint.Stats) uint64 { return st.Reconnects } },
+}
+
+func sorted(m map[string]map[string]endpoint.Stats) []string {
+  keys := make([]string, 0, len(m))
+  for k := range m {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+/* Handler serves the metrics of driver and of the endpoints returned by stats */
+func Handler(driver *Driver, stats StatsFunc) http.Handler {
+  return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+    networks, err := stats()
+    if err != nil {
+      http.Error(rw, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    rw.Header().Set("Content-Type", ContentType)
+    w := NewWriter(rw)
+    driver.Collect(w)
+    endpoints := 0
+    for _, eps := range networks {
+      endpoints += len(eps)
+    }
+    w.Gauge(Namespace + "_networks", "Networks of the driver.", float64(len(networks)))
+    w.Gauge(Namespace + "_endpoints", "Endpoints of the driver.", float64(endpoints))
+    for _, c := range endpointCounters {
+      for _, netid := range sorted(networks) {
+        epids := make([]string, 0, len(networks[netid]))
+        for epid := range networks[netid] {
+          epids = append(epids, epid)
+        }
+        sort.Strings(epids)
+        for _, epid := range epids {
+          st := networks[netid][epid]
+          w.Counter(Namespace + "_endpoint_" + c.name, c.help, float64(c.value(&st)),
+            Label{ "network", netid }, Label{ "endpoint", epid })
+        }
+      }
+    }
+  })
+}
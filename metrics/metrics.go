@@ -0,0 +1,105 @@
+package metrics
+
+import (
+  "io"
+  "fmt"
+  "sync"
+  "strings"
+  "strconv"
+)
+
+/* Prometheus text exposition format, version 0.0.4 */
+const (
+  ContentType = "text/plain; version=0.0.4; charset=utf-8"
+  Namespace   = "vde_plug_docker"
+)
+
+/* DefBuckets are the upper bounds in seconds of the latency histograms */
+var DefBuckets = []float64{ .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10 }
+
+type Histogram struct {
+  mutex   sync.Mutex
+  Buckets []float64
+  counts  []uint64
+  sum     float64
+  count   uint64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+  return &Histogram{ Buckets: buckets, counts: make([]uint64, len(buckets)) }
+}
+
+func (this *Histogram) Observe(v float64) {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  for i, bound := range this.Buckets {
+    if v <= bound {
+      this.counts[i]++
+    }
+  }
+  this.sum += v
+  this.count++
+}
+
+/* Label is a name="value" pair of a sample */
+type Label struct {
+  Name, Value string
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labels(lbls []Label) string {
+  if len(lbls) == 0 {
+    return ""
+  }
+  pairs := make([]string, len(lbls))
+  for i, l := range lbls {
+    pairs[i] = l.Name + `="` + escaper.Replace(l.Value) + `"`
+  }
+  return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func format(v float64) string {
+  return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+/* Writer writes the families of samples, the header of each once */
+type Writer struct {
+  w    io.Writer
+  seen map[string]bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+  return &Writer{ w: w, seen: make(map[string]bool) }
+}
+
+func (this *Writer) header(name, kind, help string) {
+  if !this.seen[name] {
+    this.seen[name] = true
+    fmt.Fprintf(this.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+  }
+}
+
+func (this *Writer) Counter(name, help string, v float64, lbls ...Label) {
+  this.header(name, "counter", help)
+  fmt.Fprintf(this.w, "%s%s %s\n", name, labels(lbls), format(v))
+}
+
+func (this *Writer) Gauge(name, help string, v float64, lbls ...Label) {
+  this.header(name, "gauge", help)
+  fmt.Fprintf(this.w, "%s%s %s\n", name, labels(lbls), format(v))
+}
+
+func (this *Writer) Histogram(name, help string, h *Histogram, lbls ...Label) {
+  this.header(name, "histogram", help)
+  h.mutex.Lock()
+  defer h.mutex.Unlock()
+  for i, bound := range h.Buckets {
+    le := append(append([]Label{}, lbls...), Label{ "le", format(bound) })
+    fmt.Fprintf(this.w, "%s_bucket%s %d\n", name, labels(le), h.counts[i])
+  }
+  inf := append(append([]Label{}, lbls...), Label{ "le", "+Inf" })
+  fmt.Fprintf(this.w, "%s_bucket%s %d\n", name, labels(inf), h.count)
+  fmt.Fprintf(this.w, "%s_sum%s %s\n", name, labels(lbls), format(h.sum))
+  fmt.Fprintf(this.w, "%s_count%s %d\n", name, labels(lbls), h.count)
+}
@@ -0,0 +1,196 @@
+package nat
+
+import (
+  "net"
+  "errors"
+  "strconv"
+  "os/exec"
+  "strings"
+  log "github.com/Sirupsen/logrus"
+  "github.com/docker/libnetwork/types"
+)
+
+/* Rule is an iptables rule, kept to be removed later, also by another run */
+type Rule struct {
+  IPv6  bool     `json:"IPv6,omitempty"`
+  Table string   `json:"Table"`
+  Chain string   `json:"Chain"`
+  Args  []string `json:"Args"`
+}
+
+var ErrNoHostPort = errors.New("Port binding without a host port")
+
+/* ForwardChain holds the FORWARD rules, it is jumped to after the DOCKER-USER
+   chain, so that the rules of the users are evaluated first */
+const (
+  ForwardChain = "VDE-FORWARD"
+  userChain    = "DOCKER-USER"
+)
+
+/* Commands of the two families, iptables-nft works as well */
+var (
+  IPTables  = "iptables"
+  IP6Tables = "ip6tables"
+)
+
+func (this Rule) String() string {
+  return strings.Join(append([]string{ "-t", this.Table, this.Chain }, this.Args...), " ")
+}
+
+func (this Rule) run(action string) error {
+  cmd := IPTables
+  if this.IPv6 {
+    cmd = IP6Tables
+  }
+  args := append([]string{ "-w", "-t", this.Table, action, this.Chain }, this.Args...)
+  out, err := exec.Command(cmd, args...).CombinedOutput()
+  if err != nil {
+    return errors.New(cmd + " " + strings.Join(args, " ") + ": " + strings.TrimSpace(string(out)))
+  }
+  return nil
+}
+
+/* Exists reports whether the rule is installed */
+func (this Rule) Exists() bool {
+  return this.run("-C") == nil
+}
+
+/* Install adds the rule unless it is there already, creating ForwardChain if needed */
+func (this Rule) Install() error {
+  if this.Exists() {
+    return nil
+  }
+  if this.Table == "filter" && this.Chain == ForwardChain {
+    if err := forwardJump(this.IPv6); err != nil {
+      return err
+    }
+  }
+  return this.run("-A")
+}
+
+/* forwardJump creates ForwardChain and the jump from FORWARD to it, right
+   after the one to DOCKER-USER, first if there is none */
+func forwardJump(ipv6 bool) error {
+  chain := Rule{ IPv6: ipv6, Table: "filter", Chain: ForwardChain }
+  if chain.run("-S") != nil {
+    if err := chain.run("-N"); err != nil {
+      return err
+    }
+  }
+  jump := Rule{ IPv6: ipv6, Table: "filter", Chain: "FORWARD", Args: []string{ "-j", ForwardChain } }
+  if jump.Exists() {
+    return nil
+  }
+  cmd := IPTables
+  if ipv6 {
+    cmd = IP6Tables
+  }
+  out, err := exec.Command(cmd, "-w", "-t", "filter", "-S", "FORWARD").Output()
+  if err != nil {
+    return errors.New(cmd + " -S FORWARD: " + err.Error())
+  }
+  /* The first line is the policy, the rules are numbered from 1 */
+  pos := 1
+  for i, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+    if strings.TrimSpace(line) == "-A FORWARD -j " + userChain {
+      pos = i + 1
+      break
+    }
+  }
+  jump.Args = append([]string{ strconv.Itoa(pos) }, jump.Args...)
+  return jump.run("-I")
+}
+
+/* Remove deletes the rule, it succeeds if it is gone already */
+func (this Rule) Remove() error {
+  if !this.Exists() {
+    return nil
+  }
+  return this.run("-D")
+}
+
+/* InstallAll installs rules, on error the ones already installed are removed */
+func InstallAll(rules []Rule) error {
+  for i, r := range rules {
+    if err := r.Install(); err != nil {
+      RemoveAll(rules[:i])
+      return err
+    }
+  }
+  return nil
+}
+
+func RemoveAll(rules []Rule) {
+  for _, r := range rules {
+    if err := r.Remove(); err != nil {
+      log.Warnf("NAT remove [ %s ]: [ %s ]", r, err)
+    }
+  }
+}
+
+/* Masquerade returns the rules of the outbound traffic of subnet, through
+   the host interface ifname: it is forwarded and its source translated */
+func Masquerade(subnet, ifname string) ([]Rule, error) {
+  ip, ipnet, err := net.ParseCIDR(subnet)
+  if err != nil {
+    return nil, err
+  }
+  ipv6 := ip.To4() == nil
+  comment := []string{ "-m", "comment", "--comment", "vde " + ifname }
+  return []Rule{
+    { IPv6: ipv6, Table: "filter", Chain: ForwardChain, Args: append([]string{ "-i", ifname, "-j", "ACCEPT" }, comment...) },
+    { IPv6: ipv6, Table: "filter", Chain: ForwardChain, Args: append([]string{ "-o", ifname, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT" }, comment...) },
+    { IPv6: ipv6, Table: "nat", Chain: "POSTROUTING", Args: append([]string{ "-s", ipnet.String(), "!", "-o", ifname, "-j", "MASQUERADE" }, comment...) },
+  }, nil
+}
+
+func protocol(p types.Protocol) (string, error) {
+  switch p {
+  case types.TCP, types.UDP, types.SCTP:
+    return p.String(), nil
+  }
+  return "", errors.New("Unsupported protocol " + strconv.Itoa(int(p)))
+}
+
+/* Publish returns the rules that forward the host port of pb to the port of
+   the container at address, reached through the host interface ifname */
+func Publish(pb types.PortBinding, address, ifname string) ([]Rule, error) {
+  proto, err := protocol(pb.Proto)
+  if err != nil {
+    return nil, err
+  }
+  if pb.HostPort == 0 {
+    return nil, ErrNoHostPort
+  }
+  ip := net.ParseIP(address)
+  if ip == nil {
+    return nil, errors.New("Invalid address " + address)
+  }
+  ipv6 := ip.To4() == nil
+  if pb.HostIP != nil && !pb.HostIP.IsUnspecified() && (pb.HostIP.To4() == nil) != ipv6 {
+    return nil, nil
+  }
+  port := []string{ "-p", proto, "-m", proto, "--dport", strconv.Itoa(int(pb.HostPort)) }
+  dst := []string{ "-m", "addrtype", "--dst-type", "LOCAL" }
+  /* The loopback addresses are not routed to the containers */
+  loopback := "127.0.0.0/8"
+  if ipv6 {
+    loopback = "::1/128"
+  }
+  local := append([]string{ "!", "-d", loopback }, dst...)
+  if pb.HostIP != nil && !pb.HostIP.IsUnspecified() {
+    if pb.HostIP.IsLoopback() {
+      return nil, errors.New("Unsupported loopback host address " + pb.HostIP.String())
+    }
+    dst = []string{ "-d", pb.HostIP.String() }
+    local = dst
+  }
+  to := net.JoinHostPort(ip.String(), strconv.Itoa(int(pb.Port)))
+  comment := []string{ "-m", "comment", "--comment", "vde " + ifname }
+  dnat := append(append(append([]string{}, port...), "-j", "DNAT", "--to-destination", to), comment...)
+  return []Rule{
+    { IPv6: ipv6, Table: "nat", Chain: "PREROUTING", Args: append(append([]string{}, dst...), dnat...) },
+    { IPv6: ipv6, Table: "nat", Chain: "OUTPUT", Args: append(append([]string{}, local...), dnat...) },
+    { IPv6: ipv6, Table: "filter", Chain: ForwardChain, Args: append([]string{ "-d", ip.String(), "-o", ifname, "-p", proto, "-m", proto, "--dport", strconv.Itoa(int(pb.Port)), "-j", "ACCEPT" }, comment...) },
+  }, nil
+}
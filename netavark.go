@@ -0,0 +1,244 @@
+package main
+
+import (
+  "os"
+  "net"
+  "io/ioutil"
+  "encoding/json"
+  "github.com/phocs/vde_plug_docker/admin"
+  "github.com/phocs/vde_plug_docker/vdenet"
+  "github.com/phocs/vde_plug_docker/endpoint"
+  "github.com/docker/go-plugins-helpers/network"
+)
+
+/* Podman runs the netavark plugin of a driver by its name: installed as
+   .../netavark-plugins/vde, this binary works as "vde_plug_docker netavark" */
+const (
+  netavarkPlugin     = "vde"
+  netavarkAPIVersion = "1.0.0"
+)
+
+/* Set at build time with -ldflags "-X main.version=..." */
+var version = "dev"
+
+/* nvNetwork is the network definition of Podman, only the fields used here */
+type nvNetwork struct {
+  Name     string            `json:"name"`
+  ID       string            `json:"id"`
+  Driver   string            `json:"driver"`
+  Subnets  []nvSubnet        `json:"subnets"`
+  Routes   []nvRoute         `json:"routes"`
+  Internal bool              `json:"internal"`
+  Options  map[string]string `json:"options"`
+}
+
+type nvSubnet struct {
+  Subnet  string `json:"subnet"`
+  Gateway string `json:"gateway"`
+}
+
+type nvRoute struct {
+  Destination string `json:"destination"`
+  Gateway     string `json:"gateway"`
+}
+
+/* nvExec is the input of setup and teardown */
+type nvExec struct {
+  ContainerID    string    `json:"container_id"`
+  ContainerName  string    `json:"container_name"`
+  Network        nvNetwork `json:"network"`
+  NetworkOptions nvOptions `json:"network_options"`
+}
+
+/* nvOptions are the settings of the container in the network */
+type nvOptions struct {
+  StaticIPs     []string `json:"static_ips"`
+  InterfaceName string   `json:"interface_name"`
+  StaticMac     string   `json:"static_mac"`
+  Aliases       []string `json:"aliases"`
+}
+
+type nvNetAddress struct {
+  IPNet   string `json:"ipnet"`
+  Gateway string `json:"gateway,omitempty"`
+}
+
+type nvInterface struct {
+  MacAddress string         `json:"mac_address"`
+  Subnets    []nvNetAddress `json:"subnets"`
+}
+
+/* nvStatus is the output of setup */
+type nvStatus struct {
+  DNSSearchDomains []string               `json:"dns_search_domains"`
+  DNSServerIPs     []string               `json:"dns_server_ips"`
+  Interfaces       map[string]nvInterface `json:"interfaces"`
+}
+
+type nvInfo struct {
+  Version    string `json:"version"`
+  APIVersion string `json:"api_version"`
+}
+
+type nvError struct {
+  Error string `json:"error"`
+}
+
+/* shared returns the Docker network that nw joins with -o network=<ID prefix>, if any */
+func (this *nvNetwork) shared() string {
+  return this.Options["network"]
+}
+
+/* request maps nw on the CreateNetworkRequest of Docker, the gateways in CIDR form */
+func (this *nvNetwork) request() (*network.CreateNetworkRequest, error) {
+  opt := make(map[string]interface{})
+  for key, value := range this.Options {
+    opt[key] = value
+  }
+  r := &network.CreateNetworkRequest{
+    NetworkID: this.ID,
+    Options:   map[string]interface{}{ "com.docker.network.generic": opt },
+  }
+  for _, sn := range this.Subnets {
+    _, ipnet, err := net.ParseCIDR(sn.Subnet)
+    if err != nil {
+      return nil, err
+    }
+    data := &network.IPAMData{ Pool: ipnet.String() }
+    if sn.Gateway != "" {
+      ones, _ := ipnet.Mask.Size()
+      data.Gateway = (&net.IPNet{ IP: net.ParseIP(sn.Gateway), Mask: net.CIDRMask(ones, len(ipnet.Mask) * 8) }).String()
+    }
+    if ipnet.IP.To4() != nil {
+      r.IPv4Data = append(r.IPv4Data, data)
+    } else {
+      r.IPv6Data = append(r.IPv6Data, data)
+    }
+  }
+  return r, nil
+}
+
+func nvFail(err error) {
+  json.NewEncoder(os.Stdout).Encode(&nvError{ Error: err.Error() })
+  os.Exit(1)
+}
+
+func nvRead(v interface{}) []byte {
+  buf, err := ioutil.ReadAll(os.Stdin)
+  if err == nil {
+    err = json.Unmarshal(buf, v)
+  }
+  if err != nil {
+    nvFail(err)
+  }
+  return buf
+}
+
+/* nvEnsure defines nw in the plugin, unless it joins a Docker network */
+func nvEnsure(client *admin.Client, nw *nvNetwork) error {
+  if nw.shared() != "" {
+    return nil
+  }
+  r, err := nw.request()
+  if err != nil {
+    return err
+  }
+  return client.EnsureNetwork((*admin.EnsureNetworkRequest)(r))
+}
+
+/* netavarkCreate validates the network, which is returned unchanged */
+func netavarkCreate() {
+  nw := &nvNetwork{}
+  buf := nvRead(nw)
+  if err := nvEnsure(admin.NewClient(unixSock), nw); err != nil {
+    nvFail(err)
+  }
+  os.Stdout.Write(buf)
+}
+
+/* netavarkSetup creates the endpoint of the container and moves its tap into netns */
+func netavarkSetup(netns string) {
+  in := &nvExec{}
+  nvRead(in)
+  client := admin.NewClient(unixSock)
+  if err := nvEnsure(client, &in.Network); err != nil {
+    nvFail(err)
+  }
+  req := &vdenet.AttachRequest{
+    NetworkID:  in.Network.ID,
+    EndpointID: in.ContainerID,
+    SandboxKey: netns,
+    IfName:     in.NetworkOptions.InterfaceName,
+    MacAddress: in.NetworkOptions.StaticMac,
+  }
+  if in.Network.shared() != "" {
+    req.NetworkID = in.Network.shared()
+  }
+  if in.ContainerName != "" {
+    req.Names = append(req.Names, in.ContainerName)
+  }
+  req.Names = append(req.Names, in.NetworkOptions.Aliases...)
+  iface := nvInterface{ Subnets: []nvNetAddress{} }
+  defaults := make(map[string]bool)
+  for _, sn := range in.Network.Subnets {
+    _, ipnet, err := net.ParseCIDR(sn.Subnet)
+    if err != nil {
+      nvFail(err)
+    }
+    for _, addr := range in.NetworkOptions.StaticIPs {
+      ip := net.ParseIP(addr)
+      if ip == nil || !ipnet.Contains(ip) {
+        continue
+      }
+      cidr := (&net.IPNet{ IP: ip, Mask: ipnet.Mask }).String()
+      req.Addresses = append(req.Addresses, cidr)
+      iface.Subnets = append(iface.Subnets, nvNetAddress{ IPNet: cidr, Gateway: sn.Gateway })
+      /* A default route for each family, through the first gateway reachable */
+      dst := "0.0.0.0/0"
+      if ip.To4() == nil {
+        dst = "::/0"
+      }
+      if sn.Gateway != "" && !in.Network.Internal && !defaults[dst] {
+        defaults[dst] = true
+        req.Routes = append(req.Routes, endpoint.Route{ Destination: dst, Gateway: sn.Gateway })
+      }
+    }
+  }
+  for _, route := range in.Network.Routes {
+    req.Routes = append(req.Routes, endpoint.Route{ Destination: route.Destination, Gateway: route.Gateway })
+  }
+  res, err := client.Attach(req)
+  if err != nil {
+    nvFail(err)
+  }
+  iface.MacAddress = res.MacAddress
+  status := &nvStatus{
+    DNSSearchDomains: []string{},
+    DNSServerIPs:     []string{},
+    Interfaces:       map[string]nvInterface{ in.NetworkOptions.InterfaceName: iface },
+  }
+  if res.DNS != "" {
+    status.DNSServerIPs = append(status.DNSServerIPs, res.DNS)
+  }
+  if res.DNSDomain != "" {
+    status.DNSSearchDomains = append(status.DNSSearchDomains, res.DNSDomain)
+  }
+  json.NewEncoder(os.Stdout).Encode(status)
+}
+
+/* netavarkTeardown deletes the endpoint of the container, the tap is in the netns */
+func netavarkTeardown(netns string) {
+  in := &nvExec{}
+  nvRead(in)
+  netid := in.Network.ID
+  if in.Network.shared() != "" {
+    netid = in.Network.shared()
+  }
+  if err := admin.NewClient(unixSock).Detach(netid, in.ContainerID); err != nil {
+    nvFail(err)
+  }
+}
+
+func netavarkInfo() {
+  json.NewEncoder(os.Stdout).Encode(&nvInfo{ Version: version, APIVersion: netavarkAPIVersion })
+}
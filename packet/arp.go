@@ -0,0 +1,64 @@
+package packet
+
+import (
+  "net"
+  "encoding/binary"
+)
+
+const (
+  ARPLen     = 28
+  ARPRequest = 1
+  ARPReply   = 2
+)
+
+/* ARP is an Ethernet/IPv4 ARP packet (RFC 826) */
+type ARP []byte
+
+func ParseARP(b []byte) (ARP, bool) {
+  if len(b) < ARPLen || binary.BigEndian.Uint16(b[0:2]) != 1 || binary.BigEndian.Uint16(b[2:4]) != EtherTypeIPv4 || b[4] != 6 || b[5] != 4 {
+    return nil, false
+  }
+  return ARP(b[:ARPLen]), true
+}
+
+func (this ARP) Op() uint16 {
+  return binary.BigEndian.Uint16(this[6:8])
+}
+
+func (this ARP) SenderMAC() net.HardwareAddr {
+  return net.HardwareAddr(this[8:14])
+}
+
+func (this ARP) SenderIP() net.IP {
+  return net.IP(this[14:18])
+}
+
+func (this ARP) TargetMAC() net.HardwareAddr {
+  return net.HardwareAddr(this[18:24])
+}
+
+func (this ARP) TargetIP() net.IP {
+  return net.IP(this[24:28])
+}
+
+/* NewARP returns an Ethernet frame with an ARP packet, to the sender of a
+   request for a reply, broadcast for a request */
+func NewARP(op uint16, srcmac net.HardwareAddr, src net.IP, dstmac net.HardwareAddr, dst net.IP) Ethernet {
+  ethdst := dstmac
+  if op == ARPRequest {
+    ethdst = Broadcast
+  }
+  frame := NewEthernet(ethdst, srcmac, EtherTypeARP, ARPLen)
+  arp := frame[EthernetHeaderLen:]
+  binary.BigEndian.PutUint16(arp[0:2], 1)
+  binary.BigEndian.PutUint16(arp[2:4], EtherTypeIPv4)
+  arp[4], arp[5] = 6, 4
+  binary.BigEndian.PutUint16(arp[6:8], op)
+  copy(arp[8:14], srcmac)
+  copy(arp[14:18], src.To4())
+  if op == ARPReply {
+    copy(arp[18:24], dstmac)
+  }
+  copy(arp[24:28], dst.To4())
+  return frame
+}
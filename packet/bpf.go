@@ -0,0 +1,301 @@
+package packet
+
+import (
+  "fmt"
+  "errors"
+  "strings"
+  "strconv"
+  "encoding/binary"
+)
+
+/* Classic BPF, the filters of tcpdump and SO_ATTACH_FILTER, see
+   include/uapi/linux/filter.h and bpf_common.h */
+const (
+  bpfLD   = 0x00
+  bpfLDX  = 0x01
+  bpfST   = 0x02
+  bpfSTX  = 0x03
+  bpfALU  = 0x04
+  bpfJMP  = 0x05
+  bpfRET  = 0x06
+  bpfMISC = 0x07
+
+  bpfW    = 0x00
+  bpfH    = 0x08
+  bpfB    = 0x10
+
+  bpfIMM  = 0x00
+  bpfABS  = 0x20
+  bpfIND  = 0x40
+  bpfMEM  = 0x60
+  bpfLEN  = 0x80
+  bpfMSH  = 0xa0
+
+  bpfADD  = 0x00
+  bpfSUB  = 0x10
+  bpfMUL  = 0x20
+  bpfDIV  = 0x30
+  bpfOR   = 0x40
+  bpfAND  = 0x50
+  bpfLSH  = 0x60
+  bpfRSH  = 0x70
+  bpfNEG  = 0x80
+  bpfMOD  = 0x90
+  bpfXOR  = 0xa0
+
+  bpfJA   = 0x00
+  bpfJEQ  = 0x10
+  bpfJGT  = 0x20
+  bpfJGE  = 0x30
+  bpfJSET = 0x40
+
+  bpfK    = 0x00
+  bpfX    = 0x08
+  bpfA    = 0x10
+
+  bpfTAX  = 0x00
+  bpfTXA  = 0x80
+
+  bpfMemWords = 16
+  bpfMaxLen   = 4096
+)
+
+var ErrBPFProgram = errors.New("Invalid BPF program")
+
+type BPFInstruction struct {
+  Code uint16
+  Jt   uint8
+  Jf   uint8
+  K    uint32
+}
+
+/* BPF is a classic BPF program for Ethernet frames */
+type BPF []BPFInstruction
+
+/* ParseBPF reads a program in the format of tcpdump -ddd and of the iptables
+   bpf match: the number of instructions, then "code jt jf k" for each one,
+   separated by commas or new lines */
+func ParseBPF(text string) (BPF, error) {
+  fields := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' })
+  if len(fields) == 0 {
+    return nil, ErrBPFProgram
+  }
+  count, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+  if err != nil || count != len(fields) - 1 {
+    return nil, ErrBPFProgram
+  }
+  prog := make(BPF, count)
+  for i, field := range fields[1:] {
+    var code, jt, jf, k uint64
+    if n, _ := fmt.Sscan(field, &code, &jt, &jf, &k); n != 4 || code > 0xffff || jt > 0xff || jf > 0xff || k > 0xffffffff {
+      return nil, fmt.Errorf("%s: instruction %d", ErrBPFProgram, i)
+    }
+    prog[i] = BPFInstruction{ Code: uint16(code), Jt: uint8(jt), Jf: uint8(jf), K: uint32(k) }
+  }
+  return prog, prog.Validate()
+}
+
+/* String is the format read by ParseBPF */
+func (this BPF) String() string {
+  fields := []string{ strconv.Itoa(len(this)) }
+  for _, ins := range this {
+    fields = append(fields, fmt.Sprintf("%d %d %d %d", ins.Code, ins.Jt, ins.Jf, ins.K))
+  }
+  return strings.Join(fields, ",")
+}
+
+/* Validate checks a program as sk_chk_filter does: the jumps stay inside, it
+   ends with a return and it has no unknown instructions */
+func (this BPF) Validate() error {
+  if len(this) == 0 || len(this) > bpfMaxLen {
+    return ErrBPFProgram
+  }
+  for pc, ins := range this {
+    bad := false
+    switch ins.Code & 0x07 {
+    case bpfLD, bpfLDX:
+      switch ins.Code & 0xe0 {
+      case bpfMEM:
+        bad = ins.K >= bpfMemWords
+      case bpfIMM, bpfLEN:
+      case bpfABS, bpfIND:
+        bad = ins.Code & 0x07 == bpfLDX || ins.Code & 0x18 == 0x18
+      case bpfMSH:
+        bad = ins.Code & 0x07 == bpfLD
+      default:
+        bad = true
+      }
+    case bpfST, bpfSTX:
+      bad = ins.K >= bpfMemWords
+    case bpfALU:
+      switch ins.Code & 0xf0 {
+      case bpfDIV, bpfMOD:
+        bad = ins.Code & bpfX == bpfK && ins.K == 0
+      case bpfADD, bpfSUB, bpfMUL, bpfOR, bpfAND, bpfLSH, bpfRSH, bpfNEG, bpfXOR:
+      default:
+        bad = true
+      }
+    case bpfJMP:
+      rest := uint64(len(this) - pc - 1)
+      switch ins.Code & 0xf0 {
+      case bpfJA:
+        bad = uint64(ins.K) >= rest
+      case bpfJEQ, bpfJGT, bpfJGE, bpfJSET:
+        bad = uint64(ins.Jt) >= rest || uint64(ins.Jf) >= rest
+      default:
+        bad = true
+      }
+    case bpfRET:
+      bad = ins.Code & 0x18 != bpfK && ins.Code & 0x18 != bpfA
+    case bpfMISC:
+      bad = ins.Code & 0xf8 != bpfTAX && ins.Code & 0xf8 != bpfTXA
+    }
+    if bad {
+      return fmt.Errorf("%s: instruction %d", ErrBPFProgram, pc)
+    }
+  }
+  if this[len(this) - 1].Code & 0x07 != bpfRET {
+    return fmt.Errorf("%s: no final return", ErrBPFProgram)
+  }
+  return nil
+}
+
+/* bpfLoad reads a word, half word or byte of frame at off, false past its end */
+func bpfLoad(frame []byte, off uint32, size uint16) (uint32, bool) {
+  end := uint64(off)
+  switch size {
+  case bpfW:
+    end += 4
+  case bpfH:
+    end += 2
+  default:
+    end += 1
+  }
+  if end > uint64(len(frame)) {
+    return 0, false
+  }
+  switch size {
+  case bpfW:
+    return binary.BigEndian.Uint32(frame[off:]), true
+  case bpfH:
+    return uint32(binary.BigEndian.Uint16(frame[off:])), true
+  }
+  return uint32(frame[off]), true
+}
+
+/* Run returns the bytes of frame the program keeps, 0 if it rejects it. A
+   load past the end rejects the frame, as in the kernel; the ancillary
+   data of the kernel (e.g. the VLAN of the skb) is not there, the tags of
+   the frames on a VDE network are in the frames. The program is valid. */
+func (this BPF) Run(frame []byte) uint32 {
+  var a, x uint32
+  var mem [bpfMemWords]uint32
+  for pc := 0; pc < len(this); pc++ {
+    ins := this[pc]
+    class := ins.Code & 0x07
+    switch class {
+    case bpfLD, bpfLDX:
+      var v uint32
+      ok := true
+      switch ins.Code & 0xe0 {
+      case bpfIMM:
+        v = ins.K
+      case bpfLEN:
+        v = uint32(len(frame))
+      case bpfMEM:
+        v = mem[ins.K]
+      case bpfABS:
+        v, ok = bpfLoad(frame, ins.K, ins.Code & 0x18)
+      case bpfIND:
+        v, ok = bpfLoad(frame, x + ins.K, ins.Code & 0x18)
+      case bpfMSH:
+        var b uint32
+        b, ok = bpfLoad(frame, ins.K, bpfB)
+        v = (b & 0x0f) * 4
+      }
+      if !ok {
+        return 0
+      }
+      if class == bpfLD {
+        a = v
+      } else {
+        x = v
+      }
+    case bpfST:
+      mem[ins.K] = a
+    case bpfSTX:
+      mem[ins.K] = x
+    case bpfALU:
+      v := ins.K
+      if ins.Code & bpfX != 0 {
+        v = x
+      }
+      switch ins.Code & 0xf0 {
+      case bpfADD:
+        a += v
+      case bpfSUB:
+        a -= v
+      case bpfMUL:
+        a *= v
+      case bpfDIV:
+        if v == 0 {
+          return 0
+        }
+        a /= v
+      case bpfMOD:
+        if v == 0 {
+          return 0
+        }
+        a %= v
+      case bpfOR:
+        a |= v
+      case bpfAND:
+        a &= v
+      case bpfXOR:
+        a ^= v
+      case bpfLSH:
+        a <<= v
+      case bpfRSH:
+        a >>= v
+      case bpfNEG:
+        a = -a
+      }
+    case bpfJMP:
+      v := ins.K
+      if ins.Code & bpfX != 0 {
+        v = x
+      }
+      var cond bool
+      switch ins.Code & 0xf0 {
+      case bpfJA:
+        pc += int(ins.K)
+        continue
+      case bpfJEQ:
+        cond = a == v
+      case bpfJGT:
+        cond = a > v
+      case bpfJGE:
+        cond = a >= v
+      case bpfJSET:
+        cond = a & v != 0
+      }
+      if cond {
+        pc += int(ins.Jt)
+      } else {
+        pc += int(ins.Jf)
+      }
+    case bpfRET:
+      if ins.Code & 0x18 == bpfA {
+        return a
+      }
+      return ins.K
+    case bpfMISC:
+      if ins.Code & 0xf8 == bpfTXA {
+        a = x
+      } else {
+        x = a
+      }
+    }
+  }
+  return 0
+}
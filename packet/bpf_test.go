@@ -0,0 +1,194 @@
+package packet
+
+import (
+  "strings"
+  "testing"
+)
+
+/* tcpdump -y EN10MB -ddd 'icmp or arp' */
+const bpfICMPOrARP = `7
+40 0 0 12
+21 0 2 2048
+48 0 0 23
+21 1 2 1
+21 0 1 2054
+6 0 0 262144
+6 0 0 0
+`
+
+/* 'tcp port 80' of IPv4, with the fragments and the IP options */
+const bpfTCP80 = `13
+40 0 0 12
+21 0 9 2048
+48 0 0 23
+21 0 7 6
+40 0 0 20
+69 5 0 8191
+177 0 0 14
+72 0 0 14
+21 3 0 80
+72 0 0 16
+21 1 0 80
+6 0 0 0
+6 0 0 262144
+`
+
+func mustBPF(t *testing.T, text string) BPF {
+  prog, err := ParseBPF(text)
+  if err != nil {
+    t.Fatalf("%q: %s", text, err)
+  }
+  return prog
+}
+
+/* ipv4Frame is an IPv4 frame of proto, with ihl words of header, from sport to dport */
+func ipv4Frame(proto byte, ihl int, sport, dport uint16) []byte {
+  frame := make([]byte, EthernetHeaderLen + ihl * 4 + 20)
+  frame[12], frame[13] = 0x08, 0x00
+  ip := frame[EthernetHeaderLen:]
+  ip[0], ip[9] = 0x40 | byte(ihl), proto
+  l4 := ip[ihl*4:]
+  l4[0], l4[1], l4[2], l4[3] = byte(sport >> 8), byte(sport), byte(dport >> 8), byte(dport)
+  return frame
+}
+
+func TestBPFRoundTrip(t *testing.T) {
+  for _, text := range []string{ bpfICMPOrARP, bpfTCP80, "1\n6 0 0 65535\n", "2,0 0 0 7,22 0 0 0" } {
+    prog := mustBPF(t, text)
+    want := strings.Replace(strings.TrimSpace(text), "\n", ",", -1)
+    if got := prog.String(); got != want {
+      t.Errorf("String %q, want %q", got, want)
+    }
+    again := mustBPF(t, prog.String())
+    if len(again) != len(prog) {
+      t.Fatalf("%q parsed again: %d instructions", text, len(again))
+    }
+    for i := range prog {
+      if again[i] != prog[i] {
+        t.Errorf("%q parsed again: instruction %d %+v, want %+v", text, i, again[i], prog[i])
+      }
+    }
+  }
+}
+
+func TestParseBPFErrors(t *testing.T) {
+  for _, text := range []string{
+    "",
+    "ip or arp",
+    "2\n6 0 0 0\n",
+    "1\n6 0 0\n",
+    "1\n6 0 0 x\n",
+    "1\n65536 0 0 0\n",
+    "1\n6 256 0 0\n",
+    "1\n6 0 0 4294967296\n",
+    "1\n21 0 0 0\n",
+  } {
+    if _, err := ParseBPF(text); err == nil {
+      t.Errorf("%q: no error", text)
+    }
+  }
+}
+
+func TestBPFValidate(t *testing.T) {
+  ret := BPFInstruction{ Code: bpfRET | bpfK, K: 0xffff }
+  for _, tc := range []struct {
+    name string
+    prog BPF
+    ok   bool
+  } {
+    { "return", BPF{ ret }, true },
+    { "empty", BPF{}, false },
+    { "too long", make(BPF, bpfMaxLen + 1), false },
+    { "no final return", BPF{ ret, { Code: bpfLD | bpfIMM, K: 1 } }, false },
+    { "ja to the last", BPF{ { Code: bpfJMP | bpfJA, K: 1 }, ret, ret }, true },
+    { "ja past the end", BPF{ { Code: bpfJMP | bpfJA, K: 2 }, ret, ret }, false },
+    { "ja far past the end", BPF{ { Code: bpfJMP | bpfJA, K: 0xffffffff }, ret }, false },
+    { "jt to the last", BPF{ { Code: bpfJMP | bpfJEQ | bpfK, Jt: 1 }, ret, ret }, true },
+    { "jt past the end", BPF{ { Code: bpfJMP | bpfJEQ | bpfK, Jt: 2 }, ret, ret }, false },
+    { "jf past the end", BPF{ { Code: bpfJMP | bpfJGT | bpfX, Jf: 1 }, ret }, false },
+    { "jset past the end", BPF{ { Code: bpfJMP | bpfJSET | bpfK, Jt: 255 }, ret }, false },
+    { "unknown jump", BPF{ { Code: bpfJMP | 0x50 }, ret }, false },
+    { "ld mem", BPF{ { Code: bpfLD | bpfMEM, K: bpfMemWords - 1 }, ret }, true },
+    { "ld mem out of range", BPF{ { Code: bpfLD | bpfMEM, K: bpfMemWords }, ret }, false },
+    { "st out of range", BPF{ { Code: bpfST, K: bpfMemWords }, ret }, false },
+    { "ldx abs", BPF{ { Code: bpfLDX | bpfW | bpfABS }, ret }, false },
+    { "ld msh", BPF{ { Code: bpfLD | bpfB | bpfMSH }, ret }, false },
+    { "ld unknown mode", BPF{ { Code: bpfLD | 0xe0 }, ret }, false },
+    { "ld unknown size", BPF{ { Code: bpfLD | 0x18 | bpfABS }, ret }, false },
+    { "div by zero", BPF{ { Code: bpfALU | bpfDIV | bpfK }, ret }, false },
+    { "mod by zero", BPF{ { Code: bpfALU | bpfMOD | bpfK }, ret }, false },
+    { "div by x", BPF{ { Code: bpfALU | bpfDIV | bpfX }, ret }, true },
+    { "unknown alu", BPF{ { Code: bpfALU | 0xb0 }, ret }, false },
+    { "ret x", BPF{ { Code: bpfRET | bpfX } }, false },
+    { "unknown misc", BPF{ { Code: bpfMISC | 0x40 }, ret }, false },
+  } {
+    if err := tc.prog.Validate(); (err == nil) != tc.ok {
+      t.Errorf("%s: %v", tc.name, err)
+    }
+  }
+}
+
+func TestBPFRun(t *testing.T) {
+  icmpOrARP, tcp80 := mustBPF(t, bpfICMPOrARP), mustBPF(t, bpfTCP80)
+  arp := make([]byte, 42)
+  arp[12], arp[13] = 0x08, 0x06
+  fragment := ipv4Frame(ProtoTCP, 5, 80, 1234)
+  fragment[EthernetHeaderLen + 7] = 1
+  for _, tc := range []struct {
+    name  string
+    prog  BPF
+    frame []byte
+    want  uint32
+  } {
+    { "arp", icmpOrARP, arp, 262144 },
+    { "icmp", icmpOrARP, ipv4Frame(ProtoICMP, 5, 0, 0), 262144 },
+    { "udp", icmpOrARP, ipv4Frame(ProtoUDP, 5, 53, 53), 0 },
+    { "short icmp", icmpOrARP, ipv4Frame(ProtoICMP, 5, 0, 0)[:23], 0 },
+    { "no ethertype", icmpOrARP, arp[:13], 0 },
+    { "tcp dst 80", tcp80, ipv4Frame(ProtoTCP, 5, 1234, 80), 262144 },
+    { "tcp src 80", tcp80, ipv4Frame(ProtoTCP, 5, 80, 1234), 262144 },
+    { "tcp with options", tcp80, ipv4Frame(ProtoTCP, 7, 1234, 80), 262144 },
+    { "tcp 8080", tcp80, ipv4Frame(ProtoTCP, 5, 1234, 8080), 0 },
+    { "udp 80", tcp80, ipv4Frame(ProtoUDP, 5, 1234, 80), 0 },
+    { "fragment", tcp80, fragment, 0 },
+    /* The ports are past the end */
+    { "tcp cut after the source port", tcp80, ipv4Frame(ProtoTCP, 5, 80, 1234)[:EthernetHeaderLen + 22], 262144 },
+    { "tcp cut in the source port", tcp80, ipv4Frame(ProtoTCP, 5, 80, 1234)[:EthernetHeaderLen + 21], 0 },
+    { "tcp cut in the destination port", tcp80, ipv4Frame(ProtoTCP, 5, 1234, 80)[:EthernetHeaderLen + 23], 0 },
+    { "tcp options past the end", tcp80, ipv4Frame(ProtoTCP, 15, 1234, 80)[:EthernetHeaderLen + 40], 0 },
+  } {
+    if got := tc.prog.Run(tc.frame); got != tc.want {
+      t.Errorf("%s: %d, want %d", tc.name, got, tc.want)
+    }
+  }
+}
+
+/* The loads past the end of the frame reject it, whatever follows */
+func TestBPFRunOutOfBounds(t *testing.T) {
+  accept := BPFInstruction{ Code: bpfRET | bpfK, K: 1 }
+  frame := make([]byte, 20)
+  for _, tc := range []struct {
+    name string
+    prog BPF
+    want uint32
+  } {
+    { "ld word at the end", BPF{ { Code: bpfLD | bpfW | bpfABS, K: 16 }, accept }, 1 },
+    { "ld word past the end", BPF{ { Code: bpfLD | bpfW | bpfABS, K: 17 }, accept }, 0 },
+    { "ld half past the end", BPF{ { Code: bpfLD | bpfH | bpfABS, K: 19 }, accept }, 0 },
+    { "ld byte at the end", BPF{ { Code: bpfLD | bpfB | bpfABS, K: 19 }, accept }, 1 },
+    { "ld byte past the end", BPF{ { Code: bpfLD | bpfB | bpfABS, K: 20 }, accept }, 0 },
+    { "ld word at the last offset", BPF{ { Code: bpfLD | bpfW | bpfABS, K: 0xffffffff }, accept }, 0 },
+    { "ld ind past the end", BPF{ { Code: bpfLDX | bpfIMM, K: 18 }, { Code: bpfLD | bpfH | bpfIND, K: 1 }, accept }, 0 },
+    { "ld ind at the end", BPF{ { Code: bpfLDX | bpfIMM, K: 18 }, { Code: bpfLD | bpfH | bpfIND }, accept }, 1 },
+    { "ld ind far past the end", BPF{ { Code: bpfLDX | bpfIMM, K: 0x7fffffff }, { Code: bpfLD | bpfB | bpfIND, K: 0x7fffffff }, accept }, 0 },
+    { "ldx msh past the end", BPF{ { Code: bpfLDX | bpfB | bpfMSH, K: 20 }, accept }, 0 },
+    { "ret len", BPF{ { Code: bpfLD | bpfLEN }, { Code: bpfRET | bpfA } }, 20 },
+    { "div by x zero", BPF{ { Code: bpfLD | bpfIMM, K: 1 }, { Code: bpfALU | bpfDIV | bpfX }, accept }, 0 },
+  } {
+    if err := tc.prog.Validate(); err != nil {
+      t.Errorf("%s: %s", tc.name, err)
+    } else if got := tc.prog.Run(frame); got != tc.want {
+      t.Errorf("%s: %d, want %d", tc.name, got, tc.want)
+    }
+  }
+}
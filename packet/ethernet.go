@@ -0,0 +1,67 @@
+package packet
+
+import (
+  "net"
+  "encoding/binary"
+)
+
+/* Helpers to read and build the frames forwarded on the VDE networks, the
+   accessors work on the raw bytes and never copy them */
+
+const (
+  EthernetHeaderLen = 14
+  EtherTypeIPv4     = 0x0800
+  EtherTypeARP      = 0x0806
+  EtherTypeVLAN     = 0x8100
+  EtherTypeIPv6     = 0x86dd
+  /* The 802.1Q tag after the source address: TPID, priority and VLAN ID */
+  VLANTagLen        = 4
+  VLANMax           = 4094
+)
+
+var Broadcast = net.HardwareAddr{ 0xff, 0xff, 0xff, 0xff, 0xff, 0xff }
+
+type Ethernet []byte
+
+/* ParseEthernet returns frame as Ethernet, if it is long enough */
+func ParseEthernet(frame []byte) (Ethernet, bool) {
+  return Ethernet(frame), len(frame) >= EthernetHeaderLen
+}
+
+func (this Ethernet) Dst() net.HardwareAddr {
+  return net.HardwareAddr(this[0:6])
+}
+
+func (this Ethernet) Src() net.HardwareAddr {
+  return net.HardwareAddr(this[6:12])
+}
+
+func (this Ethernet) Type() uint16 {
+  return binary.BigEndian.Uint16(this[12:14])
+}
+
+func (this Ethernet) Payload() []byte {
+  return this[EthernetHeaderLen:]
+}
+
+/* IsMulticast is true for the broadcast and multicast destinations */
+func (this Ethernet) IsMulticast() bool {
+  return this[0] & 1 != 0
+}
+
+/* VLAN returns the VLAN ID of a 802.1Q tagged frame */
+func (this Ethernet) VLAN() (uint16, bool) {
+  if len(this) < EthernetHeaderLen + VLANTagLen || this.Type() != EtherTypeVLAN {
+    return 0, false
+  }
+  return binary.BigEndian.Uint16(this[14:16]) & 0x0fff, true
+}
+
+/* NewEthernet returns a frame with the header and room for n bytes of payload */
+func NewEthernet(dst, src net.HardwareAddr, ethtype uint16, n int) Ethernet {
+  frame := make(Ethernet, EthernetHeaderLen + n)
+  copy(frame[0:6], dst)
+  copy(frame[6:12], src)
+  binary.BigEndian.PutUint16(frame[12:14], ethtype)
+  return frame
+}
@@ -0,0 +1,177 @@
+package packet
+
+import (
+  "errors"
+  "encoding/binary"
+)
+
+/* The virtio_net_hdr before the frames of the taps with IFF_VNET_HDR, see
+   include/uapi/linux/virtio_net.h */
+const (
+  VirtioNetHdrLen       = 10
+  VirtioNetHdrNeedsCsum = 1
+  GSONone               = 0
+  GSOTCPv4              = 1
+  GSOUDP                = 3
+  GSOTCPv6              = 4
+  GSOECN                = 0x80
+)
+
+/* TCP flags changed on the segments */
+const (
+  tcpFIN = 0x01
+  tcpPSH = 0x08
+  tcpCWR = 0x80
+)
+
+var (
+  ErrGSOType  = errors.New("Unsupported GSO type")
+  ErrGSOFrame = errors.New("Malformed GSO frame")
+  ErrGSOSpace = errors.New("No space for the GSO segments")
+)
+
+type VirtioNetHdr struct {
+  Flags      uint8
+  GSOType    uint8
+  HdrLen     uint16
+  GSOSize    uint16
+  CsumStart  uint16
+  CsumOffset uint16
+}
+
+/* ParseVirtioNetHdr reads the header at b, its fields in order: the taps use
+   the byte order of the host, virtio 1.0 little endian */
+func ParseVirtioNetHdr(b []byte, order binary.ByteOrder) VirtioNetHdr {
+  return VirtioNetHdr{
+    Flags:      b[0],
+    GSOType:    b[1],
+    HdrLen:     order.Uint16(b[2:4]),
+    GSOSize:    order.Uint16(b[4:6]),
+    CsumStart:  order.Uint16(b[6:8]),
+    CsumOffset: order.Uint16(b[8:10]),
+  }
+}
+
+func (this VirtioNetHdr) Put(b []byte, order binary.ByteOrder) {
+  b[0] = this.Flags
+  b[1] = this.GSOType
+  order.PutUint16(b[2:4], this.HdrLen)
+  order.PutUint16(b[4:6], this.GSOSize)
+  order.PutUint16(b[6:8], this.CsumStart)
+  order.PutUint16(b[8:10], this.CsumOffset)
+}
+
+/* CompleteChecksum writes the checksum the tap left partial in frame, as
+   skb_checksum_help does: the field holds the sum of the pseudo header */
+func CompleteChecksum(hdr VirtioNetHdr, frame []byte) error {
+  if hdr.Flags & VirtioNetHdrNeedsCsum == 0 {
+    return nil
+  }
+  start, field := int(hdr.CsumStart), int(hdr.CsumStart) + int(hdr.CsumOffset)
+  if field + 2 > len(frame) {
+    return ErrGSOFrame
+  }
+  sum := Checksum(frame[start:], 0)
+  if sum == 0 {
+    sum = 0xffff
+  }
+  binary.BigEndian.PutUint16(frame[field:], sum)
+  return nil
+}
+
+/* tcpHeaders returns the offsets of the IP and TCP headers of the TCP super
+   frame of a tap, and the length of the headers copied to each segment */
+func tcpHeaders(hdr VirtioNetHdr, frame []byte) (l3, l4, hlen int, v4 bool, err error) {
+  if hdr.GSOType & ^uint8(GSOECN) != GSOTCPv4 && hdr.GSOType & ^uint8(GSOECN) != GSOTCPv6 {
+    return 0, 0, 0, false, ErrGSOType
+  }
+  l3 = EthernetHeaderLen
+  if eth, ok := ParseEthernet(frame); ok && eth.Type() == EtherTypeVLAN {
+    l3 += VLANTagLen
+  }
+  if ip, ok := ParseIPv4(frame[l3:]); ok && ip.Protocol() == ProtoTCP {
+    l4, v4 = l3 + ip.HeaderLen(), true
+  } else if ip, ok := ParseIPv6(frame[l3:]); ok && ip.NextHeader() == ProtoTCP {
+    l4 = l3 + IPv6HeaderLen
+  } else {
+    return 0, 0, 0, false, ErrGSOFrame
+  }
+  if len(frame) < l4 + 20 {
+    return 0, 0, 0, false, ErrGSOFrame
+  }
+  hlen = l4 + int(frame[l4+12] >> 4) * 4
+  if hlen > len(frame) || hdr.GSOSize == 0 {
+    return 0, 0, 0, false, ErrGSOFrame
+  }
+  return l3, l4, hlen, v4, nil
+}
+
+/* GSOSegments returns the number of frames SegmentTCP makes of frame, and their bytes */
+func GSOSegments(hdr VirtioNetHdr, frame []byte) (int, int, error) {
+  _, _, hlen, _, err := tcpHeaders(hdr, frame)
+  if err != nil {
+    return 0, 0, err
+  }
+  mss := int(hdr.GSOSize)
+  n := (len(frame) - hlen + mss - 1) / mss
+  if n == 0 {
+    n = 1
+  }
+  return n, len(frame) + (n - 1) * hlen, nil
+}
+
+/* SegmentTCP splits the TCP super frame of a tap in frames of hdr.GSOSize
+   bytes of payload at most, with their checksums, as the kernel does without
+   TSO: the frames are written in buf and appended to segs */
+func SegmentTCP(hdr VirtioNetHdr, frame, buf []byte, segs [][]byte) ([][]byte, error) {
+  l3, l4, hlen, v4, err := tcpHeaders(hdr, frame)
+  if err != nil {
+    return segs, err
+  }
+  mss := int(hdr.GSOSize)
+  payload := frame[hlen:]
+  seq := binary.BigEndian.Uint32(frame[l4+4:])
+  id := binary.BigEndian.Uint16(frame[l3+4:])
+  src, dst := frame[l3+12:l3+16], frame[l3+16:l3+20]
+  if !v4 {
+    src, dst = frame[l3+8:l3+24], frame[l3+24:l3+40]
+  }
+  for off := 0; off < len(payload) || off == 0; off += mss {
+    n := len(payload) - off
+    if n > mss {
+      n = mss
+    }
+    if len(buf) < hlen + n {
+      return segs, ErrGSOSpace
+    }
+    seg := buf[:hlen + n]
+    buf = buf[hlen + n:]
+    copy(seg, frame[:hlen])
+    copy(seg[hlen:], payload[off:off+n])
+    if v4 {
+      ip := seg[l3:]
+      binary.BigEndian.PutUint16(ip[2:4], uint16(hlen - l3 + n))
+      binary.BigEndian.PutUint16(ip[4:6], id)
+      ip[10], ip[11] = 0, 0
+      binary.BigEndian.PutUint16(ip[10:12], Checksum(ip[:l4-l3], 0))
+      id++
+    } else {
+      binary.BigEndian.PutUint16(seg[l3+4:l3+6], uint16(hlen - l4 + n))
+    }
+    tcp := seg[l4:]
+    binary.BigEndian.PutUint32(tcp[4:8], seq + uint32(off))
+    if off + n < len(payload) {
+      tcp[13] &^= tcpFIN | tcpPSH
+    }
+    if off > 0 {
+      tcp[13] &^= tcpCWR
+    }
+    tcp[16], tcp[17] = 0, 0
+    binary.BigEndian.PutUint16(tcp[16:18], Checksum(tcp, pseudoSum(src, dst, ProtoTCP, len(tcp))))
+    segs = append(segs, seg)
+    if len(payload) == 0 {
+      break
+    }
+  }
+  return segs, nil
+}
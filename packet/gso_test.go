@@ -0,0 +1,196 @@
+package packet
+
+import (
+  "bytes"
+  "testing"
+  "encoding/binary"
+)
+
+/* sum16 is the Internet checksum of b over sum, folded and not complemented */
+func sum16(b []byte, sum uint32) uint16 {
+  for i := 0; i + 1 < len(b); i += 2 {
+    sum += uint32(binary.BigEndian.Uint16(b[i:]))
+  }
+  if len(b) % 2 == 1 {
+    sum += uint32(b[len(b)-1]) << 8
+  }
+  for sum > 0xffff {
+    sum = sum & 0xffff + sum >> 16
+  }
+  return uint16(sum)
+}
+
+/* superFrame builds a TCP frame of a tap with payload bytes of payload, after
+   a VLAN tag if vid is not 0 */
+func superFrame(v4 bool, vid uint16, flags byte, seq uint32, id uint16, payload int) []byte {
+  var frame []byte
+  frame = append(frame, Broadcast...)
+  frame = append(frame, 0x02, 0, 0, 0, 0, 1)
+  if vid != 0 {
+    frame = append(frame, 0x81, 0x00, byte(vid >> 8), byte(vid))
+  }
+  tcp := make([]byte, 20 + payload)
+  binary.BigEndian.PutUint16(tcp[0:], 40000)
+  binary.BigEndian.PutUint16(tcp[2:], 5001)
+  binary.BigEndian.PutUint32(tcp[4:], seq)
+  binary.BigEndian.PutUint32(tcp[8:], 1)
+  tcp[12], tcp[13] = 5 << 4, flags
+  binary.BigEndian.PutUint16(tcp[14:], 65535)
+  for i := range tcp[20:] {
+    tcp[20+i] = byte(i)
+  }
+  if v4 {
+    frame = append(frame, 0x08, 0x00)
+    ip := make([]byte, 20)
+    ip[0] = 0x45
+    binary.BigEndian.PutUint16(ip[2:], uint16(len(ip) + len(tcp)))
+    binary.BigEndian.PutUint16(ip[4:], id)
+    ip[6], ip[8], ip[9] = 0x40, 64, ProtoTCP
+    copy(ip[12:], []byte{ 10, 0, 0, 2, 10, 0, 0, 3 })
+    frame = append(frame, ip...)
+  } else {
+    frame = append(frame, 0x86, 0xdd)
+    ip := make([]byte, IPv6HeaderLen)
+    ip[0] = 0x60
+    binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+    ip[6], ip[7] = ProtoTCP, 64
+    ip[8], ip[9], ip[23] = 0xfd, 0x00, 2
+    ip[24], ip[25], ip[39] = 0xfd, 0x00, 3
+    frame = append(frame, ip...)
+  }
+  return append(frame, tcp...)
+}
+
+func TestSegmentTCP(t *testing.T) {
+  const ack, seq0, id0 = 0x10, 0xfffffff0, 0xfffe
+  for _, tc := range []struct {
+    name    string
+    v4      bool
+    vid     uint16
+    gso     uint8
+    flags   byte
+    payload int
+    mss     uint16
+  } {
+    { "IPv4", true, 0, GSOTCPv4, ack | tcpPSH, 4000, 1448 },
+    { "IPv4 exact", true, 0, GSOTCPv4, ack | tcpPSH, 2896, 1448 },
+    { "IPv4 one segment", true, 0, GSOTCPv4, ack | tcpPSH | tcpFIN, 100, 1448 },
+    { "IPv4 no payload", true, 0, GSOTCPv4, ack | tcpFIN, 0, 1448 },
+    { "IPv4 FIN CWR ECN", true, 0, GSOTCPv4 | GSOECN, ack | tcpPSH | tcpFIN | tcpCWR, 5000, 1000 },
+    { "IPv4 VLAN", true, 42, GSOTCPv4, ack | tcpPSH, 3001, 1000 },
+    { "IPv6", false, 0, GSOTCPv6, ack | tcpPSH | tcpCWR, 4000, 1428 },
+    { "IPv6 VLAN FIN", false, 4094, GSOTCPv6, ack | tcpPSH | tcpFIN, 2500, 1200 },
+  } {
+    frame := superFrame(tc.v4, tc.vid, tc.flags, seq0, id0, tc.payload)
+    orig := append([]byte{}, frame...)
+    hdr := VirtioNetHdr{ Flags: VirtioNetHdrNeedsCsum, GSOType: tc.gso, GSOSize: tc.mss }
+    segs, err := SegmentTCP(hdr, frame, make([]byte, 2 * len(frame) + 1024), nil)
+    if err != nil {
+      t.Errorf("%s: %s", tc.name, err)
+      continue
+    }
+    if !bytes.Equal(frame, orig) {
+      t.Errorf("%s: super frame changed", tc.name)
+    }
+    want := (tc.payload + int(tc.mss) - 1) / int(tc.mss)
+    if want == 0 {
+      want = 1
+    }
+    if len(segs) != want {
+      t.Errorf("%s: %d segments, want %d", tc.name, len(segs), want)
+      continue
+    }
+    l3 := EthernetHeaderLen
+    if tc.vid != 0 {
+      l3 += VLANTagLen
+    }
+    l4 := l3 + 20
+    if !tc.v4 {
+      l4 = l3 + IPv6HeaderLen
+    }
+    n, size, err := GSOSegments(hdr, frame)
+    total := 0
+    var payload []byte
+    for i, seg := range segs {
+      total += len(seg)
+      if !bytes.Equal(seg[:l3], frame[:l3]) {
+        t.Errorf("%s: segment %d link header % x", tc.name, i, seg[:l3])
+      }
+      ip, tcp := seg[l3:l4], seg[l4:]
+      data := tcp[20:]
+      if len(data) > int(tc.mss) || i < len(segs) - 1 && len(data) != int(tc.mss) {
+        t.Errorf("%s: segment %d payload %d", tc.name, i, len(data))
+      }
+      var pseudo uint32
+      if tc.v4 {
+        if got := binary.BigEndian.Uint16(ip[2:]); int(got) != len(seg) - l3 {
+          t.Errorf("%s: segment %d total length %d, want %d", tc.name, i, got, len(seg) - l3)
+        }
+        if got := binary.BigEndian.Uint16(ip[4:]); got != uint16(id0 + i) {
+          t.Errorf("%s: segment %d IP ID %#x, want %#x", tc.name, i, got, uint16(id0 + i))
+        }
+        if sum16(ip, 0) != 0xffff {
+          t.Errorf("%s: segment %d IP checksum %#x", tc.name, i, binary.BigEndian.Uint16(ip[10:]))
+        }
+        pseudo = uint32(sum16(ip[12:20], 0))
+      } else {
+        if got := binary.BigEndian.Uint16(ip[4:]); int(got) != len(tcp) {
+          t.Errorf("%s: segment %d payload length %d, want %d", tc.name, i, got, len(tcp))
+        }
+        pseudo = uint32(sum16(ip[8:40], 0))
+      }
+      pseudo += ProtoTCP + uint32(len(tcp))
+      if sum16(tcp, pseudo) != 0xffff {
+        t.Errorf("%s: segment %d TCP checksum %#x", tc.name, i, binary.BigEndian.Uint16(tcp[16:]))
+      }
+      if got, want := binary.BigEndian.Uint32(tcp[4:]), uint32(seq0) + uint32(i) * uint32(tc.mss); got != want {
+        t.Errorf("%s: segment %d seq %#x, want %#x", tc.name, i, got, want)
+      }
+      flags := tc.flags
+      if i < len(segs) - 1 {
+        flags &^= tcpFIN | tcpPSH
+      }
+      if i > 0 {
+        flags &^= tcpCWR
+      }
+      if tcp[13] != flags {
+        t.Errorf("%s: segment %d flags %#x, want %#x", tc.name, i, tcp[13], flags)
+      }
+      payload = append(payload, data...)
+    }
+    if !bytes.Equal(payload, frame[l4+20:]) {
+      t.Errorf("%s: payload of the segments differs", tc.name)
+    }
+    if err != nil || n != len(segs) || size != total {
+      t.Errorf("%s: GSOSegments %d %d %v, want %d %d", tc.name, n, size, err, len(segs), total)
+    }
+  }
+}
+
+func TestSegmentTCPErrors(t *testing.T) {
+  frame := superFrame(true, 0, 0x10, 1, 1, 3000)
+  udp := append([]byte{}, frame...)
+  udp[EthernetHeaderLen + 9] = ProtoUDP
+  for _, tc := range []struct {
+    name  string
+    hdr   VirtioNetHdr
+    frame []byte
+    buf   int
+    err   error
+  } {
+    { "UDP GSO type", VirtioNetHdr{ GSOType: GSOUDP, GSOSize: 1000 }, frame, 8192, ErrGSOType },
+    { "no GSO type", VirtioNetHdr{ GSOSize: 1000 }, frame, 8192, ErrGSOType },
+    { "UDP", VirtioNetHdr{ GSOType: GSOTCPv4, GSOSize: 1000 }, udp, 8192, ErrGSOFrame },
+    { "truncated TCP header", VirtioNetHdr{ GSOType: GSOTCPv4, GSOSize: 1000 }, frame[:EthernetHeaderLen + 30], 8192, ErrGSOFrame },
+    { "no GSO size", VirtioNetHdr{ GSOType: GSOTCPv4 }, frame, 8192, ErrGSOFrame },
+    { "no space", VirtioNetHdr{ GSOType: GSOTCPv4, GSOSize: 1000 }, frame, 2000, ErrGSOSpace },
+  } {
+    segs, err := SegmentTCP(tc.hdr, tc.frame, make([]byte, tc.buf), nil)
+    if err != tc.err {
+      t.Errorf("%s: %v, want %v", tc.name, err, tc.err)
+    }
+    if tc.err != ErrGSOSpace && len(segs) != 0 {
+      t.Errorf("%s: %d segments", tc.name, len(segs))
+    }
+  }
+}
@@ -0,0 +1,160 @@
+package packet
+
+import (
+  "net"
+  "encoding/binary"
+)
+
+const (
+  IPv4HeaderLen = 20
+  UDPHeaderLen  = 8
+  ProtoICMP     = 1
+  ProtoTCP      = 6
+  ProtoUDP      = 17
+  ProtoICMPv6   = 58
+  DefaultTTL    = 64
+)
+
+type IPv4 []byte
+
+/* ParseIPv4 returns the IPv4 packet in the payload of an Ethernet frame, trimmed to its length */
+func ParseIPv4(b []byte) (IPv4, bool) {
+  if len(b) < IPv4HeaderLen || b[0] >> 4 != 4 {
+    return nil, false
+  }
+  ip := IPv4(b)
+  if ip.HeaderLen() < IPv4HeaderLen || int(ip.TotalLen()) < ip.HeaderLen() || int(ip.TotalLen()) > len(b) {
+    return nil, false
+  }
+  return ip[:ip.TotalLen()], true
+}
+
+func (this IPv4) HeaderLen() int {
+  return int(this[0] & 0x0f) * 4
+}
+
+func (this IPv4) TotalLen() uint16 {
+  return binary.BigEndian.Uint16(this[2:4])
+}
+
+func (this IPv4) Protocol() uint8 {
+  return this[9]
+}
+
+func (this IPv4) Src() net.IP {
+  return net.IP(this[12:16])
+}
+
+func (this IPv4) Dst() net.IP {
+  return net.IP(this[16:20])
+}
+
+/* IsFragment is true for all the fragments but a whole packet */
+func (this IPv4) IsFragment() bool {
+  return binary.BigEndian.Uint16(this[6:8]) & 0x3fff != 0
+}
+
+func (this IPv4) Payload() []byte {
+  return this[this.HeaderLen():]
+}
+
+/* Checksum is the Internet checksum (RFC 1071) of b, starting from the partial sum */
+func Checksum(b []byte, sum uint32) uint16 {
+  for ; len(b) >= 2; b = b[2:] {
+    sum += uint32(b[0]) << 8 | uint32(b[1])
+  }
+  if len(b) == 1 {
+    sum += uint32(b[0]) << 8
+  }
+  for sum > 0xffff {
+    sum = sum >> 16 + sum & 0xffff
+  }
+  return ^uint16(sum)
+}
+
+/* pseudoSum is the partial checksum of the pseudo header of the transport protocols */
+func pseudoSum(src, dst net.IP, proto uint8, length int) uint32 {
+  var sum uint32
+  for _, ip := range [][]byte{ src, dst } {
+    for i := 0; i < len(ip); i += 2 {
+      sum += uint32(ip[i]) << 8 | uint32(ip[i+1])
+    }
+  }
+  return sum + uint32(proto) + uint32(length)
+}
+
+type UDP []byte
+
+/* ParseUDP returns the UDP datagram in b, trimmed to its length */
+func ParseUDP(b []byte) (UDP, bool) {
+  if len(b) < UDPHeaderLen {
+    return nil, false
+  }
+  udp := UDP(b)
+  if int(udp.Len()) < UDPHeaderLen || int(udp.Len()) > len(b) {
+    return nil, false
+  }
+  return udp[:udp.Len()], true
+}
+
+func (this UDP) SrcPort() uint16 {
+  return binary.BigEndian.Uint16(this[0:2])
+}
+
+func (this UDP) DstPort() uint16 {
+  return binary.BigEndian.Uint16(this[2:4])
+}
+
+func (this UDP) Len() uint16 {
+  return binary.BigEndian.Uint16(this[4:6])
+}
+
+func (this UDP) Payload() []byte {
+  return this[UDPHeaderLen:]
+}
+
+/* ParseUDPv4 returns the headers of an Ethernet frame that carries a whole UDP over IPv4 datagram */
+func ParseUDPv4(frame []byte) (Ethernet, IPv4, UDP, bool) {
+  eth, ok := ParseEthernet(frame)
+  if !ok || eth.Type() != EtherTypeIPv4 {
+    return nil, nil, nil, false
+  }
+  ip, ok := ParseIPv4(eth.Payload())
+  if !ok || ip.Protocol() != ProtoUDP || ip.IsFragment() {
+    return nil, nil, nil, false
+  }
+  udp, ok := ParseUDP(ip.Payload())
+  if !ok {
+    return nil, nil, nil, false
+  }
+  return eth, ip, udp, true
+}
+
+/* putIPv4 writes the header of an IPv4 packet of n bytes of payload at b */
+func putIPv4(b []byte, src, dst net.IP, proto uint8, n int) {
+  b[0] = 4 << 4 | IPv4HeaderLen / 4
+  binary.BigEndian.PutUint16(b[2:4], uint16(IPv4HeaderLen + n))
+  b[8] = DefaultTTL
+  b[9] = proto
+  copy(b[12:16], src.To4())
+  copy(b[16:20], dst.To4())
+  binary.BigEndian.PutUint16(b[10:12], Checksum(b[:IPv4HeaderLen], 0))
+}
+
+/* NewUDPv4 returns an Ethernet frame with an UDP over IPv4 datagram */
+func NewUDPv4(dstmac, srcmac net.HardwareAddr, src, dst net.IP, sport, dport uint16, payload []byte) Ethernet {
+  n := UDPHeaderLen + len(payload)
+  frame := NewEthernet(dstmac, srcmac, EtherTypeIPv4, IPv4HeaderLen + n)
+  putIPv4(frame[EthernetHeaderLen:], src, dst, ProtoUDP, n)
+  udp := frame[EthernetHeaderLen + IPv4HeaderLen:]
+  binary.BigEndian.PutUint16(udp[0:2], sport)
+  binary.BigEndian.PutUint16(udp[2:4], dport)
+  binary.BigEndian.PutUint16(udp[4:6], uint16(n))
+  copy(udp[UDPHeaderLen:], payload)
+  sum := Checksum(udp, pseudoSum(src.To4(), dst.To4(), ProtoUDP, n))
+  if sum == 0 {
+    sum = 0xffff
+  }
+  binary.BigEndian.PutUint16(udp[6:8], sum)
+  return frame
+}
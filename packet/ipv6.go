@@ -0,0 +1,187 @@
+package packet
+
+import (
+  "net"
+  "encoding/binary"
+)
+
+const (
+  IPv6HeaderLen   = 40
+  ICMPv6HeaderLen = 4
+  /* Hop limit of the Neighbor Discovery messages (RFC 4861) */
+  NDHopLimit      = 255
+)
+
+/* Extension headers of IPv6 (RFC 8200), skipped by UpperLayer */
+const (
+  IPv6HopByHop = 0
+  IPv6Routing  = 43
+  IPv6Fragment = 44
+  IPv6AH       = 51
+  IPv6DestOpts = 60
+  IPv6Mobility = 135
+  IPv6HIP      = 139
+  IPv6Shim6    = 140
+)
+
+type IPv6 []byte
+
+/* ParseIPv6 returns the IPv6 packet in the payload of an Ethernet frame, trimmed to its length */
+func ParseIPv6(b []byte) (IPv6, bool) {
+  if len(b) < IPv6HeaderLen || b[0] >> 4 != 6 {
+    return nil, false
+  }
+  ip := IPv6(b)
+  if IPv6HeaderLen + int(ip.PayloadLen()) > len(b) {
+    return nil, false
+  }
+  return ip[:IPv6HeaderLen + int(ip.PayloadLen())], true
+}
+
+func (this IPv6) PayloadLen() uint16 {
+  return binary.BigEndian.Uint16(this[4:6])
+}
+
+/* NextHeader is the protocol of the payload, when there are no extension headers, see UpperLayer */
+func (this IPv6) NextHeader() uint8 {
+  return this[6]
+}
+
+/* UpperLayer walks the extension headers to the protocol of the payload and
+   returns it with its bytes, false if they can not be parsed. After the first
+   fragment it returns IPv6Fragment: the bytes have no header of the protocol. */
+func (this IPv6) UpperLayer() (uint8, []byte, bool) {
+  proto, b := this.NextHeader(), this.Payload()
+  for {
+    var n int
+    switch proto {
+    case IPv6HopByHop, IPv6Routing, IPv6DestOpts, IPv6Mobility, IPv6HIP, IPv6Shim6:
+      if len(b) < 8 {
+        return 0, nil, false
+      }
+      n = (int(b[1]) + 1) * 8
+    case IPv6AH:
+      if len(b) < 8 {
+        return 0, nil, false
+      }
+      n = (int(b[1]) + 2) * 4
+    case IPv6Fragment:
+      if len(b) < 8 {
+        return 0, nil, false
+      }
+      if binary.BigEndian.Uint16(b[2:4]) &^ 7 != 0 {
+        return IPv6Fragment, b[8:], true
+      }
+      n = 8
+    default:
+      return proto, b, true
+    }
+    if len(b) < n {
+      return 0, nil, false
+    }
+    proto, b = b[0], b[n:]
+  }
+}
+
+func (this IPv6) HopLimit() uint8 {
+  return this[7]
+}
+
+func (this IPv6) Src() net.IP {
+  return net.IP(this[8:24])
+}
+
+func (this IPv6) Dst() net.IP {
+  return net.IP(this[24:40])
+}
+
+func (this IPv6) Payload() []byte {
+  return this[IPv6HeaderLen:]
+}
+
+/* MulticastMAC is the Ethernet destination of an IPv6 multicast group (RFC 2464) */
+func MulticastMAC(group net.IP) net.HardwareAddr {
+  group = group.To16()
+  return net.HardwareAddr{ 0x33, 0x33, group[12], group[13], group[14], group[15] }
+}
+
+/* LinkLocal is the link-local address of an interface, from its modified EUI-64 (RFC 4291) */
+func LinkLocal(mac net.HardwareAddr) net.IP {
+  ip := make(net.IP, net.IPv6len)
+  ip[0], ip[1] = 0xfe, 0x80
+  copy(ip[8:11], mac[0:3])
+  ip[8] ^= 0x02
+  ip[11], ip[12] = 0xff, 0xfe
+  copy(ip[13:16], mac[3:6])
+  return ip
+}
+
+/* ParseUDPv6 returns the headers of an Ethernet frame that carries an UDP over IPv6 datagram */
+func ParseUDPv6(frame []byte) (Ethernet, IPv6, UDP, bool) {
+  eth, ok := ParseEthernet(frame)
+  if !ok || eth.Type() != EtherTypeIPv6 {
+    return nil, nil, nil, false
+  }
+  ip, ok := ParseIPv6(eth.Payload())
+  if !ok || ip.NextHeader() != ProtoUDP {
+    return nil, nil, nil, false
+  }
+  udp, ok := ParseUDP(ip.Payload())
+  if !ok {
+    return nil, nil, nil, false
+  }
+  return eth, ip, udp, true
+}
+
+/* ParseICMPv6 returns the headers of an Ethernet frame that carries an ICMPv6 message */
+func ParseICMPv6(frame []byte) (Ethernet, IPv6, []byte, bool) {
+  eth, ok := ParseEthernet(frame)
+  if !ok || eth.Type() != EtherTypeIPv6 {
+    return nil, nil, nil, false
+  }
+  ip, ok := ParseIPv6(eth.Payload())
+  if !ok || ip.NextHeader() != ProtoICMPv6 || len(ip.Payload()) < ICMPv6HeaderLen {
+    return nil, nil, nil, false
+  }
+  return eth, ip, ip.Payload(), true
+}
+
+/* newIPv6 returns an Ethernet frame with the IPv6 header of n bytes of payload */
+func newIPv6(dstmac, srcmac net.HardwareAddr, src, dst net.IP, proto, hoplimit uint8, n int) Ethernet {
+  frame := NewEthernet(dstmac, srcmac, EtherTypeIPv6, IPv6HeaderLen + n)
+  ip := frame[EthernetHeaderLen:]
+  ip[0] = 6 << 4
+  binary.BigEndian.PutUint16(ip[4:6], uint16(n))
+  ip[6], ip[7] = proto, hoplimit
+  copy(ip[8:24], src.To16())
+  copy(ip[24:40], dst.To16())
+  return frame
+}
+
+/* NewUDPv6 returns an Ethernet frame with an UDP over IPv6 datagram */
+func NewUDPv6(dstmac, srcmac net.HardwareAddr, src, dst net.IP, sport, dport uint16, payload []byte) Ethernet {
+  n := UDPHeaderLen + len(payload)
+  frame := newIPv6(dstmac, srcmac, src, dst, ProtoUDP, DefaultTTL, n)
+  udp := frame[EthernetHeaderLen + IPv6HeaderLen:]
+  binary.BigEndian.PutUint16(udp[0:2], sport)
+  binary.BigEndian.PutUint16(udp[2:4], dport)
+  binary.BigEndian.PutUint16(udp[4:6], uint16(n))
+  copy(udp[UDPHeaderLen:], payload)
+  sum := Checksum(udp, pseudoSum(src.To16(), dst.To16(), ProtoUDP, n))
+  if sum == 0 {
+    sum = 0xffff
+  }
+  binary.BigEndian.PutUint16(udp[6:8], sum)
+  return frame
+}
+
+/* NewICMPv6 returns an Ethernet frame with an ICMPv6 message, body follows type, code and checksum */
+func NewICMPv6(dstmac, srcmac net.HardwareAddr, src, dst net.IP, hoplimit, typ, code uint8, body []byte) Ethernet {
+  n := ICMPv6HeaderLen + len(body)
+  frame := newIPv6(dstmac, srcmac, src, dst, ProtoICMPv6, hoplimit, n)
+  icmp := frame[EthernetHeaderLen + IPv6HeaderLen:]
+  icmp[0], icmp[1] = typ, code
+  copy(icmp[ICMPv6HeaderLen:], body)
+  binary.BigEndian.PutUint16(icmp[2:4], Checksum(icmp, pseudoSum(src.To16(), dst.To16(), ProtoICMPv6, n)))
+  return frame
+}
@@ -0,0 +1,88 @@
+package plugin
+
+import (
+  "os"
+  "fmt"
+  "net"
+  "net/http"
+  "net/url"
+  "context"
+  "path/filepath"
+  "net/http/httputil"
+  log "github.com/Sirupsen/logrus"
+  "github.com/docker/go-connections/sockets"
+  "github.com/docker/go-plugins-helpers/sdk"
+  "github.com/docker/go-plugins-helpers/network"
+)
+
+const (
+  SockDir      = "/run/docker/plugins"
+  activatePath = "/Plugin.Activate"
+  manifest     = `{"Implements": ["NetworkDriver", "IpamDriver"]}`
+  inmemAddr    = "vde-network"
+)
+
+/* Server serves on a single socket the network driver and the other APIs of
+   the plugin. The network.Handler of go-plugins-helpers registers its own
+   activation manifest, so it runs on an in-memory listener behind a proxy. */
+type Server struct {
+  mux     *http.ServeMux
+  server  *http.Server
+  inmem   *sockets.InmemSocket
+  handler *network.Handler
+}
+
+func NewServer(driver network.Driver) *Server {
+  this := &Server {
+    mux:     http.NewServeMux(),
+    server:  &http.Server{},
+    inmem:   sockets.NewInmemSocket(inmemAddr, 16),
+    handler: network.NewHandler(driver),
+  }
+  proxy := httputil.NewSingleHostReverseProxy(&url.URL{ Scheme: "http", Host: inmemAddr })
+  proxy.Transport = &http.Transport{ Dial: this.inmem.Dial }
+  this.mux.Handle("/", proxy)
+  this.mux.HandleFunc(activatePath, func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", sdk.DefaultContentTypeV1_1)
+    fmt.Fprintln(w, manifest)
+  })
+  return this
+}
+
+/* HandleFunc registers an API served next to the network driver */
+func (this *Server) HandleFunc(path string, fn func(w http.ResponseWriter, r *http.Request)) {
+  this.mux.HandleFunc(path, fn)
+}
+
+func (this *Server) Serve(l net.Listener) error {
+  go func() {
+    if err := this.handler.Serve(this.inmem); err != nil {
+      log.Debugf("Network handler: [ %s ]", err)
+    }
+  }()
+  defer this.inmem.Close()
+  this.server.Addr, this.server.Handler = l.Addr().String(), this.mux
+  if err := this.server.Serve(l); err != http.ErrServerClosed {
+    return err
+  }
+  return nil
+}
+
+/* Shutdown stops accepting requests and waits for the ones in flight, Serve returns at once */
+func (this *Server) Shutdown(ctx context.Context) error {
+  return this.server.Shutdown(ctx)
+}
+
+/* ServeUnix listens on SockDir/name.sock, that docker finds by plugin name */
+func (this *Server) ServeUnix(name string, gid int) error {
+  if err := os.MkdirAll(SockDir, 0755); err != nil {
+    return err
+  }
+  path := filepath.Join(SockDir, name + ".sock")
+  l, err := sockets.NewUnixSocket(path, gid)
+  if err != nil {
+    return err
+  }
+  defer os.Remove(path)
+  return this.Serve(l)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "sort"
+  "text/tabwriter"
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/admin"
+)
+
+/* shortID is the docker format of the IDs */
+func shortID(id string) string {
+  if len(id) > 12 {
+    return id[:12]
+  }
+  return id
+}
+
+func stats(netid string) {
+  res, err := admin.NewClient(unixSock).NetworkStats(netid)
+  if err != nil {
+    log.Fatal(err)
+  }
+  w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+  fmt.Fprintln(w, "NETWORK\tENDPOINT\tRX PACKETS\tRX BYTES\tRX DROP\tRX ERR\tTX PACKETS\tTX BYTES\tTX DROP\tTX ERR\tTX FILTER\tTX LIMIT\tRECONNECTS")
+  var netids []string
+  for nwkey := range res.Networks {
+    netids = append(netids, nwkey)
+  }
+  sort.Strings(netids)
+  for _, nwkey := range netids {
+    var epids []string
+    for epkey := range res.Networks[nwkey] {
+      epids = append(epids, epkey)
+    }
+    sort.Strings(epids)
+    for _, epkey := range epids {
+      st := res.Networks[nwkey][epkey]
+      fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", shortID(nwkey), shortID(epkey),
+        st.RxPackets, st.RxBytes, st.RxDropped, st.RxErrors, st.TxPackets, st.TxBytes, st.TxDropped, st.TxErrors, st.TxFiltered, st.TxLimited, st.Reconnects)
+    }
+  }
+  w.Flush()
+}
@@ -0,0 +1,118 @@
+package vdeipam
+
+import (
+  "net/http"
+  "github.com/docker/go-plugins-helpers/sdk"
+)
+
+/* Docker remote IPAM API, see libnetwork/docs/ipam.md */
+const (
+  capabilitiesPath   = "/IpamDriver.GetCapabilities"
+  addressSpacesPath  = "/IpamDriver.GetDefaultAddressSpaces"
+  requestPoolPath    = "/IpamDriver.RequestPool"
+  releasePoolPath    = "/IpamDriver.ReleasePool"
+  requestAddressPath = "/IpamDriver.RequestAddress"
+  releaseAddressPath = "/IpamDriver.ReleaseAddress"
+
+  /* Options set by libnetwork in RequestAddress */
+  RequestAddressType = "RequestAddressType"
+  GatewayAddressType = "com.docker.network.gateway"
+  MacAddressOption   = "com.docker.network.endpoint.macaddress"
+)
+
+type CapabilitiesResponse struct {
+  RequiresMACAddress    bool
+  RequiresRequestReplay bool
+}
+
+type AddressSpacesResponse struct {
+  LocalDefaultAddressSpace  string
+  GlobalDefaultAddressSpace string
+}
+
+type RequestPoolRequest struct {
+  AddressSpace string
+  Pool         string
+  SubPool      string
+  Options      map[string]string
+  V6           bool
+}
+
+type RequestPoolResponse struct {
+  PoolID string
+  Pool   string
+  Data   map[string]string
+}
+
+type ReleasePoolRequest struct {
+  PoolID string
+}
+
+type RequestAddressRequest struct {
+  PoolID  string
+  Address string
+  Options map[string]string
+}
+
+type RequestAddressResponse struct {
+  Address string
+  Data    map[string]string
+}
+
+type ReleaseAddressRequest struct {
+  PoolID  string
+  Address string
+}
+
+type ErrorResponse struct {
+  Err string
+}
+
+/* HandleFuncer is satisfied by sdk.Handler and by plugin.Server */
+type HandleFuncer interface {
+  HandleFunc(path string, fn func(w http.ResponseWriter, r *http.Request))
+}
+
+func encode(w http.ResponseWriter, res interface{}, err error) {
+  if err != nil {
+    sdk.EncodeResponse(w, &ErrorResponse{ Err: err.Error() }, true)
+    return
+  }
+  sdk.EncodeResponse(w, res, false)
+}
+
+/* Register serves the IpamDriver API of driver on h */
+func Register(h HandleFuncer, driver *Driver) {
+  h.HandleFunc(capabilitiesPath, func(w http.ResponseWriter, r *http.Request) {
+    encode(w, driver.GetCapabilities(), nil)
+  })
+  h.HandleFunc(addressSpacesPath, func(w http.ResponseWriter, r *http.Request) {
+    encode(w, driver.GetDefaultAddressSpaces(), nil)
+  })
+  h.HandleFunc(requestPoolPath, func(w http.ResponseWriter, r *http.Request) {
+    req := &RequestPoolRequest{}
+    if sdk.DecodeRequest(w, r, req) == nil {
+      res, err := driver.RequestPool(req)
+      encode(w, res, err)
+    }
+  })
+  h.HandleFunc(releasePoolPath, func(w http.ResponseWriter, r *http.Request) {
+    req := &ReleasePoolRequest{}
+    if sdk.DecodeRequest(w, r, req) == nil {
+      encode(w, struct{}{}, driver.ReleasePool(req))
+    }
+  })
+  h.HandleFunc(requestAddressPath, func(w http.ResponseWriter, r *http.Request) {
+    req := &RequestAddressRequest{}
+    if sdk.DecodeRequest(w, r, req) == nil {
+      res, err := driver.RequestAddress(req)
+      encode(w, res, err)
+    }
+  })
+  h.HandleFunc(releaseAddressPath, func(w http.ResponseWriter, r *http.Request) {
+    req := &ReleaseAddressRequest{}
+    if sdk.DecodeRequest(w, r, req) == nil {
+      encode(w, struct{}{}, driver.ReleaseAddress(req))
+    }
+  })
+}
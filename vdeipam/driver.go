@@ -0,0 +1,380 @@
+package vdeipam
+
+import (
+  "net"
+  "sync"
+  "strings"
+  log "github.com/Sirupsen/logrus"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/datastore"
+)
+
+const (
+  AddressSpace = "vde"
+  /* Pool options, e.g. --ipam-opt sock=vxvde:// --ipam-opt reserved=10.0.0.2,10.0.0.10-10.0.0.20 */
+  SockOption     = "sock"
+  ReservedOption = "reserved"
+)
+
+/* Lease is an address handed out by RequestAddress */
+type Lease struct {
+  MacAddress string `json:"MacAddress"`
+  Gateway    bool   `json:"Gateway"`
+}
+
+/* Pool is a subnet of a VDE sock, shared by the networks using both */
+type Pool struct {
+  Sock      string            `json:"Sock"`
+  Subnet    string            `json:"Subnet"`
+  Range     string            `json:"Range"`
+  V6        bool              `json:"V6"`
+  Refs      int               `json:"Refs"`
+  /* Addresses used by peers outside docker, e.g. VMs on the same switch */
+  Reserved  []string          `json:"Reserved"`
+  /* Records of their own, see LeasesBucket */
+  Leases    map[string]*Lease `json:"-"`
+}
+
+type Driver struct {
+  mutex  sync.Mutex
+  store  datastore.Store
+  Pools  map[string]*Pool
+}
+
+/* NewDriver returns the IPAM driver keeping its pools in store, the one of
+   the network driver: a MemoryStore if nil */
+func NewDriver(store datastore.Store, clean bool) *Driver {
+  driver := &Driver {
+    store: store,
+    Pools: make(map[string]*Pool),
+  }
+  if driver.store == nil {
+    driver.store = datastore.NewMemoryStore()
+  }
+  if clean == true {
+    driver.clean()
+  } else if err := driver.load(); err != nil {
+    log.Warnf("Datastore.Load: [ %s ]", err)
+    driver.Pools = make(map[string]*Pool)
+  }
+  return driver
+}
+
+func poolID(sock, subnet string) string {
+  return sock + "|" + subnet
+}
+
+/* ipRange is an inclusive range of addresses */
+type ipRange struct {
+  first, last net.IP
+}
+
+func (this ipRange) contains(ip net.IP) bool {
+  return compareIP(ip, this.first) >= 0 && compareIP(ip, this.last) <= 0
+}
+
+func compareIP(a, b net.IP) int {
+  a, b = a.To16(), b.To16()
+  for i := range a {
+    if a[i] != b[i] {
+      if a[i] < b[i] {
+        return -1
+      }
+      return 1
+    }
+  }
+  return 0
+}
+
+func nextIP(ip net.IP) net.IP {
+  next := make(net.IP, len(ip))
+  copy(next, ip)
+  for i := len(next) - 1; i >= 0; i-- {
+    if next[i]++; next[i] != 0 {
+      break
+    }
+  }
+  return next
+}
+
+func subnetRange(ipnet *net.IPNet) ipRange {
+  first := ipnet.IP.Mask(ipnet.Mask)
+  last := make(net.IP, len(first))
+  for i := range first {
+    last[i] = first[i] | ^ipnet.Mask[i]
+  }
+  return ipRange{ first: first, last: last }
+}
+
+/* parseRange accepts an address or a range first-last */
+func parseRange(s string) (ipRange, error) {
+  bounds := strings.SplitN(strings.TrimSpace(s), "-", 2)
+  first := net.ParseIP(bounds[0])
+  last := first
+  if len(bounds) == 2 {
+    last = net.ParseIP(bounds[1])
+  }
+  if first == nil || last == nil || compareIP(first, last) > 0 {
+    return ipRange{}, types.BadRequestErrorf("Invalid address range: %s", s)
+  }
+  return ipRange{ first: first, last: last }, nil
+}
+
+func (this *Pool) network() *net.IPNet {
+  _, ipnet, _ := net.ParseCIDR(this.Subnet)
+  return ipnet
+}
+
+func (this *Pool) reserved(ip net.IP) (ipRange, bool) {
+  for _, s := range this.Reserved {
+    if r, err := parseRange(s); err == nil && r.contains(ip) {
+      return r, true
+    }
+  }
+  return ipRange{}, false
+}
+
+func (this *Pool) isReserved(s string) bool {
+  for _, r := range this.Reserved {
+    if r == s {
+      return true
+    }
+  }
+  return false
+}
+
+/* usable excludes the network and broadcast addresses of IPv4 subnets */
+func (this *Pool) usable(ip net.IP) bool {
+  ipnet := this.network()
+  if !ipnet.Contains(ip) {
+    return false
+  }
+  bounds := subnetRange(ipnet)
+  if ip.Equal(bounds.first) {
+    return false
+  }
+  ones, bits := ipnet.Mask.Size()
+  return this.V6 || bits - ones < 2 || !ip.Equal(bounds.last)
+}
+
+/* nextFree returns the first address of the range that is not leased or reserved */
+func (this *Pool) nextFree() net.IP {
+  var bounds ipRange
+  if this.Range != "" {
+    _, ipnet, _ := net.ParseCIDR(this.Range)
+    bounds = subnetRange(ipnet)
+  } else {
+    bounds = subnetRange(this.network())
+  }
+  for ip := bounds.first; bounds.contains(ip); ip = nextIP(ip) {
+    if r, ok := this.reserved(ip); ok {
+      ip = r.last
+    } else if this.Leases[ip.String()] == nil && this.usable(ip) {
+      return ip
+    }
+    if ip.Equal(bounds.last) {
+      break
+    }
+  }
+  return nil
+}
+
+func (this *Pool) cidr(ip net.IP) string {
+  ones, _ := this.network().Mask.Size()
+  return (&net.IPNet{ IP: ip, Mask: net.CIDRMask(ones, len(this.network().Mask) * 8) }).String()
+}
+
+func (this *Driver) GetCapabilities() *CapabilitiesResponse {
+  return &CapabilitiesResponse{ RequiresMACAddress: true }
+}
+
+func (this *Driver) GetDefaultAddressSpaces() *AddressSpacesResponse {
+  return &AddressSpacesResponse {
+    LocalDefaultAddressSpace:  AddressSpace,
+    GlobalDefaultAddressSpace: AddressSpace,
+  }
+}
+
+func (this *Driver) RequestPool(r *RequestPoolRequest) (*RequestPoolResponse, error) {
+  log.Debugf("RequestPool: [ %+v ]", r)
+  if r.Pool == "" {
+    return nil, types.BadRequestErrorf("Subnet miss, dynamic pools are not supported.")
+  }
+  _, ipnet, err := net.ParseCIDR(r.Pool)
+  if err != nil {
+    return nil, types.BadRequestErrorf("Invalid subnet: %s", r.Pool)
+  }
+  if r.SubPool != "" {
+    _, subnet, err := net.ParseCIDR(r.SubPool)
+    if err != nil || !ipnet.Contains(subnet.IP) {
+      return nil, types.BadRequestErrorf("Invalid ip range: %s", r.SubPool)
+    }
+  }
+  var reserved []string
+  if r.Options[ReservedOption] != "" {
+    for _, s := range strings.Split(r.Options[ReservedOption], ",") {
+      if _, err := parseRange(s); err != nil {
+        return nil, err
+      }
+      reserved = append(reserved, strings.TrimSpace(s))
+    }
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  id := poolID(r.Options[SockOption], ipnet.String())
+  pool := this.Pools[id]
+  if pool == nil {
+    pool = &Pool {
+      Sock:     r.Options[SockOption],
+      Subnet:   ipnet.String(),
+      Range:    r.SubPool,
+      V6:       r.V6,
+      Leases:   make(map[string]*Lease),
+    }
+  }
+  updated := *pool
+  updated.Reserved = append([]string{}, pool.Reserved...)
+  for _, s := range reserved {
+    if !updated.isReserved(s) {
+      updated.Reserved = append(updated.Reserved, s)
+    }
+  }
+  updated.Refs++
+  if err := this.update(func(tx datastore.Tx) error {
+    return tx.Put(PoolsBucket, id, &updated)
+  }); err != nil {
+    return nil, err
+  }
+  *pool = updated
+  this.Pools[id] = pool
+  return &RequestPoolResponse{ PoolID: id, Pool: pool.Subnet, Data: map[string]string{} }, nil
+}
+
+func (this *Driver) ReleasePool(r *ReleasePoolRequest) error {
+  log.Debugf("ReleasePool: [ %+v ]", r)
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  pool := this.Pools[r.PoolID]
+  if pool == nil {
+    return nil
+  }
+  if pool.Refs > 1 {
+    updated := *pool
+    updated.Refs--
+    if err := this.update(func(tx datastore.Tx) error {
+      return tx.Put(PoolsBucket, r.PoolID, &updated)
+    }); err != nil {
+      return err
+    }
+    pool.Refs--
+    return nil
+  }
+  /* The last reference, the pool goes with its leases */
+  if err := this.update(func(tx datastore.Tx) error {
+    keys, err := tx.Keys(LeasesBucket, leaseKey(r.PoolID, ""))
+    if err != nil {
+      return err
+    }
+    for _, key := range keys {
+      if err = tx.Delete(LeasesBucket, key); err != nil {
+        return err
+      }
+    }
+    return tx.Delete(PoolsBucket, r.PoolID)
+  }); err != nil {
+    return err
+  }
+  delete(this.Pools, r.PoolID)
+  return nil
+}
+
+func (this *Driver) RequestAddress(r *RequestAddressRequest) (*RequestAddressResponse, error) {
+  log.Debugf("RequestAddress: [ %+v ]", r)
+  var ip net.IP
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  pool := this.Pools[r.PoolID]
+  if pool == nil {
+    return nil, types.NotFoundErrorf("Pool not found: %s", r.PoolID)
+  }
+  lease := &Lease {
+    MacAddress: r.Options[MacAddressOption],
+    Gateway:    r.Options[RequestAddressType] == GatewayAddressType,
+  }
+  if r.Address != "" {
+    if ip = net.ParseIP(r.Address); ip == nil || !pool.usable(ip) {
+      return nil, types.BadRequestErrorf("Invalid address: %s", r.Address)
+    }
+    if _, ok := pool.reserved(ip); ok {
+      return nil, types.ForbiddenErrorf("Address %s is reserved.", r.Address)
+    }
+    if old := pool.Leases[ip.String()]; old != nil && *old != *lease {
+      return nil, types.ForbiddenErrorf("Address %s already in use.", r.Address)
+    }
+  } else if ip = pool.nextFree(); ip == nil {
+    return nil, types.NoServiceErrorf("No address available in pool %s.", r.PoolID)
+  }
+  if err := this.update(func(tx datastore.Tx) error {
+    return tx.Put(LeasesBucket, leaseKey(r.PoolID, ip.String()), lease)
+  }); err != nil {
+    return nil, err
+  }
+  pool.Leases[ip.String()] = lease
+  return &RequestAddressResponse{ Address: pool.cidr(ip), Data: map[string]string{} }, nil
+}
+
+func (this *Driver) ReleaseAddress(r *ReleaseAddressRequest) error {
+  log.Debugf("ReleaseAddress: [ %+v ]", r)
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if pool := this.Pools[r.PoolID]; pool != nil {
+    if ip := net.ParseIP(r.Address); ip != nil && pool.Leases[ip.String()] != nil {
+      if err := this.update(func(tx datastore.Tx) error {
+        return tx.Delete(LeasesBucket, leaseKey(r.PoolID, ip.String()))
+      }); err != nil {
+        return err
+      }
+      delete(pool.Leases, ip.String())
+    }
+  }
+  return nil
+}
+
+/* ReleaseEndpoint frees the leases of a deleted endpoint of a network on sock.
+   Only leases owned by mac are released, libnetwork may release them later too. */
+func (this *Driver) ReleaseEndpoint(sock, mac string, addrs ...string) {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  var released []struct{ id, address string }
+  for _, addr := range addrs {
+    ip, _, err := net.ParseCIDR(addr)
+    if err != nil {
+      continue
+    }
+    for id, pool := range this.Pools {
+      if pool.Sock != "" && pool.Sock != sock {
+        continue
+      }
+      if lease := pool.Leases[ip.String()]; lease != nil && lease.MacAddress == mac {
+        released = append(released, struct{ id, address string }{ id, ip.String() })
+      }
+    }
+  }
+  if len(released) == 0 {
+    return
+  }
+  /* On error the leases are kept, libnetwork may release them later */
+  if err := this.update(func(tx datastore.Tx) error {
+    for _, r := range released {
+      if err := tx.Delete(LeasesBucket, leaseKey(r.id, r.address)); err != nil {
+        return err
+      }
+    }
+    return nil
+  }); err != nil {
+    return
+  }
+  for _, r := range released {
+    delete(this.Pools[r.id].Leases, r.address)
+  }
+}
@@ -0,0 +1,137 @@
+package vdeipam
+
+import (
+  "os"
+  "strings"
+  log "github.com/Sirupsen/logrus"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/datastore"
+)
+
+/* Each pool, with its reserved addresses, and each lease is a record of the
+   datastore of the driver, next to the ones of the networks */
+const (
+  PoolsBucket  = "ipam-pools"
+  LeasesBucket = "ipam-leases"
+  /* Suffix of the document of the previous versions, once imported */
+  ImportedSuffix = ".imported"
+)
+
+/* leaseKey is the key of the lease of address, the ones of a pool share the prefix leaseKey(id, "") */
+func leaseKey(id, address string) string {
+  return id + "|" + address
+}
+
+/* load reads the pools and their leases from the datastore */
+func (this *Driver) load() error {
+  return this.store.View(func(tx datastore.Tx) error {
+    ids, err := tx.Keys(PoolsBucket, "")
+    if err != nil {
+      return err
+    }
+    for _, id := range ids {
+      pool := &Pool{}
+      if err = tx.Get(PoolsBucket, id, pool); err != nil {
+        return err
+      }
+      pool.Leases = make(map[string]*Lease)
+      keys, err := tx.Keys(LeasesBucket, leaseKey(id, ""))
+      if err != nil {
+        return err
+      }
+      for _, key := range keys {
+        lease := &Lease{}
+        if err = tx.Get(LeasesBucket, key, lease); err != nil {
+          return err
+        }
+        pool.Leases[strings.TrimPrefix(key, leaseKey(id, ""))] = lease
+      }
+      this.Pools[id] = pool
+    }
+    return nil
+  })
+}
+
+/* update runs fn in a transaction of the datastore: the caller changes the
+   pools in memory only if it succeeds */
+func (this *Driver) update(fn func(tx datastore.Tx) error) error {
+  if err := this.store.Update(fn); err != nil {
+    log.Warnf("Datastore.Update: [ %s ]", err)
+    return types.InternalErrorf("Failed datastore update: %s", err)
+  }
+  return nil
+}
+
+/* clean removes the records of the pools and of the leases */
+func (this *Driver) clean() error {
+  return this.update(func(tx datastore.Tx) error {
+    for _, bucket := range []string{ PoolsBucket, LeasesBucket } {
+      keys, err := tx.Keys(bucket, "")
+      if err != nil {
+        return err
+      }
+      for _, key := range keys {
+        if err = tx.Delete(bucket, key); err != nil {
+          return err
+        }
+      }
+    }
+    return nil
+  })
+}
+
+/* filePool is a pool in the document of the previous versions, with its leases */
+type filePool struct {
+  *Pool
+  Leases map[string]*Lease `json:"Leases"`
+}
+
+/* Import moves the pools of the JSON document at path, written by the previous
+   versions, into the datastore of the driver unless it has pools already. The
+   document is kept with ImportedSuffix. */
+func (this *Driver) Import(path string) error {
+  if _, err := os.Stat(path); err != nil {
+    return nil
+  }
+  var doc struct {
+    Pools map[string]*filePool `json:"Pools"`
+  }
+  if err := datastore.New(path).Load(&doc); err != nil {
+    return err
+  }
+  for id, fp := range doc.Pools {
+    if fp == nil || fp.Pool == nil {
+      delete(doc.Pools, id)
+    }
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if len(this.Pools) > 0 {
+    log.Warnf("IPAM [ %s ] not imported: [ the datastore has pools ]", path)
+    return nil
+  }
+  if err := this.update(func(tx datastore.Tx) error {
+    for id, fp := range doc.Pools {
+      if err := tx.Put(PoolsBucket, id, fp.Pool); err != nil {
+        return err
+      }
+      for address, lease := range fp.Leases {
+        if err := tx.Put(LeasesBucket, leaseKey(id, address), lease); err != nil {
+          return err
+        }
+      }
+    }
+    return nil
+  }); err != nil {
+    return err
+  }
+  for id, fp := range doc.Pools {
+    fp.Pool.Leases = fp.Leases
+    if fp.Pool.Leases == nil {
+      fp.Pool.Leases = make(map[string]*Lease)
+    }
+    this.Pools[id] = fp.Pool
+  }
+  log.Infof("IPAM [ %s ] imported: [ %d pools ]", path, len(doc.Pools))
+  return os.Rename(path, path + ImportedSuffix)
+}
@@ -0,0 +1,134 @@
+package vdeipam
+
+import (
+  "errors"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+  "github.com/phocs/vde_plug_docker/datastore"
+)
+
+/* failingStore fails the updates once fail is set */
+type failingStore struct {
+  datastore.Store
+  fail bool
+}
+
+func (this *failingStore) Update(fn func(tx datastore.Tx) error) error {
+  if this.fail {
+    return errors.New("disk full")
+  }
+  return this.Store.Update(fn)
+}
+
+func requestPool(t *testing.T, d *Driver, subnet, reserved string) string {
+  r, err := d.RequestPool(&RequestPoolRequest{ Pool: subnet, Options: map[string]string{ SockOption: "vde:///tmp/sw", ReservedOption: reserved } })
+  if err != nil {
+    t.Fatal(err)
+  }
+  return r.PoolID
+}
+
+func requestAddress(d *Driver, id, mac string) (string, error) {
+  r, err := d.RequestAddress(&RequestAddressRequest{ PoolID: id, Options: map[string]string{ MacAddressOption: mac } })
+  if err != nil {
+    return "", err
+  }
+  return r.Address, nil
+}
+
+func TestDriverStore(t *testing.T) {
+  dir, err := ioutil.TempDir("", "vdeipam")
+  if err != nil {
+    t.Fatal(err)
+  }
+  url := "bolt://" + filepath.Join(dir, "vde.db")
+  store, err := datastore.Open(url)
+  if err != nil {
+    t.Fatal(err)
+  }
+  d := NewDriver(store, false)
+  id := requestPool(t, d, "10.0.0.0/29", "10.0.0.1")
+  requestPool(t, d, "10.0.0.0/29", "10.0.0.2")
+  a1, _ := requestAddress(d, id, "02:00:00:00:00:01")
+  a2, _ := requestAddress(d, id, "02:00:00:00:00:02")
+  if a1 != "10.0.0.3/29" || a2 != "10.0.0.4/29" {
+    t.Errorf("addresses %s %s", a1, a2)
+  }
+  d.ReleaseEndpoint("vde:///tmp/sw", "02:00:00:00:00:01", a1)
+  store.Close()
+
+  /* A new instance finds the pool, its references and the leases left */
+  if store, err = datastore.Open(url); err != nil {
+    t.Fatal(err)
+  }
+  failing := &failingStore{ Store: store }
+  d = NewDriver(failing, false)
+  pool := d.Pools[id]
+  if pool == nil || pool.Refs != 2 || len(pool.Reserved) != 2 || len(pool.Leases) != 1 || pool.Leases["10.0.0.4"] == nil {
+    t.Fatalf("pool loaded %+v", pool)
+  }
+
+  /* A failed update changes nothing */
+  failing.fail = true
+  if _, err := requestAddress(d, id, "02:00:00:00:00:03"); err == nil || len(pool.Leases) != 1 {
+    t.Errorf("RequestAddress on a failed update: %v, %d leases", err, len(pool.Leases))
+  }
+  if err := d.ReleaseAddress(&ReleaseAddressRequest{ PoolID: id, Address: "10.0.0.4" }); err == nil || len(pool.Leases) != 1 {
+    t.Errorf("ReleaseAddress on a failed update: %v, %d leases", err, len(pool.Leases))
+  }
+  if _, err := d.RequestPool(&RequestPoolRequest{ Pool: "10.0.0.0/29", Options: map[string]string{ SockOption: "vde:///tmp/sw" } }); err == nil || pool.Refs != 2 {
+    t.Errorf("RequestPool on a failed update: %v, %d references", err, pool.Refs)
+  }
+  if err := d.ReleasePool(&ReleasePoolRequest{ PoolID: id }); err == nil || pool.Refs != 2 {
+    t.Errorf("ReleasePool on a failed update: %v, %d references", err, pool.Refs)
+  }
+  failing.fail = false
+
+  /* The last reference takes the leases with the pool */
+  d.ReleasePool(&ReleasePoolRequest{ PoolID: id })
+  d.ReleasePool(&ReleasePoolRequest{ PoolID: id })
+  store.View(func(tx datastore.Tx) error {
+    for _, bucket := range []string{ PoolsBucket, LeasesBucket } {
+      if keys, _ := tx.Keys(bucket, ""); len(keys) != 0 {
+        t.Errorf("%s left: %v", bucket, keys)
+      }
+    }
+    return nil
+  })
+  store.Close()
+}
+
+func TestDriverImport(t *testing.T) {
+  dir, err := ioutil.TempDir("", "vdeipam")
+  if err != nil {
+    t.Fatal(err)
+  }
+  path := filepath.Join(dir, "vde_plug_docker_ipam.json")
+  doc := `{"Version":0,"Data":{"Pools":{"vde:///tmp/sw|10.0.0.0/24":{"Sock":"vde:///tmp/sw","Subnet":"10.0.0.0/24","Range":"","V6":false,"Refs":1,` +
+    `"Reserved":["10.0.0.9"],"Leases":{"10.0.0.1":{"MacAddress":"","Gateway":true},"10.0.0.2":{"MacAddress":"02:00:00:00:00:01","Gateway":false}}}}}}`
+  if err := ioutil.WriteFile(path, []byte(doc), datastore.OpenMode); err != nil {
+    t.Fatal(err)
+  }
+  store := datastore.NewMemoryStore()
+  d := NewDriver(store, false)
+  if err := d.Import(path); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := ioutil.ReadFile(path + ImportedSuffix); err != nil {
+    t.Errorf("document not kept: %s", err)
+  }
+  /* The records are in the store */
+  d = NewDriver(store, false)
+  pool := d.Pools["vde:///tmp/sw|10.0.0.0/24"]
+  if pool == nil || pool.Refs != 1 || len(pool.Reserved) != 1 || len(pool.Leases) != 2 || !pool.Leases["10.0.0.1"].Gateway {
+    t.Fatalf("pool imported %+v", pool)
+  }
+  if a, _ := requestAddress(d, "vde:///tmp/sw|10.0.0.0/24", "02:00:00:00:00:02"); a != "10.0.0.3/24" {
+    t.Errorf("address after the import %s", a)
+  }
+  /* Nothing more to import */
+  if err := d.Import(path); err != nil {
+    t.Errorf("Import of a missing document: %s", err)
+  }
+}
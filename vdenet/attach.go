@@ -0,0 +1,198 @@
+package vdenet
+
+import (
+  "net"
+  "strings"
+  log "github.com/Sirupsen/logrus"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/dns"
+  "github.com/phocs/vde_plug_docker/endpoint"
+  "github.com/docker/go-plugins-helpers/network"
+)
+
+/* AttachRequest connects a container of a runtime other than Docker (e.g.
+   Podman) to a network: the endpoint is created and joined in one step, and
+   the tap is set up in SandboxKey by the driver itself */
+type AttachRequest struct {
+  /* ID or unique ID prefix of the network */
+  NetworkID  string
+  EndpointID string
+  SandboxKey string
+  /* Name of the interface in the sandbox */
+  IfName     string
+  /* Random if empty */
+  MacAddress string
+  /* CIDR addresses, at most one for each family */
+  Addresses  []string
+  Routes     []endpoint.Route
+  /* Names of the container on the DNS server of the network, the invalid ones are skipped */
+  Names      []string
+}
+
+type AttachResponse struct {
+  NetworkID  string
+  MacAddress string
+  /* Address and domain of the DNS server of the network, if any */
+  DNS        string `json:",omitempty"`
+  DNSDomain  string `json:",omitempty"`
+}
+
+/* lookup returns the network whose ID is netid or starts with it, the caller holds the lock */
+func (this *Driver) lookup(netid string) (string, *NetworkStat, error) {
+  if netw := this.Networks[netid]; netw != nil {
+    return netid, netw, nil
+  }
+  var found string
+  for nwkey := range this.Networks {
+    if netid != "" && strings.HasPrefix(nwkey, netid) {
+      if found != "" {
+        return "", nil, types.BadRequestErrorf("Network ID prefix %s is ambiguous.", netid)
+      }
+      found = nwkey
+    }
+  }
+  if found == "" {
+    return "", nil, types.NotFoundErrorf("Network not found.")
+  }
+  return found, this.Networks[found], nil
+}
+
+/* EnsureNetwork creates the network, unless it exists already */
+func (this *Driver) EnsureNetwork(r *network.CreateNetworkRequest) error {
+  log.Debugf("EnsureNetwork: [ %+v ]", r)
+  netw, err := this.newNetwork(r)
+  if err != nil {
+    return err
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if old := this.Networks[r.NetworkID]; old != nil {
+    if old.Sock != netw.Sock {
+      return types.ForbiddenErrorf("Network exists with sock %s.", old.Sock)
+    }
+    return nil
+  }
+  return this.addNetwork(r.NetworkID, netw)
+}
+
+func (this *Driver) Attach(r *AttachRequest) (*AttachResponse, error) {
+  log.Debugf("Attach: [ %+v ]", r)
+  if len(r.EndpointID) < 11 {
+    return nil, types.BadRequestErrorf("EndpointID too short.")
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  netid, netw, err := this.lookup(r.NetworkID)
+  if err != nil {
+    return nil, err
+  }
+  if netw.Endpoints[r.EndpointID] != nil {
+    return nil, types.BadRequestErrorf("EndpointID already exists.")
+  }
+  edpt := &endpoint.EndpointStat{ IfName: "vde" + r.EndpointID[:11], MacAddress: r.MacAddress, LinkConfig: netw.LinkConfig }
+  if edpt.MacAddress == "" {
+    edpt.MacAddress = endpoint.RandomMacAddr()
+  }
+  for _, name := range r.Names {
+    if dns.ValidName(name) {
+      edpt.DNSNames = append(edpt.DNSNames, name)
+    } else {
+      log.Debugf("Attach [ %s ] DNS name skipped: [ %s ]", r.EndpointID, name)
+    }
+  }
+  if err := edpt.LinkAdd(); err != nil {
+    return nil, types.RetryErrorf("Failed link create: %s", err)
+  }
+  /* The addresses are set in the sandbox, not on the host */
+  for _, addr := range r.Addresses {
+    ip, _, err := net.ParseCIDR(addr)
+    if err != nil {
+      edpt.LinkDel()
+      return nil, types.BadRequestErrorf("Invalid address %s.", addr)
+    }
+    if ip.To4() != nil && edpt.IPv4Address == "" {
+      edpt.IPv4Address = addr
+    } else if ip.To4() == nil && edpt.IPv6Address == "" {
+      edpt.IPv6Address = addr
+    } else {
+      edpt.LinkDel()
+      return nil, types.BadRequestErrorf("Only one address for each family.")
+    }
+  }
+  if this.global() {
+    if err := this.claimAddresses(netid, r.EndpointID, edpt); err != nil {
+      edpt.LinkDel()
+      return nil, types.ForbiddenErrorf("%s", err)
+    }
+  }
+  if err := this.reserveAddresses(netid, r.EndpointID, edpt); err != nil {
+    edpt.LinkDel()
+    if this.global() {
+      this.releaseAddresses(netid, r.EndpointID, edpt)
+    }
+    return nil, types.ForbiddenErrorf("%s", err)
+  }
+  filter, err := this.plugFilter(netw, edpt)
+  if err == nil {
+    if err = edpt.LinkPlugTo(this.plugURL(netw), filter); err != nil {
+      err = types.NotFoundErrorf("Failed plug to interface: %s", err)
+    }
+  }
+  if err != nil {
+    edpt.LinkDel()
+    if this.global() {
+      this.releaseAddresses(netid, r.EndpointID, edpt)
+    }
+    this.unreserveAddresses(netid, edpt)
+    return nil, err
+  }
+  this.limit(netw, edpt)
+  this.capture(netid, r.EndpointID, edpt)
+  if err := edpt.LinkMoveTo(r.SandboxKey, r.IfName, mergeRoutes(netw.Routes, r.Routes)); err != nil {
+    edpt.LinkPlugStop()
+    edpt.LinkDel()
+    if this.global() {
+      this.releaseAddresses(netid, r.EndpointID, edpt)
+    }
+    this.unreserveAddresses(netid, edpt)
+    return nil, types.InternalErrorf("Failed link setup in %s: %s", r.SandboxKey, err)
+  }
+  netw.Endpoints[r.EndpointID] = edpt
+  this.addNames(netid, r.EndpointID, edpt)
+  this.storeEndpoint(netid, r.EndpointID, edpt)
+  return &AttachResponse{ NetworkID: netid, MacAddress: edpt.MacAddress, DNS: netw.DNS, DNSDomain: netw.DNSDomain }, nil
+}
+
+/* Detach unplugs and deletes an endpoint created by Attach, it succeeds if it is gone already */
+func (this *Driver) Detach(netid, epid string) error {
+  log.Debugf("Detach: [ %s ] [ %s ]", netid, epid)
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  netid, netw, err := this.lookup(netid)
+  if err != nil {
+    if _, ok := err.(types.NotFoundError); ok {
+      return nil
+    }
+    return err
+  }
+  edpt := netw.Endpoints[epid]
+  if edpt == nil {
+    return nil
+  }
+  edpt.LinkPlugStop()
+  if err := edpt.LinkDel(); err != nil {
+    log.Debugf("Detach [ %s ] LinkDel: [ %s ]", epid, err)
+  }
+  if this.global() {
+    this.releaseAddresses(netid, epid, edpt)
+  }
+  if this.ipam != nil {
+    this.ipam.ReleaseEndpoint(netw.Sock, edpt.MacAddress, edpt.IPv4Address, edpt.IPv6Address)
+  }
+  this.unreserveAddresses(netid, edpt)
+  this.removeNames(netid, epid)
+  this.removeRules(netid, epid)
+  delete(netw.Endpoints, epid)
+  this.removeEndpoint(netid, epid)
+  return nil
+}
@@ -0,0 +1,239 @@
+package vdenet
+
+import (
+  "os"
+  "sort"
+  "time"
+  "strings"
+  "path/filepath"
+  log "github.com/Sirupsen/logrus"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/packet"
+  "github.com/phocs/vde_plug_docker/endpoint"
+)
+
+/* CaptureRequest starts writing the frames of an endpoint, or of all the
+   endpoints of a network, also the ones that join later, to pcapng files */
+type CaptureRequest struct {
+  /* ID or unique ID prefix of the network */
+  NetworkID  string
+  /* ID or unique ID prefix of the endpoint, all the endpoints if empty */
+  EndpointID string
+  /* Classic BPF program, see packet.ParseBPF, all the frames if empty */
+  Filter     string
+  /* Absolute path of the directory of the files on the host of the plugin */
+  Dir        string
+  /* Bytes kept of each frame, endpoint.CaptureSnaplen if 0 */
+  Snaplen    int
+  /* A new file after RotateSize bytes or RotateTime, 0 for never */
+  RotateSize int64
+  RotateTime time.Duration
+  /* Files kept, the oldest ones are removed, 0 for all */
+  Files      int
+}
+
+type CaptureInfo struct {
+  NetworkID  string
+  EndpointID string `json:",omitempty"`
+  Filter     string `json:",omitempty"`
+  Started    time.Time
+  endpoint.CaptureStatus
+}
+
+type capture struct {
+  *endpoint.Capture
+  netid   string
+  epid    string
+  filter  string
+  started time.Time
+}
+
+func (this *capture) info() CaptureInfo {
+  return CaptureInfo{ NetworkID: this.netid, EndpointID: this.epid, Filter: this.filter,
+    Started: this.started, CaptureStatus: this.Status() }
+}
+
+func captureKey(netid, epid string) string {
+  return netid + "/" + epid
+}
+
+func shortID(id string) string {
+  if len(id) > 12 {
+    return id[:12]
+  }
+  return id
+}
+
+/* lookupEndpoint returns the endpoint of netw whose ID is epid or starts with it */
+func lookupEndpoint(netw *NetworkStat, epid string) (string, error) {
+  if netw.Endpoints[epid] != nil {
+    return epid, nil
+  }
+  var found string
+  for epkey := range netw.Endpoints {
+    if epid != "" && strings.HasPrefix(epkey, epid) {
+      if found != "" {
+        return "", types.BadRequestErrorf("Endpoint ID prefix %s is ambiguous.", epid)
+      }
+      found = epkey
+    }
+  }
+  if found == "" {
+    return "", types.NotFoundErrorf("Endpoint not found.")
+  }
+  return found, nil
+}
+
+/* StartCapture starts the capture of r, one at a time for each network and endpoint */
+func (this *Driver) StartCapture(r *CaptureRequest) (*CaptureInfo, error) {
+  log.Debugf("StartCapture: [ %+v ]", r)
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  netid, netw, err := this.lookup(r.NetworkID)
+  if err != nil {
+    return nil, err
+  }
+  epid := ""
+  if r.EndpointID != "" {
+    if epid, err = lookupEndpoint(netw, r.EndpointID); err != nil {
+      return nil, err
+    }
+  }
+  key := captureKey(netid, epid)
+  if this.captures[key] != nil {
+    return nil, types.ForbiddenErrorf("Capture is running, files %s.", this.captures[key].Status().File)
+  }
+  config := endpoint.CaptureConfig{
+    Dir:        r.Dir,
+    Prefix:     "vde-" + shortID(netid),
+    Snaplen:    r.Snaplen,
+    RotateSize: r.RotateSize,
+    RotateTime: r.RotateTime,
+    Files:      r.Files,
+  }
+  if epid != "" {
+    config.Prefix += "-" + shortID(epid)
+  }
+  if r.Filter != "" {
+    if config.Filter, err = packet.ParseBPF(r.Filter); err != nil {
+      return nil, types.BadRequestErrorf("Invalid filter: %s.", err)
+    }
+  }
+  if !filepath.IsAbs(r.Dir) {
+    return nil, types.BadRequestErrorf("Invalid directory %s, not an absolute path.", r.Dir)
+  }
+  if r.Snaplen < 0 || r.RotateSize < 0 || r.RotateTime < 0 || r.Files < 0 {
+    return nil, types.BadRequestErrorf("Invalid snaplen, rotation or files.")
+  }
+  if err = os.MkdirAll(r.Dir, 0750); err != nil {
+    return nil, types.InternalErrorf("%s", err)
+  }
+  c := &capture{ netid: netid, epid: epid, filter: r.Filter, started: time.Now() }
+  if c.Capture, err = endpoint.NewCapture(config); err != nil {
+    return nil, types.InternalErrorf("%s", err)
+  }
+  this.captures[key] = c
+  for epkey, ep := range netw.Endpoints {
+    if epid == "" || epkey == epid {
+      this.capture(netid, epkey, ep)
+    }
+  }
+  log.Infof("Capture [ %s ] [ %s ] started: [ %s ]", netid, epid, c.Status().File)
+  info := c.info()
+  return &info, nil
+}
+
+/* StopCapture stops the capture started with the same network and endpoint
+   and returns its last state, the endpoint may be gone already */
+func (this *Driver) StopCapture(netid, epid string) (*CaptureInfo, error) {
+  log.Debugf("StopCapture: [ %s ] [ %s ]", netid, epid)
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  netid, netw, err := this.lookup(netid)
+  if err != nil {
+    return nil, err
+  }
+  var found *capture
+  for _, c := range this.captures {
+    if c.netid == netid && (c.epid == epid || epid != "" && strings.HasPrefix(c.epid, epid)) {
+      if found != nil {
+        return nil, types.BadRequestErrorf("Endpoint ID prefix %s is ambiguous.", epid)
+      }
+      found = c
+    }
+  }
+  if found == nil {
+    return nil, types.NotFoundErrorf("Capture not found.")
+  }
+  this.stopCapture(netw, found)
+  info := found.info()
+  return &info, nil
+}
+
+/* stopCapture removes c from the plugs and closes its file, the caller holds the lock */
+func (this *Driver) stopCapture(netw *NetworkStat, c *capture) {
+  delete(this.captures, captureKey(c.netid, c.epid))
+  for epkey, ep := range netw.Endpoints {
+    if c.epid == "" || epkey == c.epid {
+      this.capture(c.netid, epkey, ep)
+    }
+  }
+  if err := c.Close(); err != nil {
+    log.Warnf("Capture [ %s ] close: [ %s ]", c.Status().File, err)
+  }
+  log.Infof("Capture [ %s ] [ %s ] stopped", c.netid, c.epid)
+}
+
+/* stopCaptures stops the captures of netid, of all the networks if empty */
+func (this *Driver) stopCaptures(netid string) {
+  for _, c := range this.captures {
+    if netid == "" || c.netid == netid {
+      this.stopCapture(this.Networks[c.netid], c)
+    }
+  }
+}
+
+/* Captures returns the running captures */
+func (this *Driver) Captures() []CaptureInfo {
+  this.mutex.RLock()
+  defer this.mutex.RUnlock()
+  var keys []string
+  for key := range this.captures {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  infos := []CaptureInfo{}
+  for _, key := range keys {
+    infos = append(infos, this.captures[key].info())
+  }
+  return infos
+}
+
+/* capture gives the plug of edpt to the captures of its network and of itself */
+func (this *Driver) capture(netid, epid string, edpt *endpoint.EndpointStat) {
+  if edpt.Plugger == nil {
+    return
+  }
+  var taps []func(frame []byte, out bool)
+  for _, c := range this.captures {
+    if c.netid == netid && (c.epid == "" || c.epid == epid) {
+      taps = append(taps, c.Tap(shortID(epid), edpt.IfName + " " + edpt.MacAddress))
+    }
+  }
+  var err error
+  switch len(taps) {
+  case 0:
+    err = edpt.LinkCapture(nil)
+  case 1:
+    err = edpt.LinkCapture(taps[0])
+  default:
+    err = edpt.LinkCapture(func(frame []byte, out bool) {
+      for _, tap := range taps {
+        tap(frame, out)
+      }
+    })
+  }
+  if err != nil {
+    log.Warnf("Endpoint [ %s ] capture: [ %s ]", edpt.IfName, err)
+  }
+}
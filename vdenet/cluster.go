@@ -0,0 +1,135 @@
+package vdenet
+
+import (
+  "strings"
+  log "github.com/Sirupsen/logrus"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/cluster"
+  "github.com/phocs/vde_plug_docker/endpoint"
+  "github.com/docker/go-plugins-helpers/network"
+)
+
+/* Same value of discoverapi.NodeDiscovery in libnetwork */
+const NodeDiscovery = 1
+
+func (this *Driver) global() bool {
+  return this.Scope == network.GlobalScope && this.cluster != nil
+}
+
+/* sharedNetwork completes a CreateNetworkRequest with the cluster definition of the network */
+func (this *Driver) sharedNetwork(r *network.CreateNetworkRequest, opt map[string]interface{}) error {
+  nw, err := this.cluster.GetNetwork(r.NetworkID)
+  if err == cluster.ErrNotFound {
+    /* Not allocated by a manager: this host defines it */
+    return nil
+  } else if err != nil {
+    return err
+  }
+  for key, value := range nw.Options {
+    if _, ok := opt[key]; !ok {
+      opt[key] = value
+    }
+  }
+  if len(r.IPv4Data) == 0 && nw.IPv4Pool != "" {
+    r.IPv4Data = []*network.IPAMData{ { Pool: nw.IPv4Pool, Gateway: nw.IPv4Gateway } }
+  }
+  if len(r.IPv6Data) == 0 && nw.IPv6Pool != "" {
+    r.IPv6Data = []*network.IPAMData{ { Pool: nw.IPv6Pool, Gateway: nw.IPv6Gateway } }
+  }
+  return nil
+}
+
+func addrOnly(cidr string) string {
+  return strings.Split(cidr, "/")[0]
+}
+
+/* claimAddresses reserves the addresses of edpt in the whole cluster */
+func (this *Driver) claimAddresses(netid, epid string, edpt *endpoint.EndpointStat) error {
+  claim := cluster.Claim{ Host: this.Host, Endpoint: epid }
+  var claimed []string
+  for _, addr := range []string{ edpt.IPv4Address, edpt.IPv6Address } {
+    if addr == "" {
+      continue
+    }
+    if err := this.cluster.ClaimAddress(netid, addrOnly(addr), claim); err != nil {
+      for _, done := range claimed {
+        this.cluster.ReleaseAddress(netid, done, claim)
+      }
+      return err
+    }
+    claimed = append(claimed, addrOnly(addr))
+  }
+  return nil
+}
+
+func (this *Driver) releaseAddresses(netid, epid string, edpt *endpoint.EndpointStat) {
+  claim := cluster.Claim{ Host: this.Host, Endpoint: epid }
+  for _, addr := range []string{ edpt.IPv4Address, edpt.IPv6Address } {
+    if addr == "" {
+      continue
+    }
+    if err := this.cluster.ReleaseAddress(netid, addrOnly(addr), claim); err != nil {
+      log.Warnf("Release address [ %s ]: [ %s ]", addr, err)
+    }
+  }
+}
+
+/* AllocateNetwork is called on the manager, the definition is shared with the other hosts */
+func (this *Driver) AllocateNetwork(r *network.AllocateNetworkRequest) (*network.AllocateNetworkResponse, error) {
+  log.Debugf("Allocatenetwork Request: [ %+v ]", r)
+  if !this.global() {
+    return nil, types.NotImplementedErrorf("Global scope not enabled.")
+  }
+  if r.Options["sock"] == "" {
+    return nil, types.BadRequestErrorf("Sock URL miss.")
+  }
+  nw := &cluster.Network{ NetworkID: r.NetworkID, Options: r.Options }
+  if len(r.IPv4Data) > 0 {
+    nw.IPv4Pool, nw.IPv4Gateway = r.IPv4Data[0].Pool, r.IPv4Data[0].Gateway
+  }
+  if len(r.IPv6Data) > 0 {
+    nw.IPv6Pool, nw.IPv6Gateway = r.IPv6Data[0].Pool, r.IPv6Data[0].Gateway
+  }
+  if err := this.cluster.PutNetwork(nw); err != nil {
+    return nil, types.InternalErrorf("Cluster store: %s", err)
+  }
+  return &network.AllocateNetworkResponse{ Options: r.Options }, nil
+}
+
+func (this *Driver) FreeNetwork(r *network.FreeNetworkRequest) error {
+  log.Debugf("Freenetwork Request: [ %+v ]", r)
+  if !this.global() {
+    return types.NotImplementedErrorf("Global scope not enabled.")
+  }
+  if err := this.cluster.DeleteNetwork(r.NetworkID); err != nil {
+    return types.InternalErrorf("Cluster store: %s", err)
+  }
+  return nil
+}
+
+func discoveryNode(r *network.DiscoveryNotification) (string, bool, bool) {
+  if r.DiscoveryType != NodeDiscovery {
+    return "", false, false
+  }
+  data, _ := r.DiscoveryData.(map[string]interface{})
+  addr, _ := data["Address"].(string)
+  self, _ := data["Self"].(bool)
+  return addr, self, addr != ""
+}
+
+func (this *Driver) DiscoverNew(r *network.DiscoveryNotification) error {
+  log.Debugf("DISCOVER NEW Called: [ %+v ]", r)
+  if addr, self, ok := discoveryNode(r); ok && self && this.global() {
+    return this.cluster.SetNode(this.Host, addr)
+  }
+  return nil
+}
+
+/* DiscoverDelete frees the addresses claimed by a node that left the cluster */
+func (this *Driver) DiscoverDelete(r *network.DiscoveryNotification) error {
+  log.Debugf("DISCOVER DELETE Called: [ %+v ]", r)
+  if addr, _, ok := discoveryNode(r); ok && this.global() {
+    return this.cluster.ReleaseNode(addr)
+  }
+  return nil
+}
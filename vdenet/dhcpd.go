@@ -0,0 +1,181 @@
+package vdenet
+
+import (
+  "net"
+  "strings"
+  "strconv"
+  log "github.com/Sirupsen/logrus"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/dhcp"
+  "github.com/phocs/vde_plug_docker/endpoint"
+  "github.com/phocs/vde_plug_docker/datastore"
+)
+
+/* The bindings of the DHCP servers, one record per address */
+const LeasesBucket = "dhcp-leases"
+
+/* dhcpOptions validates the options of the DHCP server in opt */
+func (this *Driver) dhcpOptions(opt map[string]interface{}, netw *NetworkStat) error {
+  enable, _ := opt["dhcp-server"].(string)
+  iprange, _ := opt["dhcp-range"].(string)
+  if on, err := strconv.ParseBool(enable); enable != "" && err != nil {
+    return types.BadRequestErrorf("Invalid dhcp-server %s.", enable)
+  } else if !on {
+    if iprange != "" {
+      return types.BadRequestErrorf("dhcp-range without dhcp-server.")
+    }
+    return nil
+  }
+  if this.global() {
+    return types.BadRequestErrorf("dhcp-server is not supported on global scope networks.")
+  }
+  if netw.IPAM == IPAMDHCP {
+    return types.BadRequestErrorf("dhcp-server and ipam=dhcp are exclusive.")
+  }
+  if _, err := serverAddress(netw.IPv4Pool); err != nil {
+    return types.BadRequestErrorf("%s", err)
+  }
+  for _, r := range strings.Split(iprange, ",") {
+    if r == "" {
+      continue
+    }
+    first, _, err := dhcp.ParseRange(r)
+    if err != nil {
+      return types.BadRequestErrorf("%s", err)
+    }
+    pool := netw.IPv4Pool
+    if first.To4() == nil {
+      pool = netw.IPv6Pool
+    }
+    if _, subnet, err := net.ParseCIDR(pool); err != nil || !subnet.Contains(first) {
+      return types.BadRequestErrorf("dhcp-range %s out of the subnets of the network.", r)
+    }
+  }
+  netw.DHCPServer, netw.DHCPRange = endpoint.RandomMacAddr(), iprange
+  return nil
+}
+
+/* serverAddress is the address of the DHCP server: the last one of pool */
+func serverAddress(pool string) (string, error) {
+  _, subnet, err := net.ParseCIDR(pool)
+  if err != nil || subnet.IP.To4() == nil {
+    return "", types.BadRequestErrorf("dhcp-server needs an IPv4 subnet.")
+  }
+  if ones, _ := subnet.Mask.Size(); ones > 30 {
+    return "", types.BadRequestErrorf("Subnet %s too small for dhcp-server.", pool)
+  }
+  ip := subnet.IP.To4()
+  last := make(net.IP, net.IPv4len)
+  for i := range last {
+    last[i] = ip[i] | ^subnet.Mask[i]
+  }
+  last[3]--
+  return (&net.IPNet{ IP: last, Mask: subnet.Mask }).String(), nil
+}
+
+/* loadBindings reads the bindings of the DHCP server of a network */
+func (this *Driver) loadBindings(netid string) []*dhcp.Binding {
+  var bindings []*dhcp.Binding
+  err := this.store.View(func(tx datastore.Tx) error {
+    keys, err := tx.Keys(LeasesBucket, endpointKey(netid, ""))
+    if err != nil {
+      return err
+    }
+    for _, key := range keys {
+      b := &dhcp.Binding{}
+      if err = tx.Get(LeasesBucket, key, b); err != nil {
+        return err
+      }
+      bindings = append(bindings, b)
+    }
+    return nil
+  })
+  if err != nil {
+    log.Warnf("Network [ %s ] DHCP leases: [ %s ]", netid, err)
+  }
+  return bindings
+}
+
+/* newDHCPServer returns the DHCP server of netw, it sends the frames with send */
+func (this *Driver) newDHCPServer(netid string, netw *NetworkStat, send func(frame []byte) error) (*dhcp.Server, error) {
+  mac, _ := net.ParseMAC(netw.DHCPServer)
+  address, _ := serverAddress(netw.IPv4Pool)
+  config := dhcp.ServerConfig{
+    MAC:      mac,
+    Address:  address,
+    Subnet6:  netw.IPv6Pool,
+    Domain:   netw.DNSDomain,
+    MTU:      netw.MTU,
+    Bindings: this.loadBindings(netid),
+    Save:     func(b *dhcp.Binding, removed bool) {
+      this.update(func(tx datastore.Tx) error {
+        if removed {
+          return tx.Delete(LeasesBucket, endpointKey(netid, b.Address))
+        }
+        return tx.Put(LeasesBucket, endpointKey(netid, b.Address), b)
+      })
+    },
+  }
+  if netw.IPv4Gateway != "" {
+    config.Router = addrOnly(netw.IPv4Gateway)
+  }
+  if netw.DNS != "" {
+    config.DNS = []string{ netw.DNS }
+  }
+  for _, r := range strings.Split(netw.DHCPRange, ",") {
+    if first, _, err := dhcp.ParseRange(r); err == nil && first.To4() != nil {
+      config.Range = r
+    } else if err == nil {
+      config.Range6 = r
+    }
+  }
+  server, err := dhcp.NewServer(config, send)
+  if err != nil {
+    return nil, err
+  }
+  if netw.IPv6Gateway != "" {
+    server.Reserve(netw.IPv6Gateway, "gateway")
+  }
+  if netw.DNS != "" {
+    server.Reserve(netw.DNS, "dns")
+  }
+  for epid, edpt := range netw.Endpoints {
+    for _, addr := range []string{ edpt.IPv4Address, edpt.IPv6Address } {
+      if err := server.Reserve(addr, epid); err != nil {
+        log.Warnf("Endpoint [ %s ]: [ %s ]", epid, err)
+      }
+    }
+  }
+  log.Debugf("DHCPServer [ %s ] started: [ %s ] [ %s ]", netw.DHCPServer, address, netw.IPv6Pool)
+  return server, nil
+}
+
+/* reserveAddresses keeps the addresses of edpt away from the servers of the network */
+func (this *Driver) reserveAddresses(netid, epid string, edpt *endpoint.EndpointStat) error {
+  s := this.services[netid]
+  if s == nil {
+    return nil
+  }
+  if netw := this.Networks[netid]; netw != nil && netw.DNS != "" && addrOnly(edpt.IPv4Address) == netw.DNS {
+    return types.ForbiddenErrorf("Address %s used by the DNS server.", netw.DNS)
+  }
+  if s.dhcp == nil {
+    return nil
+  }
+  for i, addr := range []string{ edpt.IPv4Address, edpt.IPv6Address } {
+    if err := s.dhcp.Reserve(addr, epid); err != nil {
+      if i > 0 {
+        s.dhcp.Unreserve(edpt.IPv4Address)
+      }
+      return err
+    }
+  }
+  return nil
+}
+
+func (this *Driver) unreserveAddresses(netid string, edpt *endpoint.EndpointStat) {
+  if s := this.services[netid]; s != nil && s.dhcp != nil {
+    s.dhcp.Unreserve(edpt.IPv4Address)
+    s.dhcp.Unreserve(edpt.IPv6Address)
+  }
+}
@@ -0,0 +1,173 @@
+package vdenet
+
+import (
+  "os"
+  "net"
+  "bufio"
+  "strings"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/dns"
+  "github.com/phocs/vde_plug_docker/endpoint"
+)
+
+const (
+  /* Options of the endpoints with their names on the DNS server */
+  OptDNSName    = "dns-name"
+  OptDNSAliases = "dns-aliases"
+  /* -o dns-forward=none: the unknown names are NXDOMAIN */
+  DNSForwardNone = "none"
+  resolvConf     = "/etc/resolv.conf"
+)
+
+/* dnsOptions validates the options of the DNS server in opt */
+func (this *Driver) dnsOptions(opt map[string]interface{}, netw *NetworkStat) error {
+  address, _ := opt["dns"].(string)
+  domain, _ := opt["dns-domain"].(string)
+  forward, _ := opt["dns-forward"].(string)
+  if address == "" {
+    if domain != "" || forward != "" {
+      return types.BadRequestErrorf("dns-domain and dns-forward without dns.")
+    }
+    return nil
+  }
+  ip := net.ParseIP(address).To4()
+  _, subnet, err := net.ParseCIDR(netw.IPv4Pool)
+  if ip == nil || err != nil || !subnet.Contains(ip) || ip.Equal(subnet.IP) {
+    return types.BadRequestErrorf("dns %s is not an address of the IPv4 subnet of the network.", address)
+  }
+  if netw.IPv4Gateway != "" && addrOnly(netw.IPv4Gateway) == ip.String() {
+    return types.BadRequestErrorf("dns %s is the gateway of the network.", address)
+  }
+  if netw.DHCPServer != "" {
+    if server, _ := serverAddress(netw.IPv4Pool); addrOnly(server) == ip.String() {
+      return types.BadRequestErrorf("dns %s is the address of the DHCP server.", address)
+    }
+  }
+  if domain != "" && !dns.ValidName(strings.Trim(domain, ".")) {
+    return types.BadRequestErrorf("Invalid dns-domain %s.", domain)
+  }
+  if forward != "" && forward != DNSForwardNone {
+    for _, upstream := range strings.Split(forward, ",") {
+      if _, err := forwardAddress(upstream); err != nil {
+        return types.BadRequestErrorf("Invalid dns-forward %s.", upstream)
+      }
+    }
+  }
+  netw.DNS, netw.DNSDomain, netw.DNSForward = ip.String(), strings.Trim(domain, "."), forward
+  return nil
+}
+
+/* forwardAddress returns the host:port of an upstream server ip[:port], port 53 by default */
+func forwardAddress(upstream string) (string, error) {
+  if ip := net.ParseIP(strings.Trim(upstream, "[]")); ip != nil {
+    return net.JoinHostPort(ip.String(), "53"), nil
+  }
+  host, port, err := net.SplitHostPort(upstream)
+  if err == nil && net.ParseIP(host) == nil {
+    err = dns.ErrInvalidAddress
+  }
+  return net.JoinHostPort(host, port), err
+}
+
+/* hostNameservers are the DNS servers of the host */
+func hostNameservers() []string {
+  var servers []string
+  file, err := os.Open(resolvConf)
+  if err != nil {
+    return nil
+  }
+  defer file.Close()
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) >= 2 && fields[0] == "nameserver" {
+      if addr, err := forwardAddress(fields[1]); err == nil {
+        servers = append(servers, addr)
+      }
+    }
+  }
+  return servers
+}
+
+/* newDNSServer returns the DNS server of netw, it answers for the host names
+   of the DHCP leases of s as well */
+func (this *Driver) newDNSServer(netw *NetworkStat, s *services) (*dns.Server, error) {
+  config := dns.Config{
+    Address: netw.DNS,
+    MAC:     dns.ServerMAC(netw.Sock, netw.DNS),
+    Domain:  netw.DNSDomain,
+    MTU:     netw.MTU,
+  }
+  switch netw.DNSForward {
+  case "":
+    config.Forward = hostNameservers()
+  case DNSForwardNone:
+  default:
+    for _, upstream := range strings.Split(netw.DNSForward, ",") {
+      addr, _ := forwardAddress(upstream)
+      config.Forward = append(config.Forward, addr)
+    }
+  }
+  if s.dhcp != nil {
+    config.Extra = func() []dns.Record {
+      var records []dns.Record
+      for _, b := range s.dhcp.Bindings() {
+        if b.Hostname == "" || !dns.ValidName(b.Hostname) {
+          continue
+        }
+        if ip := net.ParseIP(b.Address); ip.To4() != nil {
+          records = append(records, dns.Record{ Name: b.Hostname, IPv4: b.Address })
+        } else {
+          records = append(records, dns.Record{ Name: b.Hostname, IPv6: b.Address })
+        }
+      }
+      return records
+    }
+  }
+  return dns.NewServer(config, s.send)
+}
+
+/* dnsNames reads the name and the aliases of an endpoint in the options of a request */
+func dnsNames(opt map[string]interface{}) ([]string, error) {
+  name, aliases := endpointOption(opt, OptDNSName), endpointOption(opt, OptDNSAliases)
+  var names []string
+  for _, n := range append([]string{ name }, strings.Split(aliases, ",")...) {
+    if n = strings.TrimSpace(n); n == "" {
+      continue
+    }
+    if !dns.ValidName(n) {
+      return nil, types.BadRequestErrorf("Invalid DNS name %s.", n)
+    }
+    names = append(names, n)
+  }
+  return names, nil
+}
+
+/* endpointRecords are the records of the names of edpt */
+func endpointRecords(edpt *endpoint.EndpointStat) []dns.Record {
+  var records []dns.Record
+  for _, name := range edpt.DNSNames {
+    r := dns.Record{ Name: name }
+    if edpt.IPv4Address != "" {
+      r.IPv4 = addrOnly(edpt.IPv4Address)
+    }
+    if edpt.IPv6Address != "" {
+      r.IPv6 = addrOnly(edpt.IPv6Address)
+    }
+    records = append(records, r)
+  }
+  return records
+}
+
+/* addNames publishes the names of a joined endpoint, the caller holds the lock */
+func (this *Driver) addNames(netid, epid string, edpt *endpoint.EndpointStat) {
+  if s := this.services[netid]; s != nil && s.dns != nil && len(edpt.DNSNames) > 0 {
+    s.dns.Add(epid, endpointRecords(edpt)...)
+  }
+}
+
+func (this *Driver) removeNames(netid, epid string) {
+  if s := this.services[netid]; s != nil && s.dns != nil {
+    s.dns.Remove(epid)
+  }
+}
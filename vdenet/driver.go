@@ -6,8 +6,11 @@ import (
   "strings"
   log "github.com/Sirupsen/logrus"
   "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/dhcp"
+  "github.com/phocs/vde_plug_docker/cluster"
   "github.com/phocs/vde_plug_docker/endpoint"
   "github.com/phocs/vde_plug_docker/datastore"
+  "github.com/phocs/vde_plug_docker/vdeswitch"
   "github.com/docker/go-plugins-helpers/network"
 )
 
@@ -18,52 +21,208 @@ type NetworkStat struct {
   IPv4Gateway   string                            `json:"IPv4Gateway"`
   IPv6Pool      string                            `json:"IPv6Pool"`
   IPv6Gateway   string                            `json:"IPv6Gateway"`
-  Endpoints     map[string]*endpoint.EndpointStat `json:"Endpoints"`
+  IPAM          string                            `json:"IPAM,omitempty"`
+  /* 802.1Q VLAN of the frames on the sock, 0 for untagged */
+  VLAN          uint16                            `json:"VLAN,omitempty"`
+  /* Attributes of the taps of the endpoints */
+  endpoint.LinkConfig
+  /* MAC address and ranges of the DHCP server of the network, if any */
+  DHCPServer    string                            `json:"DHCPServer,omitempty"`
+  DHCPRange     string                            `json:"DHCPRange,omitempty"`
+  /* Address, domain and upstream servers of the DNS server of the network, if any */
+  DNS           string                            `json:"DNS,omitempty"`
+  DNSDomain     string                            `json:"DNSDomain,omitempty"`
+  DNSForward    string                            `json:"DNSForward,omitempty"`
+  /* "host" if the gateway addresses are on a tap of the host, with its MAC address */
+  Gateway       string                            `json:"Gateway,omitempty"`
+  GatewayMAC    string                            `json:"GatewayMAC,omitempty"`
+  /* Outbound NAT through the host gateway */
+  Masquerade    bool                              `json:"Masquerade,omitempty"`
+  /* Frames of the endpoints with forged sources dropped */
+  AntiSpoof     bool                              `json:"AntiSpoof,omitempty"`
+  /* Rate limits of the endpoints */
+  Limits        *endpoint.Limits                  `json:"Limits,omitempty"`
+  /* Static routes of the endpoints */
+  Routes        []endpoint.Route                  `json:"Routes,omitempty"`
+  Endpoints     map[string]*endpoint.EndpointStat `json:"-"`
 }
 
 type Driver struct {
   mutex     sync.RWMutex              `json:"-"` // ignore
+  SwitchDir string                    `json:"-"`
+  Scope     string                    `json:"-"`
+  Host      string                    `json:"-"`
+  store     datastore.Store
+  cluster   cluster.Store
+  ipam      AddressReleaser
+  switches  map[string]*vdeswitch.Switch
+  services  map[string]*services
+  gateways  map[string]*endpoint.EndpointStat
+  /* Running captures, by network and endpoint ID */
+  captures  map[string]*capture
   Networks  map[string]*NetworkStat   `json:"Networks"`
 }
 
+type Config struct {
+  /* Persistent state, a MemoryStore if nil */
+  Store     datastore.Store
+  Clean     bool
+  SwitchDir string
+  /* network.LocalScope or network.GlobalScope */
+  Scope     string
+  /* Shared state of the global scope networks */
+  Cluster   cluster.Store
+  Host      string
+  /* Built-in IPAM, notified when an endpoint is deleted */
+  IPAM      AddressReleaser
+}
+
+/* AddressReleaser frees the addresses leased to the endpoints of a sock */
+type AddressReleaser interface {
+  ReleaseEndpoint(sock, mac string, addrs ...string)
+}
+
 const (
   IfPrefixDefault = "vde"
+  /* -o ipam=dhcp: the IPv4 addresses are leased by a DHCP server of the VDE network */
+  IPAMDHCP        = "dhcp"
 )
 
-func NewDriver(storepath string, clean bool) Driver {
-  driver := Driver { Networks: make(map[string]*NetworkStat), }
-  datastore.SetPath(storepath)
-  if clean == true {
-    datastore.Clean()
-  } else if err := datastore.Load(&driver); err == nil {
-    /* Check the old Driver data */
-    for nwkey, nw := range driver.Networks {
-      for epkey, ep := range nw.Endpoints {
-        if ep.Plugger == 0 || ep.LinkDel() == nil {
-          /* Container has been stopped or is running (whitout plugger) */
-          delete(driver.Networks[nwkey].Endpoints, epkey)
+func NewDriver(config Config) *Driver {
+  driver := &Driver {
+    SwitchDir: config.SwitchDir,
+    Scope:     config.Scope,
+    Host:      config.Host,
+    store:     config.Store,
+    cluster:   config.Cluster,
+    ipam:      config.IPAM,
+    switches:  make(map[string]*vdeswitch.Switch),
+    services:  make(map[string]*services),
+    gateways:  make(map[string]*endpoint.EndpointStat),
+    captures:  make(map[string]*capture),
+    Networks:  make(map[string]*NetworkStat),
+  }
+  if driver.SwitchDir == "" {
+    driver.SwitchDir = SwitchDirDefault
+  }
+  if driver.Scope == "" {
+    driver.Scope = network.LocalScope
+  }
+  if driver.store == nil {
+    driver.store = datastore.NewMemoryStore()
+  }
+  if config.Clean == true {
+    if err := driver.store.Clean(); err != nil {
+      log.Warnf("Datastore.Clean: [ %s ]", err)
+    }
+  } else if err := driver.load(); err == nil {
+    driver.restore()
+  } else {
+    log.Warnf("Datastore.Load: [ %s ]", err)
+  }
+  return driver
+}
+
+/* restore restarts the built-in switches and plugs again the endpoints of
+   the running containers, the dead ones are removed */
+func (this *Driver) restore() {
+  for nwkey, nw := range this.Networks {
+    if err := this.startSwitch(nw); err != nil {
+      log.Warnf("Network [ %s ] switch: [ %s ]", nwkey, err)
+    }
+    if err := this.startGateway(nwkey, nw); err != nil {
+      log.Warnf("Network [ %s ] gateway: [ %s ]", nwkey, err)
+    }
+    for epkey, ep := range nw.Endpoints {
+      if !ep.Plugged {
+        /* Container has been stopped */
+        delete(nw.Endpoints, epkey)
+        this.removeEndpoint(nwkey, epkey)
+      } else if taps, err := ep.LinkReopen(); err != nil {
+        /* Container is dead, or its tap has been removed */
+        log.Infof("Endpoint [ %s ] removed: [ %s ]", epkey, err)
+        this.dropEndpoint(nwkey, epkey, nw, ep)
+      } else if filter, err := this.plugFilter(nw, ep); err != nil {
+        /* Its addresses can not be filtered on any start: removed as a dead
+           one, rather than forward its frames unfiltered */
+        log.Warnf("Endpoint [ %s ] removed: [ %s ]", epkey, err)
+        for _, tap := range taps {
+          tap.Close()
         }
+        this.dropEndpoint(nwkey, epkey, nw, ep)
+      } else if err := ep.LinkPlugTap(taps, this.plugURL(nw), filter); err != nil {
+        /* Still Plugged, it will be retried on the next start */
+        log.Warnf("Endpoint [ %s ] restore: [ %s ]", epkey, err)
+      } else {
+        if ep.DHCP != nil {
+          if err := ep.DHCPStart(dhcp.AcquireTimeout); err != nil {
+            log.Warnf("Endpoint [ %s ] lease: [ %s ]", epkey, err)
+          }
+        }
+        this.limit(nw, ep)
       }
     }
-    _ = datastore.Store(&driver)
+    if err := this.startServices(nwkey, nw); err != nil {
+      log.Warnf("Network [ %s ] services: [ %s ]", nwkey, err)
+    }
   }
-  return driver
+  this.restoreNAT()
+}
+
+/* dropEndpoint deletes the tap of an endpoint that can not be restored and
+   forgets it, with its addresses */
+func (this *Driver) dropEndpoint(nwkey, epkey string, nw *NetworkStat, ep *endpoint.EndpointStat) {
+  ep.LinkDel()
+  if this.global() {
+    this.releaseAddresses(nwkey, epkey, ep)
+  }
+  if this.ipam != nil {
+    this.ipam.ReleaseEndpoint(nw.Sock, ep.MacAddress, ep.IPv4Address, ep.IPv6Address)
+  }
+  delete(nw.Endpoints, epkey)
+  this.removeEndpoint(nwkey, epkey)
 }
 
 /* CapabilitiesResponse returns whether or not this network is global or local, */
 func (this *Driver) GetCapabilities() (*network.CapabilitiesResponse, error) {
-  return &network.CapabilitiesResponse{ Scope: network.LocalScope }, nil
+  return &network.CapabilitiesResponse{ Scope: this.Scope, ConnectivityScope: this.Scope }, nil
 }
 
 func (this *Driver) CreateNetwork(r *network.CreateNetworkRequest) error {
 	log.Debugf("Createnetwork Request: [ %+v ]", r)
+  netw, err := this.newNetwork(r)
+  if err != nil {
+    return err
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  return this.addNetwork(r.NetworkID, netw)
+}
+
+/* newNetwork validates the request and returns the network it defines */
+func (this *Driver) newNetwork(r *network.CreateNetworkRequest) (*NetworkStat, error) {
 	var sock, ifprefix, ipv6pool, ipv6gateway string
-  opt := r.Options["com.docker.network.generic"].(map[string]interface{})
-  if r.IPv4Data == nil || len(r.IPv4Data) == 0 {
-		return types.BadRequestErrorf("Network IPv4Data config miss.")
+  opt, _ := r.Options["com.docker.network.generic"].(map[string]interface{})
+  if opt == nil {
+    opt = make(map[string]interface{})
+  }
+  if this.global() {
+    if err := this.sharedNetwork(r, opt); err != nil {
+      return nil, types.InternalErrorf("Cluster store: %s", err)
+    }
+  }
+  ipam, _ := opt["ipam"].(string)
+  if ipam != "" && ipam != IPAMDHCP {
+    return nil, types.BadRequestErrorf("Unknown ipam %s.", ipam)
+  }
+  if ipam == IPAMDHCP {
+    /* The pool of Docker, 0.0.0.0/0 with --ipam-driver null, is not used */
+    r.IPv4Data = []*network.IPAMData{ {} }
+  } else if r.IPv4Data == nil || len(r.IPv4Data) == 0 {
+		return nil, types.BadRequestErrorf("Network IPv4Data config miss.")
 	}
   if sock, _ = opt["sock"].(string); sock == "" {
-    return types.NotFoundErrorf("Sock URL miss.")
+    return nil, types.NotFoundErrorf("Sock URL miss.")
   }
   if ifprefix, _ = opt["if"].(string); ifprefix == "" {
     ifprefix = IfPrefixDefault
@@ -72,24 +231,72 @@ func (this *Driver) CreateNetwork(r *network.CreateNetworkRequest) error {
     ipv6pool = r.IPv6Data[0].Pool
     ipv6gateway = r.IPv6Data[0].Gateway
   }
-  this.mutex.Lock()
-  defer this.mutex.Unlock()
-  defer datastore.Store(&this)
-  this.Networks[r.NetworkID] = &NetworkStat {
+  netw := &NetworkStat {
     Sock:         sock,
     IfPrefix:     ifprefix,
     IPv4Pool:     r.IPv4Data[0].Pool,
     IPv4Gateway:  r.IPv4Data[0].Gateway,
     IPv6Pool:     ipv6pool,
     IPv6Gateway:  ipv6gateway,
+    IPAM:         ipam,
     Endpoints:    make(map[string]*endpoint.EndpointStat),
   }
-  return nil
+  if err := this.vlanOptions(opt, netw); err != nil {
+    return nil, err
+  }
+  if err := this.linkOptions(opt, netw); err != nil {
+    return nil, err
+  }
+  if err := this.dhcpOptions(opt, netw); err != nil {
+    return nil, err
+  }
+  if err := this.dnsOptions(opt, netw); err != nil {
+    return nil, err
+  }
+  if err := this.gatewayOptions(opt, netw); err != nil {
+    return nil, err
+  }
+  if err := this.natOptions(opt, netw); err != nil {
+    return nil, err
+  }
+  if err := this.antiSpoofOptions(opt, netw); err != nil {
+    return nil, err
+  }
+  if err := this.limitsOptions(opt, netw); err != nil {
+    return nil, err
+  }
+  value, _ := opt[OptRoutes].(string)
+  routes, err := parseRoutes(value, netw)
+  if err != nil {
+    return nil, err
+  }
+  netw.Routes = routes
+  return netw, nil
 }
 
-func (this *Driver) AllocateNetwork(r *network.AllocateNetworkRequest) (*network.AllocateNetworkResponse, error) {
-//  log.Debugf("Allocatenetwork Request: [ %+v ]", r)
-  return nil, types.NotImplementedErrorf("Not implementethis.")
+/* addNetwork starts the switch of netw and stores it, the caller holds the lock */
+func (this *Driver) addNetwork(netid string, netw *NetworkStat) error {
+  if err := this.startSwitch(netw); err != nil {
+    return types.InternalErrorf("Failed switch start: %s", err)
+  }
+  if err := this.startGateway(netid, netw); err != nil {
+    this.stopSwitch(netw)
+    return types.InternalErrorf("Failed gateway start: %s", err)
+  }
+  if err := this.startNAT(netid, netw); err != nil {
+    this.stopGateway(netid, true)
+    this.stopSwitch(netw)
+    return types.InternalErrorf("Failed NAT setup: %s", err)
+  }
+  if err := this.startServices(netid, netw); err != nil {
+    this.removeRules(netid, masqueradeOwner)
+    this.stopGateway(netid, true)
+    this.stopSwitch(netw)
+    return types.InternalErrorf("Failed services start: %s", err)
+  }
+  this.Networks[netid] = netw
+  this.storeNetwork(netid, netw)
+  return nil
 }
 
 func (this *Driver) DeleteNetwork(r *network.DeleteNetworkRequest) error {
@@ -103,38 +310,134 @@ func (this *Driver) DeleteNetwork(r *network.DeleteNetworkRequest) error {
   if len(netw.Endpoints) != 0 {
     return types.BadRequestErrorf("There are still active endpoints.")
   }
+  this.stopCaptures(r.NetworkID)
+  this.stopServices(r.NetworkID)
+  this.removeRules(r.NetworkID, masqueradeOwner)
+  this.stopGateway(r.NetworkID, true)
+  this.stopSwitch(netw)
   delete(this.Networks, r.NetworkID)
-  _ = datastore.Store(&this)
+  this.removeNetwork(r.NetworkID)
   return nil
 }
 
-func (this *Driver) FreeNetwork(r *network.FreeNetworkRequest) error {
-//  log.Warnf("Freenetwork Request: [ %+v ]", r)
-	return types.NotImplementedErrorf("Not implementethis.")
-}
-
 func (this *Driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
   log.Debugf("CREATE ENDPOINT: [ %+v ]", r)
-  this.mutex.Lock()
-  defer this.mutex.Unlock()
+  names, err := dnsNames(r.Options)
+  if err != nil {
+    return nil, err
+  }
+  edpt := endpoint.NewEndpointStat(r)
+  edpt.DNSNames = names
+  this.mutex.RLock()
   netw := this.Networks[r.NetworkID]
+  this.mutex.RUnlock()
   if netw == nil {
     return nil, types.NotFoundErrorf("Network not found.")
   }
-  if netw.Endpoints[r.EndpointID] != nil {
-    return nil, types.BadRequestErrorf("EndpointID already exists.")
+  if edpt.Routes, err = parseRoutes(endpointOption(r.Options, OptRoutes), netw); err != nil {
+    return nil, err
+  }
+  limits, err := parseLimits(func(key string) string {
+    return endpointOption(r.Options, key)
+  })
+  if err != nil {
+    return nil, err
+  }
+  edpt.Limits = limits
+  if edpt.LinkConfig, err = endpointLink(r.Options, netw); err != nil {
+    return nil, err
+  }
+  for _, route := range edpt.Routes {
+    if route.Gateway != "" && (route.Gateway == addrOnly(edpt.IPv4Address) || route.Gateway == addrOnly(edpt.IPv6Address)) {
+      return nil, types.BadRequestErrorf("Next hop %s is the address of the endpoint.", route.Gateway)
+    }
   }
-  netw.Endpoints[r.EndpointID] = endpoint.NewEndpointStat(r)
   response := &network.CreateEndpointResponse {
     Interface: &network.EndpointInterface{},
   }
+  if netw.IPAM == IPAMDHCP {
+    /* Without the lock, the lease may take a while */
+    if err := this.leaseAddress(netw, r, edpt); err != nil {
+      return nil, err
+    }
+    response.Interface.Address = edpt.IPv4Address
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if this.Networks[r.NetworkID] != netw {
+    edpt.LinkPlugStop()
+    edpt.LinkDel()
+    return nil, types.NotFoundErrorf("Network not found.")
+  }
+  if netw.Endpoints[r.EndpointID] != nil {
+    edpt.LinkPlugStop()
+    edpt.LinkDel()
+    return nil, types.BadRequestErrorf("EndpointID already exists.")
+  }
+  if edpt.Plugger != nil {
+    /* Plugged by leaseAddress, filtered with the address of the lease only now */
+    if err := this.filter(netw, edpt); err != nil {
+      edpt.LinkPlugStop()
+      edpt.LinkDel()
+      return nil, err
+    }
+    this.limit(netw, edpt)
+    this.capture(r.NetworkID, r.EndpointID, edpt)
+  }
+  if this.global() {
+    if err := this.claimAddresses(r.NetworkID, r.EndpointID, edpt); err != nil {
+      edpt.LinkPlugStop()
+      edpt.LinkDel()
+      return nil, types.ForbiddenErrorf("%s", err)
+    }
+  }
+  if err := this.reserveAddresses(r.NetworkID, r.EndpointID, edpt); err != nil {
+    edpt.LinkPlugStop()
+    edpt.LinkDel()
+    if this.global() {
+      this.releaseAddresses(r.NetworkID, r.EndpointID, edpt)
+    }
+    return nil, types.ForbiddenErrorf("%s", err)
+  }
+  netw.Endpoints[r.EndpointID] = edpt
   if r.Interface.MacAddress == "" {
      response.Interface.MacAddress = netw.Endpoints[r.EndpointID].MacAddress
   }
-  _ = datastore.Store(&this)
+  this.storeEndpoint(r.NetworkID, r.EndpointID, edpt)
   return response, nil
 }
 
+/* leaseAddress plugs the tap of edpt before Join, to obtain its address from a DHCP server */
+func (this *Driver) leaseAddress(netw *NetworkStat, r *network.CreateEndpointRequest, edpt *endpoint.EndpointStat) error {
+  if r.Interface.Address != "" {
+    return types.BadRequestErrorf("Address %s assigned by Docker on a network with ipam=dhcp, create it with --ipam-driver null.", r.Interface.Address)
+  }
+  return this.plugLease(netw, edpt)
+}
+
+/* plugLease plugs a new tap of edpt and starts the client of its lease, acquired
+   if there is none: the filter lets through only the DHCP client until the caller
+   updates it with the address of the lease */
+func (this *Driver) plugLease(netw *NetworkStat, edpt *endpoint.EndpointStat) error {
+  filter, err := this.plugFilter(netw, edpt)
+  if err != nil {
+    return err
+  }
+  if err := edpt.LinkAdd(); err != nil {
+    return types.RetryErrorf("Failed link create: %s", err)
+  }
+  if err := edpt.LinkPlugTo(this.plugURL(netw), filter); err != nil {
+    edpt.LinkDel()
+    return types.NotFoundErrorf("Failed plug to interface: %s", err)
+  }
+  if err := edpt.DHCPStart(dhcp.AcquireTimeout); err != nil {
+    edpt.LinkPlugStop()
+    edpt.LinkDel()
+    return types.RetryErrorf("%s", err)
+  }
+  return nil
+}
+
 func (this *Driver) DeleteEndpoint(r *network.DeleteEndpointRequest) error {
   log.Debugf("DeleteEndpoint: [ %+v ]", r)
   this.mutex.Lock()
@@ -145,9 +448,21 @@ func (this *Driver) DeleteEndpoint(r *network.DeleteEndpointRequest) error {
   if this.Networks[r.NetworkID].Endpoints[r.EndpointID] == nil {
     return types.NotFoundErrorf("Endpoint not found.")
   }
-  this.Networks[r.NetworkID].Endpoints[r.EndpointID].LinkDel()
+  edpt := this.Networks[r.NetworkID].Endpoints[r.EndpointID]
+  /* Plugged since CreateEndpoint with ipam=dhcp */
+  edpt.LinkPlugStop()
+  edpt.LinkDel()
+  if this.global() {
+    this.releaseAddresses(r.NetworkID, r.EndpointID, edpt)
+  }
+  if this.ipam != nil {
+    this.ipam.ReleaseEndpoint(this.Networks[r.NetworkID].Sock, edpt.MacAddress, edpt.IPv4Address, edpt.IPv6Address)
+  }
+  this.unreserveAddresses(r.NetworkID, edpt)
+  this.removeNames(r.NetworkID, r.EndpointID)
+  this.removeRules(r.NetworkID, r.EndpointID)
   delete(this.Networks[r.NetworkID].Endpoints, r.EndpointID)
-  _ = datastore.Store(&this)
+  this.removeEndpoint(r.NetworkID, r.EndpointID)
   return nil
 }
 
@@ -161,9 +476,13 @@ func (this *Driver) EndpointInfo(r *network.InfoRequest) (*network.InfoResponse,
   if this.Networks[r.NetworkID].Endpoints[r.EndpointID] == nil {
     return nil, types.NotFoundErrorf("Endpoint not found.")
   }
-  info := &network.InfoResponse{ Value: make(map[string]string) }
+  edpt := this.Networks[r.NetworkID].Endpoints[r.EndpointID]
+  info := &network.InfoResponse{ Value: edpt.Stats().Map() }
+  for key, value := range edpt.LinkConfig.Map() {
+    info.Value[key] = value
+  }
   info.Value["id"]      = r.EndpointID
-  info.Value["srcName"] = this.Networks[r.NetworkID].Endpoints[r.EndpointID].IfName
+  info.Value["srcName"] = edpt.IfName
   return info, nil
 }
 
@@ -181,13 +500,36 @@ func (this *Driver) Join(r *network.JoinRequest) (*network.JoinResponse, error)
   if edpt = netw.Endpoints[r.EndpointID]; edpt == nil {
     return nil, types.NotFoundErrorf("Endpoint not found.")
   }
-  if edpt.LinkAdd() != nil {
-    return nil, types.RetryErrorf("Failed link create.")
+  names, err := dnsNames(r.Options)
+  if err != nil {
+    return nil, err
   }
-  if err := edpt.LinkPlugTo(netw.Sock); err != nil {
-    edpt.LinkDel()
-    return nil, types.NotFoundErrorf("Failed plug to interface", err)
+  if edpt.Plugger == nil {
+    filter, err := this.plugFilter(netw, edpt)
+    if err != nil {
+      return nil, err
+    }
+    if err := edpt.LinkAdd(); err != nil {
+      return nil, types.RetryErrorf("Failed link create: %s", err)
+    }
+    if err := edpt.LinkPlugTo(this.plugURL(netw), filter); err != nil {
+      edpt.LinkDel()
+      return nil, types.NotFoundErrorf("Failed plug to interface: %s", err)
+    }
+    /* Renewals of the lease kept by Leave, if it could not plug again */
+    if edpt.DHCP != nil {
+      if err := edpt.DHCPStart(dhcp.AcquireTimeout); err != nil {
+        log.Warnf("Endpoint [ %s ] lease: [ %s ]", r.EndpointID, err)
+      }
+    }
+    this.limit(netw, edpt)
+    this.capture(r.NetworkID, r.EndpointID, edpt)
+  }
+  edpt.SandboxKey = r.SandboxKey
+  if len(names) > 0 {
+    edpt.DNSNames = names
   }
+  this.addNames(r.NetworkID, r.EndpointID, edpt)
   if netw.IPv4Gateway != "" {
     gateway = net.ParseIP(strings.Split(netw.IPv4Gateway, "/")[0]).String()
   }
@@ -202,7 +544,11 @@ func (this *Driver) Join(r *network.JoinRequest) (*network.JoinResponse, error)
 		Gateway:     gateway,
 		GatewayIPv6: gateway6,
   }
-  _ = datastore.Store(&this)
+  if edpt.DHCP != nil {
+    response.Gateway = edpt.DHCP.Gateway
+  }
+  response.StaticRoutes = joinRoutes(netw, edpt)
+  this.storeEndpoint(r.NetworkID, r.EndpointID, edpt)
   return response, nil
 }
 
@@ -219,28 +565,26 @@ func (this *Driver) Leave(r *network.LeaveRequest) error {
   if edpt = netw.Endpoints[r.EndpointID]; edpt == nil {
     return types.NotFoundErrorf("Endpoint not found.")
   }
+  /* The lease is kept for the next Join, released by DeleteEndpoint */
+  edpt.DHCPStop(false)
   edpt.LinkPlugStop()
   edpt.LinkDel()
-  _ = datastore.Store(&this)
-  return nil
-}
-
-func (this *Driver) DiscoverNew(r *network.DiscoveryNotification) error {
-//  log.Debugf("DISCOVER NEW Called: [ %+v ]", r)
-  return nil
-}
-
-func (this *Driver) DiscoverDelete(r *network.DiscoveryNotification) error {
-//  log.Debugf("DISCOVER DELETE Called: [ %+v ]", r)
-  return nil
-}
-
-func (this *Driver) ProgramExternalConnectivity(r *network.ProgramExternalConnectivityRequest) error {
-//  log.Debugf("PROGRAM EXTERNAL CONNECTIVITY Called: [ %+v ]", r)
+  edpt.SandboxKey = ""
+  if edpt.DHCP != nil {
+    /* Plugged again as after CreateEndpoint, to renew the lease and release it */
+    if err := this.plugLease(netw, edpt); err != nil {
+      log.Warnf("Endpoint [ %s ] lease: [ %s ]", r.EndpointID, err)
+    } else if err := this.filter(netw, edpt); err != nil {
+      edpt.DHCPStop(false)
+      edpt.LinkPlugStop()
+      edpt.LinkDel()
+    } else {
+      this.limit(netw, edpt)
+      this.capture(r.NetworkID, r.EndpointID, edpt)
+    }
+  }
+  this.removeNames(r.NetworkID, r.EndpointID)
+  this.storeEndpoint(r.NetworkID, r.EndpointID, edpt)
   return nil
 }
 
-func (this *Driver) RevokeExternalConnectivity(r *network.RevokeExternalConnectivityRequest) error {
-//  log.Debugf("REVOKE EXTERNAL CONNECTIVITY Called: [ %+v ]", r)
-  return nil
-}
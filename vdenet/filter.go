@@ -0,0 +1,54 @@
+package vdenet
+
+import (
+  "strconv"
+  log "github.com/Sirupsen/logrus"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/endpoint"
+)
+
+/* Option of the networks: the frames of the endpoints with a source that is
+   not their own are dropped, see endpoint.Filter */
+const OptAntiSpoof = "antispoof"
+
+/* antiSpoofOptions validates the antispoof option in opt, off by default */
+func (this *Driver) antiSpoofOptions(opt map[string]interface{}, netw *NetworkStat) error {
+  value, _ := opt[OptAntiSpoof].(string)
+  if value == "" {
+    return nil
+  }
+  antispoof, err := strconv.ParseBool(value)
+  if err != nil {
+    return types.BadRequestErrorf("Invalid antispoof %s.", value)
+  }
+  netw.AntiSpoof = antispoof
+  return nil
+}
+
+/* plugFilter returns the filter of netw for the plug of edpt, nil without
+   anti-spoofing: it is set before the plug forwards the first frame. On error
+   edpt is not plugged, rather than forward its frames unfiltered. */
+func (this *Driver) plugFilter(netw *NetworkStat, edpt *endpoint.EndpointStat) (func(frame []byte) bool, error) {
+  if !netw.AntiSpoof {
+    return nil, nil
+  }
+  filter, err := edpt.NewFilter()
+  if err != nil {
+    log.Warnf("Endpoint [ %s ] filter: [ %s ]", edpt.IfName, err)
+    return nil, types.InternalErrorf("Failed anti-spoofing filter: %s", err)
+  }
+  return filter.Allow, nil
+}
+
+/* filter updates the filter of the plug of edpt with its current addresses,
+   once its lease is known: on error the caller unplugs edpt */
+func (this *Driver) filter(netw *NetworkStat, edpt *endpoint.EndpointStat) error {
+  if !netw.AntiSpoof || edpt.Plugger == nil {
+    return nil
+  }
+  if err := edpt.LinkFilter(); err != nil {
+    log.Warnf("Endpoint [ %s ] filter: [ %s ]", edpt.IfName, err)
+    return types.InternalErrorf("Failed anti-spoofing filter: %s", err)
+  }
+  return nil
+}
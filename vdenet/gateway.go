@@ -0,0 +1,88 @@
+package vdenet
+
+import (
+  log "github.com/Sirupsen/logrus"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/endpoint"
+)
+
+const (
+  /* -o gateway=host: the gateway addresses are on a tap of the host */
+  GatewayHost     = "host"
+  GatewayIfPrefix = "vdegw"
+)
+
+/* gatewayOptions validates the gateway option in opt */
+func (this *Driver) gatewayOptions(opt map[string]interface{}, netw *NetworkStat) error {
+  gateway, _ := opt["gateway"].(string)
+  if gateway == "" {
+    return nil
+  }
+  if gateway != GatewayHost {
+    return types.BadRequestErrorf("Invalid gateway %s.", gateway)
+  }
+  if this.global() {
+    return types.BadRequestErrorf("gateway=host is not supported on global scope networks.")
+  }
+  if netw.IPAM == IPAMDHCP {
+    return types.BadRequestErrorf("gateway=host and ipam=dhcp are exclusive.")
+  }
+  if netw.IPv4Gateway == "" && netw.IPv6Gateway == "" {
+    return types.BadRequestErrorf("gateway=host without a gateway address.")
+  }
+  netw.Gateway, netw.GatewayMAC = GatewayHost, endpoint.RandomMacAddr()
+  return nil
+}
+
+/* gatewayLink is the host tap of the gateway of a network */
+func gatewayLink(netid string, netw *NetworkStat) *endpoint.EndpointStat {
+  name := netid
+  if len(name) > 10 {
+    name = name[:10]
+  }
+  return &endpoint.EndpointStat{
+    IfName:      GatewayIfPrefix + name,
+    MacAddress:  netw.GatewayMAC,
+    IPv4Address: netw.IPv4Gateway,
+    IPv6Address: netw.IPv6Gateway,
+    LinkConfig:  netw.LinkConfig,
+  }
+}
+
+/* startGateway sets the host tap of netw up and plugs it, the caller holds the lock */
+func (this *Driver) startGateway(netid string, netw *NetworkStat) error {
+  if netw.Gateway != GatewayHost {
+    return nil
+  }
+  link := gatewayLink(netid, netw)
+  if err := link.LinkUp(); err != nil {
+    return err
+  }
+  if err := link.LinkPlugTo(this.plugURL(netw), nil); err != nil {
+    link.LinkDel()
+    return err
+  }
+  if err := endpoint.EnableForwarding(netw.IPv4Gateway != "", netw.IPv6Gateway != ""); err != nil {
+    log.Warnf("Network [ %s ] forwarding: [ %s ]", netid, err)
+  }
+  this.gateways[netid] = link
+  log.Debugf("Gateway [ %s ] started: [ %s ] [ %s ]", link.IfName, netw.IPv4Gateway, netw.IPv6Gateway)
+  return nil
+}
+
+/* stopGateway unplugs the tap of the gateway, it is kept for the next instance unless remove */
+func (this *Driver) stopGateway(netid string, remove bool) {
+  link := this.gateways[netid]
+  if link == nil {
+    return
+  }
+  if remove {
+    link.LinkPlugStop()
+    if err := link.LinkDel(); err != nil {
+      log.Warnf("Gateway [ %s ] LinkDel: [ %s ]", link.IfName, err)
+    }
+  } else {
+    link.LinkPlugRelease()
+  }
+  delete(this.gateways, netid)
+}
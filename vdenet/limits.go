@@ -0,0 +1,105 @@
+package vdenet
+
+import (
+  "math"
+  "strings"
+  "strconv"
+  log "github.com/Sirupsen/logrus"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/endpoint"
+)
+
+/* Options of the networks and of the endpoints, for the frames sent by the
+   endpoints: bits per second (k, m and g multiply by 1000), packets per second
+   and broadcast or multicast packets per second */
+const (
+  OptBandwidth = "bandwidth"
+  OptPackets   = "pps"
+  OptBroadcast = "broadcast-pps"
+)
+
+/* parseRate reads a positive number with an optional k, m or g suffix */
+func parseRate(value string) (uint64, bool) {
+  mult := uint64(1)
+  switch strings.ToLower(value[len(value) - 1:]) {
+  case "k":
+    mult = 1000
+  case "m":
+    mult = 1000 * 1000
+  case "g":
+    mult = 1000 * 1000 * 1000
+  }
+  if mult != 1 {
+    value = value[:len(value) - 1]
+  }
+  rate, err := strconv.ParseUint(value, 10, 64)
+  /* Past the largest rate once multiplied */
+  if err != nil || rate == 0 || rate > math.MaxUint64 / mult {
+    return 0, false
+  }
+  return rate * mult, true
+}
+
+/* parseLimits reads the limits options with get, nil if there are none */
+func parseLimits(get func(key string) string) (*endpoint.Limits, error) {
+  var limits endpoint.Limits
+  for _, opt := range []struct{ key string; value *uint64 } {
+    { OptBandwidth, &limits.Bandwidth },
+    { OptPackets, &limits.Packets },
+    { OptBroadcast, &limits.Broadcast },
+  } {
+    value := get(opt.key)
+    if value == "" {
+      continue
+    }
+    rate, ok := parseRate(value)
+    if !ok {
+      return nil, types.BadRequestErrorf("Invalid %s %s.", opt.key, value)
+    }
+    *opt.value = rate
+  }
+  if limits.IsZero() {
+    return nil, nil
+  }
+  return &limits, nil
+}
+
+/* limitsOptions validates the limits options in opt */
+func (this *Driver) limitsOptions(opt map[string]interface{}, netw *NetworkStat) (err error) {
+  netw.Limits, err = parseLimits(func(key string) string {
+    value, _ := opt[key].(string)
+    return value
+  })
+  return err
+}
+
+/* endpointLimits are the limits of edpt: its own, the ones of netw for the others */
+func endpointLimits(netw *NetworkStat, edpt *endpoint.EndpointStat) endpoint.Limits {
+  var limits endpoint.Limits
+  if netw.Limits != nil {
+    limits = *netw.Limits
+  }
+  if own := edpt.Limits; own != nil {
+    if own.Bandwidth != 0 {
+      limits.Bandwidth = own.Bandwidth
+    }
+    if own.Packets != 0 {
+      limits.Packets = own.Packets
+    }
+    if own.Broadcast != 0 {
+      limits.Broadcast = own.Broadcast
+    }
+  }
+  return limits
+}
+
+/* limit applies the limits of edpt to its plug */
+func (this *Driver) limit(netw *NetworkStat, edpt *endpoint.EndpointStat) {
+  limits := endpointLimits(netw, edpt)
+  if limits.IsZero() || edpt.Plugger == nil {
+    return
+  }
+  if err := edpt.LinkLimit(limits); err != nil {
+    log.Warnf("Endpoint [ %s ] limits: [ %s ]", edpt.IfName, err)
+  }
+}
@@ -0,0 +1,34 @@
+package vdenet
+
+import (
+  "testing"
+)
+
+func TestParseRate(t *testing.T) {
+  for _, tc := range []struct {
+    value string
+    rate  uint64
+    ok    bool
+  } {
+    { "100", 100, true },
+    { "10k", 10000, true },
+    { "10M", 10000000, true },
+    { "2g", 2000000000, true },
+    { "18446744073709551615", 18446744073709551615, true },
+    { "18446744073709551k", 18446744073709551000, true },
+    { "18446744073709552k", 0, false },
+    { "18446744073g", 18446744073000000000, true },
+    { "18446744074g", 0, false },
+    { "18446744073709551616", 0, false },
+    { "0", 0, false },
+    { "0k", 0, false },
+    { "-1", 0, false },
+    { "k", 0, false },
+    { "1.5m", 0, false },
+  } {
+    rate, ok := parseRate(tc.value)
+    if ok != tc.ok || rate != tc.rate {
+      t.Errorf("%s: %d %v, want %d %v", tc.value, rate, ok, tc.rate, tc.ok)
+    }
+  }
+}
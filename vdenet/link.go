@@ -0,0 +1,163 @@
+package vdenet
+
+import (
+  "net"
+  "runtime"
+  "strconv"
+  "strings"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/packet"
+  "github.com/phocs/vde_plug_docker/vdeplug"
+  "github.com/phocs/vde_plug_docker/endpoint"
+)
+
+/* Options of the networks and of the endpoints for the taps: the MTU, auto for
+   the one of the sock scheme, the txqueuelen, the offloads (name=on|off,
+   separated by commas), the queues, auto for one per CPU up to QueuesAutoMax,
+   and gso (on|off) for the taps with TSO, see endpoint.gsoPeers */
+const (
+  OptMTU        = "mtu"
+  OptDockerMTU  = "com.docker.network.driver.mtu"
+  OptTxQueueLen = "txqueuelen"
+  OptOffloads   = "offloads"
+  OptQueues     = "queues"
+  OptGSO        = "gso"
+  /* The value of mtu and queues chosen by the plugin */
+  OptAuto       = "auto"
+  QueuesAutoMax = 8
+  /* MAX_TAP_QUEUES of the kernel */
+  QueuesMax     = 256
+  MTUDefault    = 1500
+  MTUMin        = 68
+  /* The frames of the plugs hold the header and a VLAN tag */
+  MTUMax        = vdeplug.EthBufSize - packet.EthernetHeaderLen - packet.VLANTagLen
+)
+
+/* Bytes added to the frames by the encapsulation of the schemes over UDP/IPv4,
+   the inner Ethernet header included: IPv6 adds 20 more */
+var encapOverhead = map[string]int {
+  "vxvde": 20 + 8 + 8 + packet.EthernetHeaderLen,
+  "vxlan": 20 + 8 + 8 + packet.EthernetHeaderLen,
+  "udp":   20 + 8 + packet.EthernetHeaderLen,
+}
+
+/* autoMTU is the MTU of the sock of netw across a path with MTUDefault */
+func autoMTU(netw *NetworkStat) int {
+  url := vdeplug.ParseURL(netw.Sock)
+  overhead, ok := encapOverhead[url.Scheme]
+  if !ok {
+    return MTUDefault
+  }
+  host := url.Address
+  if h, _, err := net.SplitHostPort(host); err == nil {
+    host = h
+  }
+  if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+    overhead += 20
+  }
+  if netw.VLAN != 0 {
+    overhead += packet.VLANTagLen
+  }
+  return MTUDefault - overhead
+}
+
+/* parseLinkConfig reads the options of the taps with get */
+func parseLinkConfig(get func(key string) string, netw *NetworkStat) (endpoint.LinkConfig, error) {
+  var config endpoint.LinkConfig
+  if value := get(OptMTU); value == OptAuto {
+    config.MTU = autoMTU(netw)
+  } else if value != "" {
+    mtu, err := strconv.Atoi(value)
+    if err != nil || mtu < MTUMin || mtu > MTUMax {
+      return config, types.BadRequestErrorf("Invalid mtu %s, %d to %d or %s.", value, MTUMin, MTUMax, OptAuto)
+    }
+    config.MTU = mtu
+  }
+  if value := get(OptTxQueueLen); value != "" {
+    qlen, err := strconv.Atoi(value)
+    if err != nil || qlen <= 0 {
+      return config, types.BadRequestErrorf("Invalid txqueuelen %s.", value)
+    }
+    config.TxQueueLen = qlen
+  }
+  if value := get(OptQueues); value == OptAuto {
+    if config.Queues = runtime.NumCPU(); config.Queues > QueuesAutoMax {
+      config.Queues = QueuesAutoMax
+    }
+  } else if value != "" {
+    queues, err := strconv.Atoi(value)
+    if err != nil || queues < 1 || queues > QueuesMax {
+      return config, types.BadRequestErrorf("Invalid queues %s, 1 to %d or %s.", value, QueuesMax, OptAuto)
+    }
+    config.Queues = queues
+  }
+  switch value := get(OptGSO); value {
+  case "", "off":
+  case "on":
+    config.GSO = true
+  default:
+    return config, types.BadRequestErrorf("Invalid gso %s, on or off.", value)
+  }
+  for _, offload := range strings.Split(get(OptOffloads), ",") {
+    if offload = strings.TrimSpace(offload); offload == "" {
+      continue
+    }
+    kv := strings.SplitN(offload, "=", 2)
+    if _, ok := endpoint.Offloads[kv[0]]; !ok || len(kv) != 2 || (kv[1] != "on" && kv[1] != "off") {
+      return config, types.BadRequestErrorf("Invalid offload %s, name=on|off with name one of tx, sg, tso, gso, gro.", offload)
+    }
+    if config.Offloads == nil {
+      config.Offloads = make(map[string]bool)
+    }
+    config.Offloads[kv[0]] = kv[1] == "on"
+  }
+  return config, nil
+}
+
+/* linkOptions validates the options of the taps in opt, without mtu the one of
+   the bridge driver of Docker is taken as well */
+func (this *Driver) linkOptions(opt map[string]interface{}, netw *NetworkStat) (err error) {
+  netw.LinkConfig, err = parseLinkConfig(func(key string) string {
+    value, _ := opt[key].(string)
+    if value == "" && key == OptMTU {
+      value, _ = opt[OptDockerMTU].(string)
+    }
+    return value
+  }, netw)
+  return err
+}
+
+/* endpointLink returns the attributes of the tap of an endpoint: its own
+   options in opt, the ones of netw for the others */
+func endpointLink(opt map[string]interface{}, netw *NetworkStat) (endpoint.LinkConfig, error) {
+  own, err := parseLinkConfig(func(key string) string {
+    return endpointOption(opt, key)
+  }, netw)
+  if err != nil {
+    return own, err
+  }
+  config := netw.LinkConfig
+  if own.MTU != 0 {
+    config.MTU = own.MTU
+  }
+  if own.TxQueueLen != 0 {
+    config.TxQueueLen = own.TxQueueLen
+  }
+  if own.Queues != 0 {
+    config.Queues = own.Queues
+  }
+  if endpointOption(opt, OptGSO) != "" {
+    config.GSO = own.GSO
+  }
+  if len(own.Offloads) > 0 {
+    offloads := make(map[string]bool)
+    for name, on := range netw.Offloads {
+      offloads[name] = on
+    }
+    for name, on := range own.Offloads {
+      offloads[name] = on
+    }
+    config.Offloads = offloads
+  }
+  return config, nil
+}
@@ -0,0 +1,62 @@
+package vdenet
+
+import (
+  "github.com/phocs/vde_plug_docker/datastore"
+)
+
+/* Migrations of the document of a datastore.FileStore, append a new one when
+   NetworkStat or EndpointStat change in a way the previous records can not be decoded */
+var Migrations = []datastore.Migration {
+  migratePlugger,
+  migrateRecords,
+}
+
+func endpoints(doc map[string]interface{}) []map[string]interface{} {
+  var eps []map[string]interface{}
+  networks, _ := doc["Networks"].(map[string]interface{})
+  for _, nw := range networks {
+    nwmap, _ := nw.(map[string]interface{})
+    epmap, _ := nwmap["Endpoints"].(map[string]interface{})
+    for _, ep := range epmap {
+      if ep, ok := ep.(map[string]interface{}); ok {
+        eps = append(eps, ep)
+      }
+    }
+  }
+  return eps
+}
+
+/* Version 0: the EndpointStat kept the address of the C plug in Plugger */
+func migratePlugger(doc map[string]interface{}) error {
+  for _, ep := range endpoints(doc) {
+    if plugger, ok := ep["Plugger"].(float64); ok {
+      ep["Plugged"] = plugger != 0
+      delete(ep, "Plugger")
+    }
+  }
+  return nil
+}
+
+/* Version 1: the whole Driver was a single document, the endpoints nested
+   in their network. Since version 2 the document holds the buckets of records. */
+func migrateRecords(doc map[string]interface{}) error {
+  networks, _ := doc["Networks"].(map[string]interface{})
+  nwrecords := make(map[string]interface{})
+  eprecords := make(map[string]interface{})
+  for netid, nw := range networks {
+    nwmap, ok := nw.(map[string]interface{})
+    if !ok {
+      continue
+    }
+    epmap, _ := nwmap["Endpoints"].(map[string]interface{})
+    for epid, ep := range epmap {
+      eprecords[endpointKey(netid, epid)] = ep
+    }
+    delete(nwmap, "Endpoints")
+    nwrecords[netid] = nwmap
+  }
+  delete(doc, "Networks")
+  doc[NetworksBucket] = nwrecords
+  doc[EndpointsBucket] = eprecords
+  return nil
+}
@@ -0,0 +1,113 @@
+package vdenet
+
+import (
+  "os"
+  "strings"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+  "github.com/phocs/vde_plug_docker/endpoint"
+  "github.com/phocs/vde_plug_docker/datastore"
+)
+
+/* A data store of version 0: the whole Driver, the address of the C plug in Plugger */
+const storeV0 = `{
+  "Networks": {
+    "n1": {
+      "Sock": "vde:///tmp/sw1",
+      "IfPrefix": "eth",
+      "IPv4Pool": "10.1.0.0/24",
+      "IPv4Gateway": "10.1.0.1/24",
+      "Endpoints": {
+        "e1": { "IfName": "vde0e1", "MacAddress": "02:00:00:00:00:01", "IPv4Address": "10.1.0.2/24", "Plugger": 94371216 },
+        "e2": { "IfName": "vde0e2", "MacAddress": "02:00:00:00:00:02", "IPv4Address": "10.1.0.3/24", "Plugger": 0 }
+      }
+    },
+    "n2": { "Sock": "vxvde://239.1.2.3", "Endpoints": {} }
+  }
+}`
+
+func openStore(t *testing.T, doc string) (string, datastore.Store) {
+  dir, err := ioutil.TempDir("", "vde_migrate")
+  if err != nil {
+    t.Fatal(err)
+  }
+  path := filepath.Join(dir, "vde_plug_docker.json")
+  if err = ioutil.WriteFile(path, []byte(doc), 0644); err != nil {
+    t.Fatal(err)
+  }
+  store, err := datastore.NewFileStore(path, Migrations...)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return path, store
+}
+
+func TestMigrateV0(t *testing.T) {
+  path, store := openStore(t, storeV0)
+  defer os.RemoveAll(filepath.Dir(path))
+  driver := &Driver{ store: store, Networks: make(map[string]*NetworkStat) }
+  if err := driver.load(); err != nil {
+    t.Fatal(err)
+  }
+  if len(driver.Networks) != 2 || len(driver.Networks["n2"].Endpoints) != 0 {
+    t.Fatalf("networks %+v", driver.Networks)
+  }
+  nw := driver.Networks["n1"]
+  if nw.Sock != "vde:///tmp/sw1" || nw.IPv4Gateway != "10.1.0.1/24" || nw.IfPrefix != "eth" {
+    t.Errorf("network n1 %+v", nw)
+  }
+  for _, tc := range []struct {
+    epid    string
+    ifname  string
+    addr    string
+    plugged bool
+  } {
+    { "e1", "vde0e1", "10.1.0.2/24", true },
+    { "e2", "vde0e2", "10.1.0.3/24", false },
+  } {
+    ep := nw.Endpoints[tc.epid]
+    if ep == nil {
+      t.Errorf("%s: missing", tc.epid)
+      continue
+    }
+    if ep.IfName != tc.ifname || ep.IPv4Address != tc.addr || ep.Plugged != tc.plugged {
+      t.Errorf("%s: %+v, want %s %s plugged %v", tc.epid, ep, tc.ifname, tc.addr, tc.plugged)
+    }
+  }
+  /* The next update writes the current version */
+  driver.storeEndpoint("n1", "e3", &endpoint.EndpointStat{ IfName: "vde0e3" })
+  buf, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  var doc struct {
+    Version int
+    Data    map[string]map[string]json.RawMessage
+  }
+  if err = json.Unmarshal(buf, &doc); err != nil {
+    t.Fatal(err)
+  }
+  if doc.Version != len(Migrations) {
+    t.Errorf("version %d, want %d", doc.Version, len(Migrations))
+  }
+  if len(doc.Data[NetworksBucket]) != 2 || len(doc.Data[EndpointsBucket]) != 3 {
+    t.Errorf("records %s", buf)
+  }
+  if strings.Contains(string(buf), "Plugger") {
+    t.Errorf("Plugger left in %s", buf)
+  }
+}
+
+func TestMigrateNewer(t *testing.T) {
+  path, store := openStore(t, `{ "Version": 99, "Data": {} }`)
+  defer os.RemoveAll(filepath.Dir(path))
+  driver := &Driver{ store: store, Networks: make(map[string]*NetworkStat) }
+  if err := driver.load(); err != nil {
+    t.Fatal(err)
+  }
+  if len(driver.Networks) != 0 {
+    t.Errorf("networks %+v from a newer version", driver.Networks)
+  }
+}
@@ -0,0 +1,224 @@
+package vdenet
+
+import (
+  "strings"
+  "strconv"
+  "encoding/json"
+  log "github.com/Sirupsen/logrus"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/nat"
+  "github.com/phocs/vde_plug_docker/datastore"
+  "github.com/docker/go-plugins-helpers/network"
+)
+
+const (
+  /* The iptables rules installed, by network and owner: an endpoint or the masquerade of the network */
+  NATBucket       = "nat-rules"
+  masqueradeOwner = "masquerade"
+  portmapOption   = "com.docker.network.portmap"
+)
+
+/* natOptions validates the masquerade option in opt, on by default with gateway=host */
+func (this *Driver) natOptions(opt map[string]interface{}, netw *NetworkStat) error {
+  value, _ := opt["masquerade"].(string)
+  masquerade, err := strconv.ParseBool(value)
+  if value == "" {
+    masquerade, err = netw.Gateway == GatewayHost, nil
+  }
+  if err != nil {
+    return types.BadRequestErrorf("Invalid masquerade %s.", value)
+  }
+  if masquerade && netw.Gateway != GatewayHost {
+    return types.BadRequestErrorf("masquerade without gateway=host.")
+  }
+  netw.Masquerade = masquerade
+  return nil
+}
+
+/* installRules installs the rules of owner and keeps them in the datastore */
+func (this *Driver) installRules(netid, owner string, rules []nat.Rule) error {
+  if len(rules) == 0 {
+    return nil
+  }
+  /* Recorded first, so that a crash does not leave them behind unknown */
+  this.update(func(tx datastore.Tx) error {
+    return tx.Put(NATBucket, endpointKey(netid, owner), rules)
+  })
+  if err := nat.InstallAll(rules); err != nil {
+    this.removeRules(netid, owner)
+    return err
+  }
+  return nil
+}
+
+/* removeRules removes the rules of owner, as they are in the datastore */
+func (this *Driver) removeRules(netid, owner string) {
+  var rules []nat.Rule
+  key := endpointKey(netid, owner)
+  err := this.store.View(func(tx datastore.Tx) error {
+    return tx.Get(NATBucket, key, &rules)
+  })
+  if err != nil {
+    return
+  }
+  nat.RemoveAll(rules)
+  this.update(func(tx datastore.Tx) error {
+    return tx.Delete(NATBucket, key)
+  })
+}
+
+/* storedRules returns the rules of key in the datastore: the ones installed in
+   FORWARD by the previous versions are removed, and moved to nat.ForwardChain */
+func (this *Driver) storedRules(key string) ([]nat.Rule, error) {
+  var rules []nat.Rule
+  err := this.store.View(func(tx datastore.Tx) error {
+    return tx.Get(NATBucket, key, &rules)
+  })
+  if err != nil {
+    return nil, err
+  }
+  moved := false
+  for i, r := range rules {
+    if r.Table == "filter" && r.Chain == "FORWARD" {
+      if err := r.Remove(); err != nil {
+        log.Warnf("NAT remove [ %s ]: [ %s ]", r, err)
+      }
+      rules[i].Chain, moved = nat.ForwardChain, true
+    }
+  }
+  if moved {
+    this.update(func(tx datastore.Tx) error {
+      return tx.Put(NATBucket, key, rules)
+    })
+  }
+  return rules, nil
+}
+
+/* startNAT installs the masquerade rules of netw, the caller holds the lock */
+func (this *Driver) startNAT(netid string, netw *NetworkStat) error {
+  if !netw.Masquerade {
+    return nil
+  }
+  var rules []nat.Rule
+  ifname := gatewayLink(netid, netw).IfName
+  for _, pool := range []string{ netw.IPv4Pool, netw.IPv6Pool } {
+    if pool == "" {
+      continue
+    }
+    masquerade, err := nat.Masquerade(pool, ifname)
+    if err != nil {
+      return err
+    }
+    rules = append(rules, masquerade...)
+  }
+  return this.installRules(netid, masqueradeOwner, rules)
+}
+
+/* restoreNAT installs again the rules of the networks and of the running
+   endpoints, the ones left behind by a crash are removed */
+func (this *Driver) restoreNAT() {
+  var keys []string
+  this.store.View(func(tx datastore.Tx) (err error) {
+    keys, err = tx.Keys(NATBucket, "")
+    return err
+  })
+  for _, key := range keys {
+    fields := strings.SplitN(key, "/", 2)
+    if len(fields) != 2 {
+      continue
+    }
+    netid, owner := fields[0], fields[1]
+    netw := this.Networks[netid]
+    rules, err := this.storedRules(key)
+    if err == nil && netw != nil && owner == masqueradeOwner && netw.Masquerade {
+      /* Installed again below */
+      continue
+    }
+    if netw != nil && netw.Endpoints[owner] != nil {
+      if err == nil {
+        err = nat.InstallAll(rules)
+      }
+      if err == nil {
+        continue
+      }
+      log.Warnf("Network [ %s ] NAT [ %s ]: [ %s ]", netid, owner, err)
+    }
+    log.Infof("Network [ %s ] NAT [ %s ] removed", netid, owner)
+    this.removeRules(netid, owner)
+  }
+  for netid, netw := range this.Networks {
+    if err := this.startNAT(netid, netw); err != nil {
+      log.Warnf("Network [ %s ] NAT: [ %s ]", netid, err)
+    }
+  }
+}
+
+/* portBindings reads the published ports in the options of a request */
+func portBindings(opt map[string]interface{}) ([]types.PortBinding, error) {
+  var bindings []types.PortBinding
+  if opt[portmapOption] == nil {
+    return nil, nil
+  }
+  /* Decoded as generic JSON by the plugin helpers */
+  b, err := json.Marshal(opt[portmapOption])
+  if err == nil {
+    err = json.Unmarshal(b, &bindings)
+  }
+  return bindings, err
+}
+
+func (this *Driver) ProgramExternalConnectivity(r *network.ProgramExternalConnectivityRequest) error {
+  log.Debugf("PROGRAM EXTERNAL CONNECTIVITY: [ %+v ]", r)
+  bindings, err := portBindings(r.Options)
+  if err != nil {
+    return types.BadRequestErrorf("Invalid port bindings: %s", err)
+  }
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  netw := this.Networks[r.NetworkID]
+  if netw == nil {
+    return types.NotFoundErrorf("Network not found.")
+  }
+  edpt := netw.Endpoints[r.EndpointID]
+  if edpt == nil {
+    return types.NotFoundErrorf("Endpoint not found.")
+  }
+  if len(bindings) == 0 {
+    return nil
+  }
+  if netw.Gateway != GatewayHost {
+    log.Warnf("Endpoint [ %s ] published ports ignored: the network has no gateway=host", r.EndpointID)
+    return nil
+  }
+  /* The ones of a previous call */
+  this.removeRules(r.NetworkID, r.EndpointID)
+  var rules []nat.Rule
+  ifname := gatewayLink(r.NetworkID, netw).IfName
+  for _, pb := range bindings {
+    for _, addr := range []string{ edpt.IPv4Address, edpt.IPv6Address } {
+      if addr == "" {
+        continue
+      }
+      publish, err := nat.Publish(pb, addrOnly(addr), ifname)
+      if err == nat.ErrNoHostPort {
+        /* Docker can not be told of a port chosen here */
+        return types.BadRequestErrorf("Port %s without a host port, publish it with one (-p <host port>:%d).", pb.String(), pb.Port)
+      } else if err != nil {
+        return types.BadRequestErrorf("%s", err)
+      }
+      rules = append(rules, publish...)
+    }
+  }
+  if err := this.installRules(r.NetworkID, r.EndpointID, rules); err != nil {
+    return types.InternalErrorf("Failed port publishing: %s", err)
+  }
+  return nil
+}
+
+func (this *Driver) RevokeExternalConnectivity(r *network.RevokeExternalConnectivityRequest) error {
+  log.Debugf("REVOKE EXTERNAL CONNECTIVITY: [ %+v ]", r)
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  this.removeRules(r.NetworkID, r.EndpointID)
+  return nil
+}
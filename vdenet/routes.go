@@ -0,0 +1,129 @@
+package vdenet
+
+import (
+  "net"
+  "strings"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/dhcp"
+  "github.com/phocs/vde_plug_docker/endpoint"
+  "github.com/docker/go-plugins-helpers/network"
+)
+
+/* Option of the networks and of the endpoints: destination[@next hop], separated
+   by commas. A route without next hop is connected: the destination is on the segment. */
+const OptRoutes = "routes"
+
+/* endpointOption reads key in the options of an endpoint request, flat or in the generic ones */
+func endpointOption(opt map[string]interface{}, key string) string {
+  if generic, ok := opt["com.docker.network.generic"].(map[string]interface{}); ok {
+    opt = generic
+  }
+  value, _ := opt[key].(string)
+  return value
+}
+
+/* poolOf returns the subnet of netw of the family of ip, nil if it is unknown (e.g. ipam=dhcp) */
+func poolOf(netw *NetworkStat, ip net.IP) (*net.IPNet, bool) {
+  pool := netw.IPv4Pool
+  if ip.To4() == nil {
+    pool = netw.IPv6Pool
+  } else if netw.IPAM == IPAMDHCP {
+    return nil, true
+  }
+  _, subnet, err := net.ParseCIDR(pool)
+  if err != nil {
+    return nil, false
+  }
+  if ones, _ := subnet.Mask.Size(); ones == 0 {
+    return nil, true
+  }
+  return subnet, true
+}
+
+/* parseRoutes reads and validates the routes option against the subnets of netw */
+func parseRoutes(value string, netw *NetworkStat) ([]endpoint.Route, error) {
+  var routes []endpoint.Route
+  seen := make(map[string]bool)
+  for _, r := range strings.Split(value, ",") {
+    if r = strings.TrimSpace(r); r == "" {
+      continue
+    }
+    fields := strings.SplitN(r, "@", 2)
+    _, dst, err := net.ParseCIDR(fields[0])
+    if err != nil {
+      return nil, types.BadRequestErrorf("Invalid route destination %s.", fields[0])
+    }
+    subnet, ok := poolOf(netw, dst.IP)
+    if !ok {
+      return nil, types.BadRequestErrorf("Route %s without a subnet of its family.", r)
+    }
+    if subnet != nil && (subnet.Contains(dst.IP) || dst.Contains(subnet.IP)) {
+      return nil, types.BadRequestErrorf("Route %s overlaps the subnet %s.", r, subnet)
+    }
+    if seen[dst.String()] {
+      return nil, types.BadRequestErrorf("Duplicate route to %s.", dst)
+    }
+    seen[dst.String()] = true
+    route := endpoint.Route{ Destination: dst.String() }
+    if len(fields) == 2 {
+      gw := net.ParseIP(fields[1])
+      if gw == nil || (gw.To4() == nil) != (dst.IP.To4() == nil) {
+        return nil, types.BadRequestErrorf("Invalid next hop %s.", fields[1])
+      }
+      if subnet != nil && (!subnet.Contains(gw) || gw.Equal(subnet.IP)) {
+        return nil, types.BadRequestErrorf("Next hop %s out of the subnet %s.", gw, subnet)
+      }
+      route.Gateway = gw.String()
+    }
+    routes = append(routes, route)
+  }
+  return routes, nil
+}
+
+/* mergeRoutes appends the routes of each set, a later one replaces the route to the same destination */
+func mergeRoutes(sets ...[]endpoint.Route) []endpoint.Route {
+  var routes []endpoint.Route
+  index := make(map[string]int)
+  for _, set := range sets {
+    for _, route := range set {
+      if i, ok := index[route.Destination]; ok {
+        routes[i] = route
+        continue
+      }
+      index[route.Destination] = len(routes)
+      routes = append(routes, route)
+    }
+  }
+  return routes
+}
+
+/* leaseRoutes are the classless routes of lease */
+func leaseRoutes(lease *dhcp.Lease) []endpoint.Route {
+  var routes []endpoint.Route
+  for _, route := range lease.Routes {
+    r := endpoint.Route{ Destination: route.Destination, Gateway: route.Gateway }
+    if net.ParseIP(route.Gateway).IsUnspecified() {
+      r.Gateway = ""
+    }
+    routes = append(routes, r)
+  }
+  return routes
+}
+
+/* joinRoutes are the static routes of edpt for the Join response: the ones of
+   its lease, of the network and its own */
+func joinRoutes(netw *NetworkStat, edpt *endpoint.EndpointStat) []*network.StaticRoute {
+  var lease []endpoint.Route
+  if edpt.DHCP != nil {
+    lease = leaseRoutes(edpt.DHCP)
+  }
+  var routes []*network.StaticRoute
+  for _, route := range mergeRoutes(lease, netw.Routes, edpt.Routes) {
+    sr := &network.StaticRoute{ Destination: route.Destination, RouteType: types.NEXTHOP, NextHop: route.Gateway }
+    if route.Gateway == "" {
+      sr.RouteType = types.CONNECTED
+    }
+    routes = append(routes, sr)
+  }
+  return routes
+}
@@ -0,0 +1,80 @@
+package vdenet
+
+import (
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/dhcp"
+  "github.com/phocs/vde_plug_docker/dns"
+  "github.com/phocs/vde_plug_docker/endpoint"
+)
+
+/* services are the servers of a network (-o dhcp-server, -o dns), plugged to
+   the network with a port of their own */
+type services struct {
+  port *endpoint.Port
+  dhcp *dhcp.Server
+  dns  *dns.Server
+}
+
+func (this *services) send(frame []byte) error {
+  return this.port.Send(frame)
+}
+
+func (this *services) input(frame []byte) {
+  if this.dhcp != nil {
+    this.dhcp.Input(frame)
+  }
+  if this.dns != nil {
+    this.dns.Input(frame)
+  }
+}
+
+/* startServices plugs the servers of netw, if any, the caller holds the lock */
+func (this *Driver) startServices(netid string, netw *NetworkStat) error {
+  if netw.DHCPServer == "" && netw.DNS == "" {
+    return nil
+  }
+  var err error
+  s := &services{}
+  if netw.DHCPServer != "" {
+    if s.dhcp, err = this.newDHCPServer(netid, netw, s.send); err != nil {
+      return err
+    }
+  }
+  if netw.DNS != "" {
+    if s.dns, err = this.newDNSServer(netw, s); err != nil {
+      return err
+    }
+  }
+  if s.port, err = endpoint.NewPort(this.plugURL(netw), s.input); err != nil {
+    return err
+  }
+  if s.dhcp != nil {
+    s.dhcp.Start()
+  }
+  if s.dns != nil {
+    s.dns.Start()
+  }
+  this.services[netid] = s
+  for epid, edpt := range netw.Endpoints {
+    if edpt.SandboxKey != "" {
+      this.addNames(netid, epid, edpt)
+    }
+  }
+  return nil
+}
+
+func (this *Driver) stopServices(netid string) {
+  s := this.services[netid]
+  if s == nil {
+    return
+  }
+  if s.dns != nil {
+    s.dns.Stop()
+  }
+  if s.dhcp != nil {
+    s.dhcp.Stop()
+  }
+  s.port.Stop()
+  delete(this.services, netid)
+  log.Debugf("Network [ %s ] services stopped", netid)
+}
@@ -0,0 +1,44 @@
+package vdenet
+
+import (
+  log "github.com/Sirupsen/logrus"
+)
+
+/* Shutdown policies for the endpoints of the running containers */
+const (
+  /* Keep the taps and the plugged state, the next instance plugs them again */
+  ShutdownKeep   = "keep"
+  /* Unplug and remove the taps */
+  ShutdownUnplug = "unplug"
+)
+
+/* Shutdown stops the endpoints according to policy and the built-in switches,
+   then writes the whole state. Requests still in flight complete first. */
+func (this *Driver) Shutdown(policy string) {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  log.Infof("Shutdown: [ %s ]", policy)
+  this.stopCaptures("")
+  for _, nw := range this.Networks {
+    for _, ep := range nw.Endpoints {
+      if policy == ShutdownUnplug {
+        ep.LinkPlugStop()
+        ep.LinkDel()
+        ep.SandboxKey = ""
+      } else {
+        ep.LinkPlugRelease()
+      }
+    }
+  }
+  for netid := range this.services {
+    this.stopServices(netid)
+  }
+  for netid := range this.gateways {
+    this.stopGateway(netid, policy == ShutdownUnplug)
+  }
+  for dir, sw := range this.switches {
+    sw.Stop()
+    delete(this.switches, dir)
+  }
+  this.snapshot()
+}
@@ -0,0 +1,28 @@
+package vdenet
+
+import (
+  "strings"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/endpoint"
+)
+
+/* NetworkStats returns the counters of the endpoints of each network whose ID
+   starts with netid, of all the networks if netid is empty */
+func (this *Driver) NetworkStats(netid string) (map[string]map[string]endpoint.Stats, error) {
+  this.mutex.RLock()
+  defer this.mutex.RUnlock()
+  stats := make(map[string]map[string]endpoint.Stats)
+  for nwkey, nw := range this.Networks {
+    if !strings.HasPrefix(nwkey, netid) {
+      continue
+    }
+    stats[nwkey] = make(map[string]endpoint.Stats)
+    for epkey, ep := range nw.Endpoints {
+      stats[nwkey][epkey] = ep.Stats()
+    }
+  }
+  if len(stats) == 0 && netid != "" {
+    return nil, types.NotFoundErrorf("Network not found.")
+  }
+  return stats, nil
+}
@@ -0,0 +1,107 @@
+package vdenet
+
+import (
+  "strings"
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/endpoint"
+  "github.com/phocs/vde_plug_docker/datastore"
+)
+
+/* Each network and each endpoint is a record of the datastore */
+const (
+  NetworksBucket  = "networks"
+  EndpointsBucket = "endpoints"
+)
+
+func endpointKey(netid, epid string) string {
+  return netid + "/" + epid
+}
+
+/* load reads the networks and their endpoints from the datastore */
+func (this *Driver) load() error {
+  return this.store.View(func(tx datastore.Tx) error {
+    netids, err := tx.Keys(NetworksBucket, "")
+    if err != nil {
+      return err
+    }
+    for _, netid := range netids {
+      netw := &NetworkStat{}
+      if err = tx.Get(NetworksBucket, netid, netw); err != nil {
+        return err
+      }
+      netw.Endpoints = make(map[string]*endpoint.EndpointStat)
+      epkeys, err := tx.Keys(EndpointsBucket, endpointKey(netid, ""))
+      if err != nil {
+        return err
+      }
+      for _, key := range epkeys {
+        edpt := &endpoint.EndpointStat{}
+        if err = tx.Get(EndpointsBucket, key, edpt); err != nil {
+          return err
+        }
+        netw.Endpoints[strings.TrimPrefix(key, endpointKey(netid, ""))] = edpt
+      }
+      this.Networks[netid] = netw
+    }
+    return nil
+  })
+}
+
+func (this *Driver) update(fn func(tx datastore.Tx) error) {
+  if err := this.store.Update(fn); err != nil {
+    log.Warnf("Datastore.Update: [ %s ]", err)
+  }
+}
+
+func (this *Driver) storeNetwork(netid string, netw *NetworkStat) {
+  this.update(func(tx datastore.Tx) error {
+    return tx.Put(NetworksBucket, netid, netw)
+  })
+}
+
+/* removeNetwork deletes the network and any endpoint, lease or NAT record left behind */
+func (this *Driver) removeNetwork(netid string) {
+  this.update(func(tx datastore.Tx) error {
+    for _, bucket := range []string{ EndpointsBucket, LeasesBucket, NATBucket } {
+      keys, err := tx.Keys(bucket, endpointKey(netid, ""))
+      if err != nil {
+        return err
+      }
+      for _, key := range keys {
+        if err = tx.Delete(bucket, key); err != nil {
+          return err
+        }
+      }
+    }
+    return tx.Delete(NetworksBucket, netid)
+  })
+}
+
+func (this *Driver) storeEndpoint(netid, epid string, edpt *endpoint.EndpointStat) {
+  this.update(func(tx datastore.Tx) error {
+    return tx.Put(EndpointsBucket, endpointKey(netid, epid), edpt)
+  })
+}
+
+func (this *Driver) removeEndpoint(netid, epid string) {
+  this.update(func(tx datastore.Tx) error {
+    return tx.Delete(EndpointsBucket, endpointKey(netid, epid))
+  })
+}
+
+/* snapshot writes all the networks and endpoints in a single transaction */
+func (this *Driver) snapshot() {
+  this.update(func(tx datastore.Tx) error {
+    for netid, netw := range this.Networks {
+      if err := tx.Put(NetworksBucket, netid, netw); err != nil {
+        return err
+      }
+      for epid, edpt := range netw.Endpoints {
+        if err := tx.Put(EndpointsBucket, endpointKey(netid, epid), edpt); err != nil {
+          return err
+        }
+      }
+    }
+    return nil
+  })
+}
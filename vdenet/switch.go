@@ -0,0 +1,63 @@
+package vdenet
+
+import (
+  "path/filepath"
+  "github.com/phocs/vde_plug_docker/vdeplug"
+  "github.com/phocs/vde_plug_docker/endpoint"
+  "github.com/phocs/vde_plug_docker/vdeswitch"
+)
+
+const (
+  SwitchDirDefault = "/tmp/vde_plug_docker"
+  SwitchScheme     = "switch"
+  HubScheme        = "hub"
+)
+
+/* switchDir returns the directory of a built-in switch sock (switch://name, hub://name) */
+func (this *Driver) switchDir(sock string) (string, bool, bool) {
+  url := vdeplug.ParseURL(sock)
+  if url.Scheme != SwitchScheme && url.Scheme != HubScheme || url.Address == "" {
+    return "", false, false
+  }
+  if filepath.IsAbs(url.Address) {
+    return filepath.Clean(url.Address), url.Scheme == HubScheme, true
+  }
+  return filepath.Join(this.SwitchDir, url.Address), url.Scheme == HubScheme, true
+}
+
+/* plugURL is the url the endpoints of netw plug to */
+func (this *Driver) plugURL(netw *NetworkStat) string {
+  if dir, _, ok := this.switchDir(netw.Sock); ok {
+    return endpoint.VLANURL("vde://" + dir, netw.VLAN)
+  }
+  return endpoint.VLANURL(netw.Sock, netw.VLAN)
+}
+
+/* startSwitch starts the built-in switch of netw, shared between the networks with the same sock */
+func (this *Driver) startSwitch(netw *NetworkStat) error {
+  dir, hub, ok := this.switchDir(netw.Sock)
+  if !ok || this.switches[dir] != nil {
+    return nil
+  }
+  sw := vdeswitch.New(dir, hub)
+  if err := sw.Start(); err != nil {
+    return err
+  }
+  this.switches[dir] = sw
+  return nil
+}
+
+/* stopSwitch stops the built-in switch of netw when no other network uses it */
+func (this *Driver) stopSwitch(netw *NetworkStat) {
+  dir, _, ok := this.switchDir(netw.Sock)
+  if !ok || this.switches[dir] == nil {
+    return
+  }
+  for _, other := range this.Networks {
+    if odir, _, ok := this.switchDir(other.Sock); ok && other != netw && odir == dir {
+      return
+    }
+  }
+  this.switches[dir].Stop()
+  delete(this.switches, dir)
+}
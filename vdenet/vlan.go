@@ -0,0 +1,25 @@
+package vdenet
+
+import (
+  "strconv"
+  "github.com/docker/libnetwork/types"
+  "github.com/phocs/vde_plug_docker/packet"
+)
+
+/* Option of the networks: the VLAN of the network on a trunk VDE network,
+   shared with the other networks of the same sock */
+const OptVLAN = "vlan"
+
+/* vlanOptions validates the vlan option in opt */
+func (this *Driver) vlanOptions(opt map[string]interface{}, netw *NetworkStat) error {
+  value, _ := opt[OptVLAN].(string)
+  if value == "" {
+    return nil
+  }
+  vid, err := strconv.ParseUint(value, 10, 16)
+  if err != nil || vid == 0 || vid > packet.VLANMax {
+    return types.BadRequestErrorf("Invalid vlan %s, 1 to %d.", value, packet.VLANMax)
+  }
+  netw.VLAN = uint16(vid)
+  return nil
+}
@@ -0,0 +1,148 @@
+package vdeplug
+
+import (
+  "sync"
+  "unsafe"
+  "syscall"
+  "golang.org/x/sys/unix"
+)
+
+/* Frames moved at most by a syscall of the batches */
+const BatchSize = 32
+
+/* BatchConn is a Conn that moves several frames with a syscall, with
+   recvmmsg(2) and sendmmsg(2) */
+type BatchConn interface {
+  Conn
+  /* RecvBatch waits for a frame and reads up to len(bufs) of them, their sizes in sizes */
+  RecvBatch(bufs [][]byte, sizes []int) (int, error)
+  /* SendBatch sends frames in order, it returns how many before an error */
+  SendBatch(frames [][]byte) (int, error)
+}
+
+/* RecvBatch reads the frames of conn with RecvBatch if it has it, one by one otherwise */
+func RecvBatch(conn Conn, bufs [][]byte, sizes []int) (int, error) {
+  if batch, ok := conn.(BatchConn); ok {
+    return batch.RecvBatch(bufs, sizes)
+  }
+  n, err := conn.Recv(bufs[0])
+  if err != nil || n == 0 {
+    return 0, err
+  }
+  sizes[0] = n
+  return 1, nil
+}
+
+/* SendBatch sends the frames on conn with SendBatch if it has it, one by one otherwise */
+func SendBatch(conn Conn, frames [][]byte) (int, error) {
+  if batch, ok := conn.(BatchConn); ok {
+    return batch.SendBatch(frames)
+  }
+  for i, frame := range frames {
+    if _, err := conn.Send(frame); err != nil {
+      return i, err
+    }
+  }
+  return len(frames), nil
+}
+
+/* mmsghdr of recvmmsg(2) and sendmmsg(2) */
+type mmsghdr struct {
+  hdr unix.Msghdr
+  len uint32
+  _   [4]byte
+}
+
+type mmsgs struct {
+  msgs []mmsghdr
+  iovs []unix.Iovec
+}
+
+var mmsgPool = sync.Pool{ New: func() interface{} {
+  return &mmsgs{ msgs: make([]mmsghdr, BatchSize), iovs: make([]unix.Iovec, BatchSize) }
+} }
+
+/* prepare points the first len(bufs) headers to bufs, and to names: none, the
+   same for each one or one each */
+func (this *mmsgs) prepare(bufs [][]byte, names [][]byte) int {
+  n := len(bufs)
+  if n > BatchSize {
+    n = BatchSize
+  }
+  for i := 0; i < n; i++ {
+    this.iovs[i].Base = &bufs[i][0]
+    this.iovs[i].SetLen(len(bufs[i]))
+    this.msgs[i] = mmsghdr{}
+    this.msgs[i].hdr.Iov = &this.iovs[i]
+    this.msgs[i].hdr.Iovlen = 1
+    name := names
+    if len(names) > 1 {
+      name = names[i:]
+    }
+    if len(name) > 0 && len(name[0]) > 0 {
+      this.msgs[i].hdr.Name = &name[0][0]
+      this.msgs[i].hdr.Namelen = uint32(len(name[0]))
+    }
+  }
+  return n
+}
+
+func mmsg(trap uintptr, fd uintptr, msgs []mmsghdr, flags int) (int, error) {
+  n, _, errno := unix.Syscall6(trap, fd, uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), uintptr(flags), 0, 0)
+  if errno != 0 {
+    return 0, errno
+  }
+  return int(n), nil
+}
+
+/* Recvmmsg reads up to len(bufs) datagrams from raw, it waits for the first one */
+func Recvmmsg(raw syscall.RawConn, bufs [][]byte, sizes []int) (int, error) {
+  m := mmsgPool.Get().(*mmsgs)
+  defer mmsgPool.Put(m)
+  count := m.prepare(bufs, nil)
+  var n int
+  var err error
+  rerr := raw.Read(func(fd uintptr) bool {
+    n, err = mmsg(unix.SYS_RECVMMSG, fd, m.msgs[:count], unix.MSG_DONTWAIT)
+    return err != unix.EAGAIN
+  })
+  if rerr != nil {
+    return 0, rerr
+  }
+  if err != nil {
+    return 0, err
+  }
+  for i := 0; i < n; i++ {
+    sizes[i] = int(m.msgs[i].len)
+  }
+  return n, nil
+}
+
+/* Sendmmsg writes frames to raw, to the raw sockaddrs in names: none if raw is
+   connected, one for all the frames or one each */
+func Sendmmsg(raw syscall.RawConn, frames [][]byte, names [][]byte) (int, error) {
+  m := mmsgPool.Get().(*mmsgs)
+  defer mmsgPool.Put(m)
+  sent := 0
+  for sent < len(frames) {
+    dests := names
+    if len(names) > 1 {
+      dests = names[sent:]
+    }
+    count := m.prepare(frames[sent:], dests)
+    var n int
+    var err error
+    werr := raw.Write(func(fd uintptr) bool {
+      n, err = mmsg(unix.SYS_SENDMMSG, fd, m.msgs[:count], 0)
+      return err != unix.EAGAIN
+    })
+    if werr != nil {
+      return sent, werr
+    }
+    if err != nil || n == 0 {
+      return sent, err
+    }
+    sent += n
+  }
+  return sent, nil
+}
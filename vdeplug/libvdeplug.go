@@ -0,0 +1,105 @@
+// +build cgo
+
+package vdeplug
+
+/*
+#cgo LDFLAGS: -lvdeplug
+#include <poll.h>
+#include <stdlib.h>
+#include <libvdeplug.h>
+
+static VDECONN *vdeplug_open(char *url, char *descr) {
+  return vde_open(url, descr, NULL);
+}
+
+// Wait for a frame on the data fd, returns 0 when wakefd is closed
+static ssize_t vdeplug_recv(VDECONN *conn, void *buf, size_t len, int wakefd) {
+  struct pollfd pfd[] = { {vde_datafd(conn), POLLIN, 0}, {wakefd, POLLIN, 0} };
+  if (poll(pfd, 2, -1) < 0)
+    return -1;
+  if (pfd[1].revents)
+    return 0;
+  return vde_recv(conn, buf, len, 0);
+}
+*/
+import "C"
+import (
+  "os"
+  "sync"
+  "unsafe"
+  "syscall"
+)
+
+/* libvdeplug backend, for the schemes without a native implementation */
+type libConn struct {
+  sync.RWMutex
+  conn   *C.VDECONN
+  wake   *os.File
+  wakew  *os.File
+  closed bool
+}
+
+func init() {
+  fallback = openLibVdeplug
+}
+
+func openLibVdeplug(url *URL, descr string) (Conn, error) {
+  var err error
+  curl, cdescr := C.CString(url.Raw), C.CString(descr)
+  defer C.free(unsafe.Pointer(curl))
+  defer C.free(unsafe.Pointer(cdescr))
+  conn := &libConn{}
+  if conn.wake, conn.wakew, err = os.Pipe(); err != nil {
+    return nil, err
+  }
+  if conn.conn, err = C.vdeplug_open(curl, cdescr); conn.conn == nil {
+    conn.wake.Close()
+    conn.wakew.Close()
+    if err == nil {
+      err = ErrScheme
+    }
+    return nil, err
+  }
+  return conn, nil
+}
+
+func (this *libConn) Recv(buf []byte) (int, error) {
+  this.RLock()
+  defer this.RUnlock()
+  if this.closed {
+    return 0, syscall.EBADF
+  }
+  n, err := C.vdeplug_recv(this.conn, unsafe.Pointer(&buf[0]), C.size_t(len(buf)), C.int(this.wake.Fd()))
+  if n < 0 {
+    return 0, err
+  } else if n == 0 {
+    return 0, syscall.EBADF
+  }
+  return int(n), nil
+}
+
+func (this *libConn) Send(buf []byte) (int, error) {
+  this.RLock()
+  defer this.RUnlock()
+  if this.closed {
+    return 0, syscall.EBADF
+  }
+  n, err := C.vde_send(this.conn, unsafe.Pointer(&buf[0]), C.size_t(len(buf)), 0)
+  if n < 0 {
+    return 0, err
+  }
+  return int(n), nil
+}
+
+func (this *libConn) Close() error {
+  /* Wake up a pending Recv before taking the write lock */
+  this.wakew.Close()
+  this.Lock()
+  defer this.Unlock()
+  if !this.closed {
+    this.closed = true
+    C.vde_close(this.conn)
+    this.wake.Close()
+  }
+  return nil
+}
@@ -0,0 +1,207 @@
+package vdeplug
+
+import (
+  "os"
+  "io"
+  "io/ioutil"
+  "fmt"
+  "net"
+  "sync"
+  "errors"
+  "strconv"
+  "strings"
+  "unsafe"
+  "syscall"
+  "path/filepath"
+  "encoding/binary"
+)
+
+/* vde_switch data socket protocol, see vde_switch/datasock.c */
+const (
+  SwitchMagic   = 0xfeedface
+  SwitchVersion = 3
+  ReqNewControl = 0
+  MaxDescr      = 128
+  SunPathLen    = 108
+  SockaddrLen   = 2 + SunPathLen
+  RequestLen    = 4 + 4 + 4 + SockaddrLen + MaxDescr
+)
+
+var StdSock = []string{ "/var/run/vde.ctl", "/tmp/vde.ctl" }
+
+var NativeEndian binary.ByteOrder = binary.LittleEndian
+
+type vdeConn struct {
+  ctl       net.Conn
+  data      *net.UnixConn
+  raw       syscall.RawConn
+  local     string
+  remote    *net.UnixAddr
+  /* remote as a raw sockaddr, for sendmmsg */
+  name      []byte
+  closeOnce sync.Once
+}
+
+func init() {
+  var probe uint16 = 1
+  if *(*byte)(unsafe.Pointer(&probe)) == 0 {
+    NativeEndian = binary.BigEndian
+  }
+  Register("vde", openVde)
+}
+
+/* EncodeRequest builds a request_v3, the first message sent on the control socket */
+func EncodeRequest(port int, sock, descr string) []byte {
+  req := make([]byte, RequestLen)
+  NativeEndian.PutUint32(req[0:], SwitchMagic)
+  NativeEndian.PutUint32(req[4:], SwitchVersion)
+  NativeEndian.PutUint32(req[8:], uint32(ReqNewControl | port << 8))
+  copy(req[12:], EncodeSockaddr(sock))
+  copy(req[12+SockaddrLen:RequestLen-1], descr)
+  return req
+}
+
+/* DecodeRequest is the switch side of EncodeRequest */
+func DecodeRequest(req []byte) (port int, sock, descr string, err error) {
+  if len(req) < 12 + SockaddrLen ||
+      NativeEndian.Uint32(req[0:]) != SwitchMagic ||
+      NativeEndian.Uint32(req[4:]) != SwitchVersion {
+    return 0, "", "", errors.New("Invalid vde_switch request")
+  }
+  port = int(NativeEndian.Uint32(req[8:]) >> 8)
+  sock = DecodeSockaddr(req[12:12+SockaddrLen])
+  if len(req) > 12 + SockaddrLen {
+    descr = cstring(req[12+SockaddrLen:])
+  }
+  return port, sock, descr, nil
+}
+
+func EncodeSockaddr(path string) []byte {
+  sa := make([]byte, SockaddrLen)
+  NativeEndian.PutUint16(sa[0:], 1) /* AF_UNIX */
+  copy(sa[2:SockaddrLen-1], path)
+  return sa
+}
+
+func DecodeSockaddr(sa []byte) string {
+  return cstring(sa[2:])
+}
+
+func cstring(buf []byte) string {
+  if i := strings.IndexByte(string(buf), 0); i >= 0 {
+    return string(buf[:i])
+  }
+  return string(buf)
+}
+
+/* ctlPath returns the control socket and the requested port of a vde url */
+func ctlPath(address string) (string, int) {
+  port := 0
+  if i := strings.LastIndex(address, "["); i >= 0 && strings.HasSuffix(address, "]") {
+    port, _ = strconv.Atoi(address[i+1:len(address)-1])
+    address = address[:i]
+  }
+  if address == "" {
+    address = StdSock[0]
+    for _, path := range StdSock {
+      if _, err := os.Stat(path); err == nil {
+        address = path
+        break
+      }
+    }
+  }
+  if info, err := os.Stat(address); err == nil && info.IsDir() {
+    return filepath.Join(address, "ctl"), port
+  }
+  return address, port
+}
+
+func openVde(url *URL, descr string) (Conn, error) {
+  ctlpath, port := ctlPath(url.Address)
+  if p, ok := url.Options["port"]; ok {
+    port, _ = strconv.Atoi(p)
+  }
+  ctl, err := net.Dial("unix", ctlpath)
+  if err != nil {
+    return nil, err
+  }
+  conn := &vdeConn{ ctl: ctl }
+  /* The data socket is bound next to the control socket, as libvdeplug does */
+  for i := 0; conn.data == nil && i < 100; i++ {
+    for _, dir := range []string{ filepath.Dir(ctlpath), os.TempDir() } {
+      conn.local = filepath.Join(dir, fmt.Sprintf(".vde.%05d-%05d", os.Getpid(), i))
+      addr := &net.UnixAddr{ Name: conn.local, Net: "unixgram" }
+      if conn.data, err = net.ListenUnixgram("unixgram", addr); err == nil {
+        break
+      }
+    }
+  }
+  if conn.data == nil {
+    ctl.Close()
+    return nil, err
+  }
+  descr = fmt.Sprintf("%s PID=%d", descr, os.Getpid())
+  if _, err = ctl.Write(EncodeRequest(port, conn.local, descr)); err == nil {
+    sa := make([]byte, SockaddrLen)
+    if _, err = io.ReadFull(ctl, sa); err == nil {
+      conn.remote = &net.UnixAddr{ Name: DecodeSockaddr(sa), Net: "unixgram" }
+      conn.name = EncodeSockaddr(conn.remote.Name)
+      if conn.raw, err = conn.data.SyscallConn(); err == nil {
+        err = conn.connect()
+      }
+    }
+  }
+  if err != nil {
+    conn.Close()
+    return nil, fmt.Errorf("vde_switch %s: %s", ctlpath, err)
+  }
+  go conn.watch()
+  return conn, nil
+}
+
+/* connect makes the port of the switch the peer of the data socket: the
+   kernel queues at most net.unix.max_dgram_qlen datagrams between unix
+   sockets that are not peers, too few for the batches */
+func (this *vdeConn) connect() error {
+  var err error
+  cerr := this.raw.Control(func(fd uintptr) {
+    err = syscall.Connect(int(fd), &syscall.SockaddrUnix{ Name: this.remote.Name })
+  })
+  if cerr != nil {
+    return cerr
+  }
+  return err
+}
+
+/* watch closes the connection when the switch closes the control socket,
+   e.g. on exit, so that Recv fails instead of waiting forever */
+func (this *vdeConn) watch() {
+  io.Copy(ioutil.Discard, this.ctl)
+  this.Close()
+}
+
+func (this *vdeConn) Recv(buf []byte) (int, error) {
+  n, _, err := this.data.ReadFromUnix(buf)
+  return n, err
+}
+
+func (this *vdeConn) Send(buf []byte) (int, error) {
+  return this.data.WriteToUnix(buf, this.remote)
+}
+
+func (this *vdeConn) RecvBatch(bufs [][]byte, sizes []int) (int, error) {
+  return Recvmmsg(this.raw, bufs, sizes)
+}
+
+func (this *vdeConn) SendBatch(frames [][]byte) (int, error) {
+  return Sendmmsg(this.raw, frames, [][]byte{ this.name })
+}
+
+func (this *vdeConn) Close() error {
+  this.closeOnce.Do(func() {
+    this.data.Close()
+    this.ctl.Close()
+    os.Remove(this.local)
+  })
+  return nil
+}
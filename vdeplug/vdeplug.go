@@ -0,0 +1,86 @@
+package vdeplug
+
+import (
+  "errors"
+  "strings"
+)
+
+/* Same value of VDE_ETHBUFSIZE in libvdeplug.h */
+const EthBufSize = 9216 + 14 + 4
+
+/* Frames of the plugs with GSO: a TCP segment of 64KiB with its headers */
+const MaxBufSize = 65536 + 256
+
+/* Conn is the Go counterpart of a libvdeplug VDECONN */
+type Conn interface {
+  Recv(buf []byte) (int, error)
+  Send(buf []byte) (int, error)
+  Close() error
+}
+
+type OpenFunc func(url *URL, descr string) (Conn, error)
+
+var (
+  backends = make(map[string]OpenFunc)
+  /* Used for the schemes without a native backend (see libvdeplug.go) */
+  fallback OpenFunc
+)
+
+var ErrScheme = errors.New("VDE url scheme not supported")
+
+/* URL is a parsed VDE url: scheme://address[/opt=value...] */
+type URL struct {
+  Raw     string
+  Scheme  string
+  Address string
+  Options map[string]string
+}
+
+/* Register makes a native backend available for the given scheme */
+func Register(scheme string, open OpenFunc) {
+  backends[scheme] = open
+}
+
+func ParseURL(raw string) *URL {
+  url := &URL{ Raw: raw, Scheme: "vde", Options: make(map[string]string) }
+  rest := raw
+  if i := strings.Index(raw, "://"); i >= 0 {
+    url.Scheme, rest = raw[:i], raw[i+3:]
+  }
+  /* Options follow the address as /key=value elements, like in vdeplug4 */
+  elems := strings.Split(rest, "/")
+  for len(elems) > 1 && strings.Contains(elems[len(elems)-1], "=") {
+    kv := strings.SplitN(elems[len(elems)-1], "=", 2)
+    url.Options[kv[0]] = kv[1]
+    elems = elems[:len(elems)-1]
+  }
+  url.Address = strings.Join(elems, "/")
+  return url
+}
+
+/* Open connects to the VDE network identified by url, as vde_open(3) does */
+func Open(url, descr string) (Conn, error) {
+  parsed := ParseURL(url)
+  if open := backends[parsed.Scheme]; open != nil {
+    return open(parsed, descr)
+  }
+  if fallback != nil {
+    return fallback(parsed, descr)
+  }
+  return nil, ErrScheme
+}
+
+/* MaxFrame returns the longest frame a conn to url carries: only the data
+   socket of a switch takes the ones of MaxBufSize (if the switch does), the
+   buffers of vxvde and of libvdeplug are of EthBufSize */
+func MaxFrame(url string) int {
+  if parsed := ParseURL(url); parsed.Scheme == "vde" && backends[parsed.Scheme] != nil {
+    return MaxBufSize
+  }
+  return EthBufSize
+}
+
+/* Native reports whether url is handled without libvdeplug */
+func Native(url string) bool {
+  return backends[ParseURL(url).Scheme] != nil
+}
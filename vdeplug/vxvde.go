@@ -0,0 +1,330 @@
+package vdeplug
+
+import (
+  "net"
+  "sync"
+  "time"
+  "errors"
+  "strconv"
+  "syscall"
+  "encoding/binary"
+  "golang.org/x/sys/unix"
+)
+
+/* vxvde defaults, see libvdeplug_vxvde.c */
+const (
+  VxvdeDefaultGroup = "239.0.0.1"
+  VxvdeDefaultPort  = 14789
+  VxvdeDefaultVni   = 1
+  VxvdeDefaultTTL   = 1
+  VxvdeHdrLen       = 8
+  VxvdeHashTimeout  = 30 * time.Second
+)
+
+type vxvdeFrame struct {
+  buf []byte
+  n   int
+}
+
+type vxvdeDest struct {
+  addr    *net.UDPAddr
+  /* addr as a raw sockaddr, for sendmmsg */
+  name    []byte
+  expires time.Time
+}
+
+type vxvdeConn struct {
+  vni       uint32
+  group     *net.UDPAddr
+  groupName []byte
+  mcast     *net.UDPConn
+  ucast     *net.UDPConn
+  raw       syscall.RawConn
+  self      map[string]bool
+  port      int
+  frames    chan vxvdeFrame
+  pool      sync.Pool
+  mutex     sync.Mutex
+  hash      map[[6]byte]vxvdeDest
+  done      chan struct{}
+  closeOnce sync.Once
+}
+
+func init() {
+  Register("vxvde", openVxvde)
+}
+
+func optInt(url *URL, key string, def int) (int, error) {
+  if v, ok := url.Options[key]; ok {
+    return strconv.Atoi(v)
+  }
+  return def, nil
+}
+
+func openVxvde(url *URL, descr string) (Conn, error) {
+  var err error
+  var port, vni, ttl int
+  var ifi *net.Interface
+  group := url.Address
+  if group == "" {
+    group = VxvdeDefaultGroup
+  }
+  if port, err = optInt(url, "port", VxvdeDefaultPort); err != nil {
+    return nil, err
+  }
+  if vni, err = optInt(url, "vni", VxvdeDefaultVni); err != nil {
+    return nil, err
+  }
+  if ttl, err = optInt(url, "ttl", VxvdeDefaultTTL); err != nil {
+    return nil, err
+  }
+  if name, ok := url.Options["if"]; ok {
+    if ifi, err = net.InterfaceByName(name); err != nil {
+      return nil, err
+    }
+  }
+  conn := &vxvdeConn{
+    vni:    uint32(vni),
+    group:  &net.UDPAddr{ IP: net.ParseIP(group), Port: port },
+    self:   make(map[string]bool),
+    frames: make(chan vxvdeFrame, 64),
+    hash:   make(map[[6]byte]vxvdeDest),
+    done:   make(chan struct{}),
+  }
+  conn.pool.New = func() interface{} { return make([]byte, VxvdeHdrLen + EthBufSize) }
+  if conn.group.IP == nil || !conn.group.IP.IsMulticast() {
+    return nil, errors.New("vxvde: invalid multicast group " + group)
+  }
+  network := "udp4"
+  if conn.group.IP.To4() == nil {
+    network = "udp6"
+  }
+  if conn.mcast, err = net.ListenMulticastUDP(network, ifi, conn.group); err != nil {
+    return nil, err
+  }
+  if conn.ucast, err = net.ListenUDP(network, nil); err != nil {
+    conn.mcast.Close()
+    return nil, err
+  }
+  conn.port = conn.ucast.LocalAddr().(*net.UDPAddr).Port
+  conn.groupName = rawSockaddr(conn.group)
+  if conn.raw, err = conn.ucast.SyscallConn(); err != nil {
+    conn.Close()
+    return nil, err
+  }
+  if err = conn.setMulticastOpts(ifi, ttl); err != nil {
+    conn.Close()
+    return nil, err
+  }
+  if addrs, err := net.InterfaceAddrs(); err == nil {
+    for _, addr := range addrs {
+      if ipnet, ok := addr.(*net.IPNet); ok {
+        conn.self[ipnet.IP.String()] = true
+      }
+    }
+  }
+  go conn.reader(conn.mcast)
+  go conn.reader(conn.ucast)
+  return conn, nil
+}
+
+/* The unicast socket is also the sender of the multicast traffic */
+func (this *vxvdeConn) setMulticastOpts(ifi *net.Interface, ttl int) error {
+  raw, err := this.ucast.SyscallConn()
+  if err != nil {
+    return err
+  }
+  ipv4 := this.group.IP.To4() != nil
+  raw.Control(func(fd uintptr) {
+    if ipv4 {
+      err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_TTL, ttl)
+      if err == nil && ifi != nil {
+        err = unix.SetsockoptIPMreqn(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_IF,
+          &unix.IPMreqn{ Ifindex: int32(ifi.Index) })
+      }
+    } else {
+      err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, ttl)
+      if err == nil && ifi != nil {
+        err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF, ifi.Index)
+      }
+    }
+  })
+  return err
+}
+
+func (this *vxvdeConn) reader(sock *net.UDPConn) {
+  for {
+    buf := this.pool.Get().([]byte)
+    n, from, err := sock.ReadFromUDP(buf)
+    if err != nil {
+      this.pool.Put(buf)
+      if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+        continue
+      }
+      this.Close()
+      return
+    }
+    if n < VxvdeHdrLen + 14 || buf[0] != 0x08 ||
+        vxvdeVni(buf) != this.vni || this.isSelf(from) {
+      this.pool.Put(buf)
+      continue
+    }
+    this.learn(buf[VxvdeHdrLen+6:VxvdeHdrLen+12], from)
+    select {
+    case this.frames <- vxvdeFrame{ buf: buf, n: n }:
+    case <-this.done:
+      return
+    }
+  }
+}
+
+/* vxvdeVni extracts the 24 bit VNI of a vxlan header */
+func vxvdeVni(hdr []byte) uint32 {
+  return uint32(hdr[4]) << 16 | uint32(hdr[5]) << 8 | uint32(hdr[6])
+}
+
+func (this *vxvdeConn) isSelf(from *net.UDPAddr) bool {
+  return from.Port == this.port && this.self[from.IP.String()]
+}
+
+func (this *vxvdeConn) learn(mac []byte, from *net.UDPAddr) {
+  var key [6]byte
+  if mac[0] & 1 != 0 {
+    return
+  }
+  copy(key[:], mac)
+  this.mutex.Lock()
+  this.hash[key] = vxvdeDest{ addr: from, expires: time.Now().Add(VxvdeHashTimeout) }
+  this.mutex.Unlock()
+}
+
+/* lookup returns the unicast peer of a destination mac, or the group, with its raw sockaddr */
+func (this *vxvdeConn) lookup(mac []byte) (*net.UDPAddr, []byte) {
+  var key [6]byte
+  if mac[0] & 1 != 0 {
+    return this.group, this.groupName
+  }
+  copy(key[:], mac)
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if dest, ok := this.hash[key]; ok {
+    if time.Now().Before(dest.expires) {
+      if dest.name == nil {
+        dest.name = rawSockaddr(dest.addr)
+        this.hash[key] = dest
+      }
+      return dest.addr, dest.name
+    }
+    delete(this.hash, key)
+  }
+  return this.group, this.groupName
+}
+
+/* rawSockaddr returns addr as a sockaddr_in or sockaddr_in6 */
+func rawSockaddr(addr *net.UDPAddr) []byte {
+  if ip4 := addr.IP.To4(); ip4 != nil {
+    sa := make([]byte, unix.SizeofSockaddrInet4)
+    NativeEndian.PutUint16(sa[0:], unix.AF_INET)
+    binary.BigEndian.PutUint16(sa[2:], uint16(addr.Port))
+    copy(sa[4:8], ip4)
+    return sa
+  }
+  sa := make([]byte, unix.SizeofSockaddrInet6)
+  NativeEndian.PutUint16(sa[0:], unix.AF_INET6)
+  binary.BigEndian.PutUint16(sa[2:], uint16(addr.Port))
+  copy(sa[8:24], addr.IP.To16())
+  if ifi, err := net.InterfaceByName(addr.Zone); err == nil && addr.Zone != "" {
+    NativeEndian.PutUint32(sa[24:], uint32(ifi.Index))
+  }
+  return sa
+}
+
+func (this *vxvdeConn) Recv(buf []byte) (int, error) {
+  select {
+  case frame := <-this.frames:
+    n := copy(buf, frame.buf[VxvdeHdrLen:frame.n])
+    this.pool.Put(frame.buf)
+    return n, nil
+  case <-this.done:
+    return 0, syscall.EBADF
+  }
+}
+
+func (this *vxvdeConn) Send(buf []byte) (int, error) {
+  if len(buf) < 14 {
+    return 0, nil
+  }
+  pkt := this.pool.Get().([]byte)
+  defer this.pool.Put(pkt)
+  pkt = this.encap(pkt, buf)
+  addr, _ := this.lookup(buf[0:6])
+  if _, err := this.ucast.WriteToUDP(pkt, addr); err != nil {
+    return 0, err
+  }
+  return len(pkt) - VxvdeHdrLen, nil
+}
+
+/* encap writes the vxlan header and frame in pkt */
+func (this *vxvdeConn) encap(pkt, frame []byte) []byte {
+  for i := 0; i < VxvdeHdrLen; i++ {
+    pkt[i] = 0
+  }
+  pkt[0] = 0x08
+  pkt[4], pkt[5], pkt[6] = byte(this.vni >> 16), byte(this.vni >> 8), byte(this.vni)
+  return pkt[:VxvdeHdrLen + copy(pkt[VxvdeHdrLen:], frame)]
+}
+
+/* SendBatch sends the frames with sendmmsg, the ones too short are skipped as Send does */
+func (this *vxvdeConn) SendBatch(frames [][]byte) (int, error) {
+  var pkts, names [][]byte
+  var index []int
+  for i, frame := range frames {
+    if len(frame) < 14 {
+      continue
+    }
+    pkt := this.pool.Get().([]byte)
+    defer this.pool.Put(pkt)
+    _, name := this.lookup(frame[0:6])
+    pkts = append(pkts, this.encap(pkt, frame))
+    names = append(names, name)
+    index = append(index, i)
+  }
+  if len(pkts) == 0 {
+    return len(frames), nil
+  }
+  n, err := Sendmmsg(this.raw, pkts, names)
+  if err != nil {
+    return index[n], err
+  }
+  return len(frames), nil
+}
+
+/* RecvBatch waits for a frame, then takes the ones already received */
+func (this *vxvdeConn) RecvBatch(bufs [][]byte, sizes []int) (int, error) {
+  n, err := this.Recv(bufs[0])
+  if err != nil {
+    return 0, err
+  }
+  sizes[0] = n
+  for count := 1; count < len(bufs); count++ {
+    select {
+    case frame := <-this.frames:
+      sizes[count] = copy(bufs[count], frame.buf[VxvdeHdrLen:frame.n])
+      this.pool.Put(frame.buf)
+    default:
+      return count, nil
+    }
+  }
+  return len(bufs), nil
+}
+
+func (this *vxvdeConn) Close() error {
+  this.closeOnce.Do(func() {
+    close(this.done)
+    this.mcast.Close()
+    if this.ucast != nil {
+      this.ucast.Close()
+    }
+  })
+  return nil
+}
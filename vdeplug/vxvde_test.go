@@ -0,0 +1,96 @@
+package vdeplug
+
+import (
+  "time"
+  "bytes"
+  "testing"
+)
+
+func testFrame(dst, src byte, payload string) []byte {
+  frame := []byte{ dst, 0, 0, 0, 0, dst, 0x02, 0, 0, 0, 0, src, 0x88, 0xb5 }
+  if dst == 0xff {
+    copy(frame[0:6], []byte{ 0xff, 0xff, 0xff, 0xff, 0xff, 0xff })
+  }
+  return append(frame, payload...)
+}
+
+/* receiver passes the frames of conn to a channel, until it is closed */
+func receiver(conn Conn) <-chan []byte {
+  frames := make(chan []byte, 16)
+  go func() {
+    defer close(frames)
+    for {
+      buf := make([]byte, EthBufSize)
+      n, err := conn.Recv(buf)
+      if err != nil {
+        return
+      }
+      frames <- buf[:n]
+    }
+  }()
+  return frames
+}
+
+/* recvTimeout returns the next frame of a receiver, nil if none comes in time */
+func recvTimeout(frames <-chan []byte, timeout time.Duration) []byte {
+  select {
+  case frame := <-frames:
+    return frame
+  case <-time.After(timeout):
+    return nil
+  }
+}
+
+func TestVxvde(t *testing.T) {
+  url := "vxvde://239.255.42.99/port=24789/vni=4242"
+  a, err := Open(url, "test a")
+  if err != nil {
+    t.Skipf("No multicast on the host: %s", err)
+  }
+  defer a.Close()
+  b, err := Open(url, "test b")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer b.Close()
+  other, err := Open("vxvde://239.255.42.99/port=24789/vni=4243", "test other")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer other.Close()
+  arx, brx, otherrx := receiver(a), receiver(b), receiver(other)
+
+  /* To the group, the MAC of a is learned by b */
+  hello := testFrame(0xff, 0x0a, "hello")
+  if _, err := a.Send(hello); err != nil {
+    t.Fatal(err)
+  }
+  got := recvTimeout(brx, time.Second)
+  if got == nil {
+    t.Skip("No multicast loopback on the host")
+  }
+  if !bytes.Equal(got, hello) {
+    t.Errorf("b received % x, want % x", got, hello)
+  }
+  if got := recvTimeout(otherrx, 200 * time.Millisecond); got != nil {
+    t.Errorf("another VNI received % x", got)
+  }
+  if got := recvTimeout(arx, 200 * time.Millisecond); got != nil {
+    t.Errorf("a received its own frame % x", got)
+  }
+
+  /* Unicast to a, in a batch with a short frame that is skipped */
+  reply := testFrame(0x0a, 0x0b, "reply")
+  if n, err := b.(BatchConn).SendBatch([][]byte{ reply[:10], reply }); err != nil || n != 2 {
+    t.Fatalf("SendBatch %d %v", n, err)
+  }
+  if got := recvTimeout(arx, time.Second); !bytes.Equal(got, reply) {
+    t.Errorf("a received % x, want % x", got, reply)
+  }
+
+  /* The receiver ends with the conn */
+  a.Close()
+  if _, ok := <-arx; ok {
+    t.Errorf("Recv after Close")
+  }
+}
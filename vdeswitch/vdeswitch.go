@@ -0,0 +1,254 @@
+package vdeswitch
+
+import (
+  "io"
+  "os"
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "errors"
+  "syscall"
+  "io/ioutil"
+  "path/filepath"
+  "golang.org/x/sys/unix"
+  log "github.com/Sirupsen/logrus"
+  "github.com/phocs/vde_plug_docker/vdeplug"
+)
+
+const (
+  NumPortsDefault = 64
+  HashTimeout     = 300 * time.Second
+  CtlName         = "ctl"
+  DirMode         = 0755
+)
+
+type port struct {
+  num   int
+  descr string
+  ctl   net.Conn
+  data  *net.UnixConn
+  raw   syscall.RawConn
+  path  string
+}
+
+/* send never blocks the switch: frames to a congested port are dropped */
+func (this *port) send(frame []byte) {
+  this.raw.Write(func(fd uintptr) bool {
+    unix.SendmsgN(int(fd), frame, nil, nil, unix.MSG_DONTWAIT)
+    return true
+  })
+}
+
+type hashEntry struct {
+  port    int
+  expires time.Time
+}
+
+/* Switch is a learning Ethernet switch (or a hub) reachable through the
+   vde_switch control/data unix sockets in Dir */
+type Switch struct {
+  Dir       string
+  Hub       bool
+  NumPorts  int
+  mutex     sync.RWMutex
+  listener  *net.UnixListener
+  ports     map[int]*port
+  hash      map[[6]byte]hashEntry
+  sockno    int
+  wg        sync.WaitGroup
+}
+
+func New(dir string, hub bool) *Switch {
+  return &Switch{
+    Dir:      dir,
+    Hub:      hub,
+    NumPorts: NumPortsDefault,
+    ports:    make(map[int]*port),
+    hash:     make(map[[6]byte]hashEntry),
+  }
+}
+
+func (this *Switch) CtlPath() string {
+  return filepath.Join(this.Dir, CtlName)
+}
+
+/* Start listens on the control socket, a stale one is replaced */
+func (this *Switch) Start() error {
+  var err error
+  if err = os.MkdirAll(this.Dir, DirMode); err != nil {
+    return err
+  }
+  ctlpath := this.CtlPath()
+  if conn, err := net.Dial("unix", ctlpath); err == nil {
+    conn.Close()
+    return errors.New("Switch already running on " + ctlpath)
+  }
+  os.Remove(ctlpath)
+  if this.listener, err = net.ListenUnix("unix", &net.UnixAddr{ Name: ctlpath, Net: "unix" }); err != nil {
+    return err
+  }
+  log.Debugf("Switch started: [ %s ] hub [ %t ]", this.Dir, this.Hub)
+  this.wg.Add(1)
+  go this.accept()
+  return nil
+}
+
+func (this *Switch) Stop() {
+  if this.listener == nil {
+    return
+  }
+  this.listener.Close()
+  this.mutex.Lock()
+  for _, p := range this.ports {
+    p.ctl.Close()
+    p.data.Close()
+  }
+  this.mutex.Unlock()
+  this.wg.Wait()
+  os.Remove(this.Dir)
+  log.Debugf("Switch stopped: [ %s ]", this.Dir)
+}
+
+func (this *Switch) accept() {
+  defer this.wg.Done()
+  for {
+    conn, err := this.listener.Accept()
+    if err != nil {
+      return
+    }
+    this.wg.Add(1)
+    go this.newPort(conn)
+  }
+}
+
+/* newPort serves a client from its request_v3 to the closing of its control connection */
+func (this *Switch) newPort(ctl net.Conn) {
+  defer this.wg.Done()
+  req := make([]byte, vdeplug.RequestLen)
+  if _, err := io.ReadFull(ctl, req); err != nil {
+    ctl.Close()
+    return
+  }
+  num, sock, descr, err := vdeplug.DecodeRequest(req)
+  if err == nil {
+    var p *port
+    if p, err = this.addPort(num, ctl, sock, descr); err == nil {
+      if _, err = ctl.Write(vdeplug.EncodeSockaddr(p.path)); err == nil {
+        this.wg.Add(1)
+        go this.portReader(p)
+        /* Nothing else is expected on the control connection */
+        io.Copy(ioutil.Discard, ctl)
+      }
+      this.delPort(p)
+    }
+  }
+  if err != nil {
+    log.Warnf("Switch [ %s ] new port: [ %s ]", this.Dir, err)
+  }
+  ctl.Close()
+}
+
+func (this *Switch) addPort(num int, ctl net.Conn, sock, descr string) (*port, error) {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if num == 0 {
+    for num = 1; num <= this.NumPorts && this.ports[num] != nil; num++ {
+    }
+  }
+  if num < 1 || num > this.NumPorts || this.ports[num] != nil {
+    return nil, fmt.Errorf("port %d not available", num)
+  }
+  this.sockno++
+  p := &port{ num: num, descr: descr, ctl: ctl }
+  p.path = filepath.Join(this.Dir, fmt.Sprintf("%03d.%d", num, this.sockno))
+  os.Remove(p.path)
+  data, err := net.DialUnix("unixgram",
+    &net.UnixAddr{ Name: p.path, Net: "unixgram" },
+    &net.UnixAddr{ Name: sock, Net: "unixgram" })
+  if err != nil {
+    return nil, err
+  }
+  if p.raw, err = data.SyscallConn(); err != nil {
+    data.Close()
+    return nil, err
+  }
+  p.data = data
+  this.ports[num] = p
+  log.Debugf("Switch [ %s ] port [ %d ] connected: [ %s ]", this.Dir, num, descr)
+  return p, nil
+}
+
+func (this *Switch) delPort(p *port) {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if this.ports[p.num] == p {
+    delete(this.ports, p.num)
+    for mac, entry := range this.hash {
+      if entry.port == p.num {
+        delete(this.hash, mac)
+      }
+    }
+  }
+  p.data.Close()
+  os.Remove(p.path)
+  log.Debugf("Switch [ %s ] port [ %d ] disconnected", this.Dir, p.num)
+}
+
+func (this *Switch) portReader(p *port) {
+  defer this.wg.Done()
+  bufs := make([][]byte, vdeplug.BatchSize)
+  for i := range bufs {
+    bufs[i] = make([]byte, vdeplug.MaxBufSize)
+  }
+  sizes := make([]int, vdeplug.BatchSize)
+  for {
+    n, err := vdeplug.Recvmmsg(p.raw, bufs, sizes)
+    if err != nil {
+      if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+        continue
+      }
+      return
+    }
+    for i := 0; i < n; i++ {
+      if sizes[i] >= 14 {
+        this.forward(p, bufs[i][:sizes[i]])
+      }
+    }
+  }
+}
+
+func (this *Switch) forward(src *port, frame []byte) {
+  var dst, srcmac [6]byte
+  copy(dst[:], frame[0:6])
+  copy(srcmac[:], frame[6:12])
+  now := time.Now()
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if !this.Hub {
+    if srcmac[0] & 1 == 0 {
+      this.hash[srcmac] = hashEntry{ port: src.num, expires: now.Add(HashTimeout) }
+    }
+    if entry, ok := this.hash[dst]; ok && dst[0] & 1 == 0 {
+      if now.Before(entry.expires) {
+        if p := this.ports[entry.port]; p != nil && p != src {
+          p.send(frame)
+        }
+        return
+      }
+      delete(this.hash, dst)
+    }
+  }
+  for _, p := range this.ports {
+    if p != src {
+      p.send(frame)
+    }
+  }
+}
+
+/* Ports returns the number of connected ports */
+func (this *Switch) Ports() int {
+  this.mutex.RLock()
+  defer this.mutex.RUnlock()
+  return len(this.ports)
+}
@@ -0,0 +1,143 @@
+package vdeswitch
+
+import (
+  "fmt"
+  "time"
+  "bytes"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+  "github.com/phocs/vde_plug_docker/vdeplug"
+)
+
+var broadcast = []byte{ 0xff, 0xff, 0xff, 0xff, 0xff, 0xff }
+
+func mac(n byte) []byte {
+  return []byte{ 0x02, 0, 0, 0, 0, n }
+}
+
+func frame(dst, src []byte, payload string) []byte {
+  f := append(append(append([]byte{}, dst...), src...), 0x88, 0xb5)
+  return append(f, payload...)
+}
+
+/* testPort is a port of the switch plugged through the vde:// transport */
+type testPort struct {
+  conn   vdeplug.Conn
+  frames chan []byte
+}
+
+func plug(t *testing.T, sw *Switch) *testPort {
+  conn, err := vdeplug.Open("vde://" + sw.Dir, "test")
+  if err != nil {
+    t.Fatal(err)
+  }
+  p := &testPort{ conn: conn, frames: make(chan []byte, 16) }
+  go func() {
+    for {
+      buf := make([]byte, vdeplug.EthBufSize)
+      n, err := conn.Recv(buf)
+      if err != nil {
+        close(p.frames)
+        return
+      }
+      p.frames <- buf[:n]
+    }
+  }()
+  return p
+}
+
+/* expect checks that p receives want, or nothing if want is nil */
+func (this *testPort) expect(t *testing.T, name string, want []byte) {
+  timeout := time.Second
+  if want == nil {
+    timeout = 100 * time.Millisecond
+  }
+  select {
+  case got := <-this.frames:
+    if want == nil {
+      t.Errorf("%s: unexpected % x", name, got)
+    } else if !bytes.Equal(got, want) {
+      t.Errorf("%s: % x, want % x", name, got, want)
+    }
+  case <-time.After(timeout):
+    if want != nil {
+      t.Errorf("%s: nothing received", name)
+    }
+  }
+}
+
+func startSwitch(t *testing.T, hub bool) *Switch {
+  dir, err := ioutil.TempDir("", "vdeswitch")
+  if err != nil {
+    t.Fatal(err)
+  }
+  sw := New(filepath.Join(dir, "sw"), hub)
+  if err = sw.Start(); err != nil {
+    t.Fatal(err)
+  }
+  return sw
+}
+
+func TestSwitch(t *testing.T) {
+  for _, hub := range []bool{ false, true } {
+    sw := startSwitch(t, hub)
+    ports := []*testPort{ plug(t, sw), plug(t, sw), plug(t, sw) }
+    for deadline := time.Now().Add(time.Second); sw.Ports() < len(ports) && time.Now().Before(deadline); {
+      time.Sleep(10 * time.Millisecond)
+    }
+    if sw.Ports() != len(ports) {
+      t.Fatalf("hub %v: %d ports", hub, sw.Ports())
+    }
+    /* Each step: the sender, the frame, the frame received by each port */
+    f1 := frame(broadcast, mac(1), "broadcast from 1")
+    f2 := frame(mac(9), mac(2), "unknown from 2")
+    f3 := frame(mac(1), mac(3), "from 3 to 1")
+    f4 := frame(mac(3), mac(1), "from 1 to 3")
+    f5 := frame(mac(2), mac(2), "to itself")
+    for i, step := range []struct {
+      from  int
+      frame []byte
+      hub   []bool
+      sw    []bool
+    } {
+      { 0, f1, []bool{ false, true, true }, []bool{ false, true, true } },
+      { 1, f2, []bool{ true, false, true }, []bool{ true, false, true } },
+      /* Port 0 has learned mac 1, port 2 mac 3 */
+      { 2, f3, []bool{ true, true, false }, []bool{ true, false, false } },
+      { 0, f4, []bool{ false, true, true }, []bool{ false, false, true } },
+      { 1, f5, []bool{ true, false, true }, []bool{ false, false, false } },
+    } {
+      if _, err := ports[step.from].conn.Send(step.frame); err != nil {
+        t.Fatal(err)
+      }
+      recv := step.sw
+      if hub {
+        recv = step.hub
+      }
+      for j, p := range ports {
+        var want []byte
+        if recv[j] {
+          want = step.frame
+        }
+        p.expect(t, fmt.Sprintf("hub %v step %d port %d", hub, i, j), want)
+      }
+    }
+    /* A port that leaves is forgotten: the frames to its MACs are flooded */
+    ports[0].conn.Close()
+    for deadline := time.Now().Add(time.Second); sw.Ports() > 2 && time.Now().Before(deadline); {
+      time.Sleep(10 * time.Millisecond)
+    }
+    f6 := frame(mac(1), mac(3), "to the port gone")
+    ports[2].conn.Send(f6)
+    ports[1].expect(t, fmt.Sprintf("hub %v flood after leave", hub), f6)
+    sw.Stop()
+    /* The ports see the end of the switch */
+    for _, p := range ports[1:] {
+      for range p.frames {
+      }
+    }
+    ports[1].conn.Close()
+    ports[2].conn.Close()
+  }
+}